@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Aggregate is one aggregate column of an AggregateQuery
+type Aggregate struct {
+	Func     string // COUNT, SUM, AVG, MIN or MAX
+	Column   string // Empty for COUNT(*)
+	Distinct bool
+	As       string // Output name; defaults to e.g. "count" or "sum_value"
+}
+
+// AggregateQuery groups the rows of a table
+type AggregateQuery struct {
+	Table      string
+	Where      string // Optional SQL condition, may use $n parameters
+	GroupBy    []string
+	Aggregates []Aggregate
+	Having     string // Optional SQL condition such as "COUNT(*) > 1"
+}
+
+// JoinQuery joins two tables on equal column values
+type JoinQuery struct {
+	Left        string
+	Right       string
+	LeftColumn  string
+	RightColumn string
+	Kind        JoinKind
+	Where       string // Optional SQL condition, may use $n parameters
+}
+
+// Aggregate runs q and returns one record per group, keyed by the GROUP BY
+// columns and the aggregate output names
+func (db *Database) Aggregate(ctx context.Context, q AggregateQuery, args ...any) ([]Record, error) {
+	stmt := &SelectStmt{From: &TableRef{Name: q.Table}}
+	for _, column := range q.GroupBy {
+		ref := &ColumnRef{Column: column}
+		stmt.GroupBy = append(stmt.GroupBy, ref)
+		stmt.Columns = append(stmt.Columns, SelectItem{Expr: ref})
+		stmt.OrderBy = append(stmt.OrderBy, OrderItem{Expr: ref})
+	}
+	for _, agg := range q.Aggregates {
+		call := &FuncCall{Name: strings.ToUpper(agg.Func), Distinct: agg.Distinct}
+		if !aggregateFuncs[call.Name] {
+			return nil, fmt.Errorf("unknown aggregate function %q", agg.Func)
+		}
+		name := agg.As
+		if agg.Column == "" {
+			if call.Name != "COUNT" || agg.Distinct {
+				return nil, fmt.Errorf("%s needs a column", call.Name)
+			}
+			call.Star = true
+			if name == "" {
+				name = "count"
+			}
+		} else {
+			call.Args = []Expr{&ColumnRef{Column: agg.Column}}
+			if name == "" {
+				name = strings.ToLower(call.Name) + "_" + agg.Column
+			}
+		}
+		stmt.Columns = append(stmt.Columns, SelectItem{Expr: call, Alias: name})
+	}
+	if len(stmt.Columns) == 0 {
+		return nil, errors.New("aggregate query needs GROUP BY columns or aggregates")
+	}
+
+	var err error
+	if stmt.Where, err = parseOptionalExpr(q.Where); err != nil {
+		return nil, err
+	}
+	if stmt.Having, err = parseOptionalExpr(q.Having); err != nil {
+		return nil, err
+	}
+	result, err := db.ExecStatement(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	return result.Records(), nil
+}
+
+// Join runs q and returns the joined rows keyed "table.column". For a left
+// join the right-hand columns of unmatched rows are nil.
+func (db *Database) Join(ctx context.Context, q JoinQuery, args ...any) ([]Record, error) {
+	if q.Left == q.Right {
+		return nil, errors.New("cannot join a table with itself; use SQL with aliases")
+	}
+	stmt := &SelectStmt{
+		From: &TableRef{Name: q.Left},
+		Joins: []JoinClause{{
+			Kind:  q.Kind,
+			Table: TableRef{Name: q.Right},
+			On: &BinaryExpr{
+				Op:    "=",
+				Left:  &ColumnRef{Table: q.Left, Column: q.LeftColumn},
+				Right: &ColumnRef{Table: q.Right, Column: q.RightColumn},
+			},
+		}},
+	}
+	for _, tableName := range []string{q.Left, q.Right} {
+		schema, err := db.Schema(tableName)
+		if err != nil {
+			return nil, err
+		}
+		for _, column := range schema.Columns {
+			stmt.Columns = append(stmt.Columns, SelectItem{
+				Expr:  &ColumnRef{Table: tableName, Column: column.Name},
+				Alias: tableName + "." + column.Name,
+			})
+		}
+	}
+
+	var err error
+	if stmt.Where, err = parseOptionalExpr(q.Where); err != nil {
+		return nil, err
+	}
+	result, err := db.ExecStatement(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	return result.Records(), nil
+}
+
+// Records converts the rows of a result into records keyed by column name
+func (r *Result) Records() []Record {
+	records := make([]Record, len(r.Rows))
+	for i, row := range r.Rows {
+		record := make(Record, len(r.Columns))
+		for j, name := range r.Columns {
+			record[name] = row[j]
+		}
+		records[i] = record
+	}
+	return records
+}
+
+func parseOptionalExpr(text string) (Expr, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	return ParseExpr(text)
+}
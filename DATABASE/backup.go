@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const backupManifestName = "backup.json"
+
+// BackupInfo describes a backup. Version is the last commit version of the
+// source database included in it.
+type BackupInfo struct {
+	Version int           `json:"version"`
+	Time    time.Time     `json:"time"`
+	Tables  []BackupTable `json:"tables"`
+}
+
+// BackupTable is one table of a backup. Its rows are stored as JSON Lines in
+// File, relative to the backup directory.
+type BackupTable struct {
+	Name    string      `json:"name"`
+	Schema  Schema      `json:"schema"`
+	Indexes []IndexSpec `json:"indexes"`
+	Rows    int         `json:"rows"`
+	File    string      `json:"file"`
+}
+
+// RestoreOptions configures RestoreBackup
+type RestoreOptions struct {
+	// Options of the restored database
+	Options
+	// LogDirs hold write-ahead log segments archived by Options.ArchiveDir
+	// and possibly the source's live wal.log. Their entries after the backup
+	// are replayed, so a restore can reach past the time of the backup.
+	LogDirs []string
+	// Version stops the replay after this commit version if not zero
+	Version int
+	// Time stops the replay before the first entry logged after Time if not
+	// zero
+	Time time.Time
+}
+
+// Backup writes a consistent copy of every table to dir, which must not
+// already hold a backup. The rows are read from one snapshot, so writers
+// carry on while the backup runs. The manifest is written last; a directory
+// without one is an incomplete backup. Every file is encrypted with the
+// database's newest key, if it has keys.
+func (db *Database) Backup(ctx context.Context, dir string) (BackupInfo, error) {
+	manifest := filepath.Join(dir, backupManifestName)
+	if _, err := os.Stat(manifest); err == nil {
+		return BackupInfo{}, fmt.Errorf("%s already holds a backup", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return BackupInfo{}, err
+	}
+
+	tx, err := db.BeginTransaction(ctx)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	defer tx.Rollback()
+	info := BackupInfo{Version: tx.startVersion, Time: time.Now().UTC(), Tables: db.backupTables()}
+
+	for i := range info.Tables {
+		if err := ctx.Err(); err != nil {
+			return BackupInfo{}, err
+		}
+		table := &info.Tables[i]
+		table.File = fmt.Sprintf("table-%d.jsonl", i)
+		var buf bytes.Buffer
+		n, err := tx.export(table.Name, &buf, FormatJSONL)
+		if err != nil {
+			return BackupInfo{}, fmt.Errorf("table %s: %w", table.Name, err)
+		}
+		table.Rows = n
+		data, err := db.keys.seal(buf.Bytes(), []byte(table.File))
+		if err != nil {
+			return BackupInfo{}, err
+		}
+		if err := writeFileAtomic(filepath.Join(dir, table.File), data); err != nil {
+			return BackupInfo{}, err
+		}
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err == nil {
+		data, err = db.keys.seal(data, []byte(backupManifestName))
+	}
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	if err := writeFileAtomic(manifest, data); err != nil {
+		return BackupInfo{}, err
+	}
+	return info, nil
+}
+
+// backupTables lists the schema and indexes of every table, by name
+func (db *Database) backupTables() []BackupTable {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	tables := make([]BackupTable, 0, len(db.tables))
+	for name, table := range db.tables {
+		table.mu.RLock()
+		tables = append(tables, table.backupTable(name))
+		table.mu.RUnlock()
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].Name < tables[j].Name })
+	return tables
+}
+
+// backupTable describes the schema and indexes of the table. The caller must
+// hold t.mu.
+func (t *Table) backupTable(name string) BackupTable {
+	bt := BackupTable{Name: name, Schema: t.currentSchema(), Indexes: []IndexSpec{}}
+	for _, idx := range t.indexes {
+		bt.Indexes = append(bt.Indexes, idx.spec)
+	}
+	sort.Slice(bt.Indexes, func(i, j int) bool { return bt.Indexes[i].Name < bt.Indexes[j].Name })
+	return bt
+}
+
+// ReadBackupInfo reads the manifest of the backup in dir, decrypting it with
+// keys if it is encrypted
+func ReadBackupInfo(dir string, keys *Keyring) (BackupInfo, error) {
+	data, err := os.ReadFile(filepath.Join(dir, backupManifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return BackupInfo{}, fmt.Errorf("%s holds no complete backup", dir)
+	}
+	if err == nil {
+		data, err = keys.open(data, []byte(backupManifestName))
+	}
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	var info BackupInfo
+	if err := decodeJSON(data, &info); err != nil {
+		return BackupInfo{}, err
+	}
+	return info, nil
+}
+
+// RestoreBackup creates a durable database in dir, which must be empty or
+// missing, from the backup in backupDir. The write-ahead log entries found in
+// opts.LogDirs are then replayed up to opts.Version or opts.Time. It returns
+// the restored database and the commit version of the source database it
+// now matches; versions of the restored database itself start afresh.
+// opts.Keys must hold the keys of the backup and log segments as well as
+// the key the restored database is encrypted with.
+func RestoreBackup(backupDir, dir string, opts RestoreOptions) (*Database, int, error) {
+	if opts.EncryptPlaintext && opts.Keys != nil {
+		// Only the backup and log segments may be unencrypted; the restored
+		// database is written with the keys
+		opts.Keys.setPlaintext(true)
+		defer opts.Keys.setPlaintext(false)
+	}
+	info, err := ReadBackupInfo(backupDir, opts.Keys)
+	if err != nil {
+		return nil, 0, err
+	}
+	if opts.Version != 0 && opts.Version < info.Version {
+		return nil, 0, fmt.Errorf("backup is at version %d, after the target version %d", info.Version, opts.Version)
+	}
+	if !opts.Time.IsZero() && opts.Time.Before(info.Time) {
+		return nil, 0, fmt.Errorf("backup was taken at %s, after the target time", info.Time.Format(time.RFC3339))
+	}
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return nil, 0, fmt.Errorf("%s is not empty", dir)
+	}
+	entries, err := readLogDirs(opts.LogDirs, opts.Keys)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	db, err := OpenDatabaseWithOptions(dir, opts.Options)
+	if err != nil {
+		return nil, 0, err
+	}
+	version, err := db.restore(backupDir, info, entries, opts)
+	if err == nil {
+		err = db.checkpoint()
+	}
+	if err != nil {
+		db.Close()
+		return nil, 0, err
+	}
+	return db, version, nil
+}
+
+// restore loads a backup into the empty database db and replays entries on
+// top of it
+func (db *Database) restore(backupDir string, info BackupInfo, entries []walEntry, opts RestoreOptions) (int, error) {
+	ctx := context.Background()
+	for _, bt := range dependencyOrder(info.Tables) {
+		if err := db.CreateTable(bt.Name, bt.Schema); err != nil {
+			return 0, fmt.Errorf("table %s: %w", bt.Name, err)
+		}
+		data, err := os.ReadFile(filepath.Join(backupDir, bt.File))
+		if err == nil {
+			data, err = db.keys.open(data, []byte(bt.File))
+		}
+		if err != nil {
+			return 0, fmt.Errorf("table %s: %w", bt.Name, err)
+		}
+		n, err := db.importTable(ctx, bt.Name, bytes.NewReader(data), FormatJSONL, false)
+		if err == nil && n != bt.Rows {
+			err = fmt.Errorf("backup file holds %d of %d rows", n, bt.Rows)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("table %s: %w", bt.Name, err)
+		}
+		for _, spec := range bt.Indexes {
+			if db.hasIndex(bt.Name, spec.Name) {
+				continue // Enforces a unique constraint of the schema
+			}
+			if err := db.CreateIndexWithSpec(ctx, bt.Name, spec); err != nil {
+				return 0, fmt.Errorf("table %s: %w", bt.Name, err)
+			}
+		}
+	}
+
+	version := info.Version
+	for _, entry := range entries {
+		if !opts.Time.IsZero() && entry.Time > opts.Time.UnixNano() {
+			break
+		}
+		switch entry.Op {
+		case opCreateTable:
+			if _, err := db.lookupTable(entry.Table); err == nil {
+				continue // Part of the backup
+			}
+		case opCreateIndex:
+			if entry.Index != nil && db.hasIndex(entry.Table, entry.Index.Name) {
+				continue
+			}
+		case opSetTTL:
+		default:
+			if entry.Version == 0 {
+				return version, fmt.Errorf("wal entry %d predates commit versions and cannot be replayed", entry.LSN)
+			}
+			if entry.Version <= info.Version {
+				continue
+			}
+			if opts.Version != 0 && entry.Version > opts.Version {
+				return version, nil
+			}
+		}
+		if err := db.redo(ctx, entry); err != nil {
+			return version, fmt.Errorf("replaying wal entry %d: %w", entry.LSN, err)
+		}
+		version = max(version, entry.Version)
+	}
+	return version, nil
+}
+
+// hasIndex reports whether a table has the named index
+func (db *Database) hasIndex(tableName, name string) bool {
+	table, err := db.lookupTable(tableName)
+	if err != nil {
+		return false
+	}
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	_, exists := table.indexes[name]
+	return exists
+}
+
+// redo applies an entry read from another database's log as a new logged
+// mutation of db
+func (db *Database) redo(ctx context.Context, entry walEntry) error {
+	switch entry.Op {
+	case opCreateTable, opCreateIndex, opSetTTL:
+		return db.applyEntry(ctx, entry)
+	case opInsert, opUpdate, opDelete:
+		entry.Batch = []walEntry{entry}
+	case opCommit:
+	default:
+		return fmt.Errorf("unknown wal operation %q", entry.Op)
+	}
+	entry, err := db.decodeEntry(walEntry{Op: opCommit, Batch: entry.Batch})
+	if err != nil {
+		return err
+	}
+
+	byName := make(map[string]*Table)
+	for _, e := range entry.Batch {
+		if byName[e.Table], err = db.lookupTable(e.Table); err != nil {
+			return err
+		}
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		byName[name].mu.Lock()
+	}
+	defer func() {
+		for _, name := range names {
+			byName[name].mu.Unlock()
+		}
+	}()
+
+	// Log the rows this database replaces, not the source's
+	for i, e := range entry.Batch {
+		old, _, err := byName[e.Table].engine.Get(e.Key)
+		if err != nil {
+			return err
+		}
+		entry.Batch[i].Old = old.Record
+	}
+	version, keepHistory, done, err := db.logWrite(walEntry{Op: opCommit, Batch: entry.Batch})
+	if err != nil {
+		return err
+	}
+	defer done()
+	for _, e := range entry.Batch {
+		table := byName[e.Table]
+		if e.Op == opDelete {
+			err = table.remove(e.Key, version, keepHistory)
+		} else {
+			err = table.put(e.Key, e.Record, version, keepHistory)
+		}
+		if err != nil {
+			return db.storageFailure(err)
+		}
+	}
+	return nil
+}
+
+// readLogDirs returns the entries of every write-ahead log segment in dirs,
+// in LSN order without duplicates
+func readLogDirs(dirs []string, keys *Keyring) ([]walEntry, error) {
+	byLSN := make(map[uint64]walEntry)
+	for _, dir := range dirs {
+		paths, err := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, filepath.Join(dir, walFileName))
+		for _, path := range paths {
+			_, _, err := readWAL(path, keys, func(entry walEntry) error {
+				byLSN[entry.LSN] = entry
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+	entries := make([]walEntry, 0, len(byLSN))
+	for _, entry := range byLSN {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].LSN < entries[j].LSN })
+	return entries, nil
+}
+
+// archiveWAL copies the log into the archive directory before a checkpoint
+// truncates it. Segments are named by their last LSN. The caller must hold
+// every table lock, as Checkpoint does.
+func (db *Database) archiveWAL() error {
+	data, err := os.ReadFile(filepath.Join(db.dir, walFileName))
+	if err != nil || len(data) == 0 {
+		return err
+	}
+	if err := os.MkdirAll(db.archive, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("wal-%020d.log", db.wal.LSN())
+	return writeFileAtomic(filepath.Join(db.archive, name), data)
+}
+
+// runBackup implements "backup": copy a database directory to a backup
+func runBackup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	dir := flags.String("data", "data", "database directory")
+	out := flags.String("out", "", "directory to write the backup to")
+	keyring := keyFileFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		return errors.New("-out is required")
+	}
+	keys, err := keyring()
+	if err != nil {
+		return err
+	}
+
+	db, err := OpenDatabaseWithOptions(*dir, Options{Keys: keys})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	info, err := db.Backup(context.Background(), *out)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Backed up %d tables at version %d to %s\n", len(info.Tables), info.Version, *out)
+	return nil
+}
+
+// runRestore implements "restore": create a database directory from a
+// backup, optionally rolled forward with archived logs
+func runRestore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	from := flags.String("from", "", "backup directory")
+	dir := flags.String("data", "", "new database directory")
+	logs := flags.String("logs", "", "comma-separated directories of archived wal segments to replay")
+	version := flags.Int("until-version", 0, "stop after this commit version")
+	until := flags.String("until-time", "", "stop at this RFC 3339 time")
+	engine := flags.String("engine", "", "storage engine: disk or memory")
+	plaintext := flags.Bool("encrypt-plaintext", false, "accept an unencrypted backup and logs, encrypting the restored database with -key-file")
+	keyring := keyFileFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || *dir == "" {
+		return errors.New("-from and -data are required")
+	}
+	keys, err := keyring()
+	if err != nil {
+		return err
+	}
+
+	opts := RestoreOptions{Options: Options{Engine: EngineKind(*engine), Keys: keys, EncryptPlaintext: *plaintext}, Version: *version}
+	if *logs != "" {
+		opts.LogDirs = strings.Split(*logs, ",")
+	}
+	if *until != "" {
+		t, err := time.Parse(time.RFC3339Nano, *until)
+		if err != nil {
+			return fmt.Errorf("-until-time: %w", err)
+		}
+		opts.Time = t
+	}
+
+	db, restored, err := RestoreBackup(*from, *dir, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored %s to version %d in %s\n", *from, restored, *dir)
+	return db.Close()
+}
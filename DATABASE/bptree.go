@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	maxKeySize     = 512               // Largest encoded primary key the disk engine accepts
+	maxInlineValue = pageSize / 4      // Larger rows go to overflow pages
+	minFill        = pageSize / 4      // Pages smaller than this are merged with a sibling when possible
+	overflowData   = pageCapacity - 11 // Payload bytes per overflow page
+)
+
+// ErrKeyTooLarge is returned when a primary key is too long to be stored in
+// a disk engine page
+var ErrKeyTooLarge = fmt.Errorf("primary key too large for the disk engine (max %d bytes encoded)", maxKeySize)
+
+// diskEngine is an Engine storing one table as a B+tree of pages. Keys are
+// the order-preserving encoding of the primary key; leaves hold the rows as
+// JSON, spilling large rows into overflow pages.
+type diskEngine struct {
+	pager  *pager
+	schema Schema
+	root   pageID
+	rows   int
+}
+
+// newDiskEngine creates an empty tree
+func newDiskEngine(p *pager, schema Schema) *diskEngine {
+	return &diskEngine{pager: p, schema: schema, root: p.alloc(&node{kind: pageLeaf})}
+}
+
+// openDiskEngine opens the tree rooted at root, as saved by a checkpoint
+func openDiskEngine(p *pager, schema Schema, root pageID, rows int) *diskEngine {
+	return &diskEngine{pager: p, schema: schema, root: root, rows: rows}
+}
+
+// split is the result of splitting a page: the separator key and the new
+// right-hand page
+type split struct {
+	key   []byte
+	right pageID
+}
+
+func (e *diskEngine) Get(key any) (VersionedRecord, bool, error) {
+	k, err := appendKey(nil, key)
+	if err != nil {
+		return VersionedRecord{}, false, err
+	}
+	id := e.root
+	for {
+		n, err := e.pager.get(id)
+		if err != nil {
+			return VersionedRecord{}, false, err
+		}
+		if n.kind == pageInternal {
+			id = n.children[childIndex(n, k)]
+			continue
+		}
+		i, found := leafIndex(n, k)
+		if !found {
+			return VersionedRecord{}, false, nil
+		}
+		vRecord, err := e.decode(n.values[i])
+		return vRecord, err == nil, err
+	}
+}
+
+func (e *diskEngine) Put(key any, vRecord VersionedRecord) error {
+	k, err := appendKey(nil, key)
+	if err != nil {
+		return err
+	}
+	if len(k) > maxKeySize {
+		return ErrKeyTooLarge
+	}
+	data, err := json.Marshal(vRecord)
+	if err != nil {
+		return err
+	}
+
+	var value leafValue
+	if len(data) > maxInlineValue {
+		value = leafValue{overflow: e.writeOverflow(data), length: len(data)}
+	} else {
+		value = leafValue{inline: data}
+	}
+	s, err := e.insert(e.root, k, value)
+	if err != nil {
+		e.freeOverflow(value)
+		return err
+	}
+	if s != nil {
+		e.root = e.pager.alloc(&node{kind: pageInternal, keys: [][]byte{s.key}, children: []pageID{e.root, s.right}})
+	}
+	return nil
+}
+
+// insert stores value under key in the subtree at id and returns the split
+// of id if it overflowed. All reads happen on the way down, so an error
+// leaves the tree unchanged.
+func (e *diskEngine) insert(id pageID, key []byte, value leafValue) (*split, error) {
+	n, err := e.pager.pin(id)
+	if err != nil {
+		return nil, err
+	}
+	defer e.pager.unpin(id)
+
+	if n.kind == pageInternal {
+		i := childIndex(n, key)
+		s, err := e.insert(n.children[i], key, value)
+		if err != nil || s == nil {
+			return nil, err
+		}
+		n.keys = insertAt(n.keys, i, s.key)
+		n.children = insertAt(n.children, i+1, s.right)
+		e.pager.markDirty(id)
+		return e.splitIfFull(n), nil
+	}
+
+	i, found := leafIndex(n, key)
+	if found {
+		old, err := e.overflowPages(n.values[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, page := range old {
+			e.pager.release(page)
+		}
+		n.values[i] = value
+	} else {
+		n.keys = insertAt(n.keys, i, key)
+		n.values = insertAt(n.values, i, value)
+		e.rows++
+	}
+	e.pager.markDirty(id)
+	return e.splitIfFull(n), nil
+}
+
+// splitIfFull moves the upper part of an oversized page into a new page,
+// choosing the split point that balances the two halves by size
+func (e *diskEngine) splitIfFull(n *node) *split {
+	if n.size() <= pageCapacity {
+		return nil
+	}
+
+	best, bestSize := 1, pageSize*2
+	for i := 1; i < len(n.keys); i++ {
+		left, right := n.slice(0, i), n.slice(i, len(n.keys))
+		if size := max(left.size(), right.size()); size < bestSize {
+			best, bestSize = i, size
+		}
+	}
+
+	sep := n.keys[best]
+	var right *node
+	if n.kind == pageInternal {
+		// The separator moves up instead of staying in either half
+		right = &node{
+			kind:     pageInternal,
+			keys:     append([][]byte(nil), n.keys[best+1:]...),
+			children: append([]pageID(nil), n.children[best+1:]...),
+		}
+		n.keys, n.children = n.keys[:best:best], n.children[:best+1:best+1]
+	} else {
+		right = n.slice(best, len(n.keys))
+		n.keys, n.values = n.keys[:best:best], n.values[:best:best]
+	}
+	return &split{key: sep, right: e.pager.alloc(right)}
+}
+
+// slice returns a page holding keys i to j of n. For an internal page the
+// children between those keys are included.
+func (n *node) slice(i, j int) *node {
+	s := &node{kind: n.kind, keys: append([][]byte(nil), n.keys[i:j]...)}
+	if n.kind == pageInternal {
+		s.children = append([]pageID(nil), n.children[i:j+1]...)
+	} else {
+		s.values = append([]leafValue(nil), n.values[i:j]...)
+	}
+	return s
+}
+
+func (e *diskEngine) Delete(key any) error {
+	k, err := appendKey(nil, key)
+	if err != nil {
+		return err
+	}
+	if _, err := e.remove(e.root, k); err != nil {
+		return err
+	}
+
+	// Collapse a root left with a single child
+	for {
+		n, err := e.pager.get(e.root)
+		if err != nil || n.kind != pageInternal || len(n.keys) > 0 {
+			return nil
+		}
+		old := e.root
+		e.root = n.children[0]
+		e.pager.release(old)
+	}
+}
+
+// remove deletes key from the subtree at id and reports whether it was
+// found. Underfull children are merged with a sibling on the way back up.
+func (e *diskEngine) remove(id pageID, key []byte) (bool, error) {
+	n, err := e.pager.pin(id)
+	if err != nil {
+		return false, err
+	}
+	defer e.pager.unpin(id)
+
+	if n.kind == pageLeaf {
+		i, found := leafIndex(n, key)
+		if !found {
+			return false, nil
+		}
+		old, err := e.overflowPages(n.values[i])
+		if err != nil {
+			return false, err
+		}
+		for _, page := range old {
+			e.pager.release(page)
+		}
+		n.keys = removeAt(n.keys, i)
+		n.values = removeAt(n.values, i)
+		e.rows--
+		e.pager.markDirty(id)
+		return true, nil
+	}
+
+	i := childIndex(n, key)
+	found, err := e.remove(n.children[i], key)
+	if err != nil || !found {
+		return found, err
+	}
+	e.merge(id, n, i)
+	return true, nil
+}
+
+// merge joins child i of the pinned internal page n with a neighbour if it
+// has become small and the two fit in one page. A sibling that cannot be
+// read is left alone; an underfull page is still a valid tree.
+func (e *diskEngine) merge(id pageID, n *node, i int) {
+	if len(n.children) < 2 {
+		return
+	}
+	child, err := e.pager.get(n.children[i])
+	if err != nil || child.size() >= minFill {
+		return
+	}
+	if i == len(n.children)-1 {
+		i-- // Merge the last child into its left neighbour
+	}
+
+	leftID, rightID := n.children[i], n.children[i+1]
+	left, err := e.pager.pin(leftID)
+	if err != nil {
+		return
+	}
+	defer e.pager.unpin(leftID)
+	right, err := e.pager.pin(rightID)
+	if err != nil {
+		return
+	}
+	defer e.pager.unpin(rightID)
+
+	merged := &node{kind: left.kind, keys: append(append([][]byte(nil), left.keys...), right.keys...)}
+	if left.kind == pageInternal {
+		merged.keys = insertAt(merged.keys, len(left.keys), n.keys[i])
+		merged.children = append(append([]pageID(nil), left.children...), right.children...)
+	} else {
+		merged.values = append(append([]leafValue(nil), left.values...), right.values...)
+	}
+	if merged.size() > pageCapacity {
+		return
+	}
+
+	*left = *merged
+	e.pager.markDirty(leftID)
+	n.keys = removeAt(n.keys, i)
+	n.children = removeAt(n.children, i+1)
+	e.pager.markDirty(id)
+	e.pager.release(rightID)
+}
+
+func (e *diskEngine) Len() int {
+	return e.rows
+}
+
+// Scan visits rows in primary key order
+func (e *diskEngine) Scan(fn func(key any, vRecord VersionedRecord) bool) error {
+	_, err := e.scan(e.root, fn)
+	return err
+}
+
+func (e *diskEngine) scan(id pageID, fn func(key any, vRecord VersionedRecord) bool) (bool, error) {
+	n, err := e.pager.get(id)
+	if err != nil {
+		return false, err
+	}
+	if n.kind == pageInternal {
+		for _, child := range n.children {
+			if more, err := e.scan(child, fn); !more || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	for _, value := range n.values {
+		vRecord, err := e.decode(value)
+		if err != nil {
+			return false, err
+		}
+		if !fn(e.schema.primaryKey(vRecord.Record), vRecord) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// scanRange visits the rows between two primary key bounds in key order
+func (e *diskEngine) scanRange(lower, upper *Bound, fn func(key any, vRecord VersionedRecord) bool) error {
+	var lo, hi []byte
+	var err error
+	if lower != nil {
+		if lo, err = appendKey(nil, lower.Value); err != nil {
+			return err
+		}
+		if !lower.Inclusive {
+			lo = prefixEnd(lo)
+		}
+	}
+	if upper != nil {
+		if hi, err = appendKey(nil, upper.Value); err != nil {
+			return err
+		}
+		if upper.Inclusive {
+			hi = prefixEnd(hi)
+		}
+	}
+	_, err = e.scanFrom(e.root, lo, hi, hi != nil, fn)
+	return err
+}
+
+// scanFrom visits the rows of a subtree with keys in [lo, hi), where hi only
+// applies if bounded
+func (e *diskEngine) scanFrom(id pageID, lo, hi []byte, bounded bool, fn func(key any, vRecord VersionedRecord) bool) (bool, error) {
+	n, err := e.pager.get(id)
+	if err != nil {
+		return false, err
+	}
+	if n.kind == pageInternal {
+		for i := childIndex(n, lo); i < len(n.children); i++ {
+			if bounded && i > 0 && bytes.Compare(n.keys[i-1], hi) >= 0 {
+				return false, nil
+			}
+			if more, err := e.scanFrom(n.children[i], lo, hi, bounded, fn); !more || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	i, _ := leafIndex(n, lo)
+	for ; i < len(n.keys); i++ {
+		if bounded && bytes.Compare(n.keys[i], hi) >= 0 {
+			return false, nil
+		}
+		vRecord, err := e.decode(n.values[i])
+		if err != nil {
+			return false, err
+		}
+		if !fn(e.schema.primaryKey(vRecord.Record), vRecord) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// checkKey reports whether key can be stored, before a write is logged
+func (e *diskEngine) checkKey(key any) error {
+	k, err := appendKey(nil, key)
+	if err != nil {
+		return err
+	}
+	if len(k) > maxKeySize {
+		return ErrKeyTooLarge
+	}
+	return nil
+}
+
+// decode reads a row, following its overflow chain if it has one
+func (e *diskEngine) decode(value leafValue) (VersionedRecord, error) {
+	data := value.inline
+	if value.overflow != 0 {
+		data = make([]byte, 0, value.length)
+		for id := value.overflow; id != 0; {
+			n, err := e.pager.get(id)
+			if err != nil {
+				return VersionedRecord{}, err
+			}
+			data = append(data, n.data...)
+			id = n.next
+		}
+		if len(data) != value.length {
+			return VersionedRecord{}, errors.New("overflow chain has the wrong length")
+		}
+	}
+
+	var vRecord VersionedRecord
+	if err := decodeJSON(data, &vRecord); err != nil {
+		return VersionedRecord{}, err
+	}
+	row, err := e.schema.decodeRow(vRecord.Record)
+	if err != nil {
+		return VersionedRecord{}, err
+	}
+	vRecord.Record = row
+	return vRecord, nil
+}
+
+// writeOverflow stores data in a new chain of overflow pages and returns the
+// first one
+func (e *diskEngine) writeOverflow(data []byte) pageID {
+	var next pageID
+	for end := len(data); end > 0; end -= overflowData {
+		start := max(end-overflowData, 0)
+		next = e.pager.alloc(&node{kind: pageOverflow, data: bytes.Clone(data[start:end]), next: next})
+	}
+	return next
+}
+
+// overflowPages lists the overflow chain of value
+func (e *diskEngine) overflowPages(value leafValue) ([]pageID, error) {
+	var pages []pageID
+	for id := value.overflow; id != 0; {
+		n, err := e.pager.get(id)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, id)
+		id = n.next
+	}
+	return pages, nil
+}
+
+// freeOverflow releases the chain of a value that was never stored
+func (e *diskEngine) freeOverflow(value leafValue) {
+	for id := value.overflow; id != 0; {
+		n, err := e.pager.get(id)
+		e.pager.release(id)
+		if err != nil {
+			return
+		}
+		id = n.next
+	}
+}
+
+// childIndex returns the child of an internal page that covers key
+func childIndex(n *node, key []byte) int {
+	return sort.Search(len(n.keys), func(i int) bool { return bytes.Compare(n.keys[i], key) > 0 })
+}
+
+// leafIndex returns the position of key in a leaf, or where it would go
+func leafIndex(n *node, key []byte) (int, bool) {
+	i := sort.Search(len(n.keys), func(i int) bool { return bytes.Compare(n.keys[i], key) >= 0 })
+	return i, i < len(n.keys) && bytes.Equal(n.keys[i], key)
+}
+
+func insertAt[T any](s []T, i int, v T) []T {
+	s = append(s, v)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+	return s
+}
+
+func removeAt[T any](s []T, i int) []T {
+	return append(s[:i], s[i+1:]...)
+}
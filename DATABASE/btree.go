@@ -0,0 +1,259 @@
+package main
+
+import (
+	"slices"
+	"sort"
+)
+
+// btreeDegree is the minimum degree of the tree: every node except the root
+// holds between btreeDegree-1 and 2*btreeDegree-1 items
+const btreeDegree = 16
+
+// btreeItem is a key and the primary keys stored under it
+type btreeItem struct {
+	key   string
+	value []any
+}
+
+type btreeNode struct {
+	items    []btreeItem
+	children []*btreeNode
+}
+
+// btree is an in-memory B-tree mapping encoded index keys to posting lists.
+// It is not safe for concurrent use; the owning Table's lock guards it.
+type btree struct {
+	root *btreeNode
+	size int
+}
+
+func (n *btreeNode) leaf() bool {
+	return len(n.children) == 0
+}
+
+// find returns the position of the first item >= key and whether it matches
+func (n *btreeNode) find(key string) (int, bool) {
+	i := sort.Search(len(n.items), func(i int) bool { return n.items[i].key >= key })
+	return i, i < len(n.items) && n.items[i].key == key
+}
+
+// Len returns the number of keys in the tree
+func (t *btree) Len() int {
+	return t.size
+}
+
+// Get returns the value stored under key
+func (t *btree) Get(key string) ([]any, bool) {
+	n := t.root
+	for n != nil {
+		i, found := n.find(key)
+		if found {
+			return n.items[i].value, true
+		}
+		if n.leaf() {
+			return nil, false
+		}
+		n = n.children[i]
+	}
+	return nil, false
+}
+
+// Set inserts key or replaces its value
+func (t *btree) Set(key string, value []any) {
+	if t.root == nil {
+		t.root = &btreeNode{items: []btreeItem{{key: key, value: value}}}
+		t.size = 1
+		return
+	}
+	if len(t.root.items) == 2*btreeDegree-1 {
+		old := t.root
+		t.root = &btreeNode{children: []*btreeNode{old}}
+		t.root.splitChild(0)
+	}
+	if t.root.insertNonFull(key, value) {
+		t.size++
+	}
+}
+
+// splitChild splits the full child at i around its median item
+func (n *btreeNode) splitChild(i int) {
+	child := n.children[i]
+	mid := btreeDegree - 1
+	median := child.items[mid]
+
+	right := &btreeNode{items: slices.Clone(child.items[mid+1:])}
+	if !child.leaf() {
+		right.children = slices.Clone(child.children[mid+1:])
+		child.children = child.children[:mid+1]
+	}
+	child.items = child.items[:mid]
+
+	n.items = slices.Insert(n.items, i, median)
+	n.children = slices.Insert(n.children, i+1, right)
+}
+
+// insertNonFull inserts into a node that has room; it reports whether a new
+// key was added
+func (n *btreeNode) insertNonFull(key string, value []any) bool {
+	i, found := n.find(key)
+	if found {
+		n.items[i].value = value
+		return false
+	}
+	if n.leaf() {
+		n.items = slices.Insert(n.items, i, btreeItem{key: key, value: value})
+		return true
+	}
+	if len(n.children[i].items) == 2*btreeDegree-1 {
+		n.splitChild(i)
+		switch {
+		case key == n.items[i].key:
+			n.items[i].value = value
+			return false
+		case key > n.items[i].key:
+			i++
+		}
+	}
+	return n.children[i].insertNonFull(key, value)
+}
+
+// Delete removes key and reports whether it was present
+func (t *btree) Delete(key string) bool {
+	if t.root == nil {
+		return false
+	}
+	removed := t.root.remove(key)
+	if len(t.root.items) == 0 {
+		if t.root.leaf() {
+			t.root = nil
+		} else {
+			t.root = t.root.children[0]
+		}
+	}
+	if removed {
+		t.size--
+	}
+	return removed
+}
+
+// remove deletes key from the subtree rooted at n. Every node it descends
+// into is first topped up to at least btreeDegree items so the removal never
+// leaves a node under-full.
+func (n *btreeNode) remove(key string) bool {
+	i, found := n.find(key)
+	if n.leaf() {
+		if !found {
+			return false
+		}
+		n.items = slices.Delete(n.items, i, i+1)
+		return true
+	}
+
+	if found {
+		left, right := n.children[i], n.children[i+1]
+		switch {
+		case len(left.items) >= btreeDegree:
+			pred := left.max()
+			n.items[i] = pred
+			return left.remove(pred.key)
+		case len(right.items) >= btreeDegree:
+			succ := right.min()
+			n.items[i] = succ
+			return right.remove(succ.key)
+		default:
+			n.merge(i)
+			return left.remove(key)
+		}
+	}
+
+	if len(n.children[i].items) < btreeDegree {
+		i = n.grow(i)
+	}
+	return n.children[i].remove(key)
+}
+
+// grow tops up children[i] by borrowing from a sibling or merging with one.
+// It returns the index of the child that now covers the same key range.
+func (n *btreeNode) grow(i int) int {
+	child := n.children[i]
+	if i > 0 && len(n.children[i-1].items) >= btreeDegree {
+		left := n.children[i-1]
+		child.items = slices.Insert(child.items, 0, n.items[i-1])
+		n.items[i-1] = left.items[len(left.items)-1]
+		left.items = left.items[:len(left.items)-1]
+		if !left.leaf() {
+			child.children = slices.Insert(child.children, 0, left.children[len(left.children)-1])
+			left.children = left.children[:len(left.children)-1]
+		}
+		return i
+	}
+	if i < len(n.children)-1 && len(n.children[i+1].items) >= btreeDegree {
+		right := n.children[i+1]
+		child.items = append(child.items, n.items[i])
+		n.items[i] = right.items[0]
+		right.items = slices.Delete(right.items, 0, 1)
+		if !right.leaf() {
+			child.children = append(child.children, right.children[0])
+			right.children = slices.Delete(right.children, 0, 1)
+		}
+		return i
+	}
+	if i > 0 {
+		n.merge(i - 1)
+		return i - 1
+	}
+	n.merge(i)
+	return i
+}
+
+// merge folds items[i] and children[i+1] into children[i]
+func (n *btreeNode) merge(i int) {
+	left, right := n.children[i], n.children[i+1]
+	left.items = append(left.items, n.items[i])
+	left.items = append(left.items, right.items...)
+	left.children = append(left.children, right.children...)
+	n.items = slices.Delete(n.items, i, i+1)
+	n.children = slices.Delete(n.children, i+1, i+2)
+}
+
+func (n *btreeNode) min() btreeItem {
+	for !n.leaf() {
+		n = n.children[0]
+	}
+	return n.items[0]
+}
+
+func (n *btreeNode) max() btreeItem {
+	for !n.leaf() {
+		n = n.children[len(n.children)-1]
+	}
+	return n.items[len(n.items)-1]
+}
+
+// Ascend calls fn for every key in [lo, hi) in order until fn returns false.
+// With bounded false there is no upper limit.
+func (t *btree) Ascend(lo, hi string, bounded bool, fn func(key string, value []any) bool) {
+	if t.root != nil {
+		t.root.ascend(lo, hi, bounded, fn)
+	}
+}
+
+func (n *btreeNode) ascend(lo, hi string, bounded bool, fn func(key string, value []any) bool) bool {
+	i, _ := n.find(lo)
+	for ; i <= len(n.items); i++ {
+		if !n.leaf() && !n.children[i].ascend(lo, hi, bounded, fn) {
+			return false
+		}
+		if i == len(n.items) {
+			break
+		}
+		item := n.items[i]
+		if bounded && item.key >= hi {
+			return false
+		}
+		if !fn(item.key, item.value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DefaultCacheSize is the number of rows the read cache holds by default
+const DefaultCacheSize = 10000
+
+// CacheStats reports the activity of the read cache
+type CacheStats struct {
+	Hits          uint64
+	Misses        uint64
+	Evictions     uint64 // Entries dropped to stay within capacity
+	Invalidations uint64 // Entries dropped because the row changed
+	Size          int
+	Capacity      int
+}
+
+// cacheKey identifies a row. Keying by table pointer means rows of a replaced
+// table can never be served for its replacement. Tables are only replaced all
+// at once, by a restore or a replica's snapshot, which clear the cache so the
+// old tables are not kept alive by their rows.
+type cacheKey struct {
+	table *Table
+	key   any
+}
+
+type cacheEntry struct {
+	key cacheKey
+	row Record
+}
+
+// rowCache is a size-bounded LRU cache of committed rows used by Get. Entries
+// are added while the table's read lock is held and removed by Table.put and
+// Table.remove under its write lock, so a cached row is never older than the
+// latest committed version.
+type rowCache struct {
+	capacity int
+	entries  map[cacheKey]*list.Element
+	order    *list.List // Front is most recently used
+	stats    CacheStats
+	mu       sync.Mutex
+}
+
+func newRowCache(capacity int) *rowCache {
+	return &rowCache{
+		capacity: capacity,
+		entries:  make(map[cacheKey]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// get returns the cached row for key, counting a hit or a miss
+func (c *rowCache) get(key cacheKey) (Record, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, found := c.entries[key]
+	if !found {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).row, true
+}
+
+// add caches row, evicting the least recently used rows beyond capacity. The
+// caller must hold the read lock of key.table.
+func (c *rowCache) add(key cacheKey, row Record) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.capacity <= 0 {
+		return
+	}
+	if elem, found := c.entries[key]; found {
+		elem.Value.(*cacheEntry).row = row
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, row: row})
+	c.evict()
+}
+
+// invalidate drops the cached row for key, if any
+func (c *rowCache) invalidate(key cacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, found := c.entries[key]; found {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		c.stats.Invalidations++
+	}
+}
+
+// clear drops every cached row
+func (c *rowCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[cacheKey]*list.Element)
+	c.order.Init()
+}
+
+// resize changes the capacity, evicting rows if it shrinks
+func (c *rowCache) resize(capacity int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.capacity = max(capacity, 0)
+	c.evict()
+}
+
+// evict removes the least recently used rows beyond capacity. The caller must
+// hold c.mu.
+func (c *rowCache) evict() {
+	for c.order.Len() > c.capacity {
+		elem := c.order.Back()
+		c.order.Remove(elem)
+		delete(c.entries, elem.Value.(*cacheEntry).key)
+		c.stats.Evictions++
+	}
+}
+
+func (c *rowCache) snapshot() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Size = c.order.Len()
+	stats.Capacity = c.capacity
+	return stats
+}
+
+// SetCacheSize sets the number of rows the read cache may hold. Zero disables
+// caching.
+func (db *Database) SetCacheSize(rows int) {
+	db.cache.resize(rows)
+}
+
+// CacheStats returns the read cache counters
+func (db *Database) CacheStats() CacheStats {
+	return db.cache.snapshot()
+}
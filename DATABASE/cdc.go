@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Change operations
+const (
+	ChangeInsert = "insert"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+const (
+	changesFileName = "changes.log"
+
+	// DefaultChangeRetention is the number of recent change events kept for
+	// subscribers resuming from an earlier position
+	DefaultChangeRetention = 10000
+
+	changeBatch = 256 // Events copied out of the feed at a time
+)
+
+// ErrPositionExpired is returned when subscribing from a position older than
+// the retained change events
+var ErrPositionExpired = errors.New("change position is no longer retained")
+
+// ChangeEvent is one committed row change. Positions start at 1 and grow by
+// one per event in commit order, so a consumer resumes by subscribing from
+// the position after the last event it processed. Events of one transaction
+// share a version and time and are delivered together.
+type ChangeEvent struct {
+	Position uint64    `json:"position"`
+	Table    string    `json:"table"`
+	Op       string    `json:"op"`
+	Key      any       `json:"key"`
+	Old      Record    `json:"old,omitempty"` // Row before an update or delete
+	New      Record    `json:"new,omitempty"` // Row after an insert or update
+	Version  int       `json:"version"`
+	Time     time.Time `json:"time"`
+}
+
+// changeFrame is the changes.log record of the events of one WAL entry
+type changeFrame struct {
+	LSN    uint64        `json:"lsn"`
+	Events []ChangeEvent `json:"events"`
+}
+
+// changeFeed retains recent change events and wakes subscribers. A durable
+// database also appends them to changes.log so positions survive a restart;
+// events lost from the end of that file in a crash are rebuilt from the WAL
+// with the same positions, because both are written in log order.
+type changeFeed struct {
+	file      *os.File // nil for an in-memory database
+	path      string
+	keys      *Keyring      // Encrypts changes.log, if set
+	rewrite   bool          // Rewrite changes.log at the next sync, for a new key
+	events    []ChangeEvent // Oldest first, positions are contiguous
+	next      uint64        // Position of the next event
+	lastLSN   uint64        // Last WAL entry whose events were recorded
+	logged    int           // Events in changes.log
+	retention int
+	pending   map[uint64]struct{} // First positions of events not yet applied
+	notify    chan struct{}       // Closed and replaced when events become visible
+	err       error               // First changes.log write error
+	closed    bool
+	mu        sync.Mutex
+}
+
+func newChangeFeed(retention int) *changeFeed {
+	return &changeFeed{
+		next:      1,
+		retention: max(retention, 1),
+		pending:   make(map[uint64]struct{}),
+		notify:    make(chan struct{}),
+	}
+}
+
+// open loads the events retained in the change log at path and appends
+// further events to it, encrypted with keys
+func (f *changeFeed) open(path string, keys *Keyring) error {
+	f.keys = keys
+	offset, torn, err := readFrames(path, func(payload []byte) (bool, error) {
+		payload, err := keys.open(payload, changesAAD)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", path, err)
+		}
+		var fr changeFrame
+		if err := decodeJSON(payload, &fr); err != nil {
+			return false, nil
+		}
+		if len(fr.Events) > 0 {
+			f.next = fr.Events[len(fr.Events)-1].Position + 1
+			f.retain(fr.Events)
+		}
+		f.lastLSN = max(f.lastLSN, fr.LSN)
+		f.logged += len(fr.Events)
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	if torn {
+		if err := os.Truncate(path, offset); err != nil {
+			return err
+		}
+	}
+	f.path = path
+	f.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+// decode converts the keys and rows of the events before position end, as
+// loaded from changes.log, back to their column types. It runs once the WAL
+// has been replayed and every table exists.
+func (f *changeFeed) decode(db *Database, end uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, event := range f.events {
+		if event.Position >= end {
+			break
+		}
+		table, err := db.lookupTable(event.Table)
+		if err != nil {
+			return fmt.Errorf("change %d: %w", event.Position, err)
+		}
+		if f.events[i].Key, err = table.schema.normalizeKey(event.Key); err != nil {
+			return fmt.Errorf("change %d: %w", event.Position, err)
+		}
+		for _, row := range []*Record{&f.events[i].Old, &f.events[i].New} {
+			if *row != nil {
+				if *row, err = table.schema.decodeRow(*row); err != nil {
+					return fmt.Errorf("change %d: %w", event.Position, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// publish numbers the events of the WAL entry lsn (0 for an in-memory
+// database) and records them. They stay invisible to subscribers until
+// release is called with the returned ticket, once the write is applied.
+func (f *changeFeed) publish(lsn uint64, events []ChangeEvent) uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastLSN = max(f.lastLSN, lsn)
+	if len(events) == 0 {
+		return 0
+	}
+	ticket := f.next
+	for i := range events {
+		events[i].Position = f.next
+		f.next++
+	}
+	if f.file != nil && f.err == nil {
+		payload, err := json.Marshal(changeFrame{LSN: lsn, Events: events})
+		if err == nil {
+			payload, err = f.keys.seal(payload, changesAAD)
+		}
+		if err == nil {
+			_, err = f.file.Write(encodeFrame(payload))
+		}
+		if err != nil {
+			// Keep serving from memory; the failed sync stops the next
+			// checkpoint, so the WAL keeps the events for recovery
+			f.err = err
+		}
+		f.logged += len(events)
+	}
+	f.retain(events)
+	f.pending[ticket] = struct{}{}
+	return ticket
+}
+
+// release makes the events of ticket visible to subscribers
+func (f *changeFeed) release(ticket uint64) {
+	if ticket == 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.pending, ticket)
+	close(f.notify)
+	f.notify = make(chan struct{})
+}
+
+// retain appends events, dropping the oldest beyond the retention. The caller
+// must hold f.mu or have exclusive access.
+func (f *changeFeed) retain(events []ChangeEvent) {
+	f.events = append(f.events, events...)
+	if len(f.events) > f.retention+f.retention/4 {
+		f.events = slices.Clone(f.events[len(f.events)-f.retention:])
+	}
+}
+
+// visibleEnd returns the position after the last event subscribers may see.
+// The caller must hold f.mu.
+func (f *changeFeed) visibleEnd() uint64 {
+	end := f.next
+	for ticket := range f.pending {
+		end = min(end, ticket)
+	}
+	return end
+}
+
+// first returns the oldest retained position. The caller must hold f.mu.
+func (f *changeFeed) first() uint64 {
+	if len(f.events) == 0 {
+		return f.next
+	}
+	return f.events[0].Position
+}
+
+// sync makes changes.log durable and rewrites it once it holds well over the
+// retained events, or after a key rotation. It runs at checkpoints, before
+// the WAL is truncated.
+func (f *changeFeed) sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil || f.err != nil {
+		return f.err
+	}
+	if f.logged <= 2*f.retention && !f.rewrite {
+		return f.file.Sync()
+	}
+
+	var data []byte
+	for events := f.events; len(events) > 0; {
+		n := min(len(events), changeBatch)
+		payload, err := json.Marshal(changeFrame{LSN: f.lastLSN, Events: events[:n]})
+		if err == nil {
+			payload, err = f.keys.seal(payload, changesAAD)
+		}
+		if err != nil {
+			return err
+		}
+		data = append(data, encodeFrame(payload)...)
+		events = events[n:]
+	}
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(f.path, data); err != nil {
+		f.err = err
+		return err
+	}
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		f.err = err
+		return err
+	}
+	f.file, f.logged, f.rewrite = file, len(f.events), false
+	return nil
+}
+
+// rekey makes the next sync rewrite changes.log, encrypting the events it
+// keeps with the newest key
+func (f *changeFeed) rekey() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rewrite = true
+}
+
+// close ends every subscription and closes changes.log
+func (f *changeFeed) close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	close(f.notify)
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Sync()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Subscribe delivers the committed changes with positions from from onwards,
+// in order, until ctx is done or the database is closed. A from of 0 starts
+// at the oldest retained event; ChangePosition gives the position of the next
+// change. If tables are given, only their changes are delivered. The channel
+// is also closed if the subscriber falls behind the retained events;
+// subscribing again from the same position then returns ErrPositionExpired.
+func (db *Database) Subscribe(ctx context.Context, from uint64, tables ...string) (<-chan ChangeEvent, error) {
+	f := db.feed
+	f.mu.Lock()
+	if from == 0 {
+		from = f.first()
+	}
+	if from < f.first() {
+		f.mu.Unlock()
+		return nil, ErrPositionExpired
+	}
+	f.mu.Unlock()
+
+	ch := make(chan ChangeEvent)
+	go func() {
+		defer close(ch)
+		next := from
+		for {
+			f.mu.Lock()
+			if next < f.first() {
+				f.mu.Unlock()
+				return
+			}
+			start := int(next - f.first())
+			end := min(int(f.visibleEnd()-f.first()), start+changeBatch)
+			batch := slices.Clone(f.events[min(start, end):end])
+			wait, closed := f.notify, f.closed
+			f.mu.Unlock()
+
+			if len(batch) == 0 {
+				if closed {
+					return
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-wait:
+				}
+				continue
+			}
+			for _, event := range batch {
+				next = event.Position + 1
+				if len(tables) > 0 && !slices.Contains(tables, event.Table) {
+					continue
+				}
+				event.Old, event.New = event.Old.clone(), event.New.clone()
+				select {
+				case ch <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// ChangePosition returns the position the next committed change will have
+func (db *Database) ChangePosition() uint64 {
+	db.feed.mu.Lock()
+	defer db.feed.mu.Unlock()
+	return db.feed.next
+}
+
+// changesOf returns the change events of a logged row write or commit. Rows
+// must already have their column types (see decodeEntry).
+func changesOf(entry walEntry) []ChangeEvent {
+	batch := []walEntry{entry}
+	switch entry.Op {
+	case opInsert, opUpdate, opDelete:
+	case opCommit:
+		batch = entry.Batch
+	default:
+		return nil
+	}
+
+	events := make([]ChangeEvent, 0, len(batch))
+	for _, e := range batch {
+		event := ChangeEvent{
+			Table:   e.Table,
+			Key:     e.Key,
+			Old:     e.Old,
+			New:     e.Record,
+			Version: entry.Version,
+			Time:    time.Unix(0, entry.Time).UTC(),
+		}
+		switch e.Op {
+		case opInsert:
+			event.Op = ChangeInsert
+		case opUpdate:
+			event.Op = ChangeUpdate
+		case opDelete:
+			event.Op, event.New = ChangeDelete, nil
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// decodeEntry converts the keys and rows of a row write read back from the
+// WAL to their column types
+func (db *Database) decodeEntry(entry walEntry) (walEntry, error) {
+	switch entry.Op {
+	case opInsert, opUpdate, opDelete:
+		table, err := db.lookupTable(entry.Table)
+		if err != nil {
+			return entry, err
+		}
+		if entry.Record != nil {
+			if entry.Record, err = table.schema.decodeRow(entry.Record); err != nil {
+				return entry, err
+			}
+		}
+		if entry.Old != nil {
+			if entry.Old, err = table.schema.decodeRow(entry.Old); err != nil {
+				return entry, err
+			}
+		}
+		if entry.Key == nil {
+			entry.Key = table.schema.primaryKey(entry.Record)
+		} else if entry.Key, err = table.schema.normalizeKey(entry.Key); err != nil {
+			return entry, err
+		}
+	case opCommit:
+		batch := make([]walEntry, len(entry.Batch))
+		for i, e := range entry.Batch {
+			var err error
+			if batch[i], err = db.decodeEntry(e); err != nil {
+				return entry, err
+			}
+		}
+		entry.Batch = batch
+	}
+	return entry, nil
+}
+
+// ChangesHandler serves the change stream over HTTP as newline-delimited
+// JSON events: GET ?from=N&table=name streams every change from position N
+// (default: the oldest retained), optionally only for the given tables, and
+// keeps the response open for new changes. Clients resume after a
+// disconnect with from set to the last position they saw plus one. An
+// expired position is answered with 410 Gone.
+func (db *Database) ChangesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var from uint64
+		if text := r.URL.Query().Get("from"); text != "" {
+			var err error
+			if from, err = strconv.ParseUint(text, 10, 64); err != nil {
+				http.Error(w, "invalid from position", http.StatusBadRequest)
+				return
+			}
+		}
+
+		events, err := db.Subscribe(r.Context(), from, r.URL.Query()["table"]...)
+		if errors.Is(err, ErrPositionExpired) {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		flusher, _ := w.(http.Flusher)
+		encoder := json.NewEncoder(w)
+		for {
+			if flusher != nil {
+				flusher.Flush()
+			}
+			event, ok := <-events
+			if !ok {
+				return
+			}
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+			// Send whatever else is ready before flushing
+			for more := true; more; {
+				select {
+				case event, ok = <-events:
+					if !ok {
+						return
+					}
+					if err := encoder.Encode(event); err != nil {
+						return
+					}
+				default:
+					more = false
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,469 @@
+// Package client is a small client for the database server. It speaks the
+// subset of the PostgreSQL wire protocol the server implements and depends
+// only on the standard library.
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Type OIDs used on the wire
+const (
+	oidBool        = 16
+	oidBytea       = 17
+	oidInt8        = 20
+	oidInt2        = 21
+	oidInt4        = 23
+	oidFloat4      = 700
+	oidFloat8      = 701
+	oidTimestamp   = 1114
+	oidTimestamptz = 1184
+)
+
+// ErrClosed is returned when using a closed or broken connection
+var ErrClosed = errors.New("connection closed")
+
+// Error is an error reported by the server
+type Error struct {
+	Severity string
+	Code     string // SQLSTATE, e.g. "42601" for a syntax error
+	Message  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s (SQLSTATE %s)", e.Severity, e.Message, e.Code)
+}
+
+// Rows is the complete result of a query
+type Rows struct {
+	Columns []string
+	Types   []uint32 // Type OID of each column
+	Values  [][]any  // int64, float64, string, bool, time.Time, []byte or nil
+	Tag     string   // Command tag such as "SELECT 3" or "INSERT 0 1"
+}
+
+// Conn is a connection to the server. It is safe for concurrent use, but
+// statements are executed one at a time.
+type Conn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	status byte // Transaction status from the last ReadyForQuery
+	broken bool
+	mu     sync.Mutex
+}
+
+// Dial connects to the server at addr as user
+func Dial(ctx context.Context, addr string, user string) (*Conn, error) {
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{conn: netConn, r: bufio.NewReader(netConn), w: bufio.NewWriter(netConn)}
+	defer c.watch(ctx)()
+
+	startup := binary.BigEndian.AppendUint32(nil, 196608)
+	for _, kv := range [][2]string{{"user", user}, {"database", "main"}, {"client_encoding", "UTF8"}} {
+		startup = append(append(startup, kv[0]...), 0)
+		startup = append(append(startup, kv[1]...), 0)
+	}
+	startup = append(startup, 0)
+	packet := binary.BigEndian.AppendUint32(nil, uint32(len(startup)+4))
+	if _, err := netConn.Write(append(packet, startup...)); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	for {
+		typ, body, err := c.readMessage()
+		if err != nil {
+			netConn.Close()
+			return nil, err
+		}
+		switch typ {
+		case 'R':
+			if len(body) < 4 || binary.BigEndian.Uint32(body) != 0 {
+				netConn.Close()
+				return nil, errors.New("unsupported authentication method")
+			}
+		case 'E':
+			netConn.Close()
+			return nil, parseError(body)
+		case 'Z':
+			c.status = body[0]
+			return c, nil
+		}
+	}
+}
+
+// Close terminates the session; the server rolls back any open transaction
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.broken {
+		c.send('X', nil)
+		c.w.Flush()
+		c.broken = true
+	}
+	return c.conn.Close()
+}
+
+// TxStatus reports 'I' when idle, 'T' inside a transaction and 'E' inside a
+// failed transaction
+func (c *Conn) TxStatus() byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
+
+// Begin starts a transaction on the connection
+func (c *Conn) Begin(ctx context.Context) error {
+	_, err := c.Exec(ctx, "BEGIN")
+	return err
+}
+
+// Commit commits the connection's transaction
+func (c *Conn) Commit(ctx context.Context) error {
+	tag, err := c.Exec(ctx, "COMMIT")
+	if err == nil && tag == "ROLLBACK" {
+		return errors.New("transaction was rolled back after an earlier error")
+	}
+	return err
+}
+
+// Rollback aborts the connection's transaction
+func (c *Conn) Rollback(ctx context.Context) error {
+	_, err := c.Exec(ctx, "ROLLBACK")
+	return err
+}
+
+// Exec runs a statement and returns its command tag
+func (c *Conn) Exec(ctx context.Context, query string, args ...any) (string, error) {
+	rows, err := c.Query(ctx, query, args...)
+	if err != nil {
+		return "", err
+	}
+	return rows.Tag, nil
+}
+
+// Query runs a statement and returns its rows. Without args the query may
+// hold several statements and the last result is returned; with args it
+// must be a single statement whose $n placeholders are bound to args.
+func (c *Conn) Query(ctx context.Context, query string, args ...any) (*Rows, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.broken {
+		return nil, ErrClosed
+	}
+	defer c.watch(ctx)()
+
+	if len(args) == 0 {
+		c.send('Q', append([]byte(query), 0))
+	} else if err := c.sendExtended(query, args); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		c.broken = true
+		return nil, err
+	}
+	rows, err := c.readResults()
+	if err != nil && !isServerError(err) {
+		c.broken = true
+	}
+	return rows, err
+}
+
+// sendExtended queues Parse, Bind, Describe, Execute and Sync for a
+// parameterised query
+func (c *Conn) sendExtended(query string, args []any) error {
+	oids := make([]uint32, len(args))
+	values := make([][]byte, len(args))
+	for i, arg := range args {
+		var err error
+		if oids[i], values[i], err = encodeArg(arg); err != nil {
+			return fmt.Errorf("argument %d: %w", i+1, err)
+		}
+	}
+
+	parse := append([]byte{0}, query...)
+	parse = append(parse, 0)
+	parse = binary.BigEndian.AppendUint16(parse, uint16(len(args)))
+	for _, oid := range oids {
+		parse = binary.BigEndian.AppendUint32(parse, oid)
+	}
+	c.send('P', parse)
+
+	bind := []byte{0, 0} // Unnamed portal and statement
+	bind = binary.BigEndian.AppendUint16(bind, 0)
+	bind = binary.BigEndian.AppendUint16(bind, uint16(len(values)))
+	for _, value := range values {
+		if value == nil {
+			bind = binary.BigEndian.AppendUint32(bind, math.MaxUint32) // -1 is NULL
+			continue
+		}
+		bind = binary.BigEndian.AppendUint32(bind, uint32(len(value)))
+		bind = append(bind, value...)
+	}
+	bind = binary.BigEndian.AppendUint16(bind, 0) // Text results
+	c.send('B', bind)
+
+	c.send('D', []byte{'P', 0})
+	c.send('E', []byte{0, 0, 0, 0, 0})
+	c.send('S', nil)
+	return nil
+}
+
+// readResults collects responses up to ReadyForQuery. The first error
+// reported by the server is returned once the server is ready again.
+func (c *Conn) readResults() (*Rows, error) {
+	rows := &Rows{}
+	var queryErr error
+	for {
+		typ, body, err := c.readMessage()
+		if err != nil {
+			if queryErr != nil {
+				return nil, queryErr // Typically a FATAL error before disconnecting
+			}
+			return nil, err
+		}
+		switch typ {
+		case 'T':
+			rows = &Rows{}
+			if err := rows.describe(body); err != nil {
+				return nil, err
+			}
+		case 'D':
+			row, err := rows.decodeRow(body)
+			if err != nil {
+				return nil, err
+			}
+			rows.Values = append(rows.Values, row)
+		case 'C':
+			if rows.Tag != "" {
+				rows = &Rows{} // A later statement without rows
+			}
+			rows.Tag = strings.TrimRight(string(body), "\x00")
+		case 'E':
+			if queryErr == nil {
+				queryErr = parseError(body)
+			}
+		case 'Z':
+			if len(body) > 0 {
+				c.status = body[0]
+			}
+			if queryErr != nil {
+				return nil, queryErr
+			}
+			return rows, nil
+		}
+	}
+}
+
+// watch interrupts blocked I/O when ctx is done. The returned function must
+// be called once the operation finishes.
+func (c *Conn) watch(ctx context.Context) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			c.conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-exited
+		c.conn.SetDeadline(time.Time{})
+	}
+}
+
+func (c *Conn) send(typ byte, body []byte) {
+	c.w.WriteByte(typ)
+	c.w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(body)+4)))
+	c.w.Write(body)
+}
+
+func (c *Conn) readMessage() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length < 4 || length > 1<<30 {
+		return 0, nil, fmt.Errorf("invalid message length %d", length)
+	}
+	body := make([]byte, length-4)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[0], body, nil
+}
+
+func (r *Rows) describe(body []byte) error {
+	if len(body) < 2 {
+		return errors.New("malformed row description")
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	body = body[2:]
+	for i := 0; i < n; i++ {
+		end := strings.IndexByte(string(body), 0)
+		if end < 0 || len(body) < end+19 {
+			return errors.New("malformed row description")
+		}
+		r.Columns = append(r.Columns, string(body[:end]))
+		body = body[end+1:]
+		r.Types = append(r.Types, binary.BigEndian.Uint32(body[6:10]))
+		body = body[18:]
+	}
+	return nil
+}
+
+func (r *Rows) decodeRow(body []byte) ([]any, error) {
+	if len(body) < 2 {
+		return nil, errors.New("malformed data row")
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	body = body[2:]
+	row := make([]any, n)
+	for i := range row {
+		if len(body) < 4 {
+			return nil, errors.New("malformed data row")
+		}
+		length := int32(binary.BigEndian.Uint32(body))
+		body = body[4:]
+		if length < 0 {
+			continue
+		}
+		if int(length) > len(body) {
+			return nil, errors.New("malformed data row")
+		}
+		oid := uint32(0)
+		if i < len(r.Types) {
+			oid = r.Types[i]
+		}
+		value, err := decodeText(string(body[:length]), oid)
+		if err != nil {
+			return nil, fmt.Errorf("column %d: %w", i+1, err)
+		}
+		row[i] = value
+		body = body[length:]
+	}
+	return row, nil
+}
+
+// encodeArg converts a Go value to a text parameter and its type OID. Strings
+// are sent untyped so the server infers their type from the query.
+func encodeArg(arg any) (uint32, []byte, error) {
+	switch v := arg.(type) {
+	case nil:
+		return 0, nil, nil
+	case int:
+		return oidInt8, strconv.AppendInt(nil, int64(v), 10), nil
+	case int8:
+		return oidInt8, strconv.AppendInt(nil, int64(v), 10), nil
+	case int16:
+		return oidInt8, strconv.AppendInt(nil, int64(v), 10), nil
+	case int32:
+		return oidInt8, strconv.AppendInt(nil, int64(v), 10), nil
+	case int64:
+		return oidInt8, strconv.AppendInt(nil, v, 10), nil
+	case uint8:
+		return oidInt8, strconv.AppendUint(nil, uint64(v), 10), nil
+	case uint16:
+		return oidInt8, strconv.AppendUint(nil, uint64(v), 10), nil
+	case uint32:
+		return oidInt8, strconv.AppendUint(nil, uint64(v), 10), nil
+	case float32:
+		return oidFloat8, strconv.AppendFloat(nil, float64(v), 'g', -1, 32), nil
+	case float64:
+		return oidFloat8, strconv.AppendFloat(nil, v, 'g', -1, 64), nil
+	case bool:
+		if v {
+			return oidBool, []byte("t"), nil
+		}
+		return oidBool, []byte("f"), nil
+	case string:
+		return 0, []byte(v), nil
+	case []byte:
+		return oidBytea, []byte(`\x` + hex.EncodeToString(v)), nil
+	case time.Time:
+		return oidTimestamptz, []byte(v.Format(time.RFC3339Nano)), nil
+	}
+	return 0, nil, fmt.Errorf("unsupported type %T", arg)
+}
+
+// decodeText converts a text column value according to its type OID
+func decodeText(text string, oid uint32) (any, error) {
+	switch oid {
+	case oidInt2, oidInt4, oidInt8:
+		return strconv.ParseInt(text, 10, 64)
+	case oidFloat4, oidFloat8:
+		switch text {
+		case "Infinity":
+			return math.Inf(1), nil
+		case "-Infinity":
+			return math.Inf(-1), nil
+		}
+		return strconv.ParseFloat(text, 64)
+	case oidBool:
+		return text == "t", nil
+	case oidBytea:
+		if !strings.HasPrefix(text, `\x`) {
+			return nil, errors.New("unsupported bytea format")
+		}
+		return hex.DecodeString(text[2:])
+	case oidTimestamp, oidTimestamptz:
+		for _, layout := range []string{"2006-01-02 15:04:05.999999999Z07:00", "2006-01-02 15:04:05.999999999Z07", "2006-01-02 15:04:05.999999999"} {
+			if t, err := time.Parse(layout, text); err == nil {
+				return t.UTC(), nil
+			}
+		}
+		return nil, fmt.Errorf("invalid timestamp %q", text)
+	}
+	return text, nil
+}
+
+func parseError(body []byte) error {
+	e := &Error{}
+	for len(body) > 1 {
+		field := body[0]
+		end := strings.IndexByte(string(body[1:]), 0)
+		if end < 0 {
+			break
+		}
+		value := string(body[1 : 1+end])
+		body = body[2+end:]
+		switch field {
+		case 'S':
+			e.Severity = value
+		case 'C':
+			e.Code = value
+		case 'M':
+			e.Message = value
+		}
+	}
+	return e
+}
+
+func isServerError(err error) bool {
+	var serverErr *Error
+	return errors.As(err, &serverErr) && serverErr.Severity != "FATAL"
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"time"
+)
+
+// A columnar file stores records in row groups. Each row group holds one
+// compressed chunk per column, and a JSON footer at the end of the file
+// records the schema and where every chunk is:
+//
+//	magic | chunks... | footer | footer length (uint32) | magic
+//
+// A chunk is a null bitmap followed by the non-null values: integers and
+// times as varint deltas, floats as 8 bytes, strings and bytes with a
+// uvarint length prefix and bools as one byte each.
+const (
+	columnarMagic     = "GDBCOL1\n"
+	columnarGroupRows = 8192
+)
+
+type columnarFooter struct {
+	Schema Schema          `json:"schema"`
+	Groups []columnarGroup `json:"groups"`
+}
+
+type columnarGroup struct {
+	Rows   int             `json:"rows"`
+	Chunks []columnarChunk `json:"chunks"` // In schema column order
+}
+
+type columnarChunk struct {
+	Offset int64  `json:"offset"`
+	Size   int    `json:"size"`
+	CRC    uint32 `json:"crc"` // Of the compressed bytes
+}
+
+// columnarWriter buffers a row group at a time
+type columnarWriter struct {
+	w      io.Writer
+	offset int64
+	footer columnarFooter
+	rows   []Record
+	err    error
+}
+
+func newColumnarWriter(w io.Writer, schema Schema) *columnarWriter {
+	cw := &columnarWriter{w: w, footer: columnarFooter{Schema: schema, Groups: []columnarGroup{}}}
+	cw.write([]byte(columnarMagic))
+	return cw
+}
+
+func (cw *columnarWriter) Write(row Record) error {
+	cw.rows = append(cw.rows, row)
+	if len(cw.rows) == columnarGroupRows {
+		cw.flush()
+	}
+	return cw.err
+}
+
+func (cw *columnarWriter) Close() error {
+	if len(cw.rows) > 0 {
+		cw.flush()
+	}
+	footer, err := json.Marshal(cw.footer)
+	if err != nil {
+		return err
+	}
+	cw.write(footer)
+	cw.write(binary.BigEndian.AppendUint32(nil, uint32(len(footer))))
+	cw.write([]byte(columnarMagic))
+	return cw.err
+}
+
+// flush writes the buffered rows as a row group
+func (cw *columnarWriter) flush() {
+	group := columnarGroup{Rows: len(cw.rows)}
+	for _, column := range cw.footer.Schema.Columns {
+		values := make([]any, len(cw.rows))
+		for i, row := range cw.rows {
+			values[i] = row[column.Name]
+		}
+		data, err := compressChunk(encodeChunk(values, column.Type))
+		if err != nil && cw.err == nil {
+			cw.err = err
+		}
+		group.Chunks = append(group.Chunks, columnarChunk{
+			Offset: cw.offset,
+			Size:   len(data),
+			CRC:    crc32.Checksum(data, crcTable),
+		})
+		cw.write(data)
+	}
+	cw.footer.Groups = append(cw.footer.Groups, group)
+	cw.rows = cw.rows[:0]
+}
+
+func (cw *columnarWriter) write(data []byte) {
+	if cw.err != nil {
+		return
+	}
+	n, err := cw.w.Write(data)
+	cw.offset += int64(n)
+	cw.err = err
+}
+
+// encodeChunk encodes the values of one column
+func encodeChunk(values []any, t ColumnType) []byte {
+	buf := make([]byte, (len(values)+7)/8)
+	var prev int64
+	for i, value := range values {
+		switch v := value.(type) {
+		case nil:
+			buf[i/8] |= 1 << (i % 8)
+		case int64:
+			buf = binary.AppendVarint(buf, v-prev)
+			prev = v
+		case float64:
+			buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(v))
+		case string:
+			buf = binary.AppendUvarint(buf, uint64(len(v)))
+			buf = append(buf, v...)
+		case []byte:
+			buf = binary.AppendUvarint(buf, uint64(len(v)))
+			buf = append(buf, v...)
+		case bool:
+			if v {
+				buf = append(buf, 1)
+			} else {
+				buf = append(buf, 0)
+			}
+		case time.Time:
+			nanos := v.UnixNano()
+			buf = binary.AppendVarint(buf, nanos-prev)
+			prev = nanos
+		}
+	}
+	return buf
+}
+
+// decodeChunk decodes rows values of type t
+func decodeChunk(data []byte, rows int, t ColumnType) ([]any, error) {
+	bitmap := (rows + 7) / 8
+	if len(data) < bitmap {
+		return nil, errors.New("columnar chunk is truncated")
+	}
+	nulls, data := data[:bitmap], data[bitmap:]
+	values := make([]any, rows)
+	var prev int64
+	for i := range values {
+		if nulls[i/8]&(1<<(i%8)) != 0 {
+			continue
+		}
+		switch t {
+		case TypeInt, TypeTime:
+			delta, n := binary.Varint(data)
+			if n <= 0 {
+				return nil, errors.New("columnar chunk is truncated")
+			}
+			data = data[n:]
+			prev += delta
+			if t == TypeInt {
+				values[i] = prev
+			} else {
+				values[i] = time.Unix(0, prev).UTC()
+			}
+		case TypeFloat:
+			if len(data) < 8 {
+				return nil, errors.New("columnar chunk is truncated")
+			}
+			values[i] = math.Float64frombits(binary.BigEndian.Uint64(data))
+			data = data[8:]
+		case TypeString, TypeBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return nil, errors.New("columnar chunk is truncated")
+			}
+			raw := data[n : n+int(length)]
+			data = data[n+int(length):]
+			if t == TypeString {
+				values[i] = string(raw)
+			} else {
+				values[i] = bytes.Clone(raw)
+			}
+		case TypeBool:
+			if len(data) < 1 {
+				return nil, errors.New("columnar chunk is truncated")
+			}
+			values[i] = data[0] != 0
+			data = data[1:]
+		default:
+			return nil, fmt.Errorf("invalid column type %d", int(t))
+		}
+	}
+	return values, nil
+}
+
+func compressChunk(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// columnarReader decodes a whole columnar file held in memory, one row group
+// at a time
+type columnarReader struct {
+	data    []byte
+	footer  columnarFooter
+	group   int      // Next row group to decode
+	columns [][]any  // Values of the current row group
+	row     int      // Next row of the current row group
+	rows    int      // Rows in the current row group
+	names   []string // Column names, in file order
+}
+
+func newColumnarReader(r io.Reader, schema Schema) (*columnarReader, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	trailer := 4 + len(columnarMagic)
+	if len(data) < len(columnarMagic)+trailer ||
+		string(data[:len(columnarMagic)]) != columnarMagic ||
+		string(data[len(data)-len(columnarMagic):]) != columnarMagic {
+		return nil, errors.New("not a columnar file")
+	}
+	length := int(binary.BigEndian.Uint32(data[len(data)-trailer:]))
+	if length > len(data)-len(columnarMagic)-trailer {
+		return nil, errors.New("columnar footer is corrupt")
+	}
+	cr := &columnarReader{data: data}
+	footer := data[len(data)-trailer-length : len(data)-trailer]
+	if err := decodeJSON(footer, &cr.footer); err != nil {
+		return nil, fmt.Errorf("columnar footer is corrupt: %w", err)
+	}
+	for _, column := range cr.footer.Schema.Columns {
+		if _, ok := schema.Column(column.Name); !ok {
+			return nil, fmt.Errorf("column %q does not exist", column.Name)
+		}
+		cr.names = append(cr.names, column.Name)
+	}
+	return cr, nil
+}
+
+func (cr *columnarReader) Read() (Record, error) {
+	for cr.row == cr.rows {
+		if cr.group == len(cr.footer.Groups) {
+			return nil, io.EOF
+		}
+		if err := cr.load(cr.footer.Groups[cr.group]); err != nil {
+			return nil, fmt.Errorf("row group %d: %w", cr.group, err)
+		}
+		cr.group++
+	}
+	row := make(Record, len(cr.names))
+	for i, name := range cr.names {
+		row[name] = cr.columns[i][cr.row]
+	}
+	cr.row++
+	return row, nil
+}
+
+// load decodes every chunk of a row group
+func (cr *columnarReader) load(group columnarGroup) error {
+	if len(group.Chunks) != len(cr.names) {
+		return errors.New("wrong number of column chunks")
+	}
+	cr.columns = cr.columns[:0]
+	for i, chunk := range group.Chunks {
+		if chunk.Offset < 0 || chunk.Size < 0 || chunk.Offset+int64(chunk.Size) > int64(len(cr.data)) {
+			return errors.New("column chunk is out of bounds")
+		}
+		data := cr.data[chunk.Offset : chunk.Offset+int64(chunk.Size)]
+		if crc32.Checksum(data, crcTable) != chunk.CRC {
+			return fmt.Errorf("column %q: checksum mismatch", cr.names[i])
+		}
+		raw, err := io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return fmt.Errorf("column %q: %w", cr.names[i], err)
+		}
+		values, err := decodeChunk(raw, group.Rows, cr.footer.Schema.Columns[i].Type)
+		if err != nil {
+			return fmt.Errorf("column %q: %w", cr.names[i], err)
+		}
+		cr.columns = append(cr.columns, values)
+	}
+	cr.row, cr.rows = 0, group.Rows
+	return nil
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// FKAction is what happens to referencing rows when the row they reference
+// is deleted
+type FKAction string
+
+// Supported ON DELETE actions
+const (
+	FKRestrict FKAction = "restrict" // Refuse the delete
+	FKCascade  FKAction = "cascade"  // Delete the referencing rows too
+	FKSetNull  FKAction = "set null" // Set the referencing column to NULL
+)
+
+// ForeignKey makes Column reference the primary key of Table. A NULL in
+// Column references nothing.
+type ForeignKey struct {
+	Column     string   `json:"column"`
+	Table      string   `json:"table"`
+	References string   `json:"references,omitempty"` // Must name Table's primary key if set
+	OnDelete   FKAction `json:"on_delete,omitempty"`  // Defaults to FKRestrict
+}
+
+// Check is a boolean expression every row must satisfy, such as
+// "price >= 0". A row for which it is NULL passes, as in SQL.
+type Check struct {
+	Name string `json:"name,omitempty"`
+	Expr string `json:"expr"`
+}
+
+// UniqueError is returned when a write would give two records the same
+// primary key or the same values in a unique index. It wraps
+// ErrUniqueViolation.
+type UniqueError struct {
+	Index   string // Empty for the primary key
+	Columns []string
+	Values  []any
+}
+
+func (e *UniqueError) Error() string {
+	values := make([]string, len(e.Columns))
+	for i, column := range e.Columns {
+		values[i] = fmt.Sprintf("%s=%v", column, e.Values[i])
+	}
+	if e.Index == "" {
+		return "record already exists: " + strings.Join(values, ", ")
+	}
+	return fmt.Sprintf("%v: %s already has %s", ErrUniqueViolation, e.Index, strings.Join(values, ", "))
+}
+
+func (e *UniqueError) Unwrap() error {
+	return ErrUniqueViolation
+}
+
+// ForeignKeyError is returned when a write would leave Table.Column
+// referencing a row of Parent that does not exist: either the written row
+// references a missing row, or Referenced is set and the write deletes a row
+// that is still referenced under ON DELETE RESTRICT.
+type ForeignKeyError struct {
+	Table      string
+	Column     string
+	Parent     string
+	Value      any
+	Referenced bool
+}
+
+func (e *ForeignKeyError) Error() string {
+	if e.Referenced {
+		return fmt.Sprintf("foreign key violation: %s row %v is still referenced by %s.%s", e.Parent, e.Value, e.Table, e.Column)
+	}
+	return fmt.Sprintf("foreign key violation: %s.%s=%v has no matching row in %s", e.Table, e.Column, e.Value, e.Parent)
+}
+
+// CheckError is returned when a row does not satisfy a check constraint
+type CheckError struct {
+	Name string // Empty for an unnamed check
+	Expr string
+	Row  Record
+}
+
+func (e *CheckError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("check constraint %s violated", e.Expr)
+	}
+	return fmt.Sprintf("check constraint %q violated: %s", e.Name, e.Expr)
+}
+
+// uniqueName returns the name of the index enforcing a unique constraint
+func uniqueName(columns []string) string {
+	return "unique(" + strings.Join(columns, ",") + ")"
+}
+
+// uniqueSpecs returns the indexes that enforce the schema's unique
+// constraints
+func (s Schema) uniqueSpecs() []IndexSpec {
+	specs := make([]IndexSpec, len(s.Unique))
+	for i, columns := range s.Unique {
+		specs[i] = IndexSpec{Name: uniqueName(columns), Columns: slices.Clone(columns), Unique: true, Ordered: true}
+	}
+	return specs
+}
+
+// prepareConstraints checks the unique, foreign key and check constraints of
+// s, whose columns are already prepared, and stores them in prepared
+func (s Schema) prepareConstraints(prepared *Schema) error {
+	seen := make(map[string]bool)
+	for _, columns := range s.Unique {
+		if len(columns) == 0 {
+			return errors.New("unique constraint has no columns")
+		}
+		for _, name := range columns {
+			column, ok := prepared.Column(name)
+			if !ok {
+				return fmt.Errorf("unique %w", &ColumnError{Column: name})
+			}
+			if column.Type == TypeBytes {
+				return fmt.Errorf("unique column %q cannot be bytes", name)
+			}
+		}
+		name := uniqueName(columns)
+		if seen[name] {
+			return fmt.Errorf("duplicate unique constraint on %s", strings.Join(columns, ", "))
+		}
+		seen[name] = true
+		prepared.Unique = append(prepared.Unique, slices.Clone(columns))
+	}
+
+	referencing := make(map[string]bool)
+	for _, fk := range s.ForeignKeys {
+		column, ok := prepared.Column(fk.Column)
+		if !ok {
+			return fmt.Errorf("foreign key %w", &ColumnError{Column: fk.Column})
+		}
+		if referencing[fk.Column] {
+			return fmt.Errorf("column %q has more than one foreign key", fk.Column)
+		}
+		referencing[fk.Column] = true
+		if fk.Table == "" {
+			return fmt.Errorf("foreign key %q references no table", fk.Column)
+		}
+		switch fk.OnDelete {
+		case "":
+			fk.OnDelete = FKRestrict
+		case FKRestrict, FKCascade:
+		case FKSetNull:
+			if !column.Nullable {
+				return fmt.Errorf("foreign key %q is ON DELETE SET NULL but cannot be null", fk.Column)
+			}
+		default:
+			return fmt.Errorf("foreign key %q: unknown ON DELETE action %q", fk.Column, fk.OnDelete)
+		}
+		prepared.ForeignKeys = append(prepared.ForeignKeys, fk)
+	}
+
+	for _, check := range s.Checks {
+		expr, err := ParseExpr(check.Expr)
+		if err != nil {
+			return fmt.Errorf("check %s: %w", check.Expr, err)
+		}
+		if err := prepared.checkExpr(expr); err != nil {
+			return fmt.Errorf("check %s: %w", check.Expr, err)
+		}
+		prepared.Checks = append(prepared.Checks, check)
+		prepared.checks = append(prepared.checks, expr)
+	}
+	return nil
+}
+
+// checkExpr reports whether expr can be evaluated against a single row: it
+// may only use the row's own columns and constants
+func (s Schema) checkExpr(expr Expr) error {
+	switch e := expr.(type) {
+	case *ColumnRef:
+		if e.Table != "" {
+			return fmt.Errorf("column %q must not be qualified", e.String())
+		}
+		if _, ok := s.Column(e.Column); !ok {
+			return &ColumnError{Column: e.Column}
+		}
+	case *Param:
+		return errors.New("parameters are not allowed")
+	case *FuncCall:
+		return fmt.Errorf("aggregate function %s is not allowed", e.Name)
+	case *RankExpr:
+		return errors.New("BM25 is not allowed")
+	case *BinaryExpr:
+		return errors.Join(s.checkExpr(e.Left), s.checkExpr(e.Right))
+	case *UnaryExpr:
+		return s.checkExpr(e.Expr)
+	case *IsNullExpr:
+		return s.checkExpr(e.Expr)
+	case *BetweenExpr:
+		return errors.Join(s.checkExpr(e.Expr), s.checkExpr(e.Low), s.checkExpr(e.High))
+	case *InExpr:
+		err := s.checkExpr(e.Expr)
+		for _, item := range e.List {
+			err = errors.Join(err, s.checkExpr(item))
+		}
+		return err
+	case *LikeExpr:
+		return errors.Join(s.checkExpr(e.Expr), s.checkExpr(e.Pattern))
+	case *MatchExpr:
+		return errors.Join(s.checkExpr(e.Expr), s.checkExpr(e.Query))
+	}
+	return nil
+}
+
+// checkRow evaluates the check constraints against a validated row
+func (s Schema) checkRow(row Record) error {
+	sc := &rowScope{schema: s, row: row}
+	for i, expr := range s.checks {
+		value, err := (&executor{}).eval(expr, sc)
+		if err != nil {
+			return fmt.Errorf("check %s: %w", s.Checks[i].Expr, err)
+		}
+		ok, isNull, err := toBool(value)
+		if err != nil {
+			return fmt.Errorf("check %s: %w", s.Checks[i].Expr, err)
+		}
+		if !ok && !isNull {
+			return &CheckError{Name: s.Checks[i].Name, Expr: s.Checks[i].Expr, Row: row.clone()}
+		}
+	}
+	return nil
+}
+
+// checkReferences reports whether the tables referenced by the foreign keys
+// of a new table exist and have primary keys of the referencing column's
+// type. A table may reference itself. The caller must hold db.mu.
+func (db *Database) checkReferences(name string, schema Schema) error {
+	for _, fk := range schema.ForeignKeys {
+		parent := schema
+		if fk.Table != name {
+			table, exists := db.tables[fk.Table]
+			if !exists {
+				return fmt.Errorf("foreign key %q: table %q does not exist", fk.Column, fk.Table)
+			}
+			parent = table.schema
+		}
+		if fk.References != "" && fk.References != parent.PrimaryKey {
+			return fmt.Errorf("foreign key %q must reference the primary key of %s", fk.Column, fk.Table)
+		}
+		column, _ := schema.Column(fk.Column)
+		pk, _ := parent.Column(parent.PrimaryKey)
+		if column.Type != pk.Type {
+			return fmt.Errorf("foreign key %q is %s but %s.%s is %s", fk.Column, column.Type, fk.Table, pk.Name, pk.Type)
+		}
+	}
+	return nil
+}
+
+// reference is a foreign key of one table, seen from the table it references
+type reference struct {
+	table string // The referencing table
+	fk    ForeignKey
+}
+
+// references returns the foreign keys of every table, grouped by the table
+// they reference and ordered by referencing table
+func (db *Database) references() map[string][]reference {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	refs := make(map[string][]reference)
+	for name, table := range db.tables {
+		for _, fk := range table.schema.ForeignKeys {
+			refs[fk.Table] = append(refs[fk.Table], reference{table: name, fk: fk})
+		}
+	}
+	for _, list := range refs {
+		sort.Slice(list, func(i, j int) bool { return list[i].table < list[j].table })
+	}
+	return refs
+}
+
+// referenced reports whether any table has a foreign key to the named table
+func (db *Database) referenced(tableName string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for _, table := range db.tables {
+		for _, fk := range table.schema.ForeignKeys {
+			if fk.Table == tableName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// constraintTables adds to the tables a commit writes the ones it must also
+// lock to enforce foreign keys: the tables that reference them directly or
+// through other references, which ON DELETE actions may write, and the tables
+// any of those reference. The result is sorted.
+func (db *Database) constraintTables(names []string, refs map[string][]reference) ([]string, error) {
+	set := make(map[string]bool)
+	written := make(map[string]bool)
+	queue := slices.Clone(names)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if written[name] {
+			continue
+		}
+		written[name] = true
+		set[name] = true
+		table, err := db.lookupTable(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, fk := range table.schema.ForeignKeys {
+			set[fk.Table] = true
+		}
+		for _, ref := range refs[name] {
+			queue = append(queue, ref.table)
+		}
+	}
+	all := make([]string, 0, len(set))
+	for name := range set {
+		all = append(all, name)
+	}
+	sort.Strings(all)
+	return all, nil
+}
+
+// current returns the newest version of a row as the transaction would
+// commit it: its own write if it has one, else the latest committed row. The
+// caller must hold tx.mu and t.mu.
+func (tx *Transaction) current(tableName string, t *Table, key any) (Record, bool, error) {
+	if w, buffered := tx.writes[tableName][key]; buffered {
+		return w.record, w.op != opDelete, nil
+	}
+	vRecord, exists, err := t.engine.Get(key)
+	return vRecord.Record, exists, err
+}
+
+// referencing returns the keys of the rows of t whose column references the
+// row with primary key parentKey, using an index on the column if there is
+// one. The caller must hold tx.mu and t.mu.
+func (tx *Transaction) referencing(tableName string, t *Table, column string, parentKey any) ([]any, error) {
+	candidates := make(map[any]bool)
+	for key := range tx.writes[tableName] {
+		candidates[key] = true
+	}
+	var idx *Index
+	for _, i := range t.indexes {
+		if len(i.spec.Columns) == 1 && i.spec.Columns[0] == column && !i.spec.FullText {
+			idx = i
+			break
+		}
+	}
+	if idx != nil {
+		k, err := appendKey(nil, parentKey)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range idx.lookup(string(k)) {
+			candidates[key] = true
+		}
+	} else {
+		err := t.engine.Scan(func(key any, vRecord VersionedRecord) bool {
+			if vRecord.Record[column] != nil && keyOf(vRecord.Record[column]) == parentKey {
+				candidates[key] = true
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var keys []any
+	for key := range candidates {
+		row, exists, err := tx.current(tableName, t, key)
+		if err != nil {
+			return nil, err
+		}
+		if exists && row[column] != nil && keyOf(row[column]) == parentKey {
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, compareValues)
+	return keys, nil
+}
+
+// enforceForeignKeys applies the ON DELETE action of every foreign key that
+// references a row the transaction deletes, adding the cascaded writes to
+// its write set, and then checks that every row it writes references rows
+// that exist. The caller must hold tx.mu and the write lock of every table
+// constraintTables returned for the write set.
+func (tx *Transaction) enforceForeignKeys(tables map[string]*Table, refs map[string][]reference) error {
+	type deletion struct {
+		table string
+		key   any
+	}
+	var queue []deletion
+	for name, writes := range tx.writes {
+		for key, w := range writes {
+			if w.op == opDelete {
+				queue = append(queue, deletion{name, key})
+			}
+		}
+	}
+
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+		for _, ref := range refs[d.table] {
+			child := tables[ref.table]
+			keys, err := tx.referencing(ref.table, child, ref.fk.Column, d.key)
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				switch ref.fk.OnDelete {
+				case FKCascade:
+					if tx.writes[ref.table][key].isNew {
+						delete(tx.writes[ref.table], key)
+					} else {
+						tx.buffer(ref.table, key, txWrite{op: opDelete})
+					}
+					queue = append(queue, deletion{ref.table, key})
+				case FKSetNull:
+					row, _, err := tx.current(ref.table, child, key)
+					if err != nil {
+						return err
+					}
+					row = row.clone()
+					row[ref.fk.Column] = nil
+					if err := child.schema.checkRow(row); err != nil {
+						return err
+					}
+					prev := tx.writes[ref.table][key]
+					tx.buffer(ref.table, key, txWrite{op: opUpdate, record: row, isNew: prev.isNew})
+				default:
+					return &ForeignKeyError{Table: ref.table, Column: ref.fk.Column, Parent: d.table, Value: d.key, Referenced: true}
+				}
+			}
+		}
+	}
+
+	for name, writes := range tx.writes {
+		for _, fk := range tables[name].schema.ForeignKeys {
+			for _, w := range writes {
+				value := w.record[fk.Column]
+				if w.op == opDelete || value == nil {
+					continue
+				}
+				_, exists, err := tx.current(fk.Table, tables[fk.Table], keyOf(value))
+				if err != nil {
+					return err
+				}
+				if !exists {
+					return &ForeignKeyError{Table: name, Column: fk.Column, Parent: fk.Table, Value: value}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// transact runs a single write in its own transaction so that it is checked
+// and cascaded under the same locks as any other commit. A single write has
+// nothing to lose by retrying, so conflicts are retried.
+func (db *Database) transact(ctx context.Context, write func(tx *Transaction) error) error {
+	for {
+		tx, err := db.BeginTransaction(ctx)
+		if err != nil {
+			return err
+		}
+		if err := write(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+}
+
+// dependencyOrder sorts tables so that every table comes after the tables
+// its foreign keys reference, keeping the given order otherwise
+func dependencyOrder(tables []BackupTable) []BackupTable {
+	placed := make(map[string]bool, len(tables))
+	ordered := make([]BackupTable, 0, len(tables))
+	for len(ordered) < len(tables) {
+		progress := false
+		for _, bt := range tables {
+			if placed[bt.Name] {
+				continue
+			}
+			ready := true
+			for _, fk := range bt.Schema.ForeignKeys {
+				if fk.Table != bt.Name && !placed[fk.Table] {
+					ready = false
+				}
+			}
+			if ready {
+				placed[bt.Name] = true
+				ordered = append(ordered, bt)
+				progress = true
+			}
+		}
+		if !progress {
+			// A reference to a table missing from the list; CreateTable
+			// reports it
+			for _, bt := range tables {
+				if !placed[bt.Name] {
+					placed[bt.Name] = true
+					ordered = append(ordered, bt)
+				}
+			}
+		}
+	}
+	return ordered
+}
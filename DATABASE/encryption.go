@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	keySize          = 32 // AES-256
+	keyIDSize        = 16 // Raw key fingerprint, or passphrase salt
+	nonceSize        = 12
+	pbkdf2Iterations = 600000
+
+	// sealOverhead is the number of bytes seal adds to its input
+	sealOverhead = 4 + keyIDSize + nonceSize + 16
+)
+
+// sealMagic starts every encrypted blob. JSON, which is everything the
+// database writes unencrypted apart from pages, never starts with a zero
+// byte.
+var sealMagic = []byte("\x00GDE")
+
+// Additional data binding each kind of sealed blob to its use, so one cannot
+// be passed off as another
+var (
+	walAAD      = []byte("wal")
+	changesAAD  = []byte("changes")
+	snapshotAAD = []byte("snapshot")
+)
+
+var (
+	// ErrEncrypted is returned when reading encrypted data without keys
+	ErrEncrypted = errors.New("data is encrypted and no key was given")
+	// ErrUnknownKey is returned when reading data encrypted with a key that
+	// is not in the keyring
+	ErrUnknownKey = errors.New("data is encrypted with a key that was not given")
+	// ErrCorrupt is returned when encrypted data fails authentication
+	ErrCorrupt = errors.New("encrypted data is corrupt")
+	// ErrNotEncrypted is returned when reading unencrypted data with keys,
+	// unless Options.EncryptPlaintext allows it
+	ErrNotEncrypted = errors.New("data is not encrypted although keys were given")
+)
+
+// Key is an encryption key: either 32 raw bytes or a passphrase, from which
+// a key is derived with PBKDF2-HMAC-SHA256 and a random salt stored with the
+// data
+type Key struct {
+	raw        []byte
+	passphrase string
+}
+
+// PassphraseKey returns a key derived from passphrase
+func PassphraseKey(passphrase string) Key {
+	return Key{passphrase: passphrase}
+}
+
+// RawKey returns a 32 byte AES-256 key
+func RawKey(key []byte) (Key, error) {
+	if len(key) != keySize {
+		return Key{}, fmt.Errorf("key must be %d bytes, not %d", keySize, len(key))
+	}
+	return Key{raw: bytes.Clone(key)}, nil
+}
+
+// ReadKeyFile reads a key from a file. A file holding 64 hex digits is a raw
+// key; anything else is a passphrase, without its final line break.
+func ReadKeyFile(path string) (Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Key{}, err
+	}
+	text := strings.TrimRight(string(data), "\r\n")
+	if raw, err := hex.DecodeString(strings.TrimSpace(text)); err == nil && len(raw) == keySize {
+		return RawKey(raw)
+	}
+	if text == "" {
+		return Key{}, fmt.Errorf("%s holds no key", path)
+	}
+	return PassphraseKey(text), nil
+}
+
+// equal reports whether k and other are the same key
+func (k Key) equal(other Key) bool {
+	return bytes.Equal(k.raw, other.raw) && k.passphrase == other.passphrase
+}
+
+// keyCipher is a key ready for use under one key ID
+type keyCipher struct {
+	aead cipher.AEAD
+	key  Key
+}
+
+// Keyring holds the keys of a database. The newest key encrypts everything
+// written; older keys only decrypt what they wrote until it is re-encrypted.
+// A nil *Keyring leaves data unencrypted.
+type Keyring struct {
+	keys      []Key                // Newest first
+	ciphers   map[string]keyCipher // By key ID; passphrase keys have one per salt
+	current   string               // Key ID sealing with keys[0], chosen on first use
+	plaintext bool                 // Unencrypted data is read as it is, while it is being encrypted
+	mu        sync.Mutex
+}
+
+// NewKeyring returns a keyring encrypting with the first key and decrypting
+// with any of them, or nil if there are no keys
+func NewKeyring(keys ...Key) *Keyring {
+	if len(keys) == 0 {
+		return nil
+	}
+	return &Keyring{keys: keys, ciphers: make(map[string]keyCipher)}
+}
+
+// rotate makes key the one that encrypts, keeping the others for reading
+func (k *Keyring) rotate(key Key) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	keys := []Key{key}
+	for _, old := range k.keys {
+		if !old.equal(key) {
+			keys = append(keys, old)
+		}
+	}
+	k.keys, k.current = keys, ""
+}
+
+// sealer returns the key ID and cipher encrypting new data. A passphrase key
+// reuses the salt of data already read with it, so a database keeps one
+// salt per passphrase. The caller must hold k.mu.
+func (k *Keyring) sealer() (string, cipher.AEAD, error) {
+	if k.current != "" {
+		return k.current, k.ciphers[k.current].aead, nil
+	}
+	for id, c := range k.ciphers {
+		if c.key.equal(k.keys[0]) {
+			k.current = id
+			return id, c.aead, nil
+		}
+	}
+
+	key := k.keys[0]
+	id := make([]byte, keyIDSize)
+	if key.raw != nil {
+		copy(id, rawKeyID(key.raw))
+	} else if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	aead, err := key.cipher(id)
+	if err != nil {
+		return "", nil, err
+	}
+	k.current = string(id)
+	k.ciphers[k.current] = keyCipher{aead: aead, key: key}
+	return k.current, aead, nil
+}
+
+// seal encrypts data as [magic][key id][nonce][ciphertext and tag],
+// authenticating aad with it
+func (k *Keyring) seal(data, aad []byte) ([]byte, error) {
+	if k == nil {
+		return data, nil
+	}
+	k.mu.Lock()
+	id, aead, err := k.sealer()
+	k.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(data)+sealOverhead)
+	out = append(out, sealMagic...)
+	out = append(out, id...)
+	out = append(out, nonce[:]...)
+	return aead.Seal(out, nonce[:], data, aad), nil
+}
+
+// open decrypts data written by seal. Unencrypted data is rejected, so it
+// cannot be swapped in for encrypted data, unless the keyring is encrypting a
+// database written without keys.
+func (k *Keyring) open(data, aad []byte) ([]byte, error) {
+	if k == nil {
+		if isSealed(data) {
+			return nil, ErrEncrypted
+		}
+		return data, nil
+	}
+	if !isSealed(data) {
+		if k.readsPlaintext() {
+			return data, nil
+		}
+		return nil, ErrNotEncrypted
+	}
+	if len(data) < sealOverhead {
+		return nil, ErrCorrupt
+	}
+	header := len(sealMagic) + keyIDSize
+	id := string(data[len(sealMagic):header])
+	nonce, body := data[header:header+nonceSize], data[header+nonceSize:]
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if c, ok := k.ciphers[id]; ok {
+		plain, err := c.aead.Open(nil, nonce, body, aad)
+		if err != nil {
+			return nil, ErrCorrupt
+		}
+		return plain, nil
+	}
+	// An unknown ID is either a raw key not used yet, a passphrase salt not
+	// seen yet or a key that is not in the keyring
+	for _, key := range k.keys {
+		if key.raw != nil && string(rawKeyID(key.raw)) != id {
+			continue
+		}
+		aead, err := key.cipher([]byte(id))
+		if err != nil {
+			return nil, err
+		}
+		if plain, err := aead.Open(nil, nonce, body, aad); err == nil {
+			k.ciphers[id] = keyCipher{aead: aead, key: key}
+			return plain, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// readsPlaintext reports whether open returns unencrypted data as it is
+func (k *Keyring) readsPlaintext() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.plaintext
+}
+
+// setPlaintext sets whether open returns unencrypted data as it is
+func (k *Keyring) setPlaintext(on bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.plaintext = on
+}
+
+// isCurrent reports whether data is encrypted with the newest key, or for a
+// nil keyring whether it is unencrypted
+func (k *Keyring) isCurrent(data []byte) bool {
+	if k == nil {
+		return !isSealed(data)
+	}
+	if !isSealed(data) || len(data) < sealOverhead {
+		return false
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	id, _, err := k.sealer()
+	return err == nil && string(data[len(sealMagic):len(sealMagic)+keyIDSize]) == id
+}
+
+// isSealed reports whether data was written by seal
+func isSealed(data []byte) bool {
+	return bytes.HasPrefix(data, sealMagic)
+}
+
+// rawKeyID fingerprints a raw key without revealing it
+func rawKeyID(raw []byte) []byte {
+	sum := sha256.Sum256(append([]byte("godb key id"), raw...))
+	return sum[:keyIDSize]
+}
+
+// cipher returns the AES-GCM cipher of the key under id, which is the salt
+// of a passphrase key
+func (k Key) cipher(id []byte) (cipher.AEAD, error) {
+	key := k.raw
+	if key == nil {
+		var err error
+		if key, err = pbkdf2.Key(sha256.New, k.passphrase, id, pbkdf2Iterations, keySize); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// KeyRotation reports the progress of re-encrypting a database with a new key
+type KeyRotation struct {
+	Running  bool
+	Pages    int      // Disk engine pages re-encrypted
+	Segments int      // Archived log segments re-encrypted
+	Skipped  []string // Archived segments with a torn end, left on their old keys
+	Err      error    // Why the last rotation failed, if it did
+}
+
+// errRotationStopped ends a key rotation interrupted by Close
+var errRotationStopped = errors.New("database closed during key rotation")
+
+// UseKeyring sets the keys with which an in-memory database encrypts the
+// files written by Save and Backup. A durable database gets its keys from
+// Options.Keys when it is opened.
+func (db *Database) UseKeyring(keys *Keyring) error {
+	if db.dir != "" {
+		return errors.New("the keys of a durable database are set when it is opened")
+	}
+	db.keys = keys
+	return nil
+}
+
+// RotateKey makes key the one that encrypts everything written from now on.
+// For a durable database a background job then re-encrypts the change log,
+// snapshot, pages and archived log segments with it; KeyRotation reports its
+// progress and failure. The old keys must stay in the keyring, both until
+// the job finishes and for as long as backups written with them are kept.
+func (db *Database) RotateKey(key Key) error {
+	if db.keys == nil {
+		return errors.New("database is not encrypted")
+	}
+	db.keys.rotate(key)
+	if db.wal == nil {
+		return nil
+	}
+
+	db.rekeyMu.Lock()
+	defer db.rekeyMu.Unlock()
+	if db.rotation.Running {
+		db.rekeyAgain = true // The running job may have passed files already
+		return nil
+	}
+	db.rotation = KeyRotation{Running: true}
+	db.wg.Add(1)
+	go func() {
+		defer db.wg.Done()
+		for {
+			err := db.rekey()
+			db.rekeyMu.Lock()
+			if err == nil && db.rekeyAgain {
+				db.rekeyAgain = false
+				db.rekeyMu.Unlock()
+				continue
+			}
+			db.rotation.Running, db.rotation.Err = false, err
+			if err == nil && len(db.rotation.Skipped) == 0 {
+				db.keys.setPlaintext(false) // Every file is encrypted now
+			}
+			db.rekeyMu.Unlock()
+			return
+		}
+	}()
+	return nil
+}
+
+// KeyRotation returns the progress of the current or last key rotation
+func (db *Database) KeyRotation() KeyRotation {
+	db.rekeyMu.Lock()
+	defer db.rekeyMu.Unlock()
+	rotation := db.rotation
+	rotation.Skipped = slices.Clone(rotation.Skipped)
+	return rotation
+}
+
+// rekey re-encrypts every file of the database with the newest key. The
+// checkpoint rewrites the snapshot and truncates the log; pages are then
+// marked dirty a batch at a time so further checkpoints rewrite them.
+func (db *Database) rekey() error {
+	db.feed.rekey()
+	if err := db.checkpoint(); err != nil {
+		return err
+	}
+
+	if db.pager != nil {
+		batch := max(db.pager.capacity/2, 1)
+		for next := pageID(1); ; {
+			select {
+			case <-db.stop:
+				return errRotationStopped
+			default:
+			}
+			var marked int
+			var err error
+			if next, marked, err = db.pager.rekey(next, batch); err != nil {
+				return err
+			}
+			if marked == 0 {
+				break
+			}
+			if err := db.checkpoint(); err != nil {
+				return err
+			}
+			db.rekeyMu.Lock()
+			db.rotation.Pages += marked
+			db.rekeyMu.Unlock()
+		}
+	}
+
+	if db.archive == "" {
+		return nil
+	}
+	paths, err := filepath.Glob(filepath.Join(db.archive, "wal-*.log"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		select {
+		case <-db.stop:
+			return errRotationStopped
+		default:
+		}
+		rewritten, torn, err := rekeyFrames(path, db.keys, walAAD)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		db.rekeyMu.Lock()
+		if rewritten {
+			db.rotation.Segments++
+		}
+		if torn {
+			db.rotation.Skipped = append(db.rotation.Skipped, path)
+		}
+		db.rekeyMu.Unlock()
+	}
+	return nil
+}
+
+// rekeyFrames rewrites the framed log at path with every payload encrypted
+// with the newest key, unless they all already are. A log with a torn end is
+// left as it is, as rewriting it would drop the tail; it reports torn.
+func rekeyFrames(path string, keys *Keyring, aad []byte) (rewritten, torn bool, err error) {
+	var data []byte
+	current := true
+	_, torn, err = readFrames(path, func(payload []byte) (bool, error) {
+		current = current && keys.isCurrent(payload)
+		plain, err := keys.open(payload, aad)
+		if err != nil {
+			return false, err
+		}
+		if payload, err = keys.seal(plain, aad); err != nil {
+			return false, err
+		}
+		data = append(data, encodeFrame(payload)...)
+		return true, nil
+	})
+	if err != nil || current || torn {
+		return false, torn, err
+	}
+	return true, false, writeFileAtomic(path, data)
+}
+
+// keyFileFlag adds a repeatable -key-file flag to flags. The returned func
+// builds a keyring from the files given, the first one being the key that
+// encrypts, or returns nil if there were none.
+func keyFileFlag(flags *flag.FlagSet) func() (*Keyring, error) {
+	var paths []string
+	flags.Func("key-file", "file holding an encryption key (64 hex digits) or passphrase; repeat for older keys after the current one", func(path string) error {
+		paths = append(paths, path)
+		return nil
+	})
+	return func() (*Keyring, error) {
+		keys := make([]Key, 0, len(paths))
+		for _, path := range paths {
+			key, err := ReadKeyFile(path)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+		return NewKeyring(keys...), nil
+	}
+}
+
+// runRotateKey implements "rotate-key": re-encrypt a database directory with
+// a new key
+func runRotateKey(args []string) error {
+	flags := flag.NewFlagSet("rotate-key", flag.ContinueOnError)
+	dir := flags.String("data", "data", "database directory")
+	archive := flags.String("archive", "", "directory of archived wal segments to re-encrypt too")
+	newKeyFile := flags.String("new-key-file", "", "file holding the new key or passphrase")
+	keyring := keyFileFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *newKeyFile == "" {
+		return errors.New("-new-key-file is required")
+	}
+	keys, err := keyring()
+	if err != nil {
+		return err
+	}
+	key, err := ReadKeyFile(*newKeyFile)
+	if err != nil {
+		return err
+	}
+	plaintext := keys == nil
+	if plaintext {
+		keys = NewKeyring(key) // Encrypt a database that is not yet
+	}
+
+	db, err := OpenDatabaseWithOptions(*dir, Options{ArchiveDir: *archive, Keys: keys, EncryptPlaintext: plaintext})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.RotateKey(key); err != nil {
+		return err
+	}
+	for db.KeyRotation().Running {
+		time.Sleep(100 * time.Millisecond)
+	}
+	rotation := db.KeyRotation()
+	if rotation.Err != nil {
+		return rotation.Err
+	}
+	fmt.Printf("Re-encrypted %d pages and %d archived segments\n", rotation.Pages, rotation.Segments)
+	for _, path := range rotation.Skipped {
+		fmt.Println("Skipped torn segment, still on its old key:", path)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+// Engine stores the newest committed version of every row of one table,
+// keyed by primary key. Older versions needed by open transactions stay in
+// the table's history. Engines are not safe for concurrent use on their own:
+// the owning Table's lock serialises writers, and Get, Len and Scan may run
+// concurrently under its read lock.
+type Engine interface {
+	Get(key any) (VersionedRecord, bool, error)
+	Put(key any, vRecord VersionedRecord) error
+	Delete(key any) error
+	Len() int
+	// Scan calls fn for every row until it returns false. Engines may visit
+	// rows in any order.
+	Scan(fn func(key any, vRecord VersionedRecord) bool) error
+}
+
+// EngineKind selects the storage engine of a durable database
+type EngineKind string
+
+const (
+	// MemoryEngine keeps every row in memory and writes all of them to
+	// snapshot.json at each checkpoint
+	MemoryEngine EngineKind = "memory"
+	// DiskEngine keeps rows in a page file behind a buffer pool, so tables
+	// may be larger than memory
+	DiskEngine EngineKind = "disk"
+)
+
+// checkKey reports whether the engine can store key, so an unstorable key is
+// rejected before its write is logged
+func (t *Table) checkKey(key any) error {
+	if checker, ok := t.engine.(interface{ checkKey(any) error }); ok {
+		return checker.checkKey(key)
+	}
+	return nil
+}
+
+// rangeScanner is implemented by engines that keep rows in primary key
+// order, so the planner can fetch a range of keys without a full scan
+type rangeScanner interface {
+	// scanRange calls fn in key order for the rows whose keys lie between
+	// the bounds, either of which may be nil, until it returns false. Bound
+	// values must be of the primary key's type.
+	scanRange(lower, upper *Bound, fn func(key any, vRecord VersionedRecord) bool) error
+}
+
+// memoryEngine is the map-backed Engine used by NewDatabase
+type memoryEngine struct {
+	records map[any]VersionedRecord
+}
+
+func newMemoryEngine() *memoryEngine {
+	return &memoryEngine{records: make(map[any]VersionedRecord)}
+}
+
+func (e *memoryEngine) Get(key any) (VersionedRecord, bool, error) {
+	vRecord, exists := e.records[key]
+	return vRecord, exists, nil
+}
+
+func (e *memoryEngine) Put(key any, vRecord VersionedRecord) error {
+	e.records[key] = vRecord
+	return nil
+}
+
+func (e *memoryEngine) Delete(key any) error {
+	delete(e.records, key)
+	return nil
+}
+
+func (e *memoryEngine) Len() int {
+	return len(e.records)
+}
+
+func (e *memoryEngine) Scan(fn func(key any, vRecord VersionedRecord) bool) error {
+	for key, vRecord := range e.records {
+		if !fn(key, vRecord) {
+			return nil
+		}
+	}
+	return nil
+}
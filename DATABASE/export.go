@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format is a table export and import format
+type Format string
+
+const (
+	// FormatCSV is a header row of column names followed by one row per
+	// record. NULL is written as \N, bytes as \x followed by hex and times
+	// in RFC 3339.
+	FormatCSV Format = "csv"
+	// FormatJSONL is one JSON object per line, as produced by encoding/json
+	FormatJSONL Format = "jsonl"
+	// FormatColumnar is a compressed, column-oriented file that carries the
+	// table schema (see columnar.go)
+	FormatColumnar Format = "columnar"
+)
+
+const (
+	csvNull     = `\N`
+	importBatch = 1000 // Rows inserted per transaction by ImportTable
+)
+
+// ParseFormat parses a format name. File extensions (csv, jsonl, col) are
+// accepted as well.
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(strings.TrimPrefix(name, ".")) {
+	case "csv":
+		return FormatCSV, nil
+	case "jsonl", "ndjson", "json":
+		return FormatJSONL, nil
+	case "columnar", "col":
+		return FormatColumnar, nil
+	}
+	return "", fmt.Errorf("unknown format %q", name)
+}
+
+// rowWriter writes records of one table in some format
+type rowWriter interface {
+	Write(row Record) error
+	Close() error // Flushes buffered rows; does not close the underlying writer
+}
+
+// rowReader reads records in some format. Read returns io.EOF after the last
+// record. Values have types Insert accepts for the table's columns.
+type rowReader interface {
+	Read() (Record, error)
+}
+
+func newRowWriter(w io.Writer, schema Schema, format Format) (rowWriter, error) {
+	switch format {
+	case FormatCSV:
+		cw := &csvRowWriter{w: csv.NewWriter(w), schema: schema}
+		header := make([]string, len(schema.Columns))
+		for i, column := range schema.Columns {
+			header[i] = column.Name
+		}
+		return cw, cw.w.Write(header)
+	case FormatJSONL:
+		bw := bufio.NewWriter(w)
+		return &jsonRowWriter{w: bw, encoder: json.NewEncoder(bw)}, nil
+	case FormatColumnar:
+		return newColumnarWriter(w, schema), nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+func newRowReader(r io.Reader, schema Schema, format Format) (rowReader, error) {
+	switch format {
+	case FormatCSV:
+		cr := csv.NewReader(r)
+		header, err := cr.Read()
+		if err == io.EOF {
+			return nil, errors.New("csv file has no header row")
+		}
+		if err != nil {
+			return nil, err
+		}
+		columns := make([]Column, len(header))
+		for i, name := range header {
+			column, ok := schema.Column(name)
+			if !ok {
+				return nil, &ColumnError{Column: name}
+			}
+			columns[i] = column
+		}
+		cr.FieldsPerRecord = len(header)
+		return &csvRowReader{r: cr, columns: columns}, nil
+	case FormatJSONL:
+		decoder := json.NewDecoder(r)
+		decoder.UseNumber()
+		return &jsonRowReader{decoder: decoder, schema: schema}, nil
+	case FormatColumnar:
+		return newColumnarReader(r, schema)
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+type csvRowWriter struct {
+	w      *csv.Writer
+	schema Schema
+}
+
+func (cw *csvRowWriter) Write(row Record) error {
+	fields := make([]string, len(cw.schema.Columns))
+	for i, column := range cw.schema.Columns {
+		fields[i] = formatCSV(row[column.Name])
+	}
+	return cw.w.Write(fields)
+}
+
+func (cw *csvRowWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+type csvRowReader struct {
+	r       *csv.Reader
+	columns []Column // In file order
+}
+
+func (cr *csvRowReader) Read() (Record, error) {
+	fields, err := cr.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	row := make(Record, len(fields))
+	for i, field := range fields {
+		value, err := parseCSV(field, cr.columns[i].Type)
+		if err != nil {
+			line, _ := cr.r.FieldPos(i)
+			return nil, fmt.Errorf("line %d, column %q: %w", line, cr.columns[i].Name, err)
+		}
+		row[cr.columns[i].Name] = value
+	}
+	return row, nil
+}
+
+// formatCSV returns the CSV field for value
+func formatCSV(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return csvNull
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case []byte:
+		return `\x` + hex.EncodeToString(v)
+	}
+	return fmt.Sprint(value)
+}
+
+// parseCSV parses a CSV field written by formatCSV
+func parseCSV(field string, t ColumnType) (any, error) {
+	if field == csvNull {
+		return nil, nil
+	}
+	if t == TypeBytes {
+		if !strings.HasPrefix(field, `\x`) {
+			return []byte(field), nil
+		}
+		return hex.DecodeString(field[2:])
+	}
+	return parseValue(field, t)
+}
+
+type jsonRowWriter struct {
+	w       *bufio.Writer
+	encoder *json.Encoder
+}
+
+func (jw *jsonRowWriter) Write(row Record) error {
+	return jw.encoder.Encode(row)
+}
+
+func (jw *jsonRowWriter) Close() error {
+	return jw.w.Flush()
+}
+
+type jsonRowReader struct {
+	decoder *json.Decoder
+	schema  Schema
+	n       int
+}
+
+func (jr *jsonRowReader) Read() (Record, error) {
+	var raw Record
+	if err := jr.decoder.Decode(&raw); err != nil {
+		if err != io.EOF {
+			err = fmt.Errorf("record %d: %w", jr.n+1, err)
+		}
+		return nil, err
+	}
+	jr.n++
+	row := make(Record, len(raw))
+	for name, value := range raw {
+		column, ok := jr.schema.Column(name)
+		if !ok {
+			return nil, fmt.Errorf("record %d: %w", jr.n, &ColumnError{Column: name})
+		}
+		decoded, err := decodeValue(value, column.Type)
+		if err != nil {
+			return nil, fmt.Errorf("record %d, column %q: %w", jr.n, name, err)
+		}
+		row[name] = decoded
+	}
+	return row, nil
+}
+
+// ExportTable writes every record of a table, ordered by primary key, to w.
+// The records are read from a single snapshot, so writes may continue while
+// a large table is exported. It returns the number of records written.
+func (db *Database) ExportTable(ctx context.Context, tableName string, w io.Writer, format Format) (int, error) {
+	tx, err := db.BeginTransaction(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	return tx.export(tableName, w, format)
+}
+
+// export writes the records of a table visible to the transaction
+func (tx *Transaction) export(tableName string, w io.Writer, format Format) (int, error) {
+	table, err := tx.db.lookupTable(tableName)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := tx.List(tableName)
+	if err != nil {
+		return 0, err
+	}
+	rw, err := newRowWriter(w, table.schema, format)
+	if err != nil {
+		return 0, err
+	}
+	for _, row := range rows {
+		if err := rw.Write(row); err != nil {
+			return 0, err
+		}
+	}
+	return len(rows), rw.Close()
+}
+
+// ImportTable inserts the records read from r into an existing table.
+// Columns are matched by name and omitted columns take their defaults.
+// Records are committed in batches of importBatch, so on error the records
+// before the failing batch stay imported; the returned count says how many.
+func (db *Database) ImportTable(ctx context.Context, tableName string, r io.Reader, format Format) (int, error) {
+	return db.importTable(ctx, tableName, r, format, true)
+}
+
+// importTable is ImportTable, optionally without enforcing foreign keys, for
+// rows that come from a consistent backup and may reference rows of the same
+// table that are imported after them
+func (db *Database) importTable(ctx context.Context, tableName string, r io.Reader, format Format, checked bool) (int, error) {
+	schema, err := db.Schema(tableName)
+	if err != nil {
+		return 0, err
+	}
+	rr, err := newRowReader(r, schema, format)
+	if err != nil {
+		return 0, err
+	}
+
+	imported := 0
+	for {
+		tx, err := db.BeginTransaction(ctx)
+		if err != nil {
+			return imported, err
+		}
+		tx.unchecked = !checked
+		n := 0
+		for n < importBatch {
+			row, err := rr.Read()
+			if err == io.EOF {
+				break
+			}
+			if err == nil {
+				err = tx.Insert(tableName, row)
+			}
+			if err != nil {
+				tx.Rollback()
+				return imported, fmt.Errorf("record %d: %w", imported+n+1, err)
+			}
+			n++
+		}
+		if err := tx.Commit(); err != nil {
+			return imported, err
+		}
+		imported += n
+		if n < importBatch {
+			return imported, nil
+		}
+	}
+}
+
+// runExport implements "export": write one table of a database directory to
+// a file or stdout
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	dir := flags.String("data", "data", "database directory")
+	tableName := flags.String("table", "", "table to export")
+	formatName := flags.String("format", "", "csv, jsonl or columnar (default: from the -out extension, else csv)")
+	out := flags.String("out", "", "output file (default: stdout)")
+	keyring := keyFileFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *tableName == "" {
+		return errors.New("-table is required")
+	}
+	format, err := fileFormat(*formatName, *out)
+	if err != nil {
+		return err
+	}
+
+	keys, err := keyring()
+	if err != nil {
+		return err
+	}
+	db, err := OpenDatabaseWithOptions(*dir, Options{Keys: keys})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	n, err := db.ExportTable(context.Background(), *tableName, w, format)
+	if err != nil {
+		return err
+	}
+	if *out != "" {
+		fmt.Printf("Exported %d records to %s\n", n, *out)
+	}
+	return nil
+}
+
+// runImport implements "import": load a file into one table of a database
+// directory
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	dir := flags.String("data", "data", "database directory")
+	tableName := flags.String("table", "", "table to import into")
+	formatName := flags.String("format", "", "csv, jsonl or columnar (default: from the -in extension, else csv)")
+	in := flags.String("in", "", "input file (default: stdin)")
+	keyring := keyFileFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *tableName == "" {
+		return errors.New("-table is required")
+	}
+	format, err := fileFormat(*formatName, *in)
+	if err != nil {
+		return err
+	}
+
+	r := io.Reader(os.Stdin)
+	if *in != "" {
+		file, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	keys, err := keyring()
+	if err != nil {
+		return err
+	}
+	db, err := OpenDatabaseWithOptions(*dir, Options{Keys: keys})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	n, err := db.ImportTable(context.Background(), *tableName, r, format)
+	fmt.Printf("Imported %d records\n", n)
+	return err
+}
+
+// fileFormat picks the format named by a flag, or else by the extension of
+// path, or else CSV
+func fileFormat(name, path string) (Format, error) {
+	if name != "" {
+		return ParseFormat(name)
+	}
+	if format, err := ParseFormat(filepath.Ext(path)); err == nil {
+		return format, nil
+	}
+	return FormatCSV, nil
+}
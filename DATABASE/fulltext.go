@@ -0,0 +1,611 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// BM25 parameters: k1 limits how much repeating a word raises a score, b how
+// much long rows are penalised
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// textWords splits text into lower-cased words at anything that is not a
+// letter or digit and stems them
+func textWords(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, field := range fields {
+		fields[i] = stem(field)
+	}
+	return fields
+}
+
+// textQuery is a parsed full-text query. A row matches if every term occurs
+// in it.
+type textQuery struct {
+	terms []textTerm
+}
+
+// textTerm is a word or a phrase of consecutive words
+type textTerm []textWord
+
+// textWord is a stemmed word, or the lower-cased start of a word for a
+// prefix query such as data*
+type textWord struct {
+	text   string
+	prefix bool
+}
+
+func (w textWord) matches(word string) bool {
+	if w.prefix {
+		return strings.HasPrefix(word, w.text)
+	}
+	return word == w.text
+}
+
+// parseTextQuery parses words, "quoted phrases" and prefixes ending in *. A
+// word the tokenizer splits, such as e-mail, is a phrase.
+func parseTextQuery(query string) textQuery {
+	var q textQuery
+	for query != "" {
+		query = strings.TrimLeftFunc(query, unicode.IsSpace)
+		var chunk string
+		if strings.HasPrefix(query, `"`) {
+			end := strings.IndexByte(query[1:], '"')
+			if end < 0 {
+				chunk, query = query[1:], ""
+			} else {
+				chunk, query = query[1:end+1], query[end+2:]
+			}
+		} else {
+			end := strings.IndexFunc(query, unicode.IsSpace)
+			if end < 0 {
+				end = len(query)
+			}
+			chunk, query = query[:end], query[end:]
+		}
+		if term := parseTextTerm(chunk); len(term) > 0 {
+			q.terms = append(q.terms, term)
+		}
+	}
+	return q
+}
+
+// parseTextTerm turns the words of a phrase into a term. Words followed by *
+// are prefixes and are not stemmed.
+func parseTextTerm(phrase string) textTerm {
+	var term textTerm
+	for _, chunk := range strings.Fields(phrase) {
+		prefix := strings.HasSuffix(chunk, "*")
+		fields := strings.FieldsFunc(strings.ToLower(chunk), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for i, field := range fields {
+			if prefix && i == len(fields)-1 {
+				term = append(term, textWord{text: field, prefix: true})
+			} else {
+				term = append(term, textWord{text: stem(field)})
+			}
+		}
+	}
+	return term
+}
+
+// matches reports whether the words of a row contain every term of the query
+func (q textQuery) matches(words []string) bool {
+	if len(q.terms) == 0 {
+		return false
+	}
+	for _, term := range q.terms {
+		if !term.occursIn(words) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t textTerm) occursIn(words []string) bool {
+	for start := 0; start+len(t) <= len(words); start++ {
+		found := true
+		for i, w := range t {
+			if !w.matches(words[start+i]) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func (q textQuery) String() string {
+	terms := make([]string, len(q.terms))
+	for i, term := range q.terms {
+		words := make([]string, len(term))
+		for j, w := range term {
+			words[j] = w.text
+			if w.prefix {
+				words[j] += "*"
+			}
+		}
+		terms[i] = strings.Join(words, " ")
+		if len(term) > 1 {
+			terms[i] = `"` + terms[i] + `"`
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+// addText indexes the words of a row's text under its primary key
+func (idx *Index) addText(pk any, row Record) {
+	text, ok := row[idx.spec.Columns[0]].(string)
+	if !ok {
+		return
+	}
+	words := textWords(text)
+	for _, word := range words {
+		idx.add(word, pk)
+	}
+	idx.docs[pk] = len(words)
+	idx.words += len(words)
+}
+
+// removeText forgets the words of a row's text
+func (idx *Index) removeText(pk any, row Record) {
+	text, ok := row[idx.spec.Columns[0]].(string)
+	if !ok {
+		return
+	}
+	for _, word := range textWords(text) {
+		idx.remove(word, pk)
+	}
+	idx.words -= idx.docs[pk]
+	delete(idx.docs, pk)
+}
+
+// wordKeys returns the primary keys of the rows holding a word, or any word
+// starting with a prefix
+func (idx *Index) wordKeys(w textWord) map[any]bool {
+	keys := make(map[any]bool)
+	if !w.prefix {
+		for _, pk := range idx.lookup(w.text) {
+			keys[pk] = true
+		}
+		return keys
+	}
+	end := prefixEnd([]byte(w.text))
+	idx.tree.Ascend(w.text, string(end), end != nil, func(_ string, pks []any) bool {
+		for _, pk := range pks {
+			keys[pk] = true
+		}
+		return true
+	})
+	return keys
+}
+
+// matchText returns the primary keys of the rows holding every word of the
+// query, in order. Phrases are only checked word by word, so the result is a
+// superset of the matching rows.
+func (idx *Index) matchText(query string) []any {
+	q := parseTextQuery(query)
+	var keys map[any]bool
+	for _, term := range q.terms {
+		for _, w := range term {
+			found := idx.wordKeys(w)
+			if keys != nil {
+				for pk := range keys {
+					if !found[pk] {
+						delete(keys, pk)
+					}
+				}
+			} else {
+				keys = found
+			}
+		}
+	}
+	pks := make([]any, 0, len(keys))
+	for pk := range keys {
+		pks = append(pks, pk)
+	}
+	slices.SortFunc(pks, compareValues)
+	return pks
+}
+
+// textRanker scores rows against a query with BM25, using the word counts of
+// a full-text index
+type textRanker struct {
+	words  []textWord
+	idf    map[string]float64 // Per indexed word the query's words match
+	avgLen float64
+}
+
+// newTextRanker collects the statistics of query's words. The caller must
+// hold the table's lock.
+func (idx *Index) newTextRanker(query string) *textRanker {
+	r := &textRanker{idf: make(map[string]float64)}
+	rows := float64(len(idx.docs))
+	if rows > 0 {
+		r.avgLen = float64(idx.words) / rows
+	}
+	for _, term := range parseTextQuery(query).terms {
+		r.words = append(r.words, term...)
+	}
+	addWord := func(word string, pks []any) {
+		df := float64(len(pks))
+		r.idf[word] = math.Log(1 + (rows-df+0.5)/(df+0.5))
+	}
+	for _, w := range r.words {
+		if !w.prefix {
+			addWord(w.text, idx.lookup(w.text))
+			continue
+		}
+		end := prefixEnd([]byte(w.text))
+		idx.tree.Ascend(w.text, string(end), end != nil, func(word string, pks []any) bool {
+			addWord(word, pks)
+			return true
+		})
+	}
+	return r
+}
+
+// score returns the BM25 score of a row's text, 0 if no query word occurs
+func (r *textRanker) score(text string) float64 {
+	words := textWords(text)
+	counts := make(map[string]int)
+	for _, word := range words {
+		counts[word]++
+	}
+	norm := 1.0
+	if r.avgLen > 0 {
+		norm = 1 - bm25B + bm25B*float64(len(words))/r.avgLen
+	}
+	score := 0.0
+	seen := make(map[string]bool)
+	for _, w := range r.words {
+		for word, tf := range counts {
+			if !w.matches(word) || seen[word] {
+				continue
+			}
+			seen[word] = true
+			f := float64(tf)
+			score += r.idf[word] * f * (bm25K1 + 1) / (f + bm25K1*norm)
+		}
+	}
+	return score
+}
+
+// textIndexOn returns the full-text index on a column
+func (t *Table) textIndexOn(column string) (*Index, bool) {
+	for _, idx := range t.indexes {
+		if idx.spec.FullText && idx.spec.Columns[0] == column {
+			return idx, true
+		}
+	}
+	return nil, false
+}
+
+// SearchResult is a row found by Search and its BM25 score
+type SearchResult struct {
+	Record Record
+	Score  float64
+}
+
+// Search returns the rows whose column matches a full-text query, best
+// first, using the full-text index on that column. A limit of zero returns
+// every match.
+func (db *Database) Search(ctx context.Context, tableName string, column string, query string, limit int) ([]SearchResult, error) {
+	table, err := db.lookupTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+	table.mu.RLock()
+	idx, exists := table.textIndexOn(column)
+	var ranker *textRanker
+	if exists {
+		ranker = idx.newTextRanker(query)
+	}
+	table.mu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("column %q has no full-text index", column)
+	}
+
+	tx, err := db.BeginTransaction(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.indexLookup(tableName, idx.spec.Name, []Range{{Match: query}})
+	if err != nil {
+		return nil, err
+	}
+	q := parseTextQuery(query)
+	var results []SearchResult
+	for _, row := range rows {
+		text, ok := row[column].(string)
+		if ok && q.matches(textWords(text)) {
+			results = append(results, SearchResult{Record: row, Score: ranker.score(text)})
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, ctx.Err()
+}
+
+// rankerFor returns the ranker of a BM25 call, built on first use from the
+// full-text index of the column's table
+func (ex *executor) rankerFor(e *RankExpr, sc scope) (*textRanker, error) {
+	if r, ok := ex.rankers[e]; ok {
+		return r, nil
+	}
+	tableName, ok := sourceTable(sc, e.Column)
+	if !ok {
+		return nil, errors.New("BM25 needs a column of a table in FROM")
+	}
+	query, err := ex.eval(e.Query, sc)
+	if err != nil {
+		return nil, err
+	}
+	text, ok := query.(string)
+	if !ok {
+		return nil, errors.New("BM25 needs a string query")
+	}
+	table, err := ex.tx.db.lookupTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	idx, exists := table.textIndexOn(e.Column.Column)
+	if !exists {
+		return nil, fmt.Errorf("column %q has no full-text index", e.Column.Column)
+	}
+	if ex.rankers == nil {
+		ex.rankers = make(map[*RankExpr]*textRanker)
+	}
+	ex.rankers[e] = idx.newTextRanker(text)
+	return ex.rankers[e], nil
+}
+
+// sourceTable returns the name of the table a column reference resolves to
+// in a row scope
+func sourceTable(sc scope, ref *ColumnRef) (string, bool) {
+	switch s := sc.(type) {
+	case *rowScope:
+		if _, exists := s.schema.Column(ref.Column); exists && (ref.Table == "" || ref.Table == s.table) {
+			return s.table, true
+		}
+	case *tupleScope:
+		if i, err := resolveSource(s.sources, ref); err == nil {
+			return s.sources[i].table, true
+		}
+	case *aliasScope:
+		return sourceTable(s.base, ref)
+	}
+	return "", false
+}
+
+// stem reduces an English word to its stem with the Porter algorithm, so
+// that connect, connected and connection are indexed alike. Words that are
+// not plain lower-case ASCII are returned as they are.
+func stem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	for i := 0; i < len(word); i++ {
+		if word[i] < 'a' || word[i] > 'z' {
+			return word
+		}
+	}
+	s := &stemmer{b: []byte(word)}
+	s.step1ab()
+	s.step1c()
+	s.step2()
+	s.step3()
+	s.step4()
+	s.step5()
+	return string(s.b)
+}
+
+// stemmer holds a word being stemmed
+type stemmer struct {
+	b []byte
+}
+
+// cons reports whether b[i] is a consonant: not a vowel, and not a y
+// following a consonant
+func (s *stemmer) cons(i int) bool {
+	switch s.b[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !s.cons(i-1)
+	}
+	return true
+}
+
+// measure counts the vowel-consonant sequences in b[:n]
+func (s *stemmer) measure(n int) int {
+	m, i := 0, 0
+	for i < n && s.cons(i) {
+		i++
+	}
+	for i < n {
+		for i < n && !s.cons(i) {
+			i++
+		}
+		if i >= n {
+			break
+		}
+		m++
+		for i < n && s.cons(i) {
+			i++
+		}
+	}
+	return m
+}
+
+// hasVowel reports whether b[:n] contains a vowel
+func (s *stemmer) hasVowel(n int) bool {
+	for i := 0; i < n; i++ {
+		if !s.cons(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// doubleCons reports whether b[:n] ends in a double consonant
+func (s *stemmer) doubleCons(n int) bool {
+	return n >= 2 && s.b[n-1] == s.b[n-2] && s.cons(n-1)
+}
+
+// cvc reports whether b[:n] ends consonant-vowel-consonant with the last
+// consonant not w, x or y, as in hop but not in snow
+func (s *stemmer) cvc(n int) bool {
+	if n < 3 || !s.cons(n-1) || s.cons(n-2) || !s.cons(n-3) {
+		return false
+	}
+	c := s.b[n-1]
+	return c != 'w' && c != 'x' && c != 'y'
+}
+
+func (s *stemmer) ends(suffix string) bool {
+	return strings.HasSuffix(string(s.b), suffix)
+}
+
+// replace swaps suffix for repl if the word ends in suffix and the rest has
+// a measure above m. It reports whether the word ends in suffix.
+func (s *stemmer) replace(suffix, repl string, m int) bool {
+	if !s.ends(suffix) {
+		return false
+	}
+	if n := len(s.b) - len(suffix); s.measure(n) > m {
+		s.b = append(s.b[:n], repl...)
+	}
+	return true
+}
+
+// step1ab removes plurals and -ed or -ing
+func (s *stemmer) step1ab() {
+	switch {
+	case s.ends("sses"), s.ends("ies"):
+		s.b = s.b[:len(s.b)-2]
+	case s.ends("ss"):
+	case s.ends("s"):
+		s.b = s.b[:len(s.b)-1]
+	}
+
+	if s.ends("eed") {
+		if s.measure(len(s.b)-3) > 0 {
+			s.b = s.b[:len(s.b)-1]
+		}
+		return
+	}
+	switch {
+	case s.ends("ed") && s.hasVowel(len(s.b)-2):
+		s.b = s.b[:len(s.b)-2]
+	case s.ends("ing") && s.hasVowel(len(s.b)-3):
+		s.b = s.b[:len(s.b)-3]
+	default:
+		return
+	}
+	n := len(s.b)
+	switch {
+	case s.ends("at"), s.ends("bl"), s.ends("iz"):
+		s.b = append(s.b, 'e')
+	case s.doubleCons(n):
+		if c := s.b[n-1]; c != 'l' && c != 's' && c != 'z' {
+			s.b = s.b[:n-1]
+		}
+	case s.measure(n) == 1 && s.cvc(n):
+		s.b = append(s.b, 'e')
+	}
+}
+
+// step1c turns a final y into i when there is another vowel
+func (s *stemmer) step1c() {
+	if n := len(s.b); s.ends("y") && s.hasVowel(n-1) {
+		s.b[n-1] = 'i'
+	}
+}
+
+// Suffix rules of steps 2 to 4. The first suffix a word ends in decides the
+// rule, so longer suffixes come before the ones they end in.
+var (
+	step2Rules = [][2]string{
+		{"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"},
+		{"izer", "ize"}, {"bli", "ble"}, {"alli", "al"}, {"entli", "ent"}, {"eli", "e"},
+		{"ousli", "ous"}, {"ization", "ize"}, {"ation", "ate"}, {"ator", "ate"},
+		{"alism", "al"}, {"iveness", "ive"}, {"fulness", "ful"}, {"ousness", "ous"},
+		{"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"}, {"logi", "log"},
+	}
+	step3Rules = [][2]string{
+		{"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"},
+		{"ical", "ic"}, {"ful", ""}, {"ness", ""},
+	}
+	step4Suffixes = []string{
+		"al", "ance", "ence", "er", "ic", "able", "ible", "ant", "ement", "ment",
+		"ent", "ion", "ou", "ism", "ate", "iti", "ous", "ive", "ize",
+	}
+)
+
+// step2 maps double suffixes to single ones, as in -ization to -ize
+func (s *stemmer) step2() {
+	for _, rule := range step2Rules {
+		if s.replace(rule[0], rule[1], 0) {
+			return
+		}
+	}
+}
+
+// step3 handles -ic-, -full, -ness and the like
+func (s *stemmer) step3() {
+	for _, rule := range step3Rules {
+		if s.replace(rule[0], rule[1], 0) {
+			return
+		}
+	}
+}
+
+// step4 removes -ant, -ence and the like from words with a long enough stem
+func (s *stemmer) step4() {
+	for _, suffix := range step4Suffixes {
+		if !s.ends(suffix) {
+			continue
+		}
+		n := len(s.b) - len(suffix)
+		if suffix == "ion" && (n == 0 || (s.b[n-1] != 's' && s.b[n-1] != 't')) {
+			continue
+		}
+		if s.measure(n) > 1 {
+			s.b = s.b[:n]
+		}
+		return
+	}
+}
+
+// step5 removes a final -e and reduces a final -ll
+func (s *stemmer) step5() {
+	if n := len(s.b) - 1; s.ends("e") {
+		if m := s.measure(n); m > 1 || (m == 1 && !s.cvc(n)) {
+			s.b = s.b[:n]
+		}
+	}
+	if n := len(s.b); s.ends("ll") && s.measure(n) > 1 {
+		s.b = s.b[:n-1]
+	}
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrUniqueViolation is wrapped by the *UniqueError returned when a write
+// would give two records the same value in a unique index or primary key
+var ErrUniqueViolation = errors.New("unique index violation")
+
+// IndexSpec describes a secondary index on one or more columns
+type IndexSpec struct {
+	Name    string   `json:"name"` // Defaults to the column names joined with ","
+	Columns []string `json:"columns"`
+	Unique  bool     `json:"unique,omitempty"`
+	Ordered bool     `json:"ordered,omitempty"` // B-tree index supporting range and prefix scans
+	// FullText indexes the words of one string column for MATCH queries
+	// instead of its value, see fulltext.go
+	FullText bool `json:"full_text,omitempty"`
+}
+
+// Bound is one end of a range scan
+type Bound struct {
+	Value     any
+	Inclusive bool
+}
+
+// Range selects entries of an index. Equal pins the leading index columns;
+// Lower/Upper or Prefix then constrain the column that follows them. A
+// full-text index is only scanned with Match.
+type Range struct {
+	Equal  []any
+	Lower  *Bound
+	Upper  *Bound
+	Prefix *string // String or bytes prefix
+	Match  string  // Full-text query, see parseTextQuery
+}
+
+// Index is a secondary index. Keys are order-preserving encodings of the
+// indexed column values; each key maps to the sorted primary keys holding it.
+// Rows with a NULL in any indexed column are not indexed. The keys of a
+// full-text index are the words of the column instead.
+type Index struct {
+	spec  IndexSpec
+	types []ColumnType
+	hash  map[string][]any
+	tree  *btree
+	docs  map[any]int // Full-text indexes: number of words in each row
+	words int         // Full-text indexes: total of docs
+}
+
+// newIndex creates an empty index after checking spec against schema
+func newIndex(spec IndexSpec, schema Schema) (*Index, error) {
+	if len(spec.Columns) == 0 {
+		return nil, errors.New("index has no columns")
+	}
+	idx := &Index{spec: spec, types: make([]ColumnType, len(spec.Columns))}
+	for i, name := range spec.Columns {
+		column, exists := schema.Column(name)
+		if !exists {
+			return nil, &ColumnError{Column: name}
+		}
+		idx.types[i] = column.Type
+	}
+	if spec.FullText {
+		switch {
+		case len(spec.Columns) != 1 || idx.types[0] != TypeString:
+			return nil, errors.New("full-text index needs one string column")
+		case spec.Unique || spec.Ordered:
+			return nil, errors.New("full-text index cannot be unique or ordered")
+		}
+		idx.tree, idx.docs = &btree{}, make(map[any]int)
+		return idx, nil
+	}
+	if spec.Ordered {
+		idx.tree = &btree{}
+	} else {
+		idx.hash = make(map[string][]any)
+	}
+	return idx, nil
+}
+
+// keyFor returns the index key of row, or false if an indexed column is NULL
+func (idx *Index) keyFor(row Record) (string, bool, error) {
+	var buf []byte
+	for _, column := range idx.spec.Columns {
+		value := row[column]
+		if value == nil {
+			return "", false, nil
+		}
+		var err error
+		if buf, err = appendKey(buf, value); err != nil {
+			return "", false, fmt.Errorf("index %q: %w", idx.spec.Name, err)
+		}
+	}
+	return string(buf), true, nil
+}
+
+// rowKeys holds the key of a row in each index that is not full-text, or
+// none where an indexed column is NULL
+type rowKeys map[*Index]string
+
+// indexKeys encodes the keys of row in every index of t, so that a write can
+// fail before it changes anything. The caller must hold t.mu.
+func (t *Table) indexKeys(row Record) (rowKeys, error) {
+	keys := make(rowKeys, len(t.indexes))
+	for _, idx := range t.indexes {
+		if idx.spec.FullText {
+			continue
+		}
+		key, ok, err := idx.keyFor(row)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			keys[idx] = key
+		}
+	}
+	return keys, nil
+}
+
+// addRow indexes row under primary key pk, given its keys
+func (idx *Index) addRow(pk any, row Record, keys rowKeys) {
+	if idx.spec.FullText {
+		idx.addText(pk, row)
+	} else if key, ok := keys[idx]; ok {
+		idx.add(key, pk)
+	}
+}
+
+// removeRow drops the entries of row, indexed under primary key pk
+func (idx *Index) removeRow(pk any, row Record, keys rowKeys) {
+	if idx.spec.FullText {
+		idx.removeText(pk, row)
+	} else if key, ok := keys[idx]; ok {
+		idx.remove(key, pk)
+	}
+}
+
+// lookup returns the primary keys stored under key
+func (idx *Index) lookup(key string) []any {
+	if idx.tree != nil {
+		pks, _ := idx.tree.Get(key)
+		return pks
+	}
+	return idx.hash[key]
+}
+
+// add records that the row with primary key pk has index key key
+func (idx *Index) add(key string, pk any) {
+	pks := idx.lookup(key)
+	i, found := slices.BinarySearchFunc(pks, pk, compareValues)
+	if found {
+		return
+	}
+	pks = slices.Insert(slices.Clip(pks), i, pk)
+	if idx.tree != nil {
+		idx.tree.Set(key, pks)
+	} else {
+		idx.hash[key] = pks
+	}
+}
+
+// remove forgets that the row with primary key pk has index key key
+func (idx *Index) remove(key string, pk any) {
+	pks := idx.lookup(key)
+	i, found := slices.BinarySearchFunc(pks, pk, compareValues)
+	if !found {
+		return
+	}
+	pks = slices.Delete(slices.Clone(pks), i, i+1)
+	switch {
+	case idx.tree != nil && len(pks) == 0:
+		idx.tree.Delete(key)
+	case idx.tree != nil:
+		idx.tree.Set(key, pks)
+	case len(pks) == 0:
+		delete(idx.hash, key)
+	default:
+		idx.hash[key] = pks
+	}
+}
+
+// scan calls fn with the primary keys of every entry matching r, in index
+// order for ordered indexes
+func (idx *Index) scan(r Range, fn func(pks []any) bool) error {
+	if idx.spec.FullText {
+		if r.Match == "" || len(r.Equal) > 0 || r.Lower != nil || r.Upper != nil || r.Prefix != nil {
+			return fmt.Errorf("full-text index %q only answers MATCH", idx.spec.Name)
+		}
+		if pks := idx.matchText(r.Match); len(pks) > 0 {
+			fn(pks)
+		}
+		return nil
+	}
+	if r.Match != "" {
+		return fmt.Errorf("index %q is not a full-text index", idx.spec.Name)
+	}
+	if len(r.Equal) > len(idx.spec.Columns) {
+		return errors.New("too many values for index")
+	}
+
+	var base []byte
+	for i, value := range r.Equal {
+		converted, err := convertValue(value, idx.types[i])
+		if err != nil {
+			return fmt.Errorf("column %q: %w", idx.spec.Columns[i], err)
+		}
+		if converted == nil {
+			return errors.New("cannot look up NULL in an index")
+		}
+		if base, err = appendKey(base, converted); err != nil {
+			return err
+		}
+	}
+
+	ranged := r.Lower != nil || r.Upper != nil || r.Prefix != nil
+	if !ranged && len(r.Equal) == len(idx.spec.Columns) {
+		if pks := idx.lookup(string(base)); len(pks) > 0 {
+			fn(pks)
+		}
+		return nil
+	}
+	if idx.tree == nil {
+		return fmt.Errorf("index %q is not ordered", idx.spec.Name)
+	}
+
+	lo, hi := base, prefixEnd(base)
+	if ranged {
+		if len(r.Equal) == len(idx.spec.Columns) {
+			return errors.New("range needs a column after the equality values")
+		}
+		columnType := idx.types[len(r.Equal)]
+		column := idx.spec.Columns[len(r.Equal)]
+
+		if r.Prefix != nil {
+			if r.Lower != nil || r.Upper != nil {
+				return errors.New("prefix cannot be combined with bounds")
+			}
+			if columnType != TypeString && columnType != TypeBytes {
+				return fmt.Errorf("column %q: prefix match needs a string or bytes column", column)
+			}
+			lo = appendPrefix(slices.Clone(base), columnType, *r.Prefix)
+			hi = prefixEnd(lo)
+		}
+		if r.Lower != nil {
+			key, err := boundKey(base, r.Lower, columnType, column)
+			if err != nil {
+				return err
+			}
+			if r.Lower.Inclusive {
+				lo = key
+			} else {
+				lo = prefixEnd(key)
+			}
+		}
+		if r.Upper != nil {
+			key, err := boundKey(base, r.Upper, columnType, column)
+			if err != nil {
+				return err
+			}
+			if r.Upper.Inclusive {
+				hi = prefixEnd(key)
+			} else {
+				hi = key
+			}
+		}
+	}
+
+	idx.tree.Ascend(string(lo), string(hi), hi != nil, func(_ string, pks []any) bool {
+		return fn(pks)
+	})
+	return nil
+}
+
+// boundKey encodes base followed by the bound value
+func boundKey(base []byte, bound *Bound, columnType ColumnType, column string) ([]byte, error) {
+	value, err := convertValue(bound.Value, columnType)
+	if err != nil {
+		return nil, fmt.Errorf("column %q: %w", column, err)
+	}
+	if value == nil {
+		return nil, errors.New("range bound cannot be NULL")
+	}
+	return appendKey(slices.Clone(base), value)
+}
+
+// Key encoding. Each value is a type tag followed by a body whose byte order
+// matches the value order, so encoded tuples sort like the tuples themselves.
+const (
+	keyInt    = 0x10
+	keyFloat  = 0x11
+	keyString = 0x12
+	keyBytes  = 0x13
+	keyBool   = 0x14
+	keyTime   = 0x15
+)
+
+// appendKey appends the order-preserving encoding of a non-NULL value
+func appendKey(buf []byte, value any) ([]byte, error) {
+	switch v := value.(type) {
+	case int64:
+		buf = append(buf, keyInt)
+		return binary.BigEndian.AppendUint64(buf, uint64(v)^(1<<63)), nil
+	case float64:
+		if v == 0 {
+			v = 0 // Fold -0 into +0
+		}
+		bits := math.Float64bits(v)
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		buf = append(buf, keyFloat)
+		return binary.BigEndian.AppendUint64(buf, bits), nil
+	case string:
+		buf = appendEscaped(append(buf, keyString), []byte(v))
+		return append(buf, 0x00, 0x01), nil
+	case []byte:
+		buf = appendEscaped(append(buf, keyBytes), v)
+		return append(buf, 0x00, 0x01), nil
+	case bool:
+		if v {
+			return append(buf, keyBool, 1), nil
+		}
+		return append(buf, keyBool, 0), nil
+	case time.Time:
+		// Seconds then nanoseconds, as UnixNano only covers 1678 to 2262
+		buf = append(buf, keyTime)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(v.Unix())^(1<<63))
+		return binary.BigEndian.AppendUint32(buf, uint32(v.Nanosecond())), nil
+	}
+	return nil, fmt.Errorf("cannot index value of type %T", value)
+}
+
+// appendPrefix encodes a string prefix without its terminator, so every
+// value starting with prefix has an encoding starting with the result
+func appendPrefix(buf []byte, columnType ColumnType, prefix string) []byte {
+	tag := byte(keyString)
+	if columnType == TypeBytes {
+		tag = keyBytes
+	}
+	return appendEscaped(append(buf, tag), []byte(prefix))
+}
+
+// appendEscaped writes b with 0x00 escaped as 0x00 0xFF so the 0x00 0x01
+// terminator sorts before any continuation
+func appendEscaped(buf []byte, b []byte) []byte {
+	for _, c := range b {
+		if c == 0x00 {
+			buf = append(buf, 0x00, 0xFF)
+		} else {
+			buf = append(buf, c)
+		}
+	}
+	return buf
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or nil if there is none
+func prefixEnd(prefix []byte) []byte {
+	end := slices.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// checkUnique reports whether applying writes (a nil row is a delete) would
+// give two records the same key in a unique index. The caller must hold t.mu.
+func (t *Table) checkUnique(writes map[any]Record) error {
+	for _, idx := range t.indexes {
+		if !idx.spec.Unique {
+			continue
+		}
+		claimed := make(map[string]bool)
+		for pk, row := range writes {
+			if row == nil {
+				continue
+			}
+			key, ok, err := idx.keyFor(row)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			if claimed[key] {
+				return uniqueError(idx, row)
+			}
+			claimed[key] = true
+			for _, holder := range idx.lookup(key) {
+				if _, rewritten := writes[holder]; !rewritten && holder != pk {
+					return uniqueError(idx, row)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// uniqueError describes a row that collides with another in a unique index
+func uniqueError(idx *Index, row Record) error {
+	values := make([]any, len(idx.spec.Columns))
+	for i, column := range idx.spec.Columns {
+		values[i] = row[column]
+	}
+	return &UniqueError{Index: idx.spec.Name, Columns: slices.Clone(idx.spec.Columns), Values: values}
+}
+
+// duplicateKey describes a row whose primary key is already taken
+func (t *Table) duplicateKey(row Record) error {
+	return &UniqueError{Columns: []string{t.schema.PrimaryKey}, Values: []any{row[t.schema.PrimaryKey]}}
+}
+
+// CreateIndexWithSpec creates a possibly unique, ordered or multi-column
+// index on a table
+func (db *Database) CreateIndexWithSpec(ctx context.Context, tableName string, spec IndexSpec) error {
+	table, err := db.lookupTable(tableName)
+	if err != nil {
+		return err
+	}
+	if spec.Name == "" {
+		spec.Name = strings.Join(spec.Columns, ",")
+	}
+	spec.Columns = slices.Clone(spec.Columns)
+
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	if _, exists := table.indexes[spec.Name]; exists {
+		return errors.New("index already exists")
+	}
+	if err := table.buildIndex(spec); err != nil {
+		return err
+	}
+	if err := db.logMutation(walEntry{Op: opCreateIndex, Table: tableName, Index: &spec}); err != nil {
+		delete(table.indexes, spec.Name)
+		return err
+	}
+	return nil
+}
+
+// buildIndex creates an index and fills it from every record. The caller
+// must hold t.mu.
+func (t *Table) buildIndex(spec IndexSpec) error {
+	idx, err := newIndex(spec, t.schema)
+	if err != nil {
+		return err
+	}
+	var failed error
+	err = t.engine.Scan(func(pk any, vRecord VersionedRecord) bool {
+		if spec.FullText {
+			idx.addText(pk, vRecord.Record)
+			return true
+		}
+		key, ok, err := idx.keyFor(vRecord.Record)
+		if err != nil {
+			failed = err
+			return false
+		}
+		if !ok {
+			return true
+		}
+		if spec.Unique && len(idx.lookup(key)) > 0 {
+			failed = uniqueError(idx, vRecord.Record)
+			return false
+		}
+		idx.add(key, pk)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if failed != nil {
+		return failed
+	}
+	t.indexes[spec.Name] = idx
+	return nil
+}
+
+// Indexes returns the specs of every index on a table
+func (db *Database) Indexes(tableName string) ([]IndexSpec, error) {
+	table, err := db.lookupTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	specs := make([]IndexSpec, 0, len(table.indexes))
+	for _, idx := range table.indexes {
+		specs = append(specs, idx.spec)
+	}
+	slices.SortFunc(specs, func(a, b IndexSpec) int { return strings.Compare(a.Name, b.Name) })
+	return specs, nil
+}
+
+// Scan returns the records matching r on the named index, in index order
+func (db *Database) Scan(ctx context.Context, tableName string, indexName string, r Range) ([]Record, error) {
+	table, err := db.lookupTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	idx, exists := table.indexes[indexName]
+	if !exists {
+		return nil, errors.New("index does not exist")
+	}
+
+	var records []Record
+	var readErr error
+	now := time.Now()
+	err = idx.scan(r, func(pks []any) bool {
+		for _, pk := range pks {
+			vRecord, exists, err := table.engine.Get(pk)
+			if err != nil {
+				readErr = err
+				return false
+			}
+			if exists && !table.expired(vRecord.Record, now) {
+				records = append(records, vRecord.Record.clone())
+			}
+		}
+		return ctx.Err() == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	return records, ctx.Err()
+}
+
+// QueryRange returns records whose column lies between lower and upper using
+// an ordered index on that column. A nil bound leaves that end open.
+func (db *Database) QueryRange(ctx context.Context, tableName string, columnName string, lower, upper *Bound) ([]Record, error) {
+	name, err := db.indexOn(tableName, columnName)
+	if err != nil {
+		return nil, err
+	}
+	return db.Scan(ctx, tableName, name, Range{Lower: lower, Upper: upper})
+}
+
+// QueryPrefix returns records whose string column starts with prefix using an
+// ordered index on that column
+func (db *Database) QueryPrefix(ctx context.Context, tableName string, columnName string, prefix string) ([]Record, error) {
+	name, err := db.indexOn(tableName, columnName)
+	if err != nil {
+		return nil, err
+	}
+	return db.Scan(ctx, tableName, name, Range{Prefix: &prefix})
+}
+
+// indexOn returns the name of an index whose only column is columnName,
+// preferring an ordered one
+func (db *Database) indexOn(tableName string, columnName string) (string, error) {
+	specs, err := db.Indexes(tableName)
+	if err != nil {
+		return "", err
+	}
+	name := ""
+	for _, spec := range specs {
+		if len(spec.Columns) == 1 && spec.Columns[0] == columnName && !spec.FullText && (name == "" || spec.Ordered) {
+			name = spec.Name
+		}
+	}
+	if name == "" {
+		return "", errors.New("index does not exist")
+	}
+	return name, nil
+}
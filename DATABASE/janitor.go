@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// janitorBatch is the number of expired rows deleted per logged batch, so a
+// table is never write-locked for long
+const janitorBatch = 1000
+
+// JanitorStats reports what the janitor has reclaimed since the database was
+// opened
+type JanitorStats struct {
+	Passes         uint64
+	RowsExpired    uint64 // Rows deleted because their TTL passed
+	VersionsPurged uint64 // Superseded row versions no open transaction can see
+	LastPass       time.Time
+	LastDuration   time.Duration
+	LastErr        error // Why the last pass stopped early, nil if it finished
+}
+
+// JanitorStats returns the janitor counters
+func (db *Database) JanitorStats() JanitorStats {
+	db.janitorMu.Lock()
+	defer db.janitorMu.Unlock()
+	return db.janitor
+}
+
+// SetTTL changes when rows of a table expire. A nil ttl stops rows from
+// expiring.
+func (db *Database) SetTTL(ctx context.Context, tableName string, ttl *TTL) error {
+	table, err := db.lookupTable(tableName)
+	if err != nil {
+		return err
+	}
+	if ttl != nil {
+		if ttl, err = table.schema.checkTTL(*ttl); err != nil {
+			return err
+		}
+	}
+
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	if err := db.logMutation(walEntry{Op: opSetTTL, Table: tableName, TTL: ttl}); err != nil {
+		return err
+	}
+	table.ttl = ttl
+	return nil
+}
+
+// Compact deletes every row whose TTL has passed and purges the row versions
+// no open transaction can see any more. Expired rows are deleted like any
+// other write: they are logged, published as change events and conflict
+// with transactions that modified them. It returns how many rows expired and
+// how many versions were purged. A replica only purges; its rows expire when
+// the primary's deletes arrive.
+func (db *Database) Compact(ctx context.Context) (expired, purged int, err error) {
+	start := time.Now()
+	defer func() {
+		db.janitorMu.Lock()
+		db.janitor.Passes++
+		db.janitor.RowsExpired += uint64(expired)
+		db.janitor.VersionsPurged += uint64(purged)
+		db.janitor.LastPass = start
+		db.janitor.LastDuration = time.Since(start)
+		db.janitor.LastErr = err
+		db.janitorMu.Unlock()
+	}()
+
+	for _, name := range db.Tables() {
+		if err := ctx.Err(); err != nil {
+			return expired, purged, err
+		}
+		table, err := db.lookupTable(name)
+		if err != nil {
+			continue // Dropped meanwhile
+		}
+		if !db.isReplica() {
+			n, err := db.expire(ctx, name, table, start)
+			expired += n
+			if err != nil {
+				return expired, purged, fmt.Errorf("table %s: %w", name, err)
+			}
+		}
+		n, err := table.purgeHistory(db.oldestSnapshot())
+		purged += n
+		if err != nil {
+			return expired, purged, fmt.Errorf("table %s: %w", name, err)
+		}
+	}
+	return expired, purged, nil
+}
+
+// StartJanitor runs Compact every interval until Close. Failed passes are
+// reported by JanitorStats.
+func (db *Database) StartJanitor(interval time.Duration) {
+	db.wg.Add(1)
+	go func() {
+		defer db.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-db.stop:
+				return
+			case <-ticker.C:
+				db.Compact(context.Background())
+			}
+		}
+	}()
+}
+
+// expire deletes the rows of a table that expired by now. Candidates are
+// found under the read lock and checked again under the write lock, since
+// they may have been updated or deleted in between.
+func (db *Database) expire(ctx context.Context, name string, table *Table, now time.Time) (int, error) {
+	var keys []any
+	table.mu.RLock()
+	ttl := table.ttl
+	err := table.engine.Scan(func(key any, vRecord VersionedRecord) bool {
+		if at, ok := ttl.expiresAt(vRecord.Record); ok && !now.Before(at) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	table.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+
+	expireBatch := db.expireBatch
+	if db.referenced(name) {
+		expireBatch = db.expireReferenced
+	}
+	expired := 0
+	for len(keys) > 0 {
+		if err := ctx.Err(); err != nil {
+			return expired, err
+		}
+		n := min(len(keys), janitorBatch)
+		deleted, err := expireBatch(name, table, keys[:n], now)
+		expired += deleted
+		if err != nil {
+			return expired, err
+		}
+		keys = keys[n:]
+	}
+	return expired, nil
+}
+
+// expireBatch deletes the given rows that are still expired as one logged
+// commit
+func (db *Database) expireBatch(name string, table *Table, keys []any, now time.Time) (int, error) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	var batch []walEntry
+	for _, key := range keys {
+		vRecord, exists, err := table.engine.Get(key)
+		if err != nil {
+			return 0, err
+		}
+		if at, ok := table.ttl.expiresAt(vRecord.Record); exists && ok && !now.Before(at) {
+			batch = append(batch, walEntry{Op: opDelete, Table: name, Key: key, Old: vRecord.Record})
+		}
+	}
+	if len(batch) == 0 {
+		return 0, nil
+	}
+
+	version, keepHistory, done, err := db.logWrite(walEntry{Op: opCommit, Batch: batch})
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	for _, entry := range batch {
+		if err := table.remove(entry.Key, version, keepHistory); err != nil {
+			return 0, db.storageFailure(err)
+		}
+	}
+	return len(batch), nil
+}
+
+// expireReferenced deletes the given rows that are still expired from a
+// table other tables reference, one transaction each so that the ON DELETE
+// action of every reference applies. Rows still referenced under RESTRICT
+// are kept until their references are gone.
+func (db *Database) expireReferenced(name string, table *Table, keys []any, now time.Time) (int, error) {
+	table.mu.RLock()
+	ttl := table.ttl
+	table.mu.RUnlock()
+
+	expired := 0
+	for _, key := range keys {
+		deleted := false
+		err := db.transact(context.Background(), func(tx *Transaction) error {
+			row, exists := tx.Get(name, key)
+			if at, ok := ttl.expiresAt(row); !exists || !ok || now.Before(at) {
+				deleted = false
+				return nil
+			}
+			deleted = true
+			return tx.Delete(name, key)
+		})
+		var fkErr *ForeignKeyError
+		switch {
+		case errors.As(err, &fkErr) && fkErr.Referenced:
+		case err != nil:
+			return expired, err
+		case deleted:
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+// oldestSnapshot returns the version the oldest open transaction reads at,
+// or the last committed version if none is open
+func (db *Database) oldestSnapshot() int {
+	db.txMu.Lock()
+	defer db.txMu.Unlock()
+	oldest := db.version
+	for tx := range db.active {
+		oldest = min(oldest, tx.startVersion)
+	}
+	return oldest
+}
+
+// purgeHistory drops the superseded versions that no snapshot at or after
+// oldest can see and returns how many it dropped. A snapshot sees the newest
+// version at or below its own, so for each row only that version as of
+// oldest and the ones after it are kept.
+func (t *Table) purgeHistory(oldest int) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	purged := 0
+	for key, history := range t.history {
+		current, exists, err := t.engine.Get(key)
+		if err != nil {
+			return purged, err
+		}
+		keep := 0 // Index of the first version to keep
+		if exists && current.Version <= oldest {
+			keep = len(history)
+		} else {
+			for i, vRecord := range history {
+				if vRecord.Version <= oldest {
+					keep = i
+				}
+			}
+			// A tombstone every snapshot sees reads the same as no version
+			if keep < len(history) && history[keep].Deleted && history[keep].Version <= oldest {
+				keep++
+			}
+		}
+		if keep == 0 {
+			continue
+		}
+		purged += keep
+		if keep == len(history) {
+			delete(t.history, key)
+		} else {
+			t.history[key] = append([]VersionedRecord(nil), history[keep:]...)
+		}
+	}
+	return purged, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Rows disappear from every read path as soon as their TTL passes, before
+// the janitor has deleted them
+func TestExpiredRowsInvisible(t *testing.T) {
+	ctx := context.Background()
+	db := NewDatabase()
+	schema := Schema{
+		Columns: []Column{
+			{Name: "id", Type: TypeInt},
+			{Name: "name", Type: TypeString},
+			{Name: "expires_at", Type: TypeTime},
+		},
+		PrimaryKey: "id",
+		TTL:        &TTL{Column: "expires_at"},
+	}
+	if err := db.CreateTable("sessions", schema); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateIndex(ctx, "sessions", "name"); err != nil {
+		t.Fatal(err)
+	}
+	expiry := time.Now().Add(50 * time.Millisecond)
+	for id, at := range map[int64]time.Time{1: expiry, 2: expiry.Add(time.Hour)} {
+		if err := db.Insert(ctx, "sessions", Record{"id": id, "name": "alice", "expires_at": at}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, found := db.Get(ctx, "sessions", int64(1)); !found {
+		t.Fatal("row 1 not visible before it expired")
+	}
+
+	time.Sleep(time.Until(expiry) + 10*time.Millisecond)
+
+	if _, found := db.Get(ctx, "sessions", int64(1)); found {
+		t.Error("Get returned an expired row")
+	}
+	if rows, err := db.List(ctx, "sessions"); err != nil || len(rows) != 1 {
+		t.Errorf("List = %d rows, %v; want 1", len(rows), err)
+	}
+	if rows, err := db.Query(ctx, "sessions", "name", "alice"); err != nil || len(rows) != 1 {
+		t.Errorf("Query = %d rows, %v; want 1", len(rows), err)
+	}
+
+	tx, err := db.BeginTransaction(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := tx.Get("sessions", int64(1)); found {
+		t.Error("transaction Get returned an expired row")
+	}
+	if rows, err := tx.List("sessions"); err != nil || len(rows) != 1 {
+		t.Errorf("transaction List = %d rows, %v; want 1", len(rows), err)
+	}
+	tx.Rollback()
+
+	for _, query := range []string{
+		"SELECT id FROM sessions",
+		"SELECT id FROM sessions WHERE id IN (1, 2)",
+		"SELECT id FROM sessions WHERE name = 'alice'",
+	} {
+		result, err := db.Exec(ctx, query)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		if len(result.Rows) != 1 || result.Rows[0][0] != int64(2) {
+			t.Errorf("%s = %v, want [[2]]", query, result.Rows)
+		}
+	}
+
+	// The expired row's key is free for a new row
+	if err := db.Insert(ctx, "sessions", Record{"id": int64(1), "name": "bob", "expires_at": expiry.Add(time.Hour)}); err != nil {
+		t.Fatalf("Insert over an expired row: %v", err)
+	}
+	if row, found := db.Get(ctx, "sessions", int64(1)); !found || row["name"] != "bob" {
+		t.Errorf("Get = %v, %v; want the new row", row, found)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+const maxHistory = 1000 // Lines kept in the shell history
+
+// errInterrupt is returned by readLine when the user presses Ctrl-C
+var errInterrupt = errors.New("interrupted")
+
+// lineEditor reads lines from a terminal with Emacs-style editing keys and
+// history. If the terminal cannot be switched to raw mode it reads plain
+// lines instead.
+type lineEditor struct {
+	in      *bufio.Reader
+	out     io.Writer
+	fd      int
+	history []string
+	file    string // History file, empty for none
+}
+
+func newLineEditor(in *os.File, out io.Writer, historyFile string) *lineEditor {
+	e := &lineEditor{in: bufio.NewReader(in), out: out, fd: int(in.Fd()), file: historyFile}
+	if data, err := os.ReadFile(historyFile); err == nil {
+		for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+			if line != "" {
+				e.history = append(e.history, line)
+			}
+		}
+		if len(e.history) > maxHistory {
+			e.history = e.history[len(e.history)-maxHistory:]
+		}
+	}
+	return e
+}
+
+// addHistory remembers line, appending it to the history file
+func (e *lineEditor) addHistory(line string) {
+	line = strings.Join(strings.Fields(line), " ")
+	if line == "" || len(e.history) > 0 && e.history[len(e.history)-1] == line {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > maxHistory {
+		e.history = e.history[len(e.history)-maxHistory:]
+	}
+	if e.file == "" {
+		return
+	}
+	if file, err := os.OpenFile(e.file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err == nil {
+		fmt.Fprintln(file, line)
+		file.Close()
+	}
+}
+
+// readLine prints prompt and reads one line. It returns io.EOF for Ctrl-D
+// on an empty line and errInterrupt for Ctrl-C.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	restore, err := makeRaw(e.fd)
+	if err != nil {
+		fmt.Fprint(e.out, prompt)
+		line, err := e.in.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	defer restore()
+
+	var buf, saved []rune
+	cursor, pos := 0, len(e.history) // pos is the history entry being shown
+	refresh := func() {
+		fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(buf))
+		if back := len(buf) - cursor; back > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", back)
+		}
+	}
+	recall := func(i int) {
+		if pos == len(e.history) {
+			saved = buf
+		}
+		pos = i
+		if pos == len(e.history) {
+			buf = saved
+		} else {
+			buf = []rune(e.history[pos])
+		}
+		cursor = len(buf)
+	}
+	refresh()
+
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(buf), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupt
+		case 4: // Ctrl-D
+			if len(buf) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			if cursor < len(buf) {
+				buf = append(buf[:cursor:cursor], buf[cursor+1:]...)
+			}
+		case 127, 8: // Backspace
+			if cursor > 0 {
+				buf = append(buf[:cursor-1:cursor-1], buf[cursor:]...)
+				cursor--
+			}
+		case 1: // Ctrl-A
+			cursor = 0
+		case 5: // Ctrl-E
+			cursor = len(buf)
+		case 2: // Ctrl-B
+			cursor = max(cursor-1, 0)
+		case 6: // Ctrl-F
+			cursor = min(cursor+1, len(buf))
+		case 11: // Ctrl-K
+			buf = buf[:cursor:cursor]
+		case 21: // Ctrl-U
+			buf, cursor = append([]rune(nil), buf[cursor:]...), 0
+		case 23: // Ctrl-W
+			start := cursor
+			for start > 0 && unicode.IsSpace(buf[start-1]) {
+				start--
+			}
+			for start > 0 && !unicode.IsSpace(buf[start-1]) {
+				start--
+			}
+			buf = append(buf[:start:start], buf[cursor:]...)
+			cursor = start
+		case 16: // Ctrl-P
+			if pos > 0 {
+				recall(pos - 1)
+			}
+		case 14: // Ctrl-N
+			if pos < len(e.history) {
+				recall(pos + 1)
+			}
+		case 12: // Ctrl-L
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+		case 27:
+			switch e.escape() {
+			case "A":
+				if pos > 0 {
+					recall(pos - 1)
+				}
+			case "B":
+				if pos < len(e.history) {
+					recall(pos + 1)
+				}
+			case "C":
+				cursor = min(cursor+1, len(buf))
+			case "D":
+				cursor = max(cursor-1, 0)
+			case "H", "1~", "7~":
+				cursor = 0
+			case "F", "4~", "8~":
+				cursor = len(buf)
+			case "3~":
+				if cursor < len(buf) {
+					buf = append(buf[:cursor:cursor], buf[cursor+1:]...)
+				}
+			}
+		default:
+			if unicode.IsPrint(r) {
+				buf = append(buf[:cursor:cursor], append([]rune{r}, buf[cursor:]...)...)
+				cursor++
+			}
+		}
+		refresh()
+	}
+}
+
+// escape reads the rest of an escape sequence and returns its final part,
+// such as "A" for the up arrow or "3~" for delete
+func (e *lineEditor) escape() string {
+	r, _, err := e.in.ReadRune()
+	if err != nil || r != '[' && r != 'O' {
+		return ""
+	}
+	var seq []rune
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return ""
+		}
+		seq = append(seq, r)
+		if (r < '0' || r > '9') && r != ';' {
+			return string(seq)
+		}
+	}
+}
@@ -2,324 +2,466 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
-// Record represents a single row in the database
-type Record struct {
-	ID    int
-	Name  string
-	Value string
-}
+// Record represents a single row in the database, keyed by column name.
+// Values are int64, float64, string, bool, time.Time, []byte or nil for NULL.
+type Record map[string]any
 
-// VersionedRecord represents a record with a version for MVCC
+// VersionedRecord represents a record with a version for MVCC. Version is the
+// database-wide commit version that wrote it.
 type VersionedRecord struct {
 	Record  Record
 	Version int
+	Deleted bool `json:",omitempty"`
 }
 
-// Table represents a database table
+// Table represents a database table. The engine holds the newest version of
+// each record, keyed by primary key.
 type Table struct {
-	records map[int]VersionedRecord
-	indexes map[string]map[string]int
+	schema  Schema
+	ttl     *TTL // Current TTL; schema.TTL is the one the table was created with
+	engine  Engine
+	history map[any][]VersionedRecord // Superseded versions still visible to open transactions
+	indexes map[string]*Index         // Keyed by index name
+	mods    int                       // Count of row changes, for stale statistics
+	cache   *rowCache                 // Shared read cache, invalidated by put and remove
 	mu      sync.RWMutex
+
+	stats      TableStats // Planner statistics as of statsMods
+	statsMods  int
+	statsValid bool
+	statsMu    sync.Mutex
 }
 
 // Database represents an in-memory database
 type Database struct {
 	tables map[string]*Table
-	cache  map[string]Record
+	cache  *rowCache
 	mu     sync.RWMutex
+
+	// MVCC
+	version int // Last committed version
+	active  map[*Transaction]struct{}
+	failed  error // Set when a logged write could not be applied
+	txMu    sync.Mutex
+
+	// Change data capture
+	feed  *changeFeed
+	logMu sync.Mutex // Orders logged writes, see logWrite
+
+	janitor   JanitorStats
+	janitorMu sync.Mutex
+
+	// Replication
+	ship    *shipLog // Recent entries for replicas of this database
+	replica *Replica // Set while following a primary, guarded by txMu
+
+	// Durability, set by OpenDatabase
+	dir       string
+	archive   string   // Receives wal segments at checkpoints, if set
+	keys      *Keyring // Encrypts every file written, if set
+	wal       *WAL
+	engine    EngineKind
+	pager     *pager // nil unless engine is DiskEngine
+	stop      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+
+	checkpointErr error // Last background checkpoint failure, not yet reported
+	checkpointMu  sync.Mutex
+
+	rotation   KeyRotation // Progress of re-encryption with a new key
+	rekeyAgain bool        // Set when the key changes during a rotation
+	rekeyMu    sync.Mutex
 }
 
 // NewDatabase creates a new database
 func NewDatabase() *Database {
 	return &Database{
 		tables: make(map[string]*Table),
-		cache:  make(map[string]Record),
+		cache:  newRowCache(DefaultCacheSize),
+		active: make(map[*Transaction]struct{}),
+		feed:   newChangeFeed(DefaultChangeRetention),
+		ship:   newShipLog(DefaultReplicationRetention),
+		stop:   make(chan struct{}),
+	}
+}
+
+// newEngine returns an empty engine of the database's kind
+func (db *Database) newEngine(schema Schema) Engine {
+	if db.pager != nil {
+		return newDiskEngine(db.pager, schema)
 	}
+	return newMemoryEngine()
+}
+
+// newTable creates a table with a prepared schema stored in engine. The
+// indexes enforcing its unique constraints start empty; callers loading rows
+// into engine rebuild them with the table's other indexes.
+func (db *Database) newTable(schema Schema, engine Engine) *Table {
+	t := &Table{
+		schema:  schema,
+		ttl:     schema.TTL,
+		engine:  engine,
+		cache:   db.cache,
+		history: make(map[any][]VersionedRecord),
+		indexes: make(map[string]*Index),
+	}
+	for _, spec := range schema.uniqueSpecs() {
+		// prepare has checked the columns, so this cannot fail
+		if idx, err := newIndex(spec, schema); err == nil {
+			t.indexes[spec.Name] = idx
+		}
+	}
+	return t
 }
 
 // CreateTable creates a new table in the database
-func (db *Database) CreateTable(name string) {
+func (db *Database) CreateTable(name string, schema Schema) error {
+	schema, err := schema.prepare()
+	if err != nil {
+		return err
+	}
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	db.tables[name] = &Table{
-		records: make(map[int]VersionedRecord),
-		indexes: make(map[string]map[string]int),
+	if _, exists := db.tables[name]; exists {
+		return errors.New("table already exists")
+	}
+	if err := db.checkReferences(name, schema); err != nil {
+		return err
+	}
+	if err := db.logMutation(walEntry{Op: opCreateTable, Table: name, Schema: &schema}); err != nil {
+		return err
+	}
+	db.tables[name] = db.newTable(schema, db.newEngine(schema))
+	return nil
+}
+
+// Schema returns the schema of a table, with its current TTL
+func (db *Database) Schema(tableName string) (Schema, error) {
+	table, err := db.lookupTable(tableName)
+	if err != nil {
+		return Schema{}, err
+	}
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	return table.currentSchema(), nil
+}
+
+// currentSchema returns the schema with the current TTL. The caller must
+// hold t.mu.
+func (t *Table) currentSchema() Schema {
+	schema := t.schema
+	schema.TTL = t.ttl
+	return schema
+}
+
+// Tables returns the names of every table, sorted
+func (db *Database) Tables() []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	names := make([]string, 0, len(db.tables))
+	for name := range db.tables {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
 }
 
 // Insert adds a new record to a table
 func (db *Database) Insert(ctx context.Context, tableName string, record Record) error {
-	db.mu.RLock()
-	table, exists := db.tables[tableName]
-	db.mu.RUnlock()
-	if !exists {
-		return errors.New("table does not exist")
+	table, err := db.lookupTable(tableName)
+	if err != nil {
+		return err
+	}
+	if len(table.schema.ForeignKeys) > 0 {
+		return db.transact(ctx, func(tx *Transaction) error { return tx.Insert(tableName, record) })
+	}
+	row, err := table.schema.validate(record)
+	if err != nil {
+		return err
+	}
+	key := table.schema.primaryKey(row)
+
+	if err := table.checkKey(key); err != nil {
+		return err
 	}
 
 	table.mu.Lock()
 	defer table.mu.Unlock()
-	table.records[record.ID] = VersionedRecord{Record: record, Version: 1}
-	for _, index := range table.indexes {
-		index[record.Name] = record.ID
+	old, exists, err := table.engine.Get(key)
+	if err != nil {
+		return err
+	}
+	if exists && !table.expired(old.Record, time.Now()) {
+		return table.duplicateKey(row)
+	}
+	if err := table.checkUnique(map[any]Record{key: row}); err != nil {
+		return err
+	}
+	version, keepHistory, done, err := db.logWrite(walEntry{Op: opInsert, Table: tableName, Key: key, Record: row})
+	if err != nil {
+		return err
+	}
+	defer done()
+	if err := table.put(key, row, version, keepHistory); err != nil {
+		return db.storageFailure(err)
 	}
 	return nil
 }
 
-// Get retrieves a record by ID from a table, using cache if available
-func (db *Database) Get(ctx context.Context, tableName string, id int) (Record, bool) {
-	cacheKey := fmt.Sprintf("%s:%d", tableName, id)
-	if record, found := db.cache[cacheKey]; found {
-		return record, true
+// Get retrieves a record by primary key from a table, using the read cache
+// if available
+func (db *Database) Get(ctx context.Context, tableName string, id any) (Record, bool) {
+	table, err := db.lookupTable(tableName)
+	if err != nil {
+		return nil, false
 	}
-
-	db.mu.RLock()
-	table, exists := db.tables[tableName]
-	db.mu.RUnlock()
-	if !exists {
-		return Record{}, false
+	key, err := table.schema.normalizeKey(id)
+	if err != nil {
+		return nil, false
 	}
 
+	// Fill the cache under the read lock so a concurrent write, which
+	// invalidates under the write lock, cannot be overtaken by a stale row
 	table.mu.RLock()
 	defer table.mu.RUnlock()
-	vRecord, exists := table.records[id]
-	if exists {
-		db.cache[cacheKey] = vRecord.Record // Add to cache
+	cacheKey := cacheKey{table: table, key: key}
+	if record, found := db.cache.get(cacheKey); found {
+		if table.expired(record, time.Now()) {
+			return nil, false
+		}
+		return record.clone(), true
+	}
+
+	vRecord, exists, err := table.engine.Get(key)
+	if err != nil || !exists || table.expired(vRecord.Record, time.Now()) {
+		return nil, false
 	}
-	return vRecord.Record, exists
+	db.cache.add(cacheKey, vRecord.Record)
+	return vRecord.Record.clone(), true
 }
 
-// Update modifies an existing record in a table
-func (db *Database) Update(ctx context.Context, tableName string, id int, newRecord Record) error {
-	db.mu.RLock()
-	table, exists := db.tables[tableName]
-	db.mu.RUnlock()
-	if !exists {
-		return errors.New("table does not exist")
+// Update modifies the given columns of an existing record in a table
+func (db *Database) Update(ctx context.Context, tableName string, id any, changes Record) error {
+	table, err := db.lookupTable(tableName)
+	if err != nil {
+		return err
+	}
+	if len(table.schema.ForeignKeys) > 0 {
+		return db.transact(ctx, func(tx *Transaction) error { return tx.Update(tableName, id, changes) })
+	}
+	key, err := table.schema.normalizeKey(id)
+	if err != nil {
+		return err
 	}
 
 	table.mu.Lock()
 	defer table.mu.Unlock()
-	vRecord, exists := table.records[id]
-	if !exists {
-		return errors.New("record does not exist")
+	vRecord, exists, err := table.engine.Get(key)
+	if err != nil {
+		return err
 	}
-	newVersion := vRecord.Version + 1
-	table.records[id] = VersionedRecord{Record: newRecord, Version: newVersion}
-	for _, index := range table.indexes {
-		index[newRecord.Name] = newRecord.ID
+	if !exists || table.expired(vRecord.Record, time.Now()) {
+		return ErrNoRecord
+	}
+	row, err := table.schema.merge(vRecord.Record, changes)
+	if err != nil {
+		return err
+	}
+	if err := table.checkUnique(map[any]Record{key: row}); err != nil {
+		return err
+	}
+	version, keepHistory, done, err := db.logWrite(walEntry{Op: opUpdate, Table: tableName, Key: key, Record: row, Old: vRecord.Record})
+	if err != nil {
+		return err
+	}
+	defer done()
+	if err := table.put(key, row, version, keepHistory); err != nil {
+		return db.storageFailure(err)
 	}
 	return nil
 }
 
-// Delete removes a record by ID from a table
-func (db *Database) Delete(ctx context.Context, tableName string, id int) error {
-	db.mu.RLock()
-	table, exists := db.tables[tableName]
-	db.mu.RUnlock()
-	if !exists {
-		return errors.New("table does not exist")
+// Delete removes a record by primary key from a table
+func (db *Database) Delete(ctx context.Context, tableName string, id any) error {
+	table, err := db.lookupTable(tableName)
+	if err != nil {
+		return err
+	}
+	if db.referenced(tableName) {
+		return db.transact(ctx, func(tx *Transaction) error { return tx.Delete(tableName, id) })
+	}
+	key, err := table.schema.normalizeKey(id)
+	if err != nil {
+		return err
 	}
 
 	table.mu.Lock()
 	defer table.mu.Unlock()
-	vRecord, exists := table.records[id]
-	if !exists {
-		return errors.New("record does not exist")
+	vRecord, exists, err := table.engine.Get(key)
+	if err != nil {
+		return err
+	}
+	if !exists || table.expired(vRecord.Record, time.Now()) {
+		return ErrNoRecord
+	}
+	version, keepHistory, done, err := db.logWrite(walEntry{Op: opDelete, Table: tableName, Key: key, Old: vRecord.Record})
+	if err != nil {
+		return err
 	}
-	delete(table.records, id)
-	for _, index := range table.indexes {
-		delete(index, vRecord.Record.Name)
+	defer done()
+	if err := table.remove(key, version, keepHistory); err != nil {
+		return db.storageFailure(err)
 	}
 	return nil
 }
 
-// List returns all records in a table
+// List returns all records in a table, ordered by primary key
 func (db *Database) List(ctx context.Context, tableName string) ([]Record, error) {
-	db.mu.RLock()
-	table, exists := db.tables[tableName]
-	db.mu.RUnlock()
-	if !exists {
-		return nil, errors.New("table does not exist")
+	table, err := db.lookupTable(tableName)
+	if err != nil {
+		return nil, err
 	}
 
 	table.mu.RLock()
 	defer table.mu.RUnlock()
-	records := make([]Record, 0, len(table.records))
-	for _, vRecord := range table.records {
-		records = append(records, vRecord.Record)
+	records := make([]Record, 0, table.engine.Len())
+	now := time.Now()
+	err = table.engine.Scan(func(key any, vRecord VersionedRecord) bool {
+		if !table.expired(vRecord.Record, now) {
+			records = append(records, vRecord.Record.clone())
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
+	sortByColumn(records, table.schema.PrimaryKey)
 	return records, nil
 }
 
-// CreateIndex creates an index on a column in a table
+// CreateIndex creates a non-unique index on a column in a table
 func (db *Database) CreateIndex(ctx context.Context, tableName string, columnName string) error {
-	db.mu.RLock()
-	table, exists := db.tables[tableName]
-	db.mu.RUnlock()
-	if !exists {
-		return errors.New("table does not exist")
-	}
-
-	table.mu.Lock()
-	defer table.mu.Unlock()
-	index := make(map[string]int)
-	for _, vRecord := range table.records {
-		index[vRecord.Record.Name] = vRecord.Record.ID
-	}
-	table.indexes[columnName] = index
-	return nil
+	return db.CreateIndexWithSpec(ctx, tableName, IndexSpec{Columns: []string{columnName}})
 }
 
-// Query retrieves records from a table based on a column value
-func (db *Database) Query(ctx context.Context, tableName string, columnName string, value string) ([]Record, error) {
-	db.mu.RLock()
-	table, exists := db.tables[tableName]
-	db.mu.RUnlock()
-	if !exists {
-		return nil, errors.New("table does not exist")
-	}
-
-	table.mu.RLock()
-	defer table.mu.RUnlock()
-	index, exists := table.indexes[columnName]
-	if !exists {
-		return nil, errors.New("index does not exist")
+// Query retrieves every record from a table whose column equals value, using
+// an index on that column
+func (db *Database) Query(ctx context.Context, tableName string, columnName string, value any) ([]Record, error) {
+	name, err := db.indexOn(tableName, columnName)
+	if err != nil {
+		return nil, err
 	}
-
-	recordID, exists := index[value]
-	if !exists {
-		return nil, errors.New("record not found")
+	records, err := db.Scan(ctx, tableName, name, Range{Equal: []any{value}})
+	if err != nil {
+		return nil, err
 	}
-
-	vRecord, exists := table.records[recordID]
-	if !exists {
+	if len(records) == 0 {
 		return nil, errors.New("record not found")
 	}
-
-	return []Record{vRecord.Record}, nil
+	return records, nil
 }
 
 // Save to persist the database to a file
 func (db *Database) Save(filename string) error {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
+	unlock := db.lockTablesForRead()
+	defer unlock()
 
-	file, err := os.Create(filename)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	encoder := json.NewEncoder(file)
-	return encoder.Encode(db.tables)
+	return writeSnapshot(filename, db.buildSnapshot(), db.keys)
 }
 
 // Load to load the database from a file
 func (db *Database) Load(filename string) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	file, err := os.Open(filename)
+	snap, err := readSnapshot(filename, db.keys)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	decoder := json.NewDecoder(file)
-	return decoder.Decode(&db.tables)
-}
-
-// Simple query parser for demonstration purposes
-func (db *Database) QueryAdvanced(ctx context.Context, query string) ([]Record, error) {
-	parts := strings.Fields(query)
-	if len(parts) < 4 || strings.ToLower(parts[0]) != "select" || strings.ToLower(parts[2]) != "from" {
-		return nil, errors.New("invalid query")
-	}
-
-	tableName := parts[3]
-	columnName := parts[1] // Assuming simple select column from table
-	if strings.ToLower(columnName) == "*" {
-		return db.List(ctx, tableName)
-	}
 
-	value := ""
-	if len(parts) > 5 && strings.ToLower(parts[4]) == "where" {
-		value = parts[5] // Assuming where column = value
-	}
-
-	return db.Query(ctx, tableName, columnName, value)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.restoreSnapshot(snap)
 }
 
-// Transaction represents a database transaction
-type Transaction struct {
-	db       *Database
-	table    *Table
-	ctx      context.Context
-	cancel   context.CancelFunc
-	versions map[int]int // Track versions of records in the transaction
+// commands are the subcommands of the program; without one it starts the
+// interactive shell
+var commands = map[string]func(args []string) error{
+	"shell":      runShell,
+	"serve":      runServe,
+	"backup":     runBackup,
+	"restore":    runRestore,
+	"export":     runExport,
+	"import":     runImport,
+	"rotate-key": runRotateKey,
+	"demo":       runDemo,
 }
 
-// BeginTransaction starts a new transaction
-func (db *Database) BeginTransaction(ctx context.Context, tableName string) (*Transaction, error) {
-	db.mu.RLock()
-	table, exists := db.tables[tableName]
-	db.mu.RUnlock()
-	if !exists {
-		return nil, errors.New("table does not exist")
+func main() {
+	name, args := "shell", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
 	}
-
-	ctx, cancel := context.WithCancel(ctx)
-	return &Transaction{db: db, table: table, ctx: ctx, cancel: cancel, versions: make(map[int]int)}, nil
-}
-
-// Get retrieves a record by ID within a transaction
-func (tx *Transaction) Get(id int) (Record, bool) {
-	tx.table.mu.RLock()
-	defer tx.table.mu.RUnlock()
-	vRecord, exists := tx.table.records[id]
-	if !exists {
-		return Record{}, false
+	run, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
+		os.Exit(2)
 	}
-	if tx.versions[id] > 0 && tx.versions[id] != vRecord.Version {
-		return Record{}, false
+	if err := run(args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s error: %v\n", name, err)
+		os.Exit(1)
 	}
-	return vRecord.Record, true
-}
-
-// Commit commits the transaction
-func (tx *Transaction) Commit() {
-	tx.cancel()
 }
 
-// Rollback rolls back the transaction
-func (tx *Transaction) Rollback() {
-	tx.cancel()
-}
-
-func main() {
-	db := NewDatabase()
+// runDemo walks through the API on the database in ./data
+func runDemo(args []string) error {
+	db, err := OpenDatabase("data")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	db.StartCheckpointer(time.Minute)
 
 	// Create a table
-	db.CreateTable("users")
+	err = db.CreateTable("users", Schema{
+		Columns: []Column{
+			{Name: "id", Type: TypeInt},
+			{Name: "name", Type: TypeString},
+			{Name: "value", Type: TypeString, Nullable: true},
+			{Name: "active", Type: TypeBool, Default: true},
+			{Name: "created", Type: TypeTime, Nullable: true},
+		},
+		PrimaryKey: "id",
+	})
+	if err != nil {
+		fmt.Println("Create table error:", err)
+	}
 
 	// Insert records
 	ctx := context.Background()
-	db.Insert(ctx, "users", Record{ID: 1, Name: "Alice", Value: "Value1"})
-	db.Insert(ctx, "users", Record{ID: 2, Name: "Bob", Value: "Value2"})
+	db.Insert(ctx, "users", Record{"id": 1, "name": "Alice", "value": "Value1", "created": time.Now()})
+	db.Insert(ctx, "users", Record{"id": 2, "name": "Bob", "value": "Value2"})
 
-	// Create an index on the Name column
-	db.CreateIndex(ctx, "users", "Name")
+	// Rows are validated against the schema
+	if err := db.Insert(ctx, "users", Record{"id": "three", "name": "Eve"}); err != nil {
+		fmt.Println("Insert error:", err)
+	}
 
-	// Query a record by Name
-	records, err := db.Query(ctx, "users", "Name", "Alice")
+	// Create an index on the name column
+	db.CreateIndex(ctx, "users", "name")
+
+	// Query a record by name
+	records, err := db.Query(ctx, "users", "name", "Alice")
 	if err != nil {
 		fmt.Println("Query error:", err)
 	} else {
@@ -335,7 +477,7 @@ func main() {
 	}
 
 	// Update a record
-	err = db.Update(ctx, "users", 1, Record{ID: 1, Name: "AliceUpdated", Value: "UpdatedValue1"})
+	err = db.Update(ctx, "users", 1, Record{"name": "AliceUpdated", "value": "UpdatedValue1"})
 	if err != nil {
 		fmt.Println("Update error:", err)
 	} else {
@@ -372,21 +514,61 @@ func main() {
 		}
 	}
 
+	// Run SQL with positional parameters
+	_, err = db.Exec(ctx, "INSERT INTO users (id, name, value) VALUES ($1, $2, $3), ($4, $5, NULL)", 10, "Dave", "Value10", 11, "Erin")
+	if err != nil {
+		fmt.Println("SQL error:", err)
+	}
+	result, err := db.Exec(ctx, `
+		SELECT id, name, value
+		FROM users
+		WHERE name LIKE 'D%' OR value IS NULL
+		ORDER BY id DESC
+		LIMIT 10`)
+	if err != nil {
+		fmt.Println("SQL error:", err)
+	} else {
+		fmt.Println(result)
+	}
+
+	// Aggregate with GROUP BY
+	if summary, err := db.Exec(ctx, "SELECT active, COUNT(*) AS n, MAX(name) FROM users GROUP BY active ORDER BY n DESC"); err != nil {
+		fmt.Println("SQL error:", err)
+	} else {
+		fmt.Println(summary)
+	}
+
+	// Show which access path the planner picks
+	if plan, err := db.Exec(ctx, "EXPLAIN SELECT * FROM users WHERE name = 'Dave'"); err == nil {
+		fmt.Println(plan)
+	}
+
+	// Parse errors report where they happened
+	if _, err := db.Exec(ctx, "SELECT name\nFROM users WHERE"); err != nil {
+		fmt.Println("SQL error:", err)
+	}
+
 	// Begin a transaction
-	tx, err := db.BeginTransaction(ctx, "users")
+	tx, err := db.BeginTransaction(ctx)
 	if err != nil {
-		fmt.Println("Transaction error:", err)
-		return
+		return err
 	}
 
-	// Insert a record in the transaction
-	err = db.Insert(tx.ctx, "users", Record{ID: 3, Name: "Charlie", Value: "Value3"})
+	// Insert a record in the transaction; it stays invisible to others until commit
+	err = tx.Insert("users", Record{"id": 3, "name": "Charlie", "value": "Value3"})
 	if err != nil {
-		fmt.Println("Insert error:", err)
 		tx.Rollback()
-		return
+		return err
+	}
+	if _, exists := db.Get(ctx, "users", 3); !exists {
+		fmt.Println("Charlie not visible before commit")
 	}
 
 	// Commit the transaction
-	tx.Commit()
-}
\ No newline at end of file
+	if err := tx.Commit(); err != nil {
+		fmt.Println("Commit error:", err)
+	}
+
+	// Fold the log into a snapshot before exiting
+	return db.Checkpoint()
+}
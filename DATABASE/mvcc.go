@@ -0,0 +1,566 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrConflict is returned by Commit when another transaction committed a
+// write to the same record after this transaction started
+var ErrConflict = errors.New("transaction conflict: record modified by a concurrent transaction")
+
+// ErrNoTable is returned for operations on a table that does not exist
+var ErrNoTable = errors.New("table does not exist")
+
+// ErrNoRecord is returned for updates and deletes of a record that does not
+// exist
+var ErrNoRecord = errors.New("record does not exist")
+
+// txWrite is a buffered write inside a transaction
+type txWrite struct {
+	op     string
+	record Record
+	isNew  bool // Record did not exist in the transaction's snapshot
+}
+
+// Transaction is a snapshot-isolated, multi-table transaction. Reads see the
+// database as of BeginTransaction plus the transaction's own writes; writes
+// are buffered until Commit.
+type Transaction struct {
+	db           *Database
+	ctx          context.Context
+	cancel       context.CancelFunc
+	stmtCtx      context.Context // Context of the running statement, when set by a session
+	startVersion int
+	writes       map[string]map[any]txWrite
+	unchecked    bool // Skip foreign keys, for loading a consistent backup
+	done         bool
+	mu           sync.Mutex
+}
+
+// BeginTransaction starts a new transaction
+func (db *Database) BeginTransaction(ctx context.Context) (*Transaction, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	tx := &Transaction{
+		db:     db,
+		ctx:    ctx,
+		cancel: cancel,
+		writes: make(map[string]map[any]txWrite),
+	}
+
+	db.txMu.Lock()
+	tx.startVersion = db.version
+	db.active[tx] = struct{}{}
+	db.txMu.Unlock()
+	return tx, nil
+}
+
+// nextVersion allocates the commit version for a write. keepHistory reports
+// whether an open transaction may still need the versions being replaced.
+func (db *Database) nextVersion() (version int, keepHistory bool) {
+	db.txMu.Lock()
+	defer db.txMu.Unlock()
+	db.version++
+	return db.version, len(db.active) > 0
+}
+
+// storageFailure records err from applying a write that was already logged.
+// The tables may now lag the log, so further writes are refused until the
+// database is reopened and the log replayed.
+func (db *Database) storageFailure(err error) error {
+	db.txMu.Lock()
+	defer db.txMu.Unlock()
+	if db.failed == nil {
+		db.failed = fmt.Errorf("storage failure, reopen the database to recover: %w", err)
+	}
+	return db.failed
+}
+
+// lookupTable returns the named table
+func (db *Database) lookupTable(tableName string) (*Table, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	table, exists := db.tables[tableName]
+	if !exists {
+		return nil, ErrNoTable
+	}
+	return table, nil
+}
+
+// put installs row as the newest version of key and keeps the indexes and
+// read cache in step. On error nothing is changed. The caller must hold t.mu.
+func (t *Table) put(key any, row Record, version int, keepHistory bool) error {
+	old, exists, err := t.engine.Get(key)
+	if err != nil {
+		return err
+	}
+	keys, err := t.indexKeys(row)
+	if err != nil {
+		return err
+	}
+	var oldKeys rowKeys
+	if exists {
+		if oldKeys, err = t.indexKeys(old.Record); err != nil {
+			return err
+		}
+	}
+	if err := t.engine.Put(key, VersionedRecord{Record: row, Version: version}); err != nil {
+		return err
+	}
+	if exists {
+		if keepHistory {
+			t.history[key] = append(t.history[key], old)
+		}
+		t.unindex(key, old.Record, oldKeys)
+	}
+	t.mods++
+	t.cache.invalidate(cacheKey{table: t, key: key})
+	for _, idx := range t.indexes {
+		idx.addRow(key, row, keys)
+	}
+	return nil
+}
+
+// remove deletes key, leaving a tombstone for open snapshots. On error
+// nothing is changed. The caller must hold t.mu.
+func (t *Table) remove(key any, version int, keepHistory bool) error {
+	old, exists, err := t.engine.Get(key)
+	if err != nil || !exists {
+		return err
+	}
+	oldKeys, err := t.indexKeys(old.Record)
+	if err != nil {
+		return err
+	}
+	if err := t.engine.Delete(key); err != nil {
+		return err
+	}
+	if keepHistory {
+		t.history[key] = append(t.history[key], old, VersionedRecord{Version: version, Deleted: true})
+	}
+	t.mods++
+	t.cache.invalidate(cacheKey{table: t, key: key})
+	t.unindex(key, old.Record, oldKeys)
+	return nil
+}
+
+// unindex drops the index entries of row, whose keys are given, that point
+// at key. The caller must hold t.mu.
+func (t *Table) unindex(key any, row Record, keys rowKeys) {
+	for _, idx := range t.indexes {
+		idx.removeRow(key, row, keys)
+	}
+}
+
+// visible returns the version of key a snapshot taken at version would see.
+// The caller must hold t.mu.
+func (t *Table) visible(key any, version int) (VersionedRecord, bool, error) {
+	vRecord, exists, err := t.engine.Get(key)
+	if err != nil {
+		return VersionedRecord{}, false, err
+	}
+	if exists && vRecord.Version <= version {
+		return vRecord, !t.expired(vRecord.Record, time.Now()), nil
+	}
+	history := t.history[key]
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Version <= version {
+			return history[i], !history[i].Deleted && !t.expired(history[i].Record, time.Now()), nil
+		}
+	}
+	return VersionedRecord{}, false, nil
+}
+
+// expired reports whether the TTL of row has passed. Reads skip expired rows
+// from then on; the janitor deletes them later to reclaim their space. The
+// caller must hold t.mu.
+func (t *Table) expired(row Record, now time.Time) bool {
+	at, ok := t.ttl.expiresAt(row)
+	return ok && !now.Before(at)
+}
+
+// latestVersion returns the version of the last committed write to key,
+// including deletes. The caller must hold t.mu.
+func (t *Table) latestVersion(key any) (int, error) {
+	latest := 0
+	vRecord, exists, err := t.engine.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		latest = vRecord.Version
+	}
+	if history := t.history[key]; len(history) > 0 && history[len(history)-1].Version > latest {
+		latest = history[len(history)-1].Version
+	}
+	return latest, nil
+}
+
+// Get retrieves a record by primary key within a transaction
+func (tx *Transaction) Get(tableName string, id any) (Record, bool) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	table, err := tx.db.lookupTable(tableName)
+	if err != nil {
+		return nil, false
+	}
+	key, err := table.schema.normalizeKey(id)
+	if err != nil {
+		return nil, false
+	}
+	record, exists, err := tx.get(tableName, table, key)
+	if err != nil {
+		return nil, false
+	}
+	return record.clone(), exists
+}
+
+// get reads key through the write set and then the snapshot. The caller must
+// hold tx.mu.
+func (tx *Transaction) get(tableName string, table *Table, key any) (Record, bool, error) {
+	if w, buffered := tx.writes[tableName][key]; buffered {
+		if w.op == opDelete {
+			return nil, false, nil
+		}
+		return w.record, true, nil
+	}
+
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	vRecord, exists, err := table.visible(key, tx.startVersion)
+	return vRecord.Record, exists, err
+}
+
+// List returns all records of a table visible to the transaction, ordered by
+// primary key
+func (tx *Transaction) List(tableName string) ([]Record, error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	table, err := tx.db.lookupTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := make(map[any]Record)
+	now := time.Now()
+	table.mu.RLock()
+	err = table.engine.Scan(func(key any, vRecord VersionedRecord) bool {
+		if vRecord.Version <= tx.startVersion && !table.expired(vRecord.Record, now) {
+			visible[key] = vRecord.Record
+		}
+		return true
+	})
+	for key := range table.history {
+		if err != nil {
+			break
+		}
+		var vRecord VersionedRecord
+		var exists bool
+		if vRecord, exists, err = table.visible(key, tx.startVersion); exists {
+			visible[key] = vRecord.Record
+		}
+	}
+	table.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	for key, w := range tx.writes[tableName] {
+		if w.op == opDelete {
+			delete(visible, key)
+		} else {
+			visible[key] = w.record
+		}
+	}
+
+	records := make([]Record, 0, len(visible))
+	for _, record := range visible {
+		records = append(records, record.clone())
+	}
+	sortByColumn(records, table.schema.PrimaryKey)
+	return records, nil
+}
+
+// Insert buffers a new record in the transaction
+func (tx *Transaction) Insert(tableName string, record Record) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if err := tx.check(); err != nil {
+		return err
+	}
+
+	table, err := tx.db.lookupTable(tableName)
+	if err != nil {
+		return err
+	}
+	row, err := table.schema.validate(record)
+	if err != nil {
+		return err
+	}
+	key := table.schema.primaryKey(row)
+	if err := table.checkKey(key); err != nil {
+		return err
+	}
+	_, exists, err := tx.get(tableName, table, key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return table.duplicateKey(row)
+	}
+
+	prev, buffered := tx.writes[tableName][key]
+	if buffered && !prev.isNew {
+		// Deleted and re-inserted in the same transaction
+		tx.buffer(tableName, key, txWrite{op: opUpdate, record: row})
+		return nil
+	}
+	tx.buffer(tableName, key, txWrite{op: opInsert, record: row, isNew: true})
+	return nil
+}
+
+// Update buffers a change to the given columns of an existing record
+func (tx *Transaction) Update(tableName string, id any, changes Record) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if err := tx.check(); err != nil {
+		return err
+	}
+
+	table, err := tx.db.lookupTable(tableName)
+	if err != nil {
+		return err
+	}
+	key, err := table.schema.normalizeKey(id)
+	if err != nil {
+		return err
+	}
+	current, exists, err := tx.get(tableName, table, key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNoRecord
+	}
+	row, err := table.schema.merge(current, changes)
+	if err != nil {
+		return err
+	}
+
+	prev := tx.writes[tableName][key]
+	tx.buffer(tableName, key, txWrite{op: opUpdate, record: row, isNew: prev.isNew})
+	return nil
+}
+
+// Delete buffers the removal of a record in the transaction
+func (tx *Transaction) Delete(tableName string, id any) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if err := tx.check(); err != nil {
+		return err
+	}
+
+	table, err := tx.db.lookupTable(tableName)
+	if err != nil {
+		return err
+	}
+	key, err := table.schema.normalizeKey(id)
+	if err != nil {
+		return err
+	}
+	_, exists, err := tx.get(tableName, table, key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNoRecord
+	}
+
+	if tx.writes[tableName][key].isNew {
+		// Never visible outside the transaction, so just forget it
+		delete(tx.writes[tableName], key)
+		return nil
+	}
+	tx.buffer(tableName, key, txWrite{op: opDelete})
+	return nil
+}
+
+// buffer records a pending write. The caller must hold tx.mu.
+func (tx *Transaction) buffer(tableName string, key any, w txWrite) {
+	if tx.writes[tableName] == nil {
+		tx.writes[tableName] = make(map[any]txWrite)
+	}
+	tx.writes[tableName][key] = w
+}
+
+// check reports whether the transaction can still be used. The caller must
+// hold tx.mu.
+func (tx *Transaction) check() error {
+	if tx.done {
+		return errors.New("transaction already finished")
+	}
+	if tx.stmtCtx != nil {
+		if err := tx.stmtCtx.Err(); err != nil {
+			return err
+		}
+	}
+	return tx.ctx.Err()
+}
+
+// Commit atomically applies the transaction's writes, along with the writes
+// of any ON DELETE CASCADE or SET NULL foreign keys. It fails with
+// ErrConflict if another transaction committed a write to any of the same
+// records first, or with a constraint error, in which case nothing is
+// applied.
+func (tx *Transaction) Commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if err := tx.check(); err != nil {
+		tx.end()
+		return err
+	}
+	defer tx.end()
+
+	names := make([]string, 0, len(tx.writes))
+	for name, writes := range tx.writes {
+		if len(writes) > 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+
+	// Foreign keys may cascade into, or need to read, other tables
+	var refs map[string][]reference
+	if !tx.unchecked {
+		refs = tx.db.references()
+	}
+	if len(refs) > 0 {
+		var err error
+		if names, err = tx.db.constraintTables(names, refs); err != nil {
+			return err
+		}
+	}
+
+	tables := make([]*Table, len(names))
+	for i, name := range names {
+		table, err := tx.db.lookupTable(name)
+		if err != nil {
+			return err
+		}
+		tables[i] = table
+	}
+
+	// Lock in name order so concurrent commits cannot deadlock
+	for _, table := range tables {
+		table.mu.Lock()
+	}
+	defer func() {
+		for _, table := range tables {
+			table.mu.Unlock()
+		}
+	}()
+
+	// First committer wins
+	for i, name := range names {
+		for key := range tx.writes[name] {
+			latest, err := tables[i].latestVersion(key)
+			if err != nil {
+				return err
+			}
+			if latest > tx.startVersion {
+				return ErrConflict
+			}
+		}
+	}
+
+	if len(refs) > 0 {
+		byName := make(map[string]*Table, len(names))
+		for i, name := range names {
+			byName[name] = tables[i]
+		}
+		if err := tx.enforceForeignKeys(byName, refs); err != nil {
+			return err
+		}
+	}
+
+	for i, name := range names {
+		rows := make(map[any]Record, len(tx.writes[name]))
+		for key, w := range tx.writes[name] {
+			rows[key] = w.record
+		}
+		if err := tables[i].checkUnique(rows); err != nil {
+			return err
+		}
+	}
+
+	var batch []walEntry
+	for i, name := range names {
+		for key, w := range tx.writes[name] {
+			entry := walEntry{Op: w.op, Table: name, Key: key, Record: w.record}
+			if w.isNew {
+				entry.Op = opInsert
+			} else {
+				// No conflict, so the committed row is the one replaced
+				old, _, err := tables[i].engine.Get(key)
+				if err != nil {
+					return err
+				}
+				entry.Old = old.Record
+			}
+			batch = append(batch, entry)
+		}
+	}
+	version, keepHistory, done, err := tx.db.logWrite(walEntry{Op: opCommit, Batch: batch})
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	for i, name := range names {
+		for key, w := range tx.writes[name] {
+			var err error
+			if w.op == opDelete {
+				err = tables[i].remove(key, version, keepHistory)
+			} else {
+				err = tables[i].put(key, w.record, version, keepHistory)
+			}
+			if err != nil {
+				return tx.db.storageFailure(err)
+			}
+		}
+	}
+	return nil
+}
+
+// Rollback discards every buffered write
+func (tx *Transaction) Rollback() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return errors.New("transaction already finished")
+	}
+	tx.end()
+	return nil
+}
+
+// end releases the transaction's snapshot. The caller must hold tx.mu.
+func (tx *Transaction) end() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	tx.writes = nil
+	tx.cancel()
+
+	tx.db.txMu.Lock()
+	delete(tx.db.active, tx)
+	tx.db.txMu.Unlock()
+}
@@ -0,0 +1,699 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+const (
+	pagesFileName   = "pages.db"
+	journalFileName = "pages.journal"
+	pageSize        = 4096
+	pageCapacity    = pageSize - sealOverhead // Usable bytes, leaving room to encrypt the page
+	pageHeaderSize  = 5                       // 4 bytes CRC32 + 1 byte kind
+
+	// DefaultBufferPoolPages is the number of pages the disk engine keeps in
+	// memory by default (8 MiB)
+	DefaultBufferPoolPages = 2048
+)
+
+var (
+	pageMagic    = []byte("GODBPAGE")
+	journalMagic = []byte("GODBJRNL")
+)
+
+// Page kinds, stored after the checksum
+const (
+	pageFileHeader byte = iota + 1 // Page 0: magic, page size and encryption flag
+	pageLeaf
+	pageInternal
+	pageOverflow
+)
+
+// pageID is the position of a page in the page file
+type pageID uint32
+
+// pagerState is the allocation state saved with each checkpoint
+type pagerState struct {
+	Pages pageID   `json:"pages"`          // Pages in use, including the header
+	Free  []pageID `json:"free,omitempty"` // Pages that can be reused
+}
+
+// node is the decoded form of a page
+type node struct {
+	kind     byte
+	keys     [][]byte    // Leaf and internal pages
+	values   []leafValue // Leaf pages, one per key
+	children []pageID    // Internal pages, len(keys)+1
+	next     pageID      // Overflow pages: next page of the chain, 0 at the end
+	data     []byte      // Overflow pages
+}
+
+// leafValue is a row stored in a leaf, either inline or in a chain of
+// overflow pages
+type leafValue struct {
+	inline   []byte
+	overflow pageID // First overflow page, 0 if inline
+	length   int    // Total length of an overflowed value
+}
+
+// frame is a buffer pool slot
+type frame struct {
+	node  *node
+	dirty bool
+	pins  int
+	elem  *list.Element // Position in the eviction list; nil while pinned or dirty
+}
+
+// pager reads and writes fixed-size pages through a buffer pool. Dirty pages
+// stay in the pool until the next checkpoint (no-steal), so the page file
+// only ever holds checkpointed state and a crash needs no undo: the journal
+// makes each checkpoint atomic and the WAL redoes everything after it.
+type pager struct {
+	file     *os.File
+	path     string
+	capacity int
+	frames   map[pageID]*frame
+	lru      *list.List // Clean, unpinned frames; front is most recently used
+	dirty    int
+	count    pageID
+	free     []pageID
+	pressure chan struct{} // Signalled when dirty pages outgrow the pool
+	keys     *Keyring      // Encrypts pages; nil if the file is not encrypted
+	mu       sync.Mutex
+}
+
+// openPager opens the page file at path, creating it if needed, with the
+// allocation state of the last checkpoint. A new file is encrypted if keys
+// are given. An existing file keeps its pages as they are, so one written
+// without keys cannot be opened with them once it holds any.
+func openPager(path string, capacity int, state *pagerState, keys *Keyring) (*pager, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	p := &pager{
+		file:     file,
+		path:     path,
+		capacity: max(capacity, 16),
+		frames:   make(map[pageID]*frame),
+		lru:      list.New(),
+		count:    1,
+		pressure: make(chan struct{}, 1),
+	}
+	if state != nil {
+		p.count = max(state.Pages, 1)
+		p.free = slices.Clone(state.Free)
+	}
+
+	header := make([]byte, pageSize)
+	_, err = file.ReadAt(header, 0)
+	fresh := errors.Is(err, io.EOF)
+	if err != nil && !fresh {
+		file.Close()
+		return nil, err
+	}
+	if !fresh {
+		if !checkPage(header) || header[4] != pageFileHeader || !bytes.Equal(header[pageHeaderSize:pageHeaderSize+len(pageMagic)], pageMagic) {
+			file.Close()
+			return nil, fmt.Errorf("%s is not a page file", path)
+		}
+		encrypted := header[headerEncrypted] == 1
+		switch {
+		case encrypted && keys == nil:
+			file.Close()
+			return nil, fmt.Errorf("%s: %w", path, ErrEncrypted)
+		case !encrypted && keys != nil:
+			info, err := file.Stat()
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+			if info.Size() > pageSize {
+				file.Close()
+				return nil, fmt.Errorf("%s is not encrypted; restore a backup into a new encrypted database", path)
+			}
+			fresh = true // Nothing to encrypt yet
+		case encrypted:
+			p.keys = keys
+		}
+	}
+	if fresh {
+		encodeHeaderPage(header, keys != nil)
+		if _, err := file.WriteAt(header, 0); err != nil {
+			file.Close()
+			return nil, err
+		}
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return nil, err
+		}
+		p.keys = keys
+	}
+	return p, nil
+}
+
+// get returns page id without pinning it. The node must not be modified.
+func (p *pager) get(id pageID) (*node, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f, err := p.load(id)
+	if err != nil {
+		return nil, err
+	}
+	if f.elem != nil {
+		p.lru.MoveToFront(f.elem)
+	}
+	p.evict()
+	return f.node, nil
+}
+
+// pin returns page id and keeps it in the pool until unpin, so it can be
+// modified and then marked dirty without further I/O
+func (p *pager) pin(id pageID) (*node, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f, err := p.load(id)
+	if err != nil {
+		return nil, err
+	}
+	f.pins++
+	if f.elem != nil {
+		p.lru.Remove(f.elem)
+		f.elem = nil
+	}
+	p.evict()
+	return f.node, nil
+}
+
+// unpin releases a pin taken by pin
+func (p *pager) unpin(id pageID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f, ok := p.frames[id]
+	if !ok {
+		return // Released while pinned
+	}
+	f.pins--
+	if f.pins == 0 && !f.dirty {
+		f.elem = p.lru.PushFront(id)
+		p.evict()
+	}
+}
+
+// markDirty records that a pinned page was modified
+func (p *pager) markDirty(id pageID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f := p.frames[id]
+	if !f.dirty {
+		f.dirty = true
+		p.dirty++
+		p.signalPressure()
+	}
+}
+
+// alloc stores n in a free or new page and returns its id. The page is dirty
+// until the next checkpoint.
+func (p *pager) alloc(n *node) pageID {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var id pageID
+	if len(p.free) > 0 {
+		id = p.free[len(p.free)-1]
+		p.free = p.free[:len(p.free)-1]
+	} else {
+		id = p.count
+		p.count++
+	}
+	p.frames[id] = &frame{node: n, dirty: true}
+	p.dirty++
+	p.signalPressure()
+	return id
+}
+
+// release returns page id to the free list
+func (p *pager) release(id pageID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if f, ok := p.frames[id]; ok {
+		if f.elem != nil {
+			p.lru.Remove(f.elem)
+		}
+		if f.dirty {
+			p.dirty--
+		}
+		delete(p.frames, id)
+	}
+	p.free = append(p.free, id)
+}
+
+// state returns the allocation state to save with a checkpoint
+func (p *pager) state() *pagerState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return &pagerState{Pages: p.count, Free: slices.Clone(p.free)}
+}
+
+// load returns the frame of page id, reading it from the file on a miss. The
+// caller must hold p.mu and call evict once the frame is pinned or used.
+func (p *pager) load(id pageID) (*frame, error) {
+	if f, ok := p.frames[id]; ok {
+		return f, nil
+	}
+	if id == 0 || id >= p.count {
+		return nil, fmt.Errorf("page %d out of range", id)
+	}
+	buf := make([]byte, pageSize)
+	if _, err := p.file.ReadAt(buf, int64(id)*pageSize); err != nil {
+		return nil, fmt.Errorf("reading page %d: %w", id, err)
+	}
+	buf, err := p.openPage(id, buf)
+	if err != nil {
+		return nil, fmt.Errorf("page %d: %w", id, err)
+	}
+	n, err := decodePage(buf)
+	if err != nil {
+		return nil, fmt.Errorf("page %d: %w", id, err)
+	}
+	f := &frame{node: n}
+	f.elem = p.lru.PushFront(id)
+	p.frames[id] = f
+	return f, nil
+}
+
+// evict drops the least recently used clean pages beyond capacity. The
+// caller must hold p.mu.
+func (p *pager) evict() {
+	for len(p.frames) > p.capacity && p.lru.Len() > 0 {
+		id := p.lru.Remove(p.lru.Back()).(pageID)
+		delete(p.frames, id)
+	}
+}
+
+// signalPressure asks for a checkpoint once dirty pages fill the pool. The
+// caller must hold p.mu.
+func (p *pager) signalPressure() {
+	if p.dirty > p.capacity {
+		select {
+		case p.pressure <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// checkpoint durably writes every dirty page together with catalog, the
+// encoded snapshot that describes them. Both are first written to the
+// journal, which is the commit point; they are then copied into place with
+// writeCatalog and the journal is removed. The caller must prevent writes.
+func (p *pager) checkpoint(catalog []byte, writeCatalog func([]byte) error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ids := make([]pageID, 0, p.dirty)
+	for id, f := range p.frames {
+		if f.dirty {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	pages := make([][]byte, len(ids))
+	for i, id := range ids {
+		buf, err := encodePage(p.frames[id].node)
+		if err == nil {
+			buf, err = p.sealPage(id, buf)
+		}
+		if err != nil {
+			return fmt.Errorf("page %d: %w", id, err)
+		}
+		pages[i] = buf
+	}
+
+	dir := filepath.Dir(p.path)
+	if err := writeJournal(filepath.Join(dir, journalFileName), catalog, ids, pages); err != nil {
+		return err
+	}
+	if err := applyJournal(p.file, ids, pages); err != nil {
+		return err
+	}
+	if err := writeCatalog(catalog); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(dir, journalFileName)); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		f := p.frames[id]
+		f.dirty = false
+		if f.pins == 0 {
+			f.elem = p.lru.PushFront(id)
+		}
+	}
+	p.dirty = 0
+	p.evict()
+	return nil
+}
+
+// rekey marks dirty up to n pages, starting at page from, that are not
+// encrypted with the newest key, so the next checkpoint rewrites them. It
+// returns the page to continue from and the number of pages marked.
+func (p *pager) rekey(from pageID, n int) (pageID, int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	free := make(map[pageID]bool, len(p.free))
+	for _, id := range p.free {
+		free[id] = true
+	}
+	buf := make([]byte, pageSize)
+	marked := 0
+	id := from
+	for ; id < p.count && marked < n; id++ {
+		if f, ok := p.frames[id]; free[id] || ok && f.dirty {
+			continue // Rewritten at the next checkpoint anyway
+		}
+		if _, err := p.file.ReadAt(buf, int64(id)*pageSize); err != nil {
+			return id, marked, fmt.Errorf("reading page %d: %w", id, err)
+		}
+		if p.keys.isCurrent(buf) {
+			continue
+		}
+		f, err := p.load(id)
+		if err != nil {
+			return id, marked, err
+		}
+		if f.elem != nil {
+			p.lru.Remove(f.elem)
+			f.elem = nil
+		}
+		f.dirty = true
+		p.dirty++
+		marked++
+	}
+	p.evict()
+	return id, marked, nil
+}
+
+// sealPage encrypts an encoded page if the file is encrypted. The page must
+// fit in pageCapacity so that it is still pageSize bytes once sealed.
+func (p *pager) sealPage(id pageID, buf []byte) ([]byte, error) {
+	if p.keys == nil {
+		return buf, nil
+	}
+	if slices.ContainsFunc(buf[pageCapacity:], func(b byte) bool { return b != 0 }) {
+		return nil, errors.New("node does not fit in an encrypted page")
+	}
+	return p.keys.seal(buf[:pageCapacity], pageAAD(id))
+}
+
+// openPage decrypts a page read from an encrypted file
+func (p *pager) openPage(id pageID, buf []byte) ([]byte, error) {
+	if p.keys == nil {
+		return buf, nil
+	}
+	plain, err := p.keys.open(buf, pageAAD(id))
+	if err != nil {
+		return nil, err
+	}
+	return append(plain, make([]byte, pageSize-len(plain))...), nil
+}
+
+// pageAAD binds an encrypted page to its position, so pages cannot be swapped
+func pageAAD(id pageID) []byte {
+	return binary.BigEndian.AppendUint32([]byte("page"), uint32(id))
+}
+
+// Close closes the page file. Dirty pages are dropped; the WAL replays them.
+func (p *pager) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.file.Close()
+}
+
+// writeJournal writes [magic][catalog length][catalog][page count]
+// ([page id][page])... [crc32] to path and makes it durable
+func writeJournal(path string, catalog []byte, ids []pageID, pages [][]byte) error {
+	buf := slices.Clone(journalMagic)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(catalog)))
+	buf = append(buf, catalog...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(ids)))
+	for i, id := range ids {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(id))
+		buf = append(buf, pages[i]...)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+	return writeFileAtomic(path, buf)
+}
+
+// readJournal decodes the journal at path. ok is false if it is incomplete.
+func readJournal(path string) (catalog []byte, ids []pageID, pages [][]byte, ok bool, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, nil, false, err
+	}
+	if len(data) < len(journalMagic)+12 || !bytes.Equal(data[:len(journalMagic)], journalMagic) {
+		return nil, nil, nil, false, nil
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, crcTable) != sum {
+		return nil, nil, nil, false, nil
+	}
+
+	rest := body[len(journalMagic):]
+	size := int(binary.BigEndian.Uint32(rest))
+	if len(rest) < 8+size {
+		return nil, nil, nil, false, nil
+	}
+	catalog, rest = rest[4:4+size], rest[4+size:]
+	count := int(binary.BigEndian.Uint32(rest))
+	rest = rest[4:]
+	if len(rest) != count*(4+pageSize) {
+		return nil, nil, nil, false, nil
+	}
+	for i := 0; i < count; i++ {
+		ids = append(ids, pageID(binary.BigEndian.Uint32(rest)))
+		pages = append(pages, rest[4:4+pageSize])
+		rest = rest[4+pageSize:]
+	}
+	return catalog, ids, pages, true, nil
+}
+
+// applyJournal writes pages in place and syncs the page file
+func applyJournal(file *os.File, ids []pageID, pages [][]byte) error {
+	for i, id := range ids {
+		if _, err := file.WriteAt(pages[i], int64(id)*pageSize); err != nil {
+			return err
+		}
+	}
+	return file.Sync()
+}
+
+// recoverJournal finishes a checkpoint interrupted by a crash. A complete
+// journal is replayed into the page file and snapshot; an incomplete one
+// belongs to a checkpoint that never committed and is discarded.
+func recoverJournal(dir string) error {
+	path := filepath.Join(dir, journalFileName)
+	catalog, ids, pages, ok, err := readJournal(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if ok {
+		file, err := os.OpenFile(filepath.Join(dir, pagesFileName), os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		err = applyJournal(file, ids, pages)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(filepath.Join(dir, snapshotFileName), catalog); err != nil {
+			return err
+		}
+	}
+	return os.Remove(path)
+}
+
+// checkPage verifies the checksum of an encoded page
+func checkPage(buf []byte) bool {
+	return binary.BigEndian.Uint32(buf) == crc32.Checksum(buf[4:], crcTable)
+}
+
+// headerEncrypted is the offset of the header page's encryption flag
+const headerEncrypted = pageHeaderSize + 8 + 4 // After the magic and page size
+
+func encodeHeaderPage(buf []byte, encrypted bool) {
+	buf[4] = pageFileHeader
+	copy(buf[pageHeaderSize:], pageMagic)
+	binary.BigEndian.PutUint32(buf[pageHeaderSize+len(pageMagic):], pageSize)
+	buf[headerEncrypted] = 0
+	if encrypted {
+		buf[headerEncrypted] = 1
+	}
+	binary.BigEndian.PutUint32(buf, crc32.Checksum(buf[4:], crcTable))
+}
+
+// size returns the encoded size of n in bytes
+func (n *node) size() int {
+	size := pageHeaderSize + 2
+	switch n.kind {
+	case pageLeaf:
+		for i, key := range n.keys {
+			size += uvarintLen(len(key)) + len(key) + n.values[i].size()
+		}
+	case pageInternal:
+		size += 4
+		for _, key := range n.keys {
+			size += uvarintLen(len(key)) + len(key) + 4
+		}
+	case pageOverflow:
+		size += 4 + len(n.data)
+	}
+	return size
+}
+
+// size returns the encoded size of v within a leaf
+func (v leafValue) size() int {
+	if v.overflow != 0 {
+		return 1 + 4 + uvarintLen(v.length)
+	}
+	return 1 + uvarintLen(len(v.inline)) + len(v.inline)
+}
+
+func uvarintLen(n int) int {
+	return len(binary.AppendUvarint(nil, uint64(n)))
+}
+
+// encodePage serialises n into a checksummed page:
+//
+//	leaf:     [crc][kind][count] ([key len][key][0][value len][value] | [key len][key][1][first page][length])...
+//	internal: [crc][kind][count][child] ([key len][key][child])...
+//	overflow: [crc][kind][length][next][data]
+func encodePage(n *node) ([]byte, error) {
+	if n.size() > pageSize {
+		return nil, errors.New("node does not fit in a page")
+	}
+	buf := make([]byte, pageHeaderSize, pageSize)
+	buf[4] = n.kind
+	switch n.kind {
+	case pageLeaf:
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(n.keys)))
+		for i, key := range n.keys {
+			buf = binary.AppendUvarint(buf, uint64(len(key)))
+			buf = append(buf, key...)
+			if v := n.values[i]; v.overflow != 0 {
+				buf = append(buf, 1)
+				buf = binary.BigEndian.AppendUint32(buf, uint32(v.overflow))
+				buf = binary.AppendUvarint(buf, uint64(v.length))
+			} else {
+				buf = append(buf, 0)
+				buf = binary.AppendUvarint(buf, uint64(len(v.inline)))
+				buf = append(buf, v.inline...)
+			}
+		}
+	case pageInternal:
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(n.keys)))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(n.children[0]))
+		for i, key := range n.keys {
+			buf = binary.AppendUvarint(buf, uint64(len(key)))
+			buf = append(buf, key...)
+			buf = binary.BigEndian.AppendUint32(buf, uint32(n.children[i+1]))
+		}
+	case pageOverflow:
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(n.data)))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(n.next))
+		buf = append(buf, n.data...)
+	default:
+		return nil, fmt.Errorf("unknown page kind %d", n.kind)
+	}
+	buf = buf[:pageSize]
+	binary.BigEndian.PutUint32(buf, crc32.Checksum(buf[4:], crcTable))
+	return buf, nil
+}
+
+// decodePage parses a page written by encodePage
+func decodePage(buf []byte) (*node, error) {
+	if !checkPage(buf) {
+		return nil, errors.New("checksum mismatch")
+	}
+	r := pageReader{buf: buf[pageHeaderSize:]}
+	n := &node{kind: buf[4]}
+	count := int(r.uint16())
+	switch n.kind {
+	case pageLeaf:
+		for i := 0; i < count && r.err == nil; i++ {
+			n.keys = append(n.keys, r.bytes(int(r.uvarint())))
+			var v leafValue
+			if r.byte() == 1 {
+				v.overflow = pageID(r.uint32())
+				v.length = int(r.uvarint())
+			} else {
+				v.inline = r.bytes(int(r.uvarint()))
+			}
+			n.values = append(n.values, v)
+		}
+	case pageInternal:
+		n.children = append(n.children, pageID(r.uint32()))
+		for i := 0; i < count && r.err == nil; i++ {
+			n.keys = append(n.keys, r.bytes(int(r.uvarint())))
+			n.children = append(n.children, pageID(r.uint32()))
+		}
+	case pageOverflow:
+		n.next = pageID(r.uint32())
+		n.data = r.bytes(count)
+	default:
+		return nil, fmt.Errorf("unknown page kind %d", n.kind)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return n, nil
+}
+
+// pageReader decodes fields from a page, remembering the first error
+type pageReader struct {
+	buf []byte
+	err error
+}
+
+func (r *pageReader) next(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.buf) {
+		r.err = errors.New("corrupt page")
+		return make([]byte, max(n, 0))
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *pageReader) byte() byte     { return r.next(1)[0] }
+func (r *pageReader) uint16() uint16 { return binary.BigEndian.Uint16(r.next(2)) }
+func (r *pageReader) uint32() uint32 { return binary.BigEndian.Uint32(r.next(4)) }
+
+func (r *pageReader) bytes(n int) []byte {
+	return bytes.Clone(r.next(n))
+}
+
+func (r *pageReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errors.New("corrupt page")
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
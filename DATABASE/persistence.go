@@ -0,0 +1,628 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const snapshotFileName = "snapshot.json"
+
+// tableSnapshot is the on-disk form of a Table. Memory engine tables carry
+// their records; disk engine tables point at the root of their tree.
+type tableSnapshot struct {
+	Schema  Schema            `json:"schema"`
+	Records []VersionedRecord `json:"records,omitempty"`
+	Indexes []IndexSpec       `json:"indexes"`
+	Root    pageID            `json:"root,omitempty"`
+	Rows    int               `json:"rows,omitempty"`
+}
+
+// snapshot is the on-disk form of the whole database. LSN is the last WAL
+// entry already reflected in Tables. Snapshots written before the disk
+// engine existed have no Engine and use the memory engine.
+type snapshot struct {
+	LSN     uint64                   `json:"lsn"`
+	Version int                      `json:"version,omitempty"` // Last committed version
+	Engine  EngineKind               `json:"engine,omitempty"`
+	Pages   *pagerState              `json:"pages,omitempty"`
+	Tables  map[string]tableSnapshot `json:"tables"`
+}
+
+// Options configures OpenDatabaseWithOptions
+type Options struct {
+	// Engine defaults to the engine the database was created with, or
+	// DiskEngine for a new database
+	Engine EngineKind
+	// BufferPoolPages is the number of disk engine pages kept in memory,
+	// DefaultBufferPoolPages if zero
+	BufferPoolPages int
+	// ChangeRetention is the number of change events kept for resuming
+	// subscribers, DefaultChangeRetention if zero
+	ChangeRetention int
+	// ArchiveDir, if set, receives a copy of the write-ahead log at every
+	// checkpoint, for point-in-time restores with RestoreBackup
+	ArchiveDir string
+	// ReplicationRetention is the number of recent log entries kept for
+	// replicas catching up, DefaultReplicationRetention if zero
+	ReplicationRetention int
+	// Keys, if set, encrypt every file the database writes: the log,
+	// snapshot, pages, change log, archived segments and backups. Files
+	// that are not encrypted are then rejected, so they cannot stand in for
+	// encrypted ones.
+	Keys *Keyring
+	// EncryptPlaintext lets Keys read unencrypted files once, to encrypt a
+	// database written without keys: RotateKey re-encrypts every file, after
+	// which unencrypted data is rejected again
+	EncryptPlaintext bool
+}
+
+// OpenDatabase opens a durable database stored in dir with default options
+func OpenDatabase(dir string) (*Database, error) {
+	return OpenDatabaseWithOptions(dir, Options{})
+}
+
+// OpenDatabaseWithOptions opens a durable database stored in dir. The latest
+// snapshot is loaded and the write-ahead log replayed on top of it; a torn
+// final record left by a crash is discarded.
+func OpenDatabaseWithOptions(dir string, opts Options) (*Database, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := recoverJournal(dir); err != nil {
+		return nil, fmt.Errorf("recovering checkpoint: %w", err)
+	}
+
+	db := NewDatabase()
+	db.dir = dir
+	db.archive = opts.ArchiveDir
+	db.keys = opts.Keys
+	if opts.EncryptPlaintext && db.keys != nil {
+		db.keys.setPlaintext(true)
+	}
+
+	snap, err := readSnapshot(filepath.Join(dir, snapshotFileName), db.keys)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	exists := err == nil
+
+	db.engine = opts.Engine
+	if exists {
+		stored := snap.Engine
+		if stored == "" {
+			stored = MemoryEngine
+		}
+		if db.engine != "" && db.engine != stored {
+			return nil, fmt.Errorf("database in %s uses the %s engine", dir, stored)
+		}
+		db.engine = stored
+	}
+	switch db.engine {
+	case "", DiskEngine:
+		db.engine = DiskEngine
+		capacity := opts.BufferPoolPages
+		if capacity == 0 {
+			capacity = DefaultBufferPoolPages
+		}
+		if db.pager, err = openPager(filepath.Join(dir, pagesFileName), capacity, snap.Pages, db.keys); err != nil {
+			return nil, err
+		}
+	case MemoryEngine:
+	default:
+		return nil, fmt.Errorf("unknown storage engine %q", db.engine)
+	}
+
+	if exists {
+		if err := db.restoreSnapshot(snap); err != nil {
+			db.closePager()
+			return nil, err
+		}
+	}
+
+	if opts.ChangeRetention > 0 {
+		db.feed = newChangeFeed(opts.ChangeRetention)
+	}
+	if err := db.feed.open(filepath.Join(dir, changesFileName), db.keys); err != nil {
+		db.closePager()
+		return nil, err
+	}
+	loaded := db.feed.next
+	if opts.ReplicationRetention > 0 {
+		db.ship = newShipLog(opts.ReplicationRetention)
+	}
+	db.ship.reset(snap.LSN)
+
+	lastLSN := snap.LSN
+	walPath := filepath.Join(dir, walFileName)
+	ctx := context.Background()
+	offset, torn, err := readWAL(walPath, db.keys, func(entry walEntry) error {
+		if entry.LSN <= snap.LSN {
+			return nil // Already part of the snapshot
+		}
+		if err := db.replay(ctx, entry); err != nil {
+			return fmt.Errorf("replaying wal entry %d: %w", entry.LSN, err)
+		}
+		db.ship.append(entry)
+		lastLSN = entry.LSN
+		return nil
+	})
+	if err == nil {
+		err = db.feed.decode(db, loaded)
+	}
+	if err != nil {
+		db.feed.close()
+		db.closePager()
+		return nil, err
+	}
+	if torn {
+		if err := os.Truncate(walPath, offset); err != nil {
+			db.feed.close()
+			db.closePager()
+			return nil, err
+		}
+	}
+
+	wal, err := openWAL(walPath, lastLSN, db.keys)
+	if err != nil {
+		db.feed.close()
+		db.closePager()
+		return nil, err
+	}
+	db.wal = wal
+	if db.pager != nil {
+		db.startPageFlusher()
+	}
+	return db, nil
+}
+
+// startPageFlusher checkpoints whenever dirty pages outgrow the buffer pool,
+// since the pool only writes pages back at checkpoints. Failures are kept
+// like those of StartCheckpointer.
+func (db *Database) startPageFlusher() {
+	db.wg.Add(1)
+	go func() {
+		defer db.wg.Done()
+		for {
+			select {
+			case <-db.stop:
+				return
+			case <-db.pager.pressure:
+				db.backgroundCheckpoint()
+			}
+		}
+	}()
+}
+
+func (db *Database) closePager() {
+	if db.pager != nil {
+		db.pager.Close()
+	}
+}
+
+// replay applies a WAL entry found on open and publishes the changes a crash
+// kept out of changes.log
+func (db *Database) replay(ctx context.Context, entry walEntry) error {
+	switch entry.Op {
+	case opInsert, opUpdate, opDelete, opCommit:
+		if entry.Version == 0 {
+			// Logged before commit versions were recorded
+			db.txMu.Lock()
+			entry.Version = db.version + 1
+			db.txMu.Unlock()
+		}
+	}
+	if err := db.applyEntry(ctx, entry); err != nil {
+		return err
+	}
+	if entry.LSN <= db.feed.lastLSN {
+		return nil
+	}
+	decoded, err := db.decodeEntry(entry)
+	if err != nil {
+		return err
+	}
+	db.feed.release(db.feed.publish(entry.LSN, changesOf(decoded)))
+	return nil
+}
+
+// applyEntry re-executes a logged mutation. It is only called while the WAL
+// is detached, so the mutation is not logged a second time.
+func (db *Database) applyEntry(ctx context.Context, entry walEntry) error {
+	switch entry.Op {
+	case opCreateTable:
+		if entry.Schema == nil {
+			return errors.New("create table entry has no schema")
+		}
+		return db.CreateTable(entry.Table, *entry.Schema)
+	case opInsert, opUpdate, opDelete:
+		return db.applyBatch(entry.Version, []walEntry{entry})
+	case opCreateIndex:
+		if entry.Index == nil {
+			return errors.New("create index entry has no index")
+		}
+		return db.CreateIndexWithSpec(ctx, entry.Table, *entry.Index)
+	case opCommit:
+		return db.applyBatch(entry.Version, entry.Batch)
+	case opSetTTL:
+		return db.SetTTL(ctx, entry.Table, entry.TTL)
+	default:
+		return fmt.Errorf("unknown wal operation %q", entry.Op)
+	}
+}
+
+// applyBatch re-applies logged row writes under a single version. Rows are
+// logged in their final form, so inserts and updates are both a put.
+func (db *Database) applyBatch(version int, batch []walEntry) error {
+	db.txMu.Lock()
+	db.version = max(db.version, version)
+	keepHistory := len(db.active) > 0
+	db.txMu.Unlock()
+	for _, entry := range batch {
+		table, err := db.lookupTable(entry.Table)
+		if err != nil {
+			return err
+		}
+		if entry.Op == opDelete {
+			key, err := table.schema.normalizeKey(entry.Key)
+			if err != nil {
+				return err
+			}
+			table.mu.Lock()
+			err = table.remove(key, version, keepHistory)
+			table.mu.Unlock()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		row, err := table.schema.decodeRow(entry.Record)
+		if err != nil {
+			return err
+		}
+		table.mu.Lock()
+		err = table.put(table.schema.primaryKey(row), row, version, keepHistory)
+		table.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logMutation appends a schema change to the write-ahead log of a durable
+// database
+func (db *Database) logMutation(entry walEntry) error {
+	_, _, done, err := db.logWrite(entry)
+	if err != nil {
+		return err
+	}
+	done()
+	return nil
+}
+
+// logWrite logs a mutation and publishes its row changes. Entries are
+// stamped with the time and row writes given their commit version here, under db.logMu, so versions, log
+// order and change positions agree. The caller applies the write and then
+// calls done to make its changes visible to subscribers.
+func (db *Database) logWrite(entry walEntry) (version int, keepHistory bool, done func(), err error) {
+	db.txMu.Lock()
+	failed, replica := db.failed, db.replica
+	db.txMu.Unlock()
+	if failed != nil {
+		return 0, false, nil, failed
+	}
+	if replica != nil {
+		return 0, false, nil, ErrReadOnly
+	}
+
+	db.logMu.Lock()
+	defer db.logMu.Unlock()
+	switch entry.Op {
+	case opInsert, opUpdate, opDelete, opCommit:
+		version, keepHistory = db.nextVersion()
+		entry.Version = version
+	}
+	entry.Time = time.Now().UnixNano()
+	var lsn uint64
+	if db.wal != nil {
+		if err := db.wal.Append(entry); err != nil {
+			return 0, false, nil, err
+		}
+		lsn = db.wal.LSN()
+		entry.LSN = lsn
+		db.ship.append(entry)
+	}
+	ticket := db.feed.publish(lsn, changesOf(entry))
+	return version, keepHistory, func() { db.feed.release(ticket) }, nil
+}
+
+// Checkpoint writes a snapshot of every table and truncates the WAL. Writers
+// are blocked for the duration so the snapshot matches the log position. If
+// it succeeds but a background checkpoint failed since the last call, that
+// failure is returned instead.
+func (db *Database) Checkpoint() error {
+	err := db.checkpoint()
+	if failed := db.checkpointFailure(); err == nil {
+		err = failed
+	}
+	return err
+}
+
+// checkpoint writes a snapshot without reporting background failures, for
+// checkpoints taken as part of another operation
+func (db *Database) checkpoint() error {
+	if db.wal == nil {
+		return errors.New("database is not durable")
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	unlock := db.lockTablesForRead()
+	defer unlock()
+
+	snap := db.buildSnapshot()
+	snap.LSN = db.wal.LSN()
+	db.txMu.Lock()
+	snap.Version = db.version
+	db.txMu.Unlock()
+	// The log is truncated below, so the changes it holds must be durable
+	if err := db.feed.sync(); err != nil {
+		return err
+	}
+	path := filepath.Join(db.dir, snapshotFileName)
+	if db.pager != nil {
+		catalog, err := json.Marshal(snap)
+		if err == nil {
+			catalog, err = db.keys.seal(catalog, snapshotAAD)
+		}
+		if err != nil {
+			return err
+		}
+		err = db.pager.checkpoint(catalog, func(catalog []byte) error {
+			return writeFileAtomic(path, catalog)
+		})
+		if err != nil {
+			return err
+		}
+	} else if err := writeSnapshot(path, snap, db.keys); err != nil {
+		return err
+	}
+	if db.archive != "" {
+		if err := db.archiveWAL(); err != nil {
+			return fmt.Errorf("archiving wal: %w", err)
+		}
+	}
+	return db.wal.Truncate()
+}
+
+// StartCheckpointer checkpoints the database every interval until Close. A
+// failed checkpoint is returned by the next call to Checkpoint or Close.
+func (db *Database) StartCheckpointer(interval time.Duration) {
+	db.wg.Add(1)
+	go func() {
+		defer db.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-db.stop:
+				return
+			case <-ticker.C:
+				db.backgroundCheckpoint()
+			}
+		}
+	}()
+}
+
+// backgroundCheckpoint checkpoints on behalf of a background goroutine and
+// keeps the error, if any, for checkpointFailure
+func (db *Database) backgroundCheckpoint() {
+	if err := db.checkpoint(); err != nil {
+		db.checkpointMu.Lock()
+		db.checkpointErr = err
+		db.checkpointMu.Unlock()
+	}
+}
+
+// checkpointFailure returns and clears the last error of a background
+// checkpoint
+func (db *Database) checkpointFailure() error {
+	db.checkpointMu.Lock()
+	defer db.checkpointMu.Unlock()
+	err := db.checkpointErr
+	db.checkpointErr = nil
+	if err != nil {
+		return fmt.Errorf("background checkpoint: %w", err)
+	}
+	return nil
+}
+
+// Close stops background work, ends change subscriptions and closes the
+// write-ahead log and page file. Pages changed since the last checkpoint are
+// rebuilt from the log on open. A background checkpoint failure not yet
+// returned by Checkpoint is returned here.
+func (db *Database) Close() error {
+	db.closeOnce.Do(func() { close(db.stop) })
+	db.ship.close()
+	db.wg.Wait()
+	err := db.checkpointFailure()
+	if feedErr := db.feed.close(); err == nil {
+		err = feedErr
+	}
+	if db.wal == nil {
+		return err
+	}
+	if walErr := db.wal.Close(); err == nil {
+		err = walErr
+	}
+	if db.pager != nil {
+		if pagerErr := db.pager.Close(); err == nil {
+			err = pagerErr
+		}
+	}
+	return err
+}
+
+// lockTablesForRead read-locks every table in name order and returns a func
+// that releases them. The caller must hold db.mu.
+func (db *Database) lockTablesForRead() func() {
+	names := make([]string, 0, len(db.tables))
+	for name := range db.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		db.tables[name].mu.RLock()
+	}
+	return func() {
+		for _, name := range names {
+			db.tables[name].mu.RUnlock()
+		}
+	}
+}
+
+// buildSnapshot copies the current contents of every table. The caller must
+// hold db.mu and a read lock on every table.
+func (db *Database) buildSnapshot() snapshot {
+	snap := snapshot{Engine: db.engine, Tables: make(map[string]tableSnapshot, len(db.tables))}
+	if db.pager != nil {
+		snap.Pages = db.pager.state()
+	}
+	for name, table := range db.tables {
+		ts := tableSnapshot{
+			Schema:  table.currentSchema(),
+			Indexes: make([]IndexSpec, 0, len(table.indexes)),
+		}
+		switch engine := table.engine.(type) {
+		case *diskEngine:
+			ts.Root, ts.Rows = engine.root, engine.rows
+		case *memoryEngine:
+			ts.Records = make([]VersionedRecord, 0, len(engine.records))
+			for _, vRecord := range engine.records {
+				ts.Records = append(ts.Records, vRecord)
+			}
+		}
+		for _, idx := range table.indexes {
+			ts.Indexes = append(ts.Indexes, idx.spec)
+		}
+		sort.Slice(ts.Indexes, func(i, j int) bool { return ts.Indexes[i].Name < ts.Indexes[j].Name })
+		snap.Tables[name] = ts
+	}
+	return snap
+}
+
+// restoreSnapshot replaces the contents of the database with snap. The caller
+// must hold db.mu or have exclusive access to db.
+func (db *Database) restoreSnapshot(snap snapshot) error {
+	tables := make(map[string]*Table, len(snap.Tables))
+	version := snap.Version
+	for name, ts := range snap.Tables {
+		schema, err := ts.Schema.prepare()
+		if err != nil {
+			return fmt.Errorf("table %s: %w", name, err)
+		}
+		var engine Engine = newMemoryEngine()
+		if db.pager != nil {
+			if ts.Root == 0 {
+				return fmt.Errorf("table %s has no root page", name)
+			}
+			engine = openDiskEngine(db.pager, schema, ts.Root, ts.Rows)
+		}
+		table := db.newTable(schema, engine)
+		for _, vRecord := range ts.Records {
+			row, err := schema.decodeRow(vRecord.Record)
+			if err != nil {
+				return fmt.Errorf("table %s: %w", name, err)
+			}
+			vRecord.Record = row
+			if err := table.engine.Put(schema.primaryKey(row), vRecord); err != nil {
+				return fmt.Errorf("table %s: %w", name, err)
+			}
+			version = max(version, vRecord.Version)
+		}
+		for _, spec := range ts.Indexes {
+			if err := table.buildIndex(spec); err != nil {
+				return fmt.Errorf("table %s: %w", name, err)
+			}
+		}
+		tables[name] = table
+	}
+
+	db.tables = tables
+	db.cache.clear()
+	db.txMu.Lock()
+	db.version = version
+	db.txMu.Unlock()
+	return nil
+}
+
+// writeSnapshot atomically replaces the file at path with snap, encrypted
+// with keys
+func writeSnapshot(path string, snap snapshot, keys *Keyring) error {
+	data, err := json.Marshal(snap)
+	if err == nil {
+		data, err = keys.seal(data, snapshotAAD)
+	}
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic durably replaces the file at path with data
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// readSnapshot decrypts and decodes the snapshot stored at path
+func readSnapshot(path string, keys *Keyring) (snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return snapshot{}, err
+	}
+	if data, err = keys.open(data, snapshotAAD); err != nil {
+		return snapshot{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var snap snapshot
+	if err := decodeJSON(data, &snap); err != nil {
+		return snapshot{}, err
+	}
+	return snap, nil
+}
+
+// syncDir flushes directory metadata so a rename survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
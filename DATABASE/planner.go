@@ -0,0 +1,829 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ColumnStats summarises the values of one column for the planner
+type ColumnStats struct {
+	Distinct int
+	Nulls    int
+	Min      any
+	Max      any
+}
+
+// TableStats are the planner statistics of a table
+type TableStats struct {
+	Rows    int
+	Columns map[string]ColumnStats
+}
+
+// maxPointLookups caps how many equality lookups an IN list may expand to
+const maxPointLookups = 64
+
+// Analyze recomputes and returns the planner statistics of a table
+func (db *Database) Analyze(ctx context.Context, tableName string) (TableStats, error) {
+	table, err := db.lookupTable(tableName)
+	if err != nil {
+		return TableStats{}, err
+	}
+	table.statsMu.Lock()
+	defer table.statsMu.Unlock()
+	table.refreshStats()
+	return table.stats, nil
+}
+
+// statistics returns the table's statistics, recomputing them once enough
+// rows have changed since the last run
+func (t *Table) statistics() TableStats {
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+
+	t.mu.RLock()
+	mods := t.mods
+	t.mu.RUnlock()
+	if !t.statsValid || mods-t.statsMods > max(100, t.stats.Rows/10) {
+		t.refreshStats()
+	}
+	return t.stats
+}
+
+// refreshStats scans every row. The caller must hold t.statsMu.
+func (t *Table) refreshStats() {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	stats := TableStats{Rows: t.engine.Len(), Columns: make(map[string]ColumnStats, len(t.schema.Columns))}
+	columns := make([]ColumnStats, len(t.schema.Columns))
+	distinct := make([]map[any]struct{}, len(t.schema.Columns))
+	for i := range distinct {
+		distinct[i] = make(map[any]struct{})
+	}
+	err := t.engine.Scan(func(key any, vRecord VersionedRecord) bool {
+		for i, column := range t.schema.Columns {
+			cs := &columns[i]
+			value := vRecord.Record[column.Name]
+			if value == nil {
+				cs.Nulls++
+				continue
+			}
+			distinct[i][keyOf(value)] = struct{}{}
+			if cs.Min == nil || compareValues(value, cs.Min) < 0 {
+				cs.Min = value
+			}
+			if cs.Max == nil || compareValues(value, cs.Max) > 0 {
+				cs.Max = value
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return // Keep the old statistics; the query itself will report the error
+	}
+	for i, column := range t.schema.Columns {
+		columns[i].Distinct = len(distinct[i])
+		stats.Columns[column.Name] = columns[i]
+	}
+
+	t.stats = stats
+	t.statsMods = t.mods
+	t.statsValid = true
+}
+
+// columnPredicates collects the sargable conditions on one column
+type columnPredicates struct {
+	equal  []any // Candidate values from = or IN
+	lower  *Bound
+	upper  *Bound
+	prefix *string
+	match  []string // Full-text queries from MATCH
+}
+
+// accessPath is how the rows of one table are fetched
+type accessPath struct {
+	table    string
+	index    *IndexSpec // nil for a full table scan or primary key access
+	primary  bool       // Fetch rows from the engine by primary key
+	ranges   []Range
+	detail   string // Human-readable index condition
+	estRows  float64
+	cost     float64
+	scanCost float64 // Cost of the full table scan it was compared against
+}
+
+// planScan chooses between a full table scan, primary key access and the
+// cheapest usable index for the conjuncts of where. The whole WHERE clause is
+// still applied to every fetched row, so the plan only has to return a
+// superset.
+func (ex *executor) planScan(table *Table, tableName string, alias string, where Expr) accessPath {
+	stats := table.statistics()
+	rows := float64(stats.Rows)
+	path := accessPath{table: tableName, estRows: rows, cost: rows, scanCost: rows}
+
+	preds := ex.sargable(table.schema, alias, where)
+	if len(preds) == 0 {
+		return path
+	}
+
+	// Primary key access reads rows straight from the engine, without the
+	// extra lookup per row an index needs
+	_, ordered := table.engine.(rangeScanner)
+	if candidate, ok := primaryPath(table.schema.PrimaryKey, ordered, preds, stats); ok {
+		candidate.table = tableName
+		candidate.scanCost = path.scanCost
+		candidate.cost = candidate.estRows + float64(max(1, len(candidate.ranges)))*math.Log2(rows+2)
+		if candidate.cost < path.cost {
+			path = candidate
+		}
+	}
+
+	table.mu.RLock()
+	specs := make([]IndexSpec, 0, len(table.indexes))
+	for _, idx := range table.indexes {
+		specs = append(specs, idx.spec)
+	}
+	table.mu.RUnlock()
+
+	for i := range specs {
+		candidate, ok := indexPath(specs[i], preds, stats)
+		if !ok {
+			continue
+		}
+		candidate.table = tableName
+		candidate.scanCost = path.scanCost
+		candidate.cost = candidate.estRows*1.5 + float64(len(candidate.ranges))*math.Log2(rows+2)
+		if candidate.cost < path.cost || (candidate.cost == path.cost && path.index != nil && candidate.index.Name < path.index.Name) {
+			path = candidate
+		}
+	}
+	return path
+}
+
+// primaryPath builds point lookups or, for engines that keep rows in key
+// order, a range scan on the primary key from preds
+func primaryPath(column string, ordered bool, preds map[string]*columnPredicates, stats TableStats) (accessPath, bool) {
+	p := preds[column]
+	if p == nil {
+		return accessPath{}, false
+	}
+	path := accessPath{primary: true}
+	switch {
+	case len(p.equal) > 0:
+		for _, value := range p.equal {
+			path.ranges = append(path.ranges, Range{Equal: []any{value}})
+		}
+		path.detail = describeEqual(column, p.equal)
+		path.estRows = math.Min(float64(len(p.equal)), math.Max(1, float64(stats.Rows)))
+	case ordered && (p.lower != nil || p.upper != nil):
+		path.ranges = []Range{{Lower: p.lower, Upper: p.upper}}
+		path.detail = describeRange(column, p.lower, p.upper)
+		path.estRows = math.Max(1, float64(stats.Rows)*rangeSelectivity(stats.Columns[column], p.lower, p.upper))
+	default:
+		return accessPath{}, false
+	}
+	return path, true
+}
+
+// indexPath builds the ranges an index can serve from preds
+func indexPath(spec IndexSpec, preds map[string]*columnPredicates, stats TableStats) (accessPath, bool) {
+	if spec.FullText {
+		return textPath(spec, preds, stats)
+	}
+	prefixes := [][]any{nil}
+	selectivity := 1.0
+	var conditions []string
+
+	i := 0
+	for ; i < len(spec.Columns); i++ {
+		column := spec.Columns[i]
+		p := preds[column]
+		if p == nil || len(p.equal) == 0 || len(prefixes)*len(p.equal) > maxPointLookups {
+			break
+		}
+		var expanded [][]any
+		for _, prefix := range prefixes {
+			for _, value := range p.equal {
+				expanded = append(expanded, append(append([]any(nil), prefix...), value))
+			}
+		}
+		prefixes = expanded
+		selectivity *= math.Min(1, float64(len(p.equal))/float64(max(1, stats.Columns[column].Distinct)))
+		conditions = append(conditions, describeEqual(column, p.equal))
+	}
+
+	var lower, upper *Bound
+	var prefix *string
+	if i < len(spec.Columns) && spec.Ordered {
+		column := spec.Columns[i]
+		if p := preds[column]; p != nil {
+			switch {
+			case p.lower != nil || p.upper != nil:
+				lower, upper = p.lower, p.upper
+				selectivity *= rangeSelectivity(stats.Columns[column], lower, upper)
+				conditions = append(conditions, describeRange(column, lower, upper))
+			case p.prefix != nil:
+				prefix = p.prefix
+				selectivity *= 0.1
+				conditions = append(conditions, fmt.Sprintf("%s LIKE '%s%%'", column, *prefix))
+			}
+		}
+	}
+
+	ranged := lower != nil || upper != nil || prefix != nil
+	if i == 0 && !ranged {
+		return accessPath{}, false
+	}
+	if !spec.Ordered && (i < len(spec.Columns) || ranged) {
+		return accessPath{}, false // Hash indexes only answer full-key equality
+	}
+
+	path := accessPath{index: &spec, detail: strings.Join(conditions, " AND ")}
+	for _, equal := range prefixes {
+		path.ranges = append(path.ranges, Range{Equal: equal, Lower: lower, Upper: upper, Prefix: prefix})
+	}
+	path.estRows = math.Max(1, float64(stats.Rows)*selectivity)
+	if spec.Unique && i == len(spec.Columns) {
+		path.estRows = math.Min(path.estRows, float64(len(prefixes)))
+	}
+	return path, true
+}
+
+// textPath serves the MATCH conditions on a full-text index's column. Rows
+// must hold every word of every query, so the queries are combined into one.
+func textPath(spec IndexSpec, preds map[string]*columnPredicates, stats TableStats) (accessPath, bool) {
+	column := spec.Columns[0]
+	p := preds[column]
+	if p == nil || len(p.match) == 0 {
+		return accessPath{}, false
+	}
+	query := strings.Join(p.match, " ")
+	conditions := make([]string, len(p.match))
+	for i, q := range p.match {
+		conditions[i] = fmt.Sprintf("%s MATCH %s", column, (&Literal{Value: q}).String())
+	}
+	return accessPath{
+		index:   &spec,
+		ranges:  []Range{{Match: query}},
+		detail:  strings.Join(conditions, " AND "),
+		estRows: math.Max(1, float64(stats.Rows)*0.01),
+	}, true
+}
+
+// rangeSelectivity estimates the fraction of rows between two bounds, using
+// the column's min and max for numeric and time columns
+func rangeSelectivity(cs ColumnStats, lower, upper *Bound) float64 {
+	lo, hi := numericPosition(cs.Min), numericPosition(cs.Max)
+	if lo == nil || hi == nil || *hi <= *lo {
+		if lower != nil && upper != nil {
+			return 0.25
+		}
+		return 1.0 / 3
+	}
+
+	from, to := *lo, *hi
+	if lower != nil {
+		if v := numericPosition(lower.Value); v != nil {
+			from = math.Max(from, *v)
+		}
+	}
+	if upper != nil {
+		if v := numericPosition(upper.Value); v != nil {
+			to = math.Min(to, *v)
+		}
+	}
+	if to < from {
+		return 0
+	}
+	return math.Max((to-from)/(*hi-*lo), 0.001)
+}
+
+// numericPosition maps ints, floats and times onto a line for interpolation
+func numericPosition(value any) *float64 {
+	var f float64
+	switch v := value.(type) {
+	case int64:
+		f = float64(v)
+	case float64:
+		f = v
+	case time.Time:
+		f = float64(v.UnixNano())
+	default:
+		return nil
+	}
+	return &f
+}
+
+// sargable extracts per-column conditions an index could answer from the
+// top-level AND terms of where
+func (ex *executor) sargable(schema Schema, alias string, where Expr) map[string]*columnPredicates {
+	preds := make(map[string]*columnPredicates)
+	get := func(column string) *columnPredicates {
+		if preds[column] == nil {
+			preds[column] = &columnPredicates{}
+		}
+		return preds[column]
+	}
+
+	for _, term := range splitConjuncts(where) {
+		switch e := term.(type) {
+		case *BinaryExpr:
+			column, op, value, ok := ex.columnComparison(schema, alias, e)
+			if !ok {
+				continue
+			}
+			p := get(column)
+			switch op {
+			case "=":
+				if p.equal == nil {
+					p.equal = []any{value}
+				}
+			case ">", ">=":
+				p.lower = tighter(p.lower, &Bound{Value: value, Inclusive: op == ">="}, 1)
+			case "<", "<=":
+				p.upper = tighter(p.upper, &Bound{Value: value, Inclusive: op == "<="}, -1)
+			}
+
+		case *BetweenExpr:
+			ref, ok := e.Expr.(*ColumnRef)
+			if !ok || e.Not {
+				continue
+			}
+			column, ok := columnOf(schema, alias, ref)
+			if !ok {
+				continue
+			}
+			low, ok1 := ex.constant(e.Low, column.Type)
+			high, ok2 := ex.constant(e.High, column.Type)
+			if !ok1 || !ok2 {
+				continue
+			}
+			p := get(column.Name)
+			p.lower = tighter(p.lower, &Bound{Value: low, Inclusive: true}, 1)
+			p.upper = tighter(p.upper, &Bound{Value: high, Inclusive: true}, -1)
+
+		case *InExpr:
+			ref, ok := e.Expr.(*ColumnRef)
+			if !ok || e.Not {
+				continue
+			}
+			column, ok := columnOf(schema, alias, ref)
+			if !ok {
+				continue
+			}
+			var values []any
+			for _, item := range e.List {
+				value, ok := ex.constant(item, column.Type)
+				if !ok {
+					values = nil
+					break
+				}
+				values = append(values, value)
+			}
+			if p := get(column.Name); len(values) > 0 && p.equal == nil {
+				p.equal = values
+			}
+
+		case *LikeExpr:
+			ref, ok := e.Expr.(*ColumnRef)
+			if !ok || e.Not {
+				continue
+			}
+			column, ok := columnOf(schema, alias, ref)
+			if !ok || column.Type != TypeString {
+				continue
+			}
+			pattern, ok := ex.constant(e.Pattern, TypeString)
+			if !ok {
+				continue
+			}
+			literal := pattern.(string)
+			if cut := strings.IndexAny(literal, "%_"); cut >= 0 {
+				if cut == 0 || literal[cut:] != "%" {
+					continue // Only "literal%" patterns map onto a range
+				}
+				prefix := literal[:cut]
+				get(column.Name).prefix = &prefix
+			} else if p := get(column.Name); p.equal == nil {
+				p.equal = []any{literal}
+			}
+
+		case *MatchExpr:
+			ref, ok := e.Expr.(*ColumnRef)
+			if !ok || e.Not {
+				continue
+			}
+			column, ok := columnOf(schema, alias, ref)
+			if !ok || column.Type != TypeString {
+				continue
+			}
+			if query, ok := ex.constant(e.Query, TypeString); ok {
+				p := get(column.Name)
+				p.match = append(p.match, query.(string))
+			}
+		}
+	}
+	return preds
+}
+
+// columnComparison matches "column op constant" or "constant op column"
+func (ex *executor) columnComparison(schema Schema, alias string, e *BinaryExpr) (string, string, any, bool) {
+	op := e.Op
+	ref, isRef := e.Left.(*ColumnRef)
+	other := e.Right
+	if !isRef {
+		ref, isRef = e.Right.(*ColumnRef)
+		other = e.Left
+		op = map[string]string{"=": "=", "<": ">", "<=": ">=", ">": "<", ">=": "<="}[op]
+	}
+	if !isRef || op == "" {
+		return "", "", nil, false
+	}
+	switch op {
+	case "=", "<", "<=", ">", ">=":
+	default:
+		return "", "", nil, false
+	}
+	column, ok := columnOf(schema, alias, ref)
+	if !ok {
+		return "", "", nil, false
+	}
+	value, ok := ex.constant(other, column.Type)
+	if !ok {
+		return "", "", nil, false
+	}
+	return column.Name, op, value, true
+}
+
+// columnOf resolves a column reference against the scanned table
+func columnOf(schema Schema, alias string, ref *ColumnRef) (Column, bool) {
+	if ref.Table != "" && ref.Table != alias {
+		return Column{}, false
+	}
+	return schema.Column(ref.Column)
+}
+
+// constant evaluates a column-free expression and converts it to t. It fails
+// for anything that is not a usable non-NULL constant.
+func (ex *executor) constant(expr Expr, t ColumnType) (any, bool) {
+	value, err := ex.eval(expr, emptyScope{})
+	if err != nil || value == nil {
+		return nil, false
+	}
+	converted, err := sqlCoerce(value, t)
+	if err != nil {
+		return nil, false
+	}
+	return converted, true
+}
+
+// tighter keeps the more restrictive of two bounds; dir is 1 for lower
+// bounds and -1 for upper bounds
+func tighter(current, candidate *Bound, dir int) *Bound {
+	if current == nil {
+		return candidate
+	}
+	c := compareValues(candidate.Value, current.Value) * dir
+	if c > 0 || (c == 0 && !candidate.Inclusive) {
+		return candidate
+	}
+	return current
+}
+
+// splitConjuncts flattens nested ANDs
+func splitConjuncts(expr Expr) []Expr {
+	if expr == nil {
+		return nil
+	}
+	if e, ok := expr.(*BinaryExpr); ok && e.Op == "AND" {
+		return append(splitConjuncts(e.Left), splitConjuncts(e.Right)...)
+	}
+	return []Expr{expr}
+}
+
+func describeEqual(column string, values []any) string {
+	if len(values) == 1 {
+		return fmt.Sprintf("%s = %s", column, (&Literal{Value: values[0]}).String())
+	}
+	items := make([]string, len(values))
+	for i, value := range values {
+		items[i] = (&Literal{Value: value}).String()
+	}
+	return fmt.Sprintf("%s IN (%s)", column, strings.Join(items, ", "))
+}
+
+func describeRange(column string, lower, upper *Bound) string {
+	var parts []string
+	if lower != nil {
+		op := ">"
+		if lower.Inclusive {
+			op = ">="
+		}
+		parts = append(parts, fmt.Sprintf("%s %s %s", column, op, (&Literal{Value: lower.Value}).String()))
+	}
+	if upper != nil {
+		op := "<"
+		if upper.Inclusive {
+			op = "<="
+		}
+		parts = append(parts, fmt.Sprintf("%s %s %s", column, op, (&Literal{Value: upper.Value}).String()))
+	}
+	return strings.Join(parts, " AND ")
+}
+
+// describe renders the access path for EXPLAIN
+func (p accessPath) describe() string {
+	if p.primary {
+		kind := "Primary Key Lookup"
+		if len(p.ranges[0].Equal) == 0 {
+			kind = "Primary Key Range Scan"
+		}
+		return fmt.Sprintf("%s on %s (%s) (rows=%.0f cost=%.2f, table scan cost=%.2f)",
+			kind, p.table, p.detail, p.estRows, p.cost, p.scanCost)
+	}
+	if p.index == nil {
+		return fmt.Sprintf("Table Scan on %s (rows=%.0f cost=%.2f)", p.table, p.estRows, p.cost)
+	}
+	kind := "hash"
+	switch {
+	case p.index.FullText:
+		kind = "fulltext"
+	case p.index.Ordered:
+		kind = "btree"
+	}
+	return fmt.Sprintf("Index Scan on %s using %s [%s] (%s) (rows=%.0f cost=%.2f, table scan cost=%.2f)",
+		p.table, p.index.Name, kind, p.detail, p.estRows, p.cost, p.scanCost)
+}
+
+// scanRows fetches the rows of a table visible to the transaction that may
+// satisfy where, using the access path chosen by the planner
+func (ex *executor) scanRows(tableName string, alias string, where Expr) (*Table, []Record, error) {
+	table, err := ex.tx.db.lookupTable(tableName)
+	if err != nil {
+		return nil, nil, err
+	}
+	path := ex.planScan(table, tableName, alias, where)
+	if path.primary {
+		rows, err := ex.tx.primaryLookup(tableName, path.ranges)
+		return table, rows, err
+	}
+	if path.index == nil {
+		rows, err := ex.tx.List(tableName)
+		return table, rows, err
+	}
+	rows, err := ex.tx.indexLookup(tableName, path.index.Name, path.ranges)
+	return table, rows, err
+}
+
+// indexLookup returns the rows visible to the transaction that an index scan
+// over ranges could match. The index reflects the latest committed state, so
+// rows with older versions still retained for open snapshots and rows in the
+// write set are added as candidates too; the caller filters every row again.
+func (tx *Transaction) indexLookup(tableName string, indexName string, ranges []Range) ([]Record, error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	table, err := tx.db.lookupTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[any]bool)
+	var keys []any
+	collect := func(key any) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	table.mu.RLock()
+	idx, exists := table.indexes[indexName]
+	if !exists {
+		table.mu.RUnlock()
+		return nil, fmt.Errorf("index %q does not exist", indexName)
+	}
+	for _, r := range ranges {
+		err := idx.scan(r, func(pks []any) bool {
+			for _, pk := range pks {
+				collect(pk)
+			}
+			return true
+		})
+		if err != nil {
+			table.mu.RUnlock()
+			return nil, err
+		}
+	}
+	for key := range table.history {
+		collect(key)
+	}
+	table.mu.RUnlock()
+
+	for key := range tx.writes[tableName] {
+		collect(key)
+	}
+
+	rows := make([]Record, 0, len(keys))
+	for _, key := range keys {
+		record, exists, err := tx.get(tableName, table, key)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			rows = append(rows, record.clone())
+		}
+	}
+	return rows, nil
+}
+
+// primaryLookup returns the rows visible to the transaction with the primary
+// keys in ranges: single keys in Equal, or a range between Lower and Upper.
+// Like indexLookup, ranges are scanned in the latest committed state, so
+// rows in the history and the write set are added as candidates too.
+func (tx *Transaction) primaryLookup(tableName string, ranges []Range) ([]Record, error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	table, err := tx.db.lookupTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[any]bool)
+	var keys []any
+	collect := func(key any) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	scanned := false
+	for _, r := range ranges {
+		if len(r.Equal) > 0 {
+			collect(keyOf(r.Equal[0]))
+			continue
+		}
+		scanner, ok := table.engine.(rangeScanner)
+		if !ok {
+			return nil, fmt.Errorf("table %q cannot scan primary key ranges", tableName)
+		}
+		table.mu.RLock()
+		err := scanner.scanRange(r.Lower, r.Upper, func(key any, _ VersionedRecord) bool {
+			collect(key)
+			return true
+		})
+		if err != nil {
+			table.mu.RUnlock()
+			return nil, err
+		}
+		for key := range table.history {
+			collect(key)
+		}
+		table.mu.RUnlock()
+		scanned = true
+	}
+	if scanned {
+		for key := range tx.writes[tableName] {
+			collect(key)
+		}
+	}
+
+	rows := make([]Record, 0, len(keys))
+	for _, key := range keys {
+		record, exists, err := tx.get(tableName, table, key)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			rows = append(rows, record.clone())
+		}
+	}
+	return rows, nil
+}
+
+// explain describes how stmt would be executed
+func (ex *executor) explain(stmt Statement) (*Result, error) {
+	var lines []string
+	addScan := func(indent, tableName, alias string, where Expr) error {
+		table, err := ex.tx.db.lookupTable(tableName)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, indent+"-> "+ex.planScan(table, tableName, alias, where).describe())
+		return nil
+	}
+	addFilter := func(where Expr) {
+		if where != nil {
+			lines = append(lines, "       Filter: "+where.String())
+		}
+	}
+
+	switch s := stmt.(type) {
+	case *SelectStmt:
+		lines = append(lines, "Select")
+		if s.From != nil {
+			sources, err := ex.tx.db.sources(s)
+			if err != nil {
+				return nil, err
+			}
+			if err := addScan("  ", sources[0].table, sources[0].name, s.Where); err != nil {
+				return nil, err
+			}
+			for j, join := range s.Joins {
+				strategy := "Nested Loop"
+				if _, _, _, hashed := equiJoin(sources[:j+2], join.On); hashed {
+					strategy = "Hash Join"
+				}
+				lines = append(lines, fmt.Sprintf("  -> %s (%s) on %s", strategy, join.Kind, join.On))
+				if err := addScan("       ", sources[j+1].table, sources[j+1].name, s.Where); err != nil {
+					return nil, err
+				}
+			}
+		}
+		addFilter(s.Where)
+		if len(s.GroupBy) > 0 {
+			keys := make([]string, len(s.GroupBy))
+			for i, key := range s.GroupBy {
+				keys[i] = key.String()
+			}
+			lines = append(lines, "  -> Group: "+strings.Join(keys, ", "))
+		} else if s.Having != nil || selectHasAggregate(s) {
+			lines = append(lines, "  -> Aggregate")
+		}
+		if s.Having != nil {
+			lines = append(lines, "       Having: "+s.Having.String())
+		}
+		if len(s.OrderBy) > 0 {
+			terms := make([]string, len(s.OrderBy))
+			for i, item := range s.OrderBy {
+				terms[i] = item.Expr.String()
+				if item.Desc {
+					terms[i] += " DESC"
+				}
+			}
+			lines = append(lines, "  -> Sort: "+strings.Join(terms, ", "))
+		}
+		if s.Limit != nil || s.Offset != nil {
+			lines = append(lines, "  -> Limit")
+		}
+	case *UpdateStmt:
+		lines = append(lines, "Update on "+s.Table)
+		if err := addScan("  ", s.Table, s.Table, s.Where); err != nil {
+			return nil, err
+		}
+		addFilter(s.Where)
+	case *DeleteStmt:
+		lines = append(lines, "Delete on "+s.Table)
+		if err := addScan("  ", s.Table, s.Table, s.Where); err != nil {
+			return nil, err
+		}
+		addFilter(s.Where)
+	case *InsertStmt:
+		lines = append(lines, fmt.Sprintf("Insert on %s (%d rows)", s.Table, len(s.Rows)))
+	default:
+		lines = append(lines, fmt.Sprintf("%T (no plan)", stmt))
+	}
+
+	result := &Result{Columns: []string{"QUERY PLAN"}}
+	for _, line := range lines {
+		result.Rows = append(result.Rows, []any{line})
+	}
+	return result, nil
+}
+
+// execAnalyze refreshes statistics and reports them per column
+func (ex *executor) execAnalyze(stmt *AnalyzeStmt) (*Result, error) {
+	names := []string{stmt.Table}
+	if stmt.Table == "" {
+		ex.tx.db.mu.RLock()
+		names = names[:0]
+		for name := range ex.tx.db.tables {
+			names = append(names, name)
+		}
+		ex.tx.db.mu.RUnlock()
+		sort.Strings(names)
+	}
+
+	result := &Result{Columns: []string{"table", "column", "rows", "distinct", "nulls", "min", "max"}}
+	for _, name := range names {
+		stats, err := ex.tx.db.Analyze(ex.tx.ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		table, err := ex.tx.db.lookupTable(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, column := range table.schema.Columns {
+			cs := stats.Columns[column.Name]
+			result.Rows = append(result.Rows, []any{name, column.Name, int64(stats.Rows), int64(cs.Distinct), int64(cs.Nulls), cs.Min, cs.Max})
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,975 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultReplicationRetention is the number of recent log entries kept
+	// for replicas catching up
+	DefaultReplicationRetention = 10000
+
+	heartbeatInterval = time.Second     // Sent by the primary while idle
+	replicaTimeout    = 5 * time.Second // Silence after which a replica reconnects
+	reconnectDelay    = time.Second
+	snapshotChunk     = 500 // Rows per snapshot message
+	shipBatch         = 256 // Entries copied out of the ship log at a time
+)
+
+// ErrReadOnly is returned for writes to a database following a primary
+var ErrReadOnly = errors.New("database is a read-only replica")
+
+// errSnapshotOutrun ends a stream whose snapshot took so long that the log
+// entries following it are no longer retained; the replica asks again
+var errSnapshotOutrun = errors.New("log moved on while the snapshot was sent")
+
+// Replication messages. A replica opens with hello, giving the LSN of the
+// last entry it applied, or 0 to be sent a snapshot first. The primary sends
+// the snapshot if asked for, then log entries in LSN order and heartbeats
+// while idle. The replica acknowledges what it has applied.
+const (
+	msgHello     = "hello"
+	msgAck       = "ack"
+	msgTable     = "table"    // Snapshot: schema and indexes of a table
+	msgRows      = "rows"     // Snapshot: rows of the last table
+	msgSnapshot  = "snapshot" // Snapshot complete as of LSN
+	msgEntry     = "entry"
+	msgHeartbeat = "heartbeat"
+	msgError     = "error" // The primary cannot serve this replica
+)
+
+// replMessage is one frame of the replication protocol
+type replMessage struct {
+	Type    string       `json:"type"`
+	LSN     uint64       `json:"lsn,omitempty"`
+	Version int          `json:"version,omitempty"` // Commit version of snapshot rows
+	Table   *BackupTable `json:"table,omitempty"`
+	Rows    []Record     `json:"rows,omitempty"`
+	Entry   *walEntry    `json:"entry,omitempty"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// replConn frames replication messages over a connection like WAL records
+type replConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+func newReplConn(conn net.Conn) *replConn {
+	return &replConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+}
+
+// send buffers msg; flush writes it out
+func (c *replConn) send(msg replMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = c.w.Write(encodeFrame(payload))
+	return err
+}
+
+func (c *replConn) flush() error {
+	return c.w.Flush()
+}
+
+func (c *replConn) receive() (replMessage, error) {
+	payload, err := readFrame(c.r)
+	if err == errTornFrame {
+		return replMessage{}, errors.New("corrupt replication message")
+	}
+	if err != nil {
+		return replMessage{}, err
+	}
+	var msg replMessage
+	err = decodeJSON(payload, &msg)
+	return msg, err
+}
+
+// shipLog retains the most recent entries logged by a durable database for
+// replicas to stream, and tracks the replicas streaming them
+type shipLog struct {
+	entries   []walEntry // Oldest first, LSNs are contiguous
+	last      uint64     // LSN of the last logged entry
+	retention int
+	replicas  map[*shipCursor]struct{}
+	notify    chan struct{} // Closed and replaced when an entry is appended
+	closed    bool
+	mu        sync.Mutex
+}
+
+// shipCursor is the progress of one connected replica
+type shipCursor struct {
+	addr      string
+	state     string
+	sent      uint64
+	acked     uint64
+	connected time.Time
+}
+
+func newShipLog(retention int) *shipLog {
+	return &shipLog{
+		retention: max(retention, 1),
+		replicas:  make(map[*shipCursor]struct{}),
+		notify:    make(chan struct{}),
+	}
+}
+
+// append retains a logged entry and wakes the streams
+func (l *shipLog) append(entry walEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if entry.LSN != l.last+1 {
+		l.entries = nil // Keep LSNs contiguous
+	}
+	l.last = entry.LSN
+	l.entries = append(l.entries, entry)
+	if len(l.entries) > l.retention+l.retention/4 {
+		l.entries = slices.Clone(l.entries[len(l.entries)-l.retention:])
+	}
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// reset drops every retained entry; the next one logged follows lsn
+func (l *shipLog) reset(lsn uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries, l.last = nil, lsn
+}
+
+// first returns the oldest retained LSN. The caller must hold l.mu.
+func (l *shipLog) first() uint64 {
+	if len(l.entries) == 0 {
+		return l.last + 1
+	}
+	return l.entries[0].LSN
+}
+
+// read returns up to shipBatch entries from LSN from onwards, and a channel
+// that is closed when more are logged
+func (l *shipLog) read(from uint64) ([]walEntry, <-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, nil, errors.New("database closed")
+	}
+	if from < l.first() {
+		return nil, nil, errors.New("replica is too far behind the primary; start it again from an empty database")
+	}
+	start := min(int(from-l.first()), len(l.entries))
+	end := min(start+shipBatch, len(l.entries))
+	return slices.Clone(l.entries[start:end]), l.notify, nil
+}
+
+func (l *shipLog) lastLSN() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.last
+}
+
+// close wakes every stream so it can end
+func (l *shipLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.notify)
+	}
+}
+
+func (l *shipLog) register(addr string) *shipCursor {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cursor := &shipCursor{addr: addr, state: "snapshot", connected: time.Now()}
+	l.replicas[cursor] = struct{}{}
+	return cursor
+}
+
+func (l *shipLog) unregister(cursor *shipCursor) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.replicas, cursor)
+}
+
+// update applies fn to a cursor under the lock
+func (l *shipLog) update(cursor *shipCursor, fn func(*shipCursor)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fn(cursor)
+}
+
+// ReplicaInfo describes a replica streaming from this database
+type ReplicaInfo struct {
+	Addr      string
+	State     string // "snapshot" while the snapshot is sent, then "streaming"
+	SentLSN   uint64
+	AckedLSN  uint64        // Last entry the replica reported as applied
+	Lag       uint64        // Entries logged here and not yet acknowledged
+	Delay     time.Duration // How long the oldest unacknowledged entry has waited
+	Connected time.Time
+}
+
+// Replicas lists the replicas streaming from this database, by address
+func (db *Database) Replicas() []ReplicaInfo {
+	l := db.ship
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	infos := make([]ReplicaInfo, 0, len(l.replicas))
+	for cursor := range l.replicas {
+		info := ReplicaInfo{
+			Addr:      cursor.addr,
+			State:     cursor.state,
+			SentLSN:   cursor.sent,
+			AckedLSN:  cursor.acked,
+			Connected: cursor.connected,
+		}
+		if cursor.acked < l.last {
+			info.Lag = l.last - cursor.acked
+			if next := cursor.acked + 1; next >= l.first() {
+				info.Delay = time.Since(time.Unix(0, l.entries[next-l.first()].Time))
+			}
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Addr < infos[j].Addr })
+	return infos
+}
+
+// ReplicationServer ships the log of a durable database to replicas over TCP
+type ReplicationServer struct {
+	db       *Database
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closing  bool
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+}
+
+// NewReplicationServer creates a replication server for db
+func NewReplicationServer(db *Database) *ReplicationServer {
+	return &ReplicationServer{db: db, conns: make(map[net.Conn]struct{})}
+}
+
+// ListenAndServe listens on the TCP address addr and serves until Close
+func (s *ReplicationServer) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts replicas on ln until Close, after which it returns nil
+func (s *ReplicationServer) Serve(ln net.Listener) error {
+	if s.db.wal == nil {
+		ln.Close()
+		return errors.New("database is not durable")
+	}
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		ln.Close()
+		return errors.New("server closed")
+	}
+	s.listener = ln
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closing := s.closing
+			s.mu.Unlock()
+			if closing {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.serveReplica(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Addr returns the address the server is listening on, or nil
+func (s *ReplicationServer) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Close stops accepting replicas and disconnects the connected ones
+func (s *ReplicationServer) Close() error {
+	s.mu.Lock()
+	s.closing = true
+	ln := s.listener
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	var err error
+	if ln != nil {
+		err = ln.Close()
+	}
+	s.wg.Wait()
+	return err
+}
+
+// serveReplica streams the log to one replica until it disconnects
+func (s *ReplicationServer) serveReplica(conn net.Conn) {
+	defer conn.Close()
+	c := newReplConn(conn)
+	conn.SetReadDeadline(time.Now().Add(replicaTimeout))
+	hello, err := c.receive()
+	if err != nil || hello.Type != msgHello {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	cursor := s.db.ship.register(conn.RemoteAddr().String())
+	defer s.db.ship.unregister(cursor)
+
+	// Acknowledgements arrive independently of the stream; a read error
+	// means the replica has gone
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			msg, err := c.receive()
+			if err != nil {
+				return
+			}
+			if msg.Type == msgAck {
+				s.db.ship.update(cursor, func(cursor *shipCursor) { cursor.acked = max(cursor.acked, msg.LSN) })
+			}
+		}
+	}()
+
+	err = s.stream(c, cursor, hello.LSN, gone)
+	if err != nil && err != errSnapshotOutrun {
+		c.send(replMessage{Type: msgError, Error: err.Error()})
+		c.flush()
+	}
+}
+
+// stream sends a snapshot if the replica has applied nothing, then every
+// entry after the replica's position
+func (s *ReplicationServer) stream(c *replConn, cursor *shipCursor, applied uint64, gone <-chan struct{}) error {
+	ship := s.db.ship
+	if applied == 0 {
+		lsn, err := s.sendSnapshot(c)
+		if err != nil {
+			return err
+		}
+		applied = lsn
+	} else if applied > ship.lastLSN() {
+		return errors.New("replica is ahead of the primary")
+	}
+	ship.update(cursor, func(cursor *shipCursor) {
+		cursor.state, cursor.sent, cursor.acked = "streaming", applied, max(cursor.acked, applied)
+	})
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	next := applied + 1
+	for {
+		entries, wait, err := ship.read(next)
+		if err != nil {
+			return err
+		}
+		for i := range entries {
+			if err := c.send(replMessage{Type: msgEntry, Entry: &entries[i]}); err != nil {
+				return err
+			}
+		}
+		if err := c.flush(); err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			next = entries[len(entries)-1].LSN + 1
+			ship.update(cursor, func(cursor *shipCursor) { cursor.sent = next - 1 })
+			continue
+		}
+
+		select {
+		case <-wait:
+		case <-gone:
+			return nil
+		case <-heartbeat.C:
+			if err := c.send(replMessage{Type: msgHeartbeat, LSN: ship.lastLSN()}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sendSnapshot sends every table as of the current log position and returns
+// that position. Writers are blocked only while the position is taken; the
+// rows are read from a transaction begun at the same point.
+func (s *ReplicationServer) sendSnapshot(c *replConn) (uint64, error) {
+	db := s.db
+	db.mu.RLock()
+	unlock := db.lockTablesForRead()
+	lsn := db.wal.LSN()
+	tables := make([]BackupTable, 0, len(db.tables))
+	for name, table := range db.tables {
+		tables = append(tables, table.backupTable(name))
+	}
+	tx, err := db.BeginTransaction(context.Background())
+	unlock()
+	db.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	sort.Slice(tables, func(i, j int) bool { return tables[i].Name < tables[j].Name })
+
+	for i := range tables {
+		if err := c.send(replMessage{Type: msgTable, Table: &tables[i], Version: tx.startVersion}); err != nil {
+			return 0, err
+		}
+		rows, err := tx.List(tables[i].Name)
+		if err != nil {
+			return 0, err
+		}
+		for len(rows) > 0 {
+			n := min(len(rows), snapshotChunk)
+			if err := c.send(replMessage{Type: msgRows, Rows: rows[:n]}); err != nil {
+				return 0, err
+			}
+			rows = rows[n:]
+		}
+	}
+
+	db.ship.mu.Lock()
+	outrun := lsn+1 < db.ship.first()
+	db.ship.mu.Unlock()
+	if outrun {
+		return 0, errSnapshotOutrun
+	}
+	if err := c.send(replMessage{Type: msgSnapshot, LSN: lsn}); err != nil {
+		return 0, err
+	}
+	return lsn, c.flush()
+}
+
+// Replica follows a primary, applying its log to a read-only database. See
+// Database.Follow.
+type Replica struct {
+	db      *Database
+	primary string
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	status      ReplicaStatus
+	appliedTime time.Time // When the primary logged the last applied entry
+	mu          sync.Mutex
+}
+
+// ReplicaStatus reports how far a replica trails its primary
+type ReplicaStatus struct {
+	Primary     string
+	State       string        // connecting, snapshot, streaming, stopped or promoted
+	AppliedLSN  uint64        // Last primary log entry applied here
+	PrimaryLSN  uint64        // Last entry logged by the primary, as of LastContact
+	Lag         uint64        // Entries behind the primary
+	Delay       time.Duration // How long ago the primary logged the last applied entry, zero when caught up
+	LastContact time.Time
+	Err         error // Last error; replication stops after errors other than a lost connection
+}
+
+// fatalError wraps an error after which a replica stops instead of
+// reconnecting
+type fatalError struct {
+	error
+}
+
+// Follow makes db a read-only replica of the primary serving replication at
+// addr and streams its log in the background until Promote or Close. A new
+// replica must start from an empty database, which is first sent a
+// snapshot; a durable replica that is reopened resumes where it stopped, so
+// it must only ever follow the same primary.
+func (db *Database) Follow(addr string) (*Replica, error) {
+	var applied uint64
+	if db.wal != nil {
+		applied = db.wal.LSN()
+	}
+	if applied == 0 && len(db.Tables()) > 0 {
+		return nil, errors.New("a new replica must start from an empty database")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Replica{
+		db:      db,
+		primary: addr,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		status:  ReplicaStatus{Primary: addr, State: "connecting", AppliedLSN: applied},
+	}
+	db.txMu.Lock()
+	if db.replica != nil {
+		db.txMu.Unlock()
+		cancel()
+		return nil, errors.New("database is already a replica")
+	}
+	db.replica = r
+	db.txMu.Unlock()
+
+	db.wg.Add(1)
+	go func() {
+		defer db.wg.Done()
+		defer close(r.done)
+		r.run(ctx)
+	}()
+	go func() {
+		select {
+		case <-db.stop:
+			cancel()
+		case <-r.done:
+		}
+	}()
+	return r, nil
+}
+
+// Promote stops following the primary and makes the database writable.
+// Entries the primary logged but had not shipped are not part of it, so
+// other replicas should be started again from this database.
+func (r *Replica) Promote() error {
+	r.cancel()
+	<-r.done
+	db := r.db
+	db.txMu.Lock()
+	defer db.txMu.Unlock()
+	if db.replica != r {
+		return errors.New("replica was already promoted")
+	}
+	db.replica = nil
+	r.mu.Lock()
+	r.status.State = "promoted"
+	r.mu.Unlock()
+	return nil
+}
+
+// Promote promotes the database if it is following a primary
+func (db *Database) Promote() error {
+	db.txMu.Lock()
+	r := db.replica
+	db.txMu.Unlock()
+	if r == nil {
+		return errors.New("database is not a replica")
+	}
+	return r.Promote()
+}
+
+// Status reports the replica's progress
+func (r *Replica) Status() ReplicaStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := r.status
+	if status.PrimaryLSN > status.AppliedLSN {
+		status.Lag = status.PrimaryLSN - status.AppliedLSN
+		if !r.appliedTime.IsZero() {
+			status.Delay = time.Since(r.appliedTime)
+		}
+	}
+	return status
+}
+
+// ReplicaStatus returns the status of the replica the database is, if it is
+// following a primary
+func (db *Database) ReplicaStatus() (ReplicaStatus, bool) {
+	db.txMu.Lock()
+	r := db.replica
+	db.txMu.Unlock()
+	if r == nil {
+		return ReplicaStatus{}, false
+	}
+	return r.Status(), true
+}
+
+// isReplica reports whether the database is following a primary
+func (db *Database) isReplica() bool {
+	db.txMu.Lock()
+	defer db.txMu.Unlock()
+	return db.replica != nil
+}
+
+// run streams from the primary, reconnecting after lost connections, until
+// ctx is done or a fatal error, which is kept in the status
+func (r *Replica) run(ctx context.Context) {
+	for {
+		err := r.stream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		var fatal fatalError
+		stop := errors.As(err, &fatal)
+		r.mu.Lock()
+		r.status.Err = err
+		r.status.State = "connecting"
+		if stop {
+			r.status.State = "stopped"
+		}
+		r.mu.Unlock()
+		if stop {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// stream runs one connection to the primary
+func (r *Replica) stream(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: replicaTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", r.primary)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer context.AfterFunc(ctx, func() { conn.Close() })()
+
+	c := newReplConn(conn)
+	applied := r.Status().AppliedLSN
+	if err := c.send(replMessage{Type: msgHello, LSN: applied}); err != nil {
+		return err
+	}
+	if err := c.flush(); err != nil {
+		return err
+	}
+	var snap *replicaSnapshot
+	state := "streaming"
+	if applied == 0 {
+		snap, state = &replicaSnapshot{tables: make(map[string]*Table)}, "snapshot"
+	}
+	r.mu.Lock()
+	r.status.State = state
+	r.mu.Unlock()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(replicaTimeout))
+		msg, err := c.receive()
+		if err != nil {
+			return err
+		}
+		primaryLSN := msg.LSN
+		switch msg.Type {
+		case msgTable, msgRows:
+			if snap == nil {
+				return fatalError{errors.New("unexpected snapshot data")}
+			}
+			if err := snap.add(r.db, msg); err != nil {
+				return fatalError{fmt.Errorf("loading snapshot: %w", err)}
+			}
+		case msgSnapshot:
+			if snap == nil {
+				return fatalError{errors.New("unexpected snapshot")}
+			}
+			if err := r.db.installSnapshot(snap, msg.LSN); err != nil {
+				return fatalError{fmt.Errorf("installing snapshot: %w", err)}
+			}
+			snap, applied = nil, msg.LSN
+			r.mu.Lock()
+			r.status.State, r.status.AppliedLSN = "streaming", applied
+			r.mu.Unlock()
+		case msgEntry:
+			if snap != nil || msg.Entry == nil || msg.Entry.LSN != applied+1 {
+				return fatalError{errors.New("replica log is out of step with the primary")}
+			}
+			if err := r.db.applyShipped(*msg.Entry); err != nil {
+				return fatalError{fmt.Errorf("applying entry %d: %w", msg.Entry.LSN, err)}
+			}
+			applied, primaryLSN = msg.Entry.LSN, msg.Entry.LSN
+			r.mu.Lock()
+			r.status.AppliedLSN, r.appliedTime = applied, time.Unix(0, msg.Entry.Time)
+			r.mu.Unlock()
+		case msgHeartbeat:
+		case msgError:
+			return fatalError{fmt.Errorf("primary: %s", msg.Error)}
+		}
+
+		r.mu.Lock()
+		r.status.PrimaryLSN = max(r.status.PrimaryLSN, primaryLSN)
+		r.status.LastContact = time.Now()
+		r.status.Err = nil
+		r.mu.Unlock()
+		if c.r.Buffered() == 0 && snap == nil {
+			if err := c.send(replMessage{Type: msgAck, LSN: applied}); err != nil {
+				return err
+			}
+			if err := c.flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// replicaSnapshot collects the tables sent to a new replica, which are
+// installed together once complete
+type replicaSnapshot struct {
+	tables  map[string]*Table
+	specs   map[string][]IndexSpec
+	last    *Table
+	version int
+}
+
+func (snap *replicaSnapshot) add(db *Database, msg replMessage) error {
+	if msg.Type == msgTable {
+		if msg.Table == nil {
+			return errors.New("table message has no table")
+		}
+		schema, err := msg.Table.Schema.prepare()
+		if err != nil {
+			return fmt.Errorf("table %s: %w", msg.Table.Name, err)
+		}
+		snap.last = db.newTable(schema, db.newEngine(schema))
+		snap.tables[msg.Table.Name] = snap.last
+		if snap.specs == nil {
+			snap.specs = make(map[string][]IndexSpec)
+		}
+		snap.specs[msg.Table.Name] = msg.Table.Indexes
+		snap.version = msg.Version
+		return nil
+	}
+
+	if snap.last == nil {
+		return errors.New("rows sent before their table")
+	}
+	table := snap.last
+	for _, record := range msg.Rows {
+		row, err := table.schema.decodeRow(record)
+		if err != nil {
+			return err
+		}
+		if err := table.engine.Put(table.schema.primaryKey(row), VersionedRecord{Record: row, Version: snap.version}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// installSnapshot makes a complete snapshot the contents of an empty
+// replica, as of the primary's log position lsn
+func (db *Database) installSnapshot(snap *replicaSnapshot, lsn uint64) error {
+	for name, table := range snap.tables {
+		for _, spec := range snap.specs[name] {
+			if err := table.buildIndex(spec); err != nil {
+				return fmt.Errorf("table %s: %w", name, err)
+			}
+		}
+	}
+
+	db.mu.Lock()
+	if len(db.tables) > 0 {
+		db.mu.Unlock()
+		return errors.New("database is not empty")
+	}
+	db.tables = snap.tables
+	db.cache.clear()
+	db.txMu.Lock()
+	db.version = max(db.version, snap.version)
+	db.txMu.Unlock()
+	db.logMu.Lock()
+	var err error
+	if db.wal != nil {
+		err = db.wal.reset(lsn)
+	}
+	db.feed.publish(lsn, nil)
+	db.ship.reset(lsn)
+	db.logMu.Unlock()
+	db.mu.Unlock()
+	if err != nil || db.wal == nil {
+		return err
+	}
+	return db.checkpoint()
+}
+
+// applyShipped logs and applies an entry received from the primary, keeping
+// its LSN, version and time. It takes the same locks as the write that
+// logged the entry on the primary.
+func (db *Database) applyShipped(entry walEntry) error {
+	switch entry.Op {
+	case opCreateTable:
+		if entry.Schema == nil {
+			return errors.New("create table entry has no schema")
+		}
+		schema, err := entry.Schema.prepare()
+		if err != nil {
+			return err
+		}
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		if _, exists := db.tables[entry.Table]; exists {
+			return errors.New("table already exists")
+		}
+		done, _, err := db.logShipped(entry)
+		if err != nil {
+			return err
+		}
+		defer done()
+		db.tables[entry.Table] = db.newTable(schema, db.newEngine(schema))
+		return nil
+
+	case opCreateIndex, opSetTTL:
+		table, err := db.lookupTable(entry.Table)
+		if err != nil {
+			return err
+		}
+		table.mu.Lock()
+		defer table.mu.Unlock()
+		switch {
+		case entry.Op == opSetTTL && entry.TTL != nil:
+			if entry.TTL, err = table.schema.checkTTL(*entry.TTL); err != nil {
+				return err
+			}
+		case entry.Op == opCreateIndex:
+			if entry.Index == nil {
+				return errors.New("create index entry has no index")
+			}
+			if err := table.buildIndex(*entry.Index); err != nil {
+				return err
+			}
+		}
+		done, _, err := db.logShipped(entry)
+		if err != nil {
+			if entry.Op == opCreateIndex {
+				delete(table.indexes, entry.Index.Name)
+			}
+			return err
+		}
+		defer done()
+		if entry.Op == opSetTTL {
+			table.ttl = entry.TTL
+		}
+		return nil
+
+	case opInsert, opUpdate, opDelete, opCommit:
+		entry, err := db.decodeEntry(entry)
+		if err != nil {
+			return err
+		}
+		batch := entry.Batch
+		if entry.Op != opCommit {
+			batch = []walEntry{entry}
+		}
+		byName := make(map[string]*Table)
+		for _, e := range batch {
+			if byName[e.Table], err = db.lookupTable(e.Table); err != nil {
+				return err
+			}
+		}
+		names := make([]string, 0, len(byName))
+		for name := range byName {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			byName[name].mu.Lock()
+			defer byName[name].mu.Unlock()
+		}
+
+		done, keepHistory, err := db.logShipped(entry)
+		if err != nil {
+			return err
+		}
+		defer done()
+		for _, e := range batch {
+			table := byName[e.Table]
+			if e.Op == opDelete {
+				err = table.remove(e.Key, entry.Version, keepHistory)
+			} else {
+				err = table.put(e.Key, e.Record, entry.Version, keepHistory)
+			}
+			if err != nil {
+				return db.storageFailure(err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown wal operation %q", entry.Op)
+}
+
+// logShipped is logWrite for an entry received from the primary: the entry
+// keeps the primary's LSN, version and time, and replicas of this database
+// are sent it in turn
+func (db *Database) logShipped(entry walEntry) (done func(), keepHistory bool, err error) {
+	db.logMu.Lock()
+	defer db.logMu.Unlock()
+	db.txMu.Lock()
+	db.version = max(db.version, entry.Version)
+	keepHistory = len(db.active) > 0
+	db.txMu.Unlock()
+	if db.wal != nil {
+		if err := db.wal.Append(entry); err != nil {
+			return nil, false, err
+		}
+		db.ship.append(entry)
+	}
+	ticket := db.feed.publish(entry.LSN, changesOf(entry))
+	return func() { db.feed.release(ticket) }, keepHistory, nil
+}
+
+// Columns of SHOW REPLICATION
+var (
+	replicationColumns = []string{"role", "peer", "state", "lsn", "primary_lsn", "lag", "delay_ms", "error"}
+	replicationTypes   = []ColumnType{TypeString, TypeString, TypeString, TypeInt, TypeInt, TypeInt, TypeInt, TypeString}
+)
+
+// execShowReplication lists the primary this database follows, if any, and
+// the replicas following it. The lsn column is the last entry applied by
+// the replica.
+func (ex *executor) execShowReplication() (*Result, error) {
+	db := ex.tx.db
+	result := &Result{Columns: replicationColumns}
+	if status, ok := db.ReplicaStatus(); ok {
+		var errText any
+		if status.Err != nil {
+			errText = status.Err.Error()
+		}
+		result.Rows = append(result.Rows, []any{"replica", status.Primary, status.State,
+			int64(status.AppliedLSN), int64(status.PrimaryLSN), int64(status.Lag), status.Delay.Milliseconds(), errText})
+	}
+	last := db.ship.lastLSN()
+	for _, info := range db.Replicas() {
+		result.Rows = append(result.Rows, []any{"primary", info.Addr, info.State,
+			int64(info.AckedLSN), int64(last), int64(info.Lag), info.Delay.Milliseconds(), nil})
+	}
+	return result, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds, failing the test after a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// countRows returns the number of rows in a table, or -1 if it can't be read
+func countRows(db *Database, table string) int {
+	rows, err := db.List(context.Background(), table)
+	if err != nil {
+		return -1
+	}
+	return len(rows)
+}
+
+// startPrimary opens a durable database serving replication on a free port
+func startPrimary(t *testing.T) (*Database, string) {
+	t.Helper()
+	db, err := OpenDatabase(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewReplicationServer(db)
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+	return db, ln.Addr().String()
+}
+
+func TestReplication(t *testing.T) {
+	ctx := context.Background()
+	primary, addr := startPrimary(t)
+	exec := func(db *Database, query string) error {
+		_, err := db.Exec(ctx, query)
+		return err
+	}
+	for _, query := range []string{
+		"CREATE TABLE t (id INT PRIMARY KEY, v TEXT)",
+		"INSERT INTO t VALUES (1, 'a'), (2, 'b'), (3, 'c')",
+	} {
+		if err := exec(primary, query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Both replicas start empty and catch up from a snapshot
+	dbs := make([]*Database, 2)
+	replicas := make([]*Replica, 2)
+	for i := range replicas {
+		dbs[i] = NewDatabase()
+		t.Cleanup(func() { dbs[i].Close() })
+		r, err := dbs[i].Follow(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replicas[i] = r
+	}
+	for _, db := range dbs {
+		waitFor(t, "snapshot", func() bool { return countRows(db, "t") == 3 })
+	}
+
+	// Later writes are streamed, and both sides report no lag once applied
+	if err := exec(primary, "INSERT INTO t VALUES (4, 'd'), (5, 'e')"); err != nil {
+		t.Fatal(err)
+	}
+	lsn := primary.wal.LSN()
+	for i, r := range replicas {
+		waitFor(t, "streamed entries", func() bool {
+			status := r.Status()
+			return status.State == "streaming" && status.AppliedLSN == lsn && countRows(dbs[i], "t") == 5
+		})
+		if status := r.Status(); status.Lag != 0 || status.Delay != 0 {
+			t.Errorf("replica %d: lag %d, delay %v after catching up", i, status.Lag, status.Delay)
+		}
+	}
+	waitFor(t, "acknowledgements", func() bool {
+		infos := primary.Replicas()
+		return len(infos) == 2 && infos[0].AckedLSN == lsn && infos[1].AckedLSN == lsn
+	})
+	for _, info := range primary.Replicas() {
+		if info.State != "streaming" || info.Lag != 0 {
+			t.Errorf("replica %s: state %s, lag %d", info.Addr, info.State, info.Lag)
+		}
+	}
+
+	// A replica that stops acknowledging is reported as lagging by the
+	// entries logged since
+	cursor := primary.ship.register("lagging")
+	primary.ship.update(cursor, func(c *shipCursor) { c.state, c.acked = "streaming", lsn })
+	for _, query := range []string{"INSERT INTO t VALUES (6, 'f')", "INSERT INTO t VALUES (7, 'g')"} {
+		if err := exec(primary, query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lagging := false
+	for _, info := range primary.Replicas() {
+		if info.Addr == "lagging" {
+			lagging = info.Lag == 2 && info.Delay > 0
+		}
+	}
+	if !lagging {
+		t.Errorf("replicas = %+v, want lagging 2 entries behind", primary.Replicas())
+	}
+	primary.ship.unregister(cursor)
+
+	// Replicas refuse writes
+	for _, db := range dbs {
+		if err := db.Insert(ctx, "t", Record{"id": int64(10), "v": "x"}); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("Insert on replica: %v, want ErrReadOnly", err)
+		}
+		if err := exec(db, "DELETE FROM t"); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("DELETE on replica: %v, want ErrReadOnly", err)
+		}
+	}
+
+	// A promoted replica keeps its data, accepts writes and stops following;
+	// the other one carries on
+	for _, db := range dbs {
+		waitFor(t, "rows 6 and 7", func() bool { return countRows(db, "t") == 7 })
+	}
+	if err := replicas[0].Promote(); err != nil {
+		t.Fatal(err)
+	}
+	if state := replicas[0].Status().State; state != "promoted" {
+		t.Errorf("state after Promote = %s", state)
+	}
+	if err := replicas[0].Promote(); err == nil {
+		t.Error("second Promote succeeded")
+	}
+	if err := exec(dbs[0], "INSERT INTO t VALUES (100, 'promoted')"); err != nil {
+		t.Fatalf("write after Promote: %v", err)
+	}
+	waitFor(t, "promoted replica to disconnect", func() bool { return len(primary.Replicas()) == 1 })
+
+	if err := exec(primary, "INSERT INTO t VALUES (8, 'h')"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "row 8", func() bool { return countRows(dbs[1], "t") == 8 })
+	if _, found := dbs[0].Get(ctx, "t", int64(8)); found {
+		t.Error("promoted replica still applies the primary's log")
+	}
+	if _, found := dbs[1].Get(ctx, "t", int64(100)); found {
+		t.Error("write on the promoted replica reached the other replica")
+	}
+}
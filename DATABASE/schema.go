@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ColumnType is the type of a table column
+type ColumnType int
+
+// Supported column types
+const (
+	TypeInt    ColumnType = iota + 1 // int64
+	TypeFloat                        // float64
+	TypeString                       // string
+	TypeBool                         // bool
+	TypeTime                         // time.Time, stored in UTC
+	TypeBytes                        // []byte
+)
+
+var columnTypeNames = map[ColumnType]string{
+	TypeInt:    "int",
+	TypeFloat:  "float",
+	TypeString: "string",
+	TypeBool:   "bool",
+	TypeTime:   "time",
+	TypeBytes:  "bytes",
+}
+
+// ParseColumnType parses a type name such as "int", "text" or "timestamp"
+func ParseColumnType(name string) (ColumnType, error) {
+	switch strings.ToLower(name) {
+	case "int", "integer", "bigint":
+		return TypeInt, nil
+	case "float", "double", "real":
+		return TypeFloat, nil
+	case "string", "text", "varchar":
+		return TypeString, nil
+	case "bool", "boolean":
+		return TypeBool, nil
+	case "time", "timestamp":
+		return TypeTime, nil
+	case "bytes", "blob", "bytea":
+		return TypeBytes, nil
+	}
+	return 0, fmt.Errorf("unknown column type %q", name)
+}
+
+func (t ColumnType) String() string {
+	if name, ok := columnTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("ColumnType(%d)", int(t))
+}
+
+// ColumnError is returned for a reference to a column that does not exist
+type ColumnError struct {
+	Column string
+}
+
+func (e *ColumnError) Error() string {
+	return fmt.Sprintf("column %q does not exist", e.Column)
+}
+
+// TypeError is returned for a value that does not fit a type: a value of
+// another type, or text that does not parse as the type
+type TypeError struct {
+	Type  string // Name of the type the value was meant to have
+	Value any
+	Text  bool // Value is text in an invalid format for the type
+}
+
+func (e *TypeError) Error() string {
+	if e.Text {
+		return fmt.Sprintf("invalid %s %q", e.Type, e.Value)
+	}
+	return fmt.Sprintf("cannot use %T as %s", e.Value, e.Type)
+}
+
+// MarshalText encodes the type by name
+func (t ColumnType) MarshalText() ([]byte, error) {
+	name, ok := columnTypeNames[t]
+	if !ok {
+		return nil, fmt.Errorf("invalid column type %d", int(t))
+	}
+	return []byte(name), nil
+}
+
+// UnmarshalText decodes a type name
+func (t *ColumnType) UnmarshalText(text []byte) error {
+	parsed, err := ParseColumnType(string(text))
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
+
+// Column describes a single column of a table
+type Column struct {
+	Name     string     `json:"name"`
+	Type     ColumnType `json:"type"`
+	Nullable bool       `json:"nullable,omitempty"`
+	Default  any        `json:"default,omitempty"` // Used when an insert omits the column
+}
+
+// Schema describes the columns, primary key and constraints of a table
+type Schema struct {
+	Columns    []Column `json:"columns"`
+	PrimaryKey string   `json:"primary_key"`
+	TTL        *TTL     `json:"ttl,omitempty"` // Expires rows, see janitor.go
+
+	// Constraints, see constraints.go
+	Unique      [][]string   `json:"unique,omitempty"` // Column sets, each enforced by a unique index
+	ForeignKeys []ForeignKey `json:"foreign_keys,omitempty"`
+	Checks      []Check      `json:"checks,omitempty"`
+
+	checks []Expr // Parsed Checks, set by prepare
+}
+
+// TTL makes rows expire once the time in Column plus After has passed. A
+// table-wide TTL uses a column such as last_seen with a non-zero After; a
+// per-row TTL stores each row's expiry time in Column with After zero. Rows
+// whose Column is NULL never expire.
+type TTL struct {
+	Column string        `json:"column"`
+	After  time.Duration `json:"after,omitempty"`
+}
+
+// expiresAt returns when row expires, or false if it never does
+func (ttl *TTL) expiresAt(row Record) (time.Time, bool) {
+	if ttl == nil {
+		return time.Time{}, false
+	}
+	t, ok := row[ttl.Column].(time.Time)
+	if !ok {
+		return time.Time{}, false
+	}
+	return t.Add(ttl.After), true
+}
+
+// Column returns the named column
+func (s Schema) Column(name string) (Column, bool) {
+	for _, column := range s.Columns {
+		if column.Name == name {
+			return column, true
+		}
+	}
+	return Column{}, false
+}
+
+// prepare checks the schema definition and returns a copy with defaults
+// converted to their column types
+func (s Schema) prepare() (Schema, error) {
+	if len(s.Columns) == 0 {
+		return Schema{}, errors.New("schema has no columns")
+	}
+
+	prepared := Schema{Columns: make([]Column, len(s.Columns)), PrimaryKey: s.PrimaryKey}
+	seen := make(map[string]bool, len(s.Columns))
+	for i, column := range s.Columns {
+		if column.Name == "" {
+			return Schema{}, errors.New("column name is empty")
+		}
+		if seen[column.Name] {
+			return Schema{}, fmt.Errorf("duplicate column %q", column.Name)
+		}
+		seen[column.Name] = true
+		if _, ok := columnTypeNames[column.Type]; !ok {
+			return Schema{}, fmt.Errorf("column %q: invalid type", column.Name)
+		}
+		if column.Default != nil {
+			value, err := decodeValue(column.Default, column.Type)
+			if err != nil {
+				return Schema{}, fmt.Errorf("column %q default: %w", column.Name, err)
+			}
+			column.Default = value
+		}
+		prepared.Columns[i] = column
+	}
+
+	pk, ok := prepared.Column(s.PrimaryKey)
+	if !ok {
+		return Schema{}, fmt.Errorf("primary key %w", &ColumnError{Column: s.PrimaryKey})
+	}
+	if pk.Nullable {
+		return Schema{}, errors.New("primary key column cannot be nullable")
+	}
+	if pk.Type == TypeBytes {
+		return Schema{}, errors.New("primary key column cannot be bytes")
+	}
+	if s.TTL != nil {
+		ttl, err := prepared.checkTTL(*s.TTL)
+		if err != nil {
+			return Schema{}, err
+		}
+		prepared.TTL = ttl
+	}
+	if err := s.prepareConstraints(&prepared); err != nil {
+		return Schema{}, err
+	}
+	return prepared, nil
+}
+
+// checkTTL checks ttl against the columns and returns a copy of it
+func (s Schema) checkTTL(ttl TTL) (*TTL, error) {
+	column, ok := s.Column(ttl.Column)
+	if !ok {
+		return nil, fmt.Errorf("ttl %w", &ColumnError{Column: ttl.Column})
+	}
+	if column.Type != TypeTime {
+		return nil, fmt.Errorf("ttl column %q must be a time column", ttl.Column)
+	}
+	if ttl.After < 0 {
+		return nil, errors.New("ttl cannot be negative")
+	}
+	return &ttl, nil
+}
+
+// validate checks record against the schema and its check constraints and
+// returns a normalized copy with defaults filled in for omitted columns
+func (s Schema) validate(record Record) (Record, error) {
+	for name := range record {
+		if _, ok := s.Column(name); !ok {
+			return nil, &ColumnError{Column: name}
+		}
+	}
+
+	row := make(Record, len(s.Columns))
+	for _, column := range s.Columns {
+		value, present := record[column.Name]
+		if !present {
+			value = column.Default
+		}
+		converted, err := convertValue(value, column.Type)
+		if err != nil {
+			return nil, fmt.Errorf("column %q: %w", column.Name, err)
+		}
+		if converted == nil && !column.Nullable {
+			return nil, fmt.Errorf("column %q cannot be null", column.Name)
+		}
+		row[column.Name] = converted
+	}
+	if err := s.checkRow(row); err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+// decodeRow rebuilds a row that went through JSON (snapshots, WAL)
+func (s Schema) decodeRow(record Record) (Record, error) {
+	row := make(Record, len(s.Columns))
+	for _, column := range s.Columns {
+		value, err := decodeValue(record[column.Name], column.Type)
+		if err != nil {
+			return nil, fmt.Errorf("column %q: %w", column.Name, err)
+		}
+		row[column.Name] = value
+	}
+	return row, nil
+}
+
+// primaryKey returns the map key of row
+func (s Schema) primaryKey(row Record) any {
+	return keyOf(row[s.PrimaryKey])
+}
+
+// normalizeKey converts a caller-supplied primary key to its map key
+func (s Schema) normalizeKey(key any) (any, error) {
+	pk, _ := s.Column(s.PrimaryKey)
+	value, err := decodeValue(key, pk.Type)
+	if err != nil {
+		return nil, fmt.Errorf("primary key: %w", err)
+	}
+	return keyOf(value), nil
+}
+
+// keyOf returns a comparable form of value for use as a map key
+func keyOf(value any) any {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.UTC().Round(0)
+	}
+	return value
+}
+
+// convertValue converts a Go value to the canonical representation of t.
+// nil (NULL) is passed through.
+func convertValue(value any, t ColumnType) (any, error) {
+	if value == nil {
+		return nil, nil
+	}
+	switch t {
+	case TypeInt:
+		switch v := value.(type) {
+		case int:
+			return int64(v), nil
+		case int8:
+			return int64(v), nil
+		case int16:
+			return int64(v), nil
+		case int32:
+			return int64(v), nil
+		case int64:
+			return v, nil
+		case uint8:
+			return int64(v), nil
+		case uint16:
+			return int64(v), nil
+		case uint32:
+			return int64(v), nil
+		case uint:
+			if uint64(v) > math.MaxInt64 {
+				return nil, errors.New("integer overflows int64")
+			}
+			return int64(v), nil
+		case uint64:
+			if v > math.MaxInt64 {
+				return nil, errors.New("integer overflows int64")
+			}
+			return int64(v), nil
+		}
+	case TypeFloat:
+		switch v := value.(type) {
+		case float32:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		}
+		if i, err := convertValue(value, TypeInt); err == nil {
+			return float64(i.(int64)), nil
+		}
+	case TypeString:
+		if v, ok := value.(string); ok {
+			return v, nil
+		}
+	case TypeBool:
+		if v, ok := value.(bool); ok {
+			return v, nil
+		}
+	case TypeTime:
+		if v, ok := value.(time.Time); ok {
+			return v.UTC().Round(0), nil
+		}
+	case TypeBytes:
+		switch v := value.(type) {
+		case []byte:
+			return append([]byte(nil), v...), nil
+		case string:
+			return []byte(v), nil
+		}
+	}
+	return nil, &TypeError{Type: t.String(), Value: value}
+}
+
+// decodeValue is convertValue extended with the forms values take after a
+// JSON round trip: json.Number, RFC 3339 timestamps and base64 bytes
+func decodeValue(value any, t ColumnType) (any, error) {
+	switch v := value.(type) {
+	case json.Number:
+		if t == TypeInt {
+			return v.Int64()
+		}
+		if t == TypeFloat {
+			return v.Float64()
+		}
+	case float64:
+		if t == TypeInt && v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v), nil
+		}
+	case string:
+		if t == TypeTime {
+			parsed, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return nil, err
+			}
+			return parsed.UTC(), nil
+		}
+		if t == TypeBytes {
+			return base64.StdEncoding.DecodeString(v)
+		}
+	}
+	return convertValue(value, t)
+}
+
+// parseValue parses the text form of a value of type t
+func parseValue(text string, t ColumnType) (any, error) {
+	var value any
+	var err error
+	switch t {
+	case TypeInt:
+		value, err = strconv.ParseInt(text, 10, 64)
+	case TypeFloat:
+		value, err = strconv.ParseFloat(text, 64)
+	case TypeString:
+		return text, nil
+	case TypeBool:
+		value, err = strconv.ParseBool(text)
+	case TypeTime:
+		var parsed time.Time
+		parsed, err = time.Parse(time.RFC3339Nano, text)
+		value = parsed.UTC()
+	case TypeBytes:
+		return []byte(text), nil
+	default:
+		return nil, fmt.Errorf("invalid column type %d", int(t))
+	}
+	if errors.Is(err, strconv.ErrRange) && t == TypeInt {
+		return nil, ErrIntegerRange
+	}
+	if err != nil {
+		return nil, &TypeError{Type: t.String(), Value: text, Text: true}
+	}
+	return value, nil
+}
+
+// clone returns a copy of r that shares no byte slices with it
+func (r Record) clone() Record {
+	if r == nil {
+		return nil
+	}
+	copied := make(Record, len(r))
+	for name, value := range r {
+		if b, ok := value.([]byte); ok {
+			value = append([]byte(nil), b...)
+		}
+		copied[name] = value
+	}
+	return copied
+}
+
+// merge applies changes on top of row and validates the result. The primary
+// key cannot be changed.
+func (s Schema) merge(row Record, changes Record) (Record, error) {
+	merged := row.clone()
+	for name, value := range changes {
+		merged[name] = value
+	}
+	merged, err := s.validate(merged)
+	if err != nil {
+		return nil, err
+	}
+	if s.primaryKey(merged) != s.primaryKey(row) {
+		return nil, errors.New("primary key cannot be changed")
+	}
+	return merged, nil
+}
+
+// compareValues orders two values of the same column type. NULL sorts first;
+// ints and floats compare numerically.
+func compareValues(a, b any) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		default:
+			return 1
+		}
+	}
+
+	switch x := a.(type) {
+	case int64:
+		switch y := b.(type) {
+		case int64:
+			return cmp.Compare(x, y)
+		case float64:
+			return cmp.Compare(float64(x), y)
+		}
+	case float64:
+		switch y := b.(type) {
+		case float64:
+			return cmp.Compare(x, y)
+		case int64:
+			return cmp.Compare(x, float64(y))
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y)
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			switch {
+			case x == y:
+				return 0
+			case !x:
+				return -1
+			default:
+				return 1
+			}
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			return x.Compare(y)
+		}
+	case []byte:
+		if y, ok := b.([]byte); ok {
+			return bytes.Compare(x, y)
+		}
+	}
+	// Mismatched types: order by type name so sorting is still total
+	return strings.Compare(fmt.Sprintf("%T", a), fmt.Sprintf("%T", b))
+}
+
+// sortByColumn orders records by the value of column
+func sortByColumn(records []Record, column string) {
+	sort.SliceStable(records, func(i, j int) bool {
+		return compareValues(records[i][column], records[j][column]) < 0
+	})
+}
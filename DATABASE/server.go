@@ -0,0 +1,1086 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// PostgreSQL wire protocol (version 3) constants
+const (
+	pgProtocolVersion = 196608
+	pgSSLRequest      = 80877103
+	pgGSSENCRequest   = 80877104
+	pgCancelRequest   = 80877102
+	pgMaxMessage      = 1 << 26
+)
+
+// Type OIDs used on the wire
+const (
+	oidBool        = 16
+	oidBytea       = 17
+	oidInt8        = 20
+	oidInt2        = 21
+	oidInt4        = 23
+	oidText        = 25
+	oidFloat4      = 700
+	oidFloat8      = 701
+	oidUnknown     = 705
+	oidVarchar     = 1043
+	oidTimestamp   = 1114
+	oidTimestamptz = 1184
+)
+
+// pgEpoch is the zero point of binary timestamps
+var pgEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Server serves a Database over a subset of the PostgreSQL wire protocol:
+// startup without authentication, simple queries and extended queries with
+// parameters. Each connection has its own Session.
+type Server struct {
+	db       *Database
+	listener net.Listener
+	conns    map[*pgConn]struct{}
+	closing  bool
+	nextPID  uint32
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+}
+
+// NewServer creates a server for db
+func NewServer(db *Database) *Server {
+	return &Server{db: db, conns: make(map[*pgConn]struct{})}
+}
+
+// ListenAndServe listens on the TCP address addr and serves until Close
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln until Close, after which it returns nil
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		ln.Close()
+		return errors.New("server closed")
+	}
+	s.listener = ln
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closing := s.closing
+			s.mu.Unlock()
+			if closing {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.nextPID++
+		c := newPGConn(s, conn, s.nextPID)
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			c.serve()
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Addr returns the address the server is listening on, or nil
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Close stops accepting connections and shuts down every session once its
+// current statement has finished. Open transactions are rolled back.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closing = true
+	ln := s.listener
+	for c := range s.conns {
+		c.conn.SetReadDeadline(time.Now()) // Wake sessions waiting for input
+	}
+	s.mu.Unlock()
+
+	var err error
+	if ln != nil {
+		err = ln.Close()
+	}
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// pgStatement is a prepared statement
+type pgStatement struct {
+	stmt       Statement // nil for an empty query
+	paramOIDs  []uint32
+	columns    []string
+	types      []ColumnType
+	returnsSet bool
+}
+
+// pgPortal is a bound statement ready to execute
+type pgPortal struct {
+	prepared *pgStatement
+	args     []any
+	formats  []int16 // Result column formats
+	result   *Result // Set once executed
+	sent     int     // Rows already sent by a suspended Execute
+}
+
+// pgConn is one client connection
+type pgConn struct {
+	server   *Server
+	conn     net.Conn
+	r        *bufio.Reader
+	w        *bufio.Writer
+	session  *Session
+	ctx      context.Context
+	cancel   context.CancelFunc
+	pid      uint32
+	secret   uint32
+	prepared map[string]*pgStatement
+	portals  map[string]*pgPortal
+	skip     bool // Discarding extended-query messages until Sync after an error
+}
+
+func newPGConn(s *Server, conn net.Conn, pid uint32) *pgConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &pgConn{
+		server:   s,
+		conn:     conn,
+		r:        bufio.NewReader(conn),
+		w:        bufio.NewWriter(conn),
+		session:  s.db.NewSession(),
+		ctx:      ctx,
+		cancel:   cancel,
+		pid:      pid,
+		secret:   uint32(time.Now().UnixNano()),
+		prepared: make(map[string]*pgStatement),
+		portals:  make(map[string]*pgPortal),
+	}
+}
+
+func (c *pgConn) serve() {
+	defer func() {
+		c.session.Close()
+		c.cancel()
+		c.conn.Close()
+	}()
+
+	if ok, err := c.startup(); !ok || err != nil {
+		return
+	}
+
+	for {
+		typ, body, err := c.readMessage()
+		if err != nil {
+			if c.server.isClosing() {
+				c.sendError("FATAL", "57P01", "terminating connection due to administrator command")
+				c.w.Flush()
+			}
+			return
+		}
+		if c.skip && typ != 'S' && typ != 'X' {
+			continue
+		}
+
+		msg := &pgReader{data: body}
+		switch typ {
+		case 'Q':
+			c.simpleQuery(msg.string())
+		case 'P':
+			c.parse(msg)
+		case 'B':
+			c.bind(msg)
+		case 'D':
+			c.describe(msg)
+		case 'E':
+			c.execute(msg)
+		case 'C':
+			c.close(msg)
+		case 'S':
+			c.skip = false
+			c.readyForQuery()
+		case 'H':
+			c.w.Flush()
+		case 'X':
+			return
+		default:
+			c.extendedError(fmt.Errorf("unsupported message type %q", typ))
+		}
+		if err := c.flushIfIdle(typ); err != nil {
+			return
+		}
+	}
+}
+
+// flushIfIdle flushes after messages that end a round trip
+func (c *pgConn) flushIfIdle(typ byte) error {
+	if typ == 'Q' || typ == 'S' || typ == 'H' {
+		return c.w.Flush()
+	}
+	return nil
+}
+
+// startup handles SSL negotiation and the startup packet. It reports false
+// for cancel requests and unsupported protocol versions.
+func (c *pgConn) startup() (bool, error) {
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(c.r, header[:]); err != nil {
+			return false, err
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		code := binary.BigEndian.Uint32(header[4:])
+		if length < 8 || length > 1<<16 {
+			return false, errors.New("invalid startup packet length")
+		}
+		body := make([]byte, length-8)
+		if _, err := io.ReadFull(c.r, body); err != nil {
+			return false, err
+		}
+
+		switch code {
+		case pgSSLRequest, pgGSSENCRequest:
+			if _, err := c.conn.Write([]byte{'N'}); err != nil {
+				return false, err
+			}
+			continue
+		case pgCancelRequest:
+			return false, nil
+		case pgProtocolVersion:
+		default:
+			c.sendError("FATAL", "0A000", fmt.Sprintf("unsupported frontend protocol %d.%d", code>>16, code&0xFFFF))
+			return false, c.w.Flush()
+		}
+
+		// Startup parameters such as user and database are accepted as given
+		msg := &pgReader{data: body}
+		for msg.err == nil && len(msg.data) > 0 && msg.data[0] != 0 {
+			msg.string()
+			msg.string()
+		}
+
+		c.send('R', newPGWriter().int32(0).bytes()) // AuthenticationOk
+		for _, param := range [][2]string{
+			{"server_version", "14.0"},
+			{"server_encoding", "UTF8"},
+			{"client_encoding", "UTF8"},
+			{"DateStyle", "ISO, MDY"},
+			{"TimeZone", "UTC"},
+			{"integer_datetimes", "on"},
+			{"standard_conforming_strings", "on"},
+		} {
+			c.send('S', newPGWriter().string(param[0]).string(param[1]).bytes())
+		}
+		c.send('K', newPGWriter().int32(int32(c.pid)).int32(int32(c.secret)).bytes())
+		c.readyForQuery()
+		return true, c.w.Flush()
+	}
+}
+
+func (c *pgConn) readMessage() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length < 4 || length > pgMaxMessage {
+		return 0, nil, fmt.Errorf("invalid message length %d", length)
+	}
+	body := make([]byte, length-4)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[0], body, nil
+}
+
+func (c *pgConn) send(typ byte, body []byte) {
+	c.w.WriteByte(typ)
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(body)+4))
+	c.w.Write(length[:])
+	c.w.Write(body)
+}
+
+func (c *pgConn) readyForQuery() {
+	c.send('Z', []byte{byte(c.session.Status())})
+}
+
+func (c *pgConn) sendError(severity, code, message string) {
+	c.send('E', newPGWriter().
+		byte('S').string(severity).
+		byte('V').string(severity).
+		byte('C').string(code).
+		byte('M').string(message).
+		byte(0).bytes())
+}
+
+// queryError reports err as an ErrorResponse with a matching SQLSTATE
+func (c *pgConn) queryError(err error) {
+	code := "XX000"
+	var syntaxErr *SyntaxError
+	var fkErr *ForeignKeyError
+	var checkErr *CheckError
+	var columnErr *ColumnError
+	var typeErr *TypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		code = "42601"
+	case errors.Is(err, ErrConflict):
+		code = "40001"
+	case errors.Is(err, ErrUniqueViolation):
+		code = "23505"
+	case errors.As(err, &fkErr):
+		code = "23503"
+	case errors.As(err, &checkErr):
+		code = "23514"
+	case errors.Is(err, ErrTxAborted):
+		code = "25P02"
+	case errors.Is(err, ErrReadOnly):
+		code = "25006"
+	case errors.Is(err, ErrNoTable):
+		code = "42P01"
+	case errors.Is(err, ErrIntegerRange):
+		code = "22003"
+	case errors.As(err, &columnErr):
+		code = "42703"
+	case errors.As(err, &typeErr) && typeErr.Text:
+		code = "22P02"
+	case errors.As(err, &typeErr):
+		code = "42804"
+	case errors.Is(err, ErrNoRecord):
+		code = "P0002"
+	}
+	c.sendError("ERROR", code, err.Error())
+}
+
+// extendedError reports an error in the extended protocol and discards
+// messages until the next Sync
+func (c *pgConn) extendedError(err error) {
+	c.queryError(err)
+	c.skip = true
+}
+
+func (c *pgConn) simpleQuery(query string) {
+	defer c.readyForQuery()
+
+	stmts, err := ParseScript(query)
+	if err != nil {
+		c.session.markFailed()
+		c.queryError(err)
+		return
+	}
+	if len(stmts) == 0 {
+		c.send('I', nil) // EmptyQueryResponse
+		return
+	}
+	for _, stmt := range stmts {
+		result, err := c.session.ExecStatement(c.ctx, stmt)
+		if err != nil {
+			c.queryError(err)
+			return
+		}
+		columns, types, _ := c.server.db.Describe(stmt)
+		if len(columns) != len(result.Columns) {
+			types = make([]ColumnType, len(result.Columns))
+		}
+		if len(result.Columns) > 0 {
+			c.rowDescription(result.Columns, types, nil)
+		}
+		if err := c.dataRows(result.Rows, types, nil); err != nil {
+			c.queryError(err)
+			return
+		}
+		c.commandComplete(result)
+	}
+}
+
+func (c *pgConn) parse(msg *pgReader) {
+	name := msg.string()
+	query := msg.string()
+	n := int(msg.int16())
+	declared := make([]uint32, n)
+	for i := range declared {
+		declared[i] = uint32(msg.int32())
+	}
+	if msg.err != nil {
+		c.extendedError(msg.err)
+		return
+	}
+	if _, exists := c.prepared[name]; exists && name != "" {
+		c.extendedError(fmt.Errorf("prepared statement %q already exists", name))
+		return
+	}
+
+	stmts, err := ParseScript(query)
+	if err != nil {
+		c.session.markFailed()
+		c.extendedError(err)
+		return
+	}
+	if len(stmts) > 1 {
+		c.extendedError(errors.New("cannot insert multiple commands into a prepared statement"))
+		return
+	}
+
+	prepared := &pgStatement{}
+	if len(stmts) == 1 {
+		prepared.stmt = stmts[0]
+		inferred, err := c.server.db.ParamTypes(prepared.stmt)
+		if err != nil {
+			c.extendedError(err)
+			return
+		}
+		prepared.paramOIDs = make([]uint32, max(len(declared), len(inferred)))
+		for i := range prepared.paramOIDs {
+			switch {
+			case i < len(declared) && declared[i] != 0:
+				prepared.paramOIDs[i] = declared[i]
+			case i < len(inferred) && inferred[i] != 0:
+				prepared.paramOIDs[i] = typeOID(inferred[i])
+			default:
+				prepared.paramOIDs[i] = oidText
+			}
+		}
+		if prepared.columns, prepared.types, err = c.server.db.Describe(prepared.stmt); err != nil {
+			c.extendedError(err)
+			return
+		}
+		prepared.returnsSet = prepared.columns != nil
+	}
+	c.prepared[name] = prepared
+	c.send('1', nil) // ParseComplete
+}
+
+func (c *pgConn) bind(msg *pgReader) {
+	portalName := msg.string()
+	stmtName := msg.string()
+	paramFormats := make([]int16, msg.int16())
+	for i := range paramFormats {
+		paramFormats[i] = msg.int16()
+	}
+	values := make([][]byte, msg.int16())
+	for i := range values {
+		if length := msg.int32(); length >= 0 {
+			values[i] = msg.next(int(length))
+			if values[i] == nil {
+				values[i] = []byte{}
+			}
+		}
+	}
+	resultFormats := make([]int16, msg.int16())
+	for i := range resultFormats {
+		resultFormats[i] = msg.int16()
+	}
+	if msg.err != nil {
+		c.extendedError(msg.err)
+		return
+	}
+
+	prepared, exists := c.prepared[stmtName]
+	if !exists {
+		c.extendedError(fmt.Errorf("prepared statement %q does not exist", stmtName))
+		return
+	}
+	if len(values) != len(prepared.paramOIDs) {
+		c.extendedError(fmt.Errorf("bind message supplies %d parameters, but prepared statement %q requires %d", len(values), stmtName, len(prepared.paramOIDs)))
+		return
+	}
+
+	args := make([]any, len(values))
+	for i, value := range values {
+		if value == nil {
+			continue
+		}
+		format := int16(0)
+		if len(paramFormats) == 1 {
+			format = paramFormats[0]
+		} else if i < len(paramFormats) {
+			format = paramFormats[i]
+		}
+		var err error
+		if args[i], err = decodeParam(value, format, prepared.paramOIDs[i]); err != nil {
+			c.extendedError(fmt.Errorf("parameter $%d: %w", i+1, err))
+			return
+		}
+	}
+
+	c.portals[portalName] = &pgPortal{prepared: prepared, args: args, formats: resultFormats}
+	c.send('2', nil) // BindComplete
+}
+
+func (c *pgConn) describe(msg *pgReader) {
+	kind := msg.byte()
+	name := msg.string()
+	if msg.err != nil {
+		c.extendedError(msg.err)
+		return
+	}
+
+	switch kind {
+	case 'S':
+		prepared, exists := c.prepared[name]
+		if !exists {
+			c.extendedError(fmt.Errorf("prepared statement %q does not exist", name))
+			return
+		}
+		w := newPGWriter().int16(int16(len(prepared.paramOIDs)))
+		for _, oid := range prepared.paramOIDs {
+			w.int32(int32(oid))
+		}
+		c.send('t', w.bytes()) // ParameterDescription
+		if prepared.returnsSet {
+			c.rowDescription(prepared.columns, prepared.types, nil)
+		} else {
+			c.send('n', nil) // NoData
+		}
+	case 'P':
+		portal, exists := c.portals[name]
+		if !exists {
+			c.extendedError(fmt.Errorf("portal %q does not exist", name))
+			return
+		}
+		if portal.prepared.returnsSet {
+			c.rowDescription(portal.prepared.columns, portal.prepared.types, portal.formats)
+		} else {
+			c.send('n', nil)
+		}
+	default:
+		c.extendedError(fmt.Errorf("invalid describe target %q", kind))
+	}
+}
+
+func (c *pgConn) execute(msg *pgReader) {
+	name := msg.string()
+	maxRows := int(msg.int32())
+	if msg.err != nil {
+		c.extendedError(msg.err)
+		return
+	}
+	portal, exists := c.portals[name]
+	if !exists {
+		c.extendedError(fmt.Errorf("portal %q does not exist", name))
+		return
+	}
+	if portal.prepared.stmt == nil {
+		c.send('I', nil)
+		return
+	}
+
+	if portal.result == nil {
+		result, err := c.session.ExecStatement(c.ctx, portal.prepared.stmt, portal.args...)
+		if err != nil {
+			c.extendedError(err)
+			return
+		}
+		portal.result = result
+	}
+
+	rows := portal.result.Rows[portal.sent:]
+	suspended := maxRows > 0 && len(rows) > maxRows
+	if suspended {
+		rows = rows[:maxRows]
+	}
+	types := portal.prepared.types
+	if len(types) != len(portal.result.Columns) {
+		types = make([]ColumnType, len(portal.result.Columns))
+	}
+	if err := c.dataRows(rows, types, portal.formats); err != nil {
+		c.extendedError(err)
+		return
+	}
+	portal.sent += len(rows)
+	if suspended {
+		c.send('s', nil) // PortalSuspended
+		return
+	}
+	c.commandComplete(portal.result)
+}
+
+func (c *pgConn) close(msg *pgReader) {
+	kind := msg.byte()
+	name := msg.string()
+	if msg.err != nil {
+		c.extendedError(msg.err)
+		return
+	}
+	if kind == 'S' {
+		delete(c.prepared, name)
+	} else {
+		delete(c.portals, name)
+	}
+	c.send('3', nil) // CloseComplete
+}
+
+func (c *pgConn) rowDescription(columns []string, types []ColumnType, formats []int16) {
+	w := newPGWriter().int16(int16(len(columns)))
+	for i, name := range columns {
+		oid, size := uint32(oidText), int16(-1)
+		if i < len(types) && types[i] != 0 {
+			oid, size = typeOID(types[i]), typeSize(types[i])
+		}
+		w.string(name).int32(0).int16(0).int32(int32(oid)).int16(size).int32(-1).int16(resultFormat(formats, i))
+	}
+	c.send('T', w.bytes())
+}
+
+func (c *pgConn) dataRows(rows [][]any, types []ColumnType, formats []int16) error {
+	for _, row := range rows {
+		w := newPGWriter().int16(int16(len(row)))
+		for i, value := range row {
+			if value == nil {
+				w.int32(-1)
+				continue
+			}
+			var data []byte
+			if resultFormat(formats, i) == 1 {
+				var err error
+				if data, err = encodeBinary(value, types[i]); err != nil {
+					return err
+				}
+			} else {
+				data = encodeText(value)
+			}
+			w.int32(int32(len(data))).raw(data)
+		}
+		c.send('D', w.bytes())
+	}
+	return nil
+}
+
+func (c *pgConn) commandComplete(result *Result) {
+	c.send('C', newPGWriter().string(result.Tag()).bytes())
+}
+
+func resultFormat(formats []int16, i int) int16 {
+	if len(formats) == 1 {
+		return formats[0]
+	}
+	if i < len(formats) {
+		return formats[i]
+	}
+	return 0
+}
+
+func typeOID(t ColumnType) uint32 {
+	switch t {
+	case TypeInt:
+		return oidInt8
+	case TypeFloat:
+		return oidFloat8
+	case TypeBool:
+		return oidBool
+	case TypeTime:
+		return oidTimestamptz
+	case TypeBytes:
+		return oidBytea
+	}
+	return oidText
+}
+
+func typeSize(t ColumnType) int16 {
+	switch t {
+	case TypeInt, TypeFloat, TypeTime:
+		return 8
+	case TypeBool:
+		return 1
+	}
+	return -1
+}
+
+// encodeText formats a value in PostgreSQL's text representation
+func encodeText(value any) []byte {
+	switch v := value.(type) {
+	case int64:
+		return strconv.AppendInt(nil, v, 10)
+	case float64:
+		switch {
+		case math.IsInf(v, 1):
+			return []byte("Infinity")
+		case math.IsInf(v, -1):
+			return []byte("-Infinity")
+		case math.IsNaN(v):
+			return []byte("NaN")
+		}
+		return strconv.AppendFloat(nil, v, 'g', -1, 64)
+	case bool:
+		if v {
+			return []byte("t")
+		}
+		return []byte("f")
+	case []byte:
+		return []byte(`\x` + hex.EncodeToString(v))
+	case time.Time:
+		return []byte(v.UTC().Format("2006-01-02 15:04:05.999999") + "+00")
+	case string:
+		return []byte(v)
+	}
+	return []byte(fmt.Sprint(value))
+}
+
+// encodeBinary formats a value in PostgreSQL's binary representation of the
+// column type announced in the row description
+func encodeBinary(value any, t ColumnType) ([]byte, error) {
+	switch t {
+	case TypeInt:
+		if v, ok := value.(int64); ok {
+			return binary.BigEndian.AppendUint64(nil, uint64(v)), nil
+		}
+	case TypeFloat:
+		if v, ok := toFloat(value); ok {
+			return binary.BigEndian.AppendUint64(nil, math.Float64bits(v)), nil
+		}
+	case TypeBool:
+		if v, ok := value.(bool); ok {
+			if v {
+				return []byte{1}, nil
+			}
+			return []byte{0}, nil
+		}
+	case TypeBytes:
+		if v, ok := value.([]byte); ok {
+			return v, nil
+		}
+	case TypeTime:
+		if v, ok := value.(time.Time); ok {
+			return binary.BigEndian.AppendUint64(nil, uint64(v.Sub(pgEpoch).Microseconds())), nil
+		}
+	default:
+		return encodeText(value), nil
+	}
+	return nil, fmt.Errorf("cannot encode %T as %s", value, t)
+}
+
+// decodeParam converts a bound parameter value according to its type OID
+func decodeParam(data []byte, format int16, oid uint32) (any, error) {
+	if format == 1 {
+		switch oid {
+		case oidInt2:
+			if len(data) == 2 {
+				return int64(int16(binary.BigEndian.Uint16(data))), nil
+			}
+		case oidInt4:
+			if len(data) == 4 {
+				return int64(int32(binary.BigEndian.Uint32(data))), nil
+			}
+		case oidInt8:
+			if len(data) == 8 {
+				return int64(binary.BigEndian.Uint64(data)), nil
+			}
+		case oidFloat4:
+			if len(data) == 4 {
+				return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), nil
+			}
+		case oidFloat8:
+			if len(data) == 8 {
+				return math.Float64frombits(binary.BigEndian.Uint64(data)), nil
+			}
+		case oidBool:
+			if len(data) == 1 {
+				return data[0] != 0, nil
+			}
+		case oidBytea:
+			return append([]byte(nil), data...), nil
+		case oidTimestamp, oidTimestamptz:
+			if len(data) == 8 {
+				return pgEpoch.Add(time.Duration(int64(binary.BigEndian.Uint64(data))) * time.Microsecond), nil
+			}
+		case oidText, oidVarchar, oidUnknown:
+			return string(data), nil
+		default:
+			return nil, fmt.Errorf("binary format is not supported for type %d", oid)
+		}
+		return nil, fmt.Errorf("invalid binary value for type %d", oid)
+	}
+
+	text := string(data)
+	switch oid {
+	case oidInt2, oidInt4, oidInt8:
+		n, err := strconv.ParseInt(strings.TrimSpace(text), 10, 64)
+		if errors.Is(err, strconv.ErrRange) {
+			return nil, ErrIntegerRange
+		}
+		if err != nil {
+			return nil, &TypeError{Type: "integer", Value: text, Text: true}
+		}
+		return n, nil
+	case oidFloat4, oidFloat8:
+		f, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		if err != nil {
+			return nil, &TypeError{Type: "float", Value: text, Text: true}
+		}
+		return f, nil
+	case oidBool:
+		switch strings.ToLower(strings.TrimSpace(text)) {
+		case "t", "true", "y", "yes", "on", "1":
+			return true, nil
+		case "f", "false", "n", "no", "off", "0":
+			return false, nil
+		}
+		return nil, &TypeError{Type: "boolean", Value: text, Text: true}
+	case oidBytea:
+		if strings.HasPrefix(text, `\x`) {
+			b, err := hex.DecodeString(text[2:])
+			if err != nil {
+				return nil, &TypeError{Type: "bytea", Value: text, Text: true}
+			}
+			return b, nil
+		}
+		return data, nil
+	case oidTimestamp, oidTimestamptz:
+		return parseTime(text)
+	}
+	return text, nil
+}
+
+// pgReader decodes the fields of a message body. The first malformed field
+// sets err; later reads return zero values.
+type pgReader struct {
+	data []byte
+	err  error
+}
+
+func (r *pgReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data) {
+		r.err = errors.New("malformed message")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *pgReader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *pgReader) int16() int16 {
+	if b := r.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *pgReader) int32() int32 {
+	if b := r.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *pgReader) string() string {
+	if r.err != nil {
+		return ""
+	}
+	end := -1
+	for i, b := range r.data {
+		if b == 0 {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		r.err = errors.New("malformed message: unterminated string")
+		return ""
+	}
+	s := string(r.data[:end])
+	r.data = r.data[end+1:]
+	return s
+}
+
+// pgWriter builds a message body
+type pgWriter struct {
+	buf []byte
+}
+
+func newPGWriter() *pgWriter {
+	return &pgWriter{}
+}
+
+func (w *pgWriter) byte(b byte) *pgWriter {
+	w.buf = append(w.buf, b)
+	return w
+}
+
+func (w *pgWriter) int16(v int16) *pgWriter {
+	w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(v))
+	return w
+}
+
+func (w *pgWriter) int32(v int32) *pgWriter {
+	w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(v))
+	return w
+}
+
+func (w *pgWriter) string(s string) *pgWriter {
+	w.buf = append(append(w.buf, s...), 0)
+	return w
+}
+
+func (w *pgWriter) raw(b []byte) *pgWriter {
+	w.buf = append(w.buf, b...)
+	return w
+}
+
+func (w *pgWriter) bytes() []byte {
+	return w.buf
+}
+
+// runServe implements "serve": open the database in a directory and serve it
+// until interrupted
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := flags.String("addr", "localhost:5432", "TCP address to listen on")
+	dir := flags.String("data", "data", "database directory")
+	engine := flags.String("engine", "", "storage engine of a new database: disk or memory")
+	pages := flags.Int("buffer-pages", DefaultBufferPoolPages, "disk engine buffer pool size in pages")
+	archive := flags.String("archive", "", "directory receiving wal segments at checkpoints, for point-in-time restores")
+	changesAddr := flags.String("changes-addr", "", "HTTP address serving the change stream at /changes (disabled if empty)")
+	janitor := flags.Duration("janitor-interval", time.Minute, "how often expired rows are deleted and old row versions purged (0 disables)")
+	replicateAddr := flags.String("replicate-addr", "", "TCP address replicas connect to (disabled if empty)")
+	replicaOf := flags.String("replica-of", "", "replication address of a primary to follow as a read-only replica")
+	keyring := keyFileFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	keys, err := keyring()
+	if err != nil {
+		return err
+	}
+
+	db, err := OpenDatabaseWithOptions(*dir, Options{Engine: EngineKind(*engine), BufferPoolPages: *pages, ArchiveDir: *archive, Keys: keys})
+	if err != nil {
+		return err
+	}
+	db.StartCheckpointer(time.Minute)
+	if *janitor > 0 {
+		db.StartJanitor(*janitor)
+	}
+	if *replicaOf != "" {
+		if _, err := db.Follow(*replicaOf); err != nil {
+			db.Close()
+			return err
+		}
+		fmt.Println("Following", *replicaOf)
+	}
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	server := NewServer(db)
+	fmt.Println("Listening on", ln.Addr())
+
+	var changes *http.Server
+	if *changesAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/changes", db.ChangesHandler())
+		changes = &http.Server{Addr: *changesAddr, Handler: mux}
+		go func() {
+			if err := changes.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fmt.Println("Change stream error:", err)
+			}
+		}()
+		fmt.Println("Serving changes on", *changesAddr)
+	}
+
+	var replication *ReplicationServer
+	if *replicateAddr != "" {
+		replication = NewReplicationServer(db)
+		go func() {
+			if err := replication.ListenAndServe(*replicateAddr); err != nil {
+				fmt.Println("Replication error:", err)
+			}
+		}()
+		fmt.Println("Serving replicas on", *replicateAddr)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		<-signals
+		fmt.Println("Shutting down")
+		server.Close()
+		if changes != nil {
+			changes.Close()
+		}
+		if replication != nil {
+			replication.Close()
+		}
+		close(stopped)
+	}()
+
+	if err := server.Serve(ln); err != nil {
+		server.Close()
+		if changes != nil {
+			changes.Close()
+		}
+		if replication != nil {
+			replication.Close()
+		}
+		db.Close()
+		return err
+	}
+	<-stopped
+	return db.Close()
+}
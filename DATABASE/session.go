@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// TxStatus is the transaction state of a session
+type TxStatus byte
+
+const (
+	TxIdle   TxStatus = 'I' // No explicit transaction
+	TxActive TxStatus = 'T' // Inside BEGIN ... COMMIT
+	TxFailed TxStatus = 'E' // A statement failed; only ROLLBACK or COMMIT are accepted
+)
+
+// ErrTxAborted is returned for statements sent after an error inside an
+// explicit transaction
+var ErrTxAborted = errors.New("current transaction is aborted, commands ignored until end of transaction block")
+
+// Session runs statements for one client. Statements run in autocommit mode
+// unless the client opened a transaction with BEGIN. A transaction lives
+// until COMMIT, ROLLBACK or Close; the context given with each statement only
+// cancels that statement.
+type Session struct {
+	db     *Database
+	tx     *Transaction
+	failed bool
+}
+
+// NewSession starts a session on the database
+func (db *Database) NewSession() *Session {
+	return &Session{db: db}
+}
+
+// Status reports whether the session is inside a transaction
+func (s *Session) Status() TxStatus {
+	switch {
+	case s.tx == nil:
+		return TxIdle
+	case s.failed:
+		return TxFailed
+	}
+	return TxActive
+}
+
+// ExecStatement runs one statement. BEGIN, COMMIT and ROLLBACK control the
+// session's transaction; COMMIT of a failed transaction rolls it back and
+// reports Command "ROLLBACK".
+func (s *Session) ExecStatement(ctx context.Context, stmt Statement, args ...any) (*Result, error) {
+	if control, ok := stmt.(*TransactionStmt); ok {
+		command, err := s.control(ctx, control.Action)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{Command: command}, nil
+	}
+	if s.tx == nil {
+		return s.db.ExecStatement(ctx, stmt, args...)
+	}
+	if s.failed {
+		return nil, ErrTxAborted
+	}
+	result, err := s.tx.execStatement(ctx, stmt, args...)
+	if err != nil {
+		s.failed = true
+	}
+	return result, err
+}
+
+// Exec parses and runs one statement
+func (s *Session) Exec(ctx context.Context, query string, args ...any) (*Result, error) {
+	stmt, err := Parse(query)
+	if err != nil {
+		s.markFailed()
+		return nil, err
+	}
+	return s.ExecStatement(ctx, stmt, args...)
+}
+
+func (s *Session) control(ctx context.Context, action string) (string, error) {
+	if action == "BEGIN" {
+		if s.tx != nil {
+			return "", errors.New("there is already a transaction in progress")
+		}
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		tx, err := s.db.BeginTransaction(context.Background())
+		if err != nil {
+			return "", err
+		}
+		s.tx, s.failed = tx, false
+		return action, nil
+	}
+
+	if s.tx == nil {
+		return "", errors.New("there is no transaction in progress")
+	}
+	tx, failed := s.tx, s.failed
+	s.tx, s.failed = nil, false
+	if action == "COMMIT" && !failed {
+		return action, tx.Commit()
+	}
+	return "ROLLBACK", tx.Rollback()
+}
+
+// markFailed aborts the open transaction, if any, after an error
+func (s *Session) markFailed() {
+	if s.tx != nil {
+		s.failed = true
+	}
+}
+
+// Close rolls back any open transaction
+func (s *Session) Close() error {
+	if s.tx == nil {
+		return nil
+	}
+	tx := s.tx
+	s.tx, s.failed = nil, false
+	return tx.Rollback()
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const historyFileName = ".go_database_history"
+
+// shell runs SQL statements and backslash commands typed by a user or read
+// from a script. Statements end with a semicolon and may span lines.
+type shell struct {
+	db      *Database
+	session *Session
+	name    string // Shown in the prompt
+	out     io.Writer
+	timing  bool
+	pending strings.Builder // Lines of an unfinished statement
+	quit    bool
+}
+
+// runShell implements "shell", the default command: an interactive SQL shell,
+// or a script runner with -f, -c or a non-terminal stdin
+func runShell(args []string) error {
+	flags := flag.NewFlagSet("shell", flag.ContinueOnError)
+	dir := flags.String("data", "data", "database directory, or empty for an in-memory database")
+	engine := flags.String("engine", "", "storage engine of a new database: disk or memory")
+	file := flags.String("f", "", "run the statements in this file and exit")
+	command := flags.String("c", "", "run these statements and exit")
+	keyring := keyFileFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	keys, err := keyring()
+	if err != nil {
+		return err
+	}
+
+	db := NewDatabase()
+	name := "memory"
+	if *dir != "" {
+		if db, err = OpenDatabaseWithOptions(*dir, Options{Engine: EngineKind(*engine), Keys: keys}); err != nil {
+			return err
+		}
+		db.StartCheckpointer(time.Minute)
+		name = filepath.Base(*dir)
+	}
+	db.StartJanitor(time.Minute)
+	defer db.Close()
+	sh := &shell{db: db, session: db.NewSession(), name: name, out: os.Stdout}
+	defer sh.session.Close()
+
+	switch {
+	case *command != "":
+		return sh.runScript("-c", strings.NewReader(*command))
+	case *file != "":
+		return sh.runFile(*file)
+	}
+	if stat, err := os.Stdin.Stat(); err != nil || stat.Mode()&os.ModeCharDevice == 0 {
+		return sh.runScript("stdin", os.Stdin)
+	}
+	return sh.interact()
+}
+
+// interact reads statements from the terminal until \q or Ctrl-D. Errors are
+// reported and the shell carries on.
+func (sh *shell) interact() error {
+	history := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		history = filepath.Join(home, historyFileName)
+	}
+	editor := newLineEditor(os.Stdin, sh.out, history)
+	fmt.Fprintln(sh.out, `Type \? for help, \q to quit.`)
+
+	var statement strings.Builder // Input of the current statement, for the history
+	for !sh.quit {
+		line, err := editor.readLine(sh.prompt())
+		if errors.Is(err, errInterrupt) {
+			sh.pending.Reset()
+			statement.Reset()
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		statement.WriteString(line + "\n")
+		if err := sh.feed(line); err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+		}
+		if sh.pending.Len() == 0 {
+			editor.addHistory(statement.String())
+			statement.Reset()
+		}
+	}
+	return nil
+}
+
+// prompt shows the database name, whether a statement is being continued
+// and the transaction state
+func (sh *shell) prompt() string {
+	if sh.pending.Len() > 0 {
+		return sh.name + "-> "
+	}
+	switch sh.session.Status() {
+	case TxActive:
+		return sh.name + "=*> "
+	case TxFailed:
+		return sh.name + "=!> "
+	}
+	return sh.name + "=> "
+}
+
+// runFile runs the script at path
+func (sh *shell) runFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return sh.runScript(path, file)
+}
+
+// runScript runs every statement and command read from r, stopping at the
+// first error. name labels error positions.
+func (sh *shell) runScript(name string, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<24)
+	line := 0
+	for !sh.quit && scanner.Scan() {
+		line++
+		if err := sh.feed(scanner.Text()); err != nil {
+			return fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	// A final statement may omit its semicolon
+	if rest := sh.pending.String(); !sh.quit && hasTokens(rest) {
+		sh.pending.Reset()
+		if err := sh.exec(rest); err != nil {
+			return fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+	}
+	sh.pending.Reset()
+	return nil
+}
+
+// feed adds one line of input, running any statements it completes. A line
+// starting with a backslash outside a statement is a shell command.
+func (sh *shell) feed(line string) error {
+	if sh.pending.Len() == 0 && strings.HasPrefix(strings.TrimSpace(line), `\`) {
+		return sh.command(strings.TrimSpace(line))
+	}
+	sh.pending.WriteString(line + "\n")
+	statements, rest := splitStatements(sh.pending.String())
+	sh.pending.Reset()
+	if hasTokens(rest) {
+		sh.pending.WriteString(rest)
+	}
+	for _, statement := range statements {
+		if err := sh.exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exec runs one statement and prints its result. Ctrl-C cancels it.
+func (sh *shell) exec(query string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	start := time.Now()
+	result, err := sh.session.Exec(ctx, query)
+	elapsed := time.Since(start)
+	if err != nil {
+		return err
+	}
+	if len(result.Columns) > 0 {
+		fmt.Fprintf(sh.out, "%s\n\n", result)
+	} else {
+		fmt.Fprintln(sh.out, result.Tag())
+	}
+	sh.printTiming(elapsed)
+	return nil
+}
+
+func (sh *shell) printTiming(elapsed time.Duration) {
+	if sh.timing {
+		fmt.Fprintf(sh.out, "Time: %.3f ms\n", float64(elapsed.Microseconds())/1000)
+	}
+}
+
+// splitStatements returns the complete, semicolon-terminated statements at
+// the start of src and the unfinished rest. Semicolons inside strings,
+// quoted identifiers and comments do not end a statement.
+func splitStatements(src string) ([]string, string) {
+	var statements []string
+	lx := &lexer{src: src, line: 1, column: 1}
+	start, empty := 0, true
+	for {
+		tok, err := lx.next()
+		if err != nil {
+			var syntaxErr *SyntaxError
+			if errors.As(err, &syntaxErr) && strings.HasPrefix(syntaxErr.Msg, "unterminated") {
+				return statements, src[start:]
+			}
+			// Leave other errors to the parser once the line ends the statement
+			if rest := strings.TrimSpace(src[start:]); strings.HasSuffix(rest, ";") {
+				return append(statements, rest), ""
+			}
+			return statements, src[start:]
+		}
+		switch {
+		case tok.kind == tokEOF:
+			return statements, src[start:]
+		case tok.kind == tokSymbol && tok.text == ";":
+			if !empty {
+				statements = append(statements, strings.TrimSpace(src[start:lx.pos]))
+			}
+			start, empty = lx.pos, true
+		default:
+			empty = false
+		}
+	}
+}
+
+// hasTokens reports whether src holds anything but whitespace and comments
+func hasTokens(src string) bool {
+	tokens, err := tokenize(src)
+	return err != nil || len(tokens) > 1
+}
+
+const shellHelp = `SQL statements end with ";" and may span several lines.
+
+  \dt               list tables
+  \d [table]        describe a table, or list tables
+  \di [table]       list indexes
+  \timing [on|off]  toggle statement timing
+  \i file           run the statements in a file
+  \s                show the history
+  \checkpoint       write a snapshot and truncate the write-ahead log
+  \cache            show read cache statistics
+  \compact          delete expired rows and purge old row versions now
+  \janitor          show what expiry and compaction have reclaimed
+  \?                show this help
+  \q                quit`
+
+// command runs a backslash command
+func (sh *shell) command(line string) error {
+	fields := strings.Fields(line)
+	name, args := fields[0], fields[1:]
+	start := time.Now()
+	switch name {
+	case `\q`, `\quit`:
+		sh.quit = true
+	case `\?`, `\h`, `\help`:
+		fmt.Fprintln(sh.out, shellHelp)
+	case `\dt`:
+		sh.print(sh.listTables())
+	case `\d`:
+		if len(args) == 0 {
+			sh.print(sh.listTables())
+			return nil
+		}
+		return sh.describe(args[0])
+	case `\di`:
+		result, err := sh.listIndexes(args)
+		if err != nil {
+			return err
+		}
+		sh.print(result)
+	case `\timing`:
+		switch {
+		case len(args) == 0:
+			sh.timing = !sh.timing
+		case args[0] == "on" || args[0] == "off":
+			sh.timing = args[0] == "on"
+		default:
+			return errors.New(`\timing: expected "on" or "off"`)
+		}
+		state := "off"
+		if sh.timing {
+			state = "on"
+		}
+		fmt.Fprintln(sh.out, "Timing is", state+".")
+	case `\i`, `\include`:
+		if len(args) != 1 {
+			return errors.New(`\i: expected a file name`)
+		}
+		return sh.runFile(args[0])
+	case `\s`:
+		return sh.printHistory()
+	case `\checkpoint`:
+		if err := sh.db.Checkpoint(); err != nil {
+			return err
+		}
+		fmt.Fprintln(sh.out, "CHECKPOINT")
+		sh.printTiming(time.Since(start))
+	case `\cache`:
+		stats := sh.db.CacheStats()
+		sh.print(&Result{
+			Columns: []string{"Size", "Capacity", "Hits", "Misses", "Evictions", "Invalidations"},
+			Rows:    [][]any{{stats.Size, stats.Capacity, stats.Hits, stats.Misses, stats.Evictions, stats.Invalidations}},
+		})
+	case `\compact`:
+		expired, purged, err := sh.db.Compact(context.Background())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(sh.out, "COMPACT %d rows expired, %d versions purged\n", expired, purged)
+		sh.printTiming(time.Since(start))
+	case `\janitor`:
+		stats := sh.db.JanitorStats()
+		last := ""
+		if !stats.LastPass.IsZero() {
+			last = fmt.Sprintf("%s (%s)", stats.LastPass.Format(time.RFC3339), stats.LastDuration.Round(time.Microsecond))
+		}
+		lastErr := ""
+		if stats.LastErr != nil {
+			lastErr = stats.LastErr.Error()
+		}
+		sh.print(&Result{
+			Columns: []string{"Passes", "Rows expired", "Versions purged", "Last pass", "Last error"},
+			Rows:    [][]any{{stats.Passes, stats.RowsExpired, stats.VersionsPurged, last, lastErr}},
+		})
+	default:
+		return fmt.Errorf(`invalid command %s, try \? for help`, name)
+	}
+	return nil
+}
+
+func (sh *shell) print(result *Result) {
+	fmt.Fprintf(sh.out, "%s\n\n", result)
+}
+
+// listTables lists every table with its row and index counts
+func (sh *shell) listTables() *Result {
+	result := &Result{Columns: []string{"Name", "Rows", "Indexes", "Primary key"}}
+	for _, name := range sh.db.Tables() {
+		table, err := sh.db.lookupTable(name)
+		if err != nil {
+			continue
+		}
+		table.mu.RLock()
+		result.Rows = append(result.Rows, []any{name, table.engine.Len(), len(table.indexes), table.schema.PrimaryKey})
+		table.mu.RUnlock()
+	}
+	return result
+}
+
+// describe prints the columns and indexes of a table
+func (sh *shell) describe(tableName string) error {
+	schema, err := sh.db.Schema(tableName)
+	if err != nil {
+		return err
+	}
+	specs, err := sh.db.Indexes(tableName)
+	if err != nil {
+		return err
+	}
+
+	result := &Result{Columns: []string{"Column", "Type", "Nullable", "Default"}}
+	for _, column := range schema.Columns {
+		nullable := "not null"
+		if column.Nullable {
+			nullable = ""
+		}
+		def := ""
+		if column.Default != nil {
+			def = formatValue(column.Default)
+		}
+		result.Rows = append(result.Rows, []any{column.Name, column.Type.String(), nullable, def})
+	}
+	fmt.Fprintf(sh.out, "Table %q\n%s\n", tableName, result)
+	fmt.Fprintf(sh.out, "Primary key: %s\n", schema.PrimaryKey)
+	if schema.TTL != nil {
+		fmt.Fprintf(sh.out, "TTL: %s + %s\n", schema.TTL.Column, schema.TTL.After)
+	}
+	for _, columns := range schema.Unique {
+		fmt.Fprintf(sh.out, "Unique: (%s)\n", strings.Join(columns, ", "))
+	}
+	for _, fk := range schema.ForeignKeys {
+		fmt.Fprintf(sh.out, "Foreign key: %s references %s on delete %s\n", fk.Column, fk.Table, fk.OnDelete)
+	}
+	for _, check := range schema.Checks {
+		if check.Name != "" {
+			fmt.Fprintf(sh.out, "Check %q: %s\n", check.Name, check.Expr)
+		} else {
+			fmt.Fprintf(sh.out, "Check: %s\n", check.Expr)
+		}
+	}
+	if len(specs) > 0 {
+		fmt.Fprintln(sh.out, "Indexes:")
+		for _, spec := range specs {
+			fmt.Fprintf(sh.out, "    %q %s (%s)\n", spec.Name, indexKind(spec), strings.Join(spec.Columns, ", "))
+		}
+	}
+	fmt.Fprintln(sh.out)
+	return nil
+}
+
+// listIndexes lists the indexes of the given table, or of every table
+func (sh *shell) listIndexes(args []string) (*Result, error) {
+	tables := args
+	if len(tables) == 0 {
+		tables = sh.db.Tables()
+	}
+	result := &Result{Columns: []string{"Table", "Index", "Kind", "Columns"}}
+	for _, name := range tables {
+		specs, err := sh.db.Indexes(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		for _, spec := range specs {
+			result.Rows = append(result.Rows, []any{name, spec.Name, indexKind(spec), strings.Join(spec.Columns, ", ")})
+		}
+	}
+	return result, nil
+}
+
+// indexKind describes an index as its CREATE INDEX keywords would
+func indexKind(spec IndexSpec) string {
+	kind := "hash"
+	switch {
+	case spec.FullText:
+		kind = "fulltext"
+	case spec.Ordered:
+		kind = "btree"
+	}
+	if spec.Unique {
+		kind = "unique " + kind
+	}
+	return kind
+}
+
+func (sh *shell) printHistory() error {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(filepath.Join(home, historyFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = sh.out.Write(data)
+	return err
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// newTestShell returns a shell on an in-memory database writing to out
+func newTestShell(t *testing.T, out *strings.Builder) *shell {
+	t.Helper()
+	db := NewDatabase()
+	sh := &shell{db: db, session: db.NewSession(), name: "memory", out: out}
+	t.Cleanup(func() { sh.session.Close() })
+	return sh
+}
+
+func TestShellTransaction(t *testing.T) {
+	var out strings.Builder
+	sh := newTestShell(t, &out)
+	script := `CREATE TABLE t (id INT PRIMARY KEY, v TEXT);
+BEGIN;
+INSERT INTO t VALUES (3, 'c');
+INSERT INTO t VALUES (4, 'd');
+COMMIT;`
+	if err := sh.runScript("-c", strings.NewReader(script)); err != nil {
+		t.Fatalf("runScript: %v\n%s", err, out.String())
+	}
+	if got, want := out.String(), "CREATE TABLE\nBEGIN\nINSERT 0 1\nINSERT 0 1\nCOMMIT\n"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+	if status := sh.session.Status(); status != TxIdle {
+		t.Errorf("status after COMMIT = %c, want %c", status, TxIdle)
+	}
+
+	rows, err := sh.db.List(context.Background(), "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Errorf("got %d committed rows, want 2", len(rows))
+	}
+}
+
+func TestShellRollback(t *testing.T) {
+	var out strings.Builder
+	sh := newTestShell(t, &out)
+	script := `CREATE TABLE t (id INT PRIMARY KEY);
+BEGIN;
+INSERT INTO t VALUES (1);
+ROLLBACK;`
+	if err := sh.runScript("-c", strings.NewReader(script)); err != nil {
+		t.Fatalf("runScript: %v\n%s", err, out.String())
+	}
+	rows, err := sh.db.List(context.Background(), "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 0 {
+		t.Errorf("got %d rows after ROLLBACK, want 0", len(rows))
+	}
+}
+
+// A cancelled statement inside a transaction fails the transaction but does
+// not end it
+func TestSessionStatementCancel(t *testing.T) {
+	db := NewDatabase()
+	session := db.NewSession()
+	defer session.Close()
+	ctx := context.Background()
+	if _, err := session.Exec(ctx, "CREATE TABLE t (id INT PRIMARY KEY)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Exec(ctx, "BEGIN"); err != nil {
+		t.Fatal(err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := session.Exec(cancelled, "INSERT INTO t VALUES (1)"); err == nil {
+		t.Fatal("INSERT with a cancelled context succeeded")
+	}
+	if status := session.Status(); status != TxFailed {
+		t.Fatalf("status = %c, want %c", status, TxFailed)
+	}
+	result, err := session.Exec(ctx, "ROLLBACK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Command != "ROLLBACK" {
+		t.Errorf("command = %q, want ROLLBACK", result.Command)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Statement is a parsed SQL statement
+type Statement interface {
+	statement()
+}
+
+// Expr is a parsed SQL expression
+type Expr interface {
+	expr()
+	String() string
+}
+
+// SelectItem is one entry of a SELECT list
+type SelectItem struct {
+	Expr  Expr   // nil for * or table.*
+	Table string // Table or alias of a table.* item
+	Alias string // Output column name, if given with AS
+}
+
+// OrderItem is one ORDER BY term
+type OrderItem struct {
+	Expr Expr
+	Desc bool
+}
+
+// TableRef names a table in a FROM clause
+type TableRef struct {
+	Name  string
+	Alias string
+}
+
+// JoinKind is the type of a JOIN
+type JoinKind int
+
+const (
+	InnerJoin JoinKind = iota
+	LeftJoin
+)
+
+func (k JoinKind) String() string {
+	if k == LeftJoin {
+		return "LEFT JOIN"
+	}
+	return "INNER JOIN"
+}
+
+// JoinClause is [INNER] JOIN or LEFT [OUTER] JOIN table ON condition
+type JoinClause struct {
+	Kind  JoinKind
+	Table TableRef
+	On    Expr
+}
+
+// SelectStmt is SELECT ... [FROM ... [JOIN ...]] [WHERE ...] [GROUP BY ...]
+// [HAVING ...] [ORDER BY ...] [LIMIT ...] [OFFSET ...]
+type SelectStmt struct {
+	Columns []SelectItem
+	From    *TableRef // nil for SELECT without FROM
+	Joins   []JoinClause
+	Where   Expr
+	GroupBy []Expr
+	Having  Expr
+	OrderBy []OrderItem
+	Limit   Expr
+	Offset  Expr
+}
+
+// InsertStmt is INSERT INTO table [(columns)] VALUES (...), ...
+type InsertStmt struct {
+	Table   string
+	Columns []string
+	Rows    [][]Expr
+}
+
+// Assignment is a single column = expr of an UPDATE
+type Assignment struct {
+	Column string
+	Value  Expr
+}
+
+// UpdateStmt is UPDATE table SET ... [WHERE ...]
+type UpdateStmt struct {
+	Table string
+	Set   []Assignment
+	Where Expr
+}
+
+// DeleteStmt is DELETE FROM table [WHERE ...]
+type DeleteStmt struct {
+	Table string
+	Where Expr
+}
+
+// CreateTableStmt is CREATE TABLE name (column definitions) [TTL (column [, 'duration'])]
+type CreateTableStmt struct {
+	Table  string
+	Schema Schema
+}
+
+// CreateIndexStmt is CREATE [UNIQUE] INDEX [name] ON table [USING BTREE|HASH|FULLTEXT] (columns)
+type CreateIndexStmt struct {
+	Table string
+	Spec  IndexSpec
+}
+
+// AlterTableStmt is ALTER TABLE name SET TTL (column [, 'duration']) or
+// ALTER TABLE name DROP TTL
+type AlterTableStmt struct {
+	Table string
+	TTL   *TTL // nil for DROP TTL
+}
+
+// ExplainStmt is EXPLAIN statement
+type ExplainStmt struct {
+	Stmt Statement
+}
+
+// AnalyzeStmt is ANALYZE [table]; an empty Table analyzes every table
+type AnalyzeStmt struct {
+	Table string
+}
+
+// PromoteStmt is PROMOTE, which makes a replica writable
+type PromoteStmt struct{}
+
+// ShowReplicationStmt is SHOW REPLICATION
+type ShowReplicationStmt struct{}
+
+// TransactionStmt is BEGIN, COMMIT or ROLLBACK
+type TransactionStmt struct {
+	Action string // "BEGIN", "COMMIT" or "ROLLBACK"
+}
+
+func (*SelectStmt) statement()          {}
+func (*InsertStmt) statement()          {}
+func (*UpdateStmt) statement()          {}
+func (*DeleteStmt) statement()          {}
+func (*CreateTableStmt) statement()     {}
+func (*CreateIndexStmt) statement()     {}
+func (*AlterTableStmt) statement()      {}
+func (*ExplainStmt) statement()         {}
+func (*AnalyzeStmt) statement()         {}
+func (*PromoteStmt) statement()         {}
+func (*ShowReplicationStmt) statement() {}
+func (*TransactionStmt) statement()     {}
+
+// aggregateFuncs are the supported aggregate functions
+var aggregateFuncs = map[string]bool{"COUNT": true, "SUM": true, "AVG": true, "MIN": true, "MAX": true}
+
+// FuncCall is an aggregate call such as COUNT(*) or SUM(DISTINCT x)
+type FuncCall struct {
+	Name     string // Upper case
+	Args     []Expr
+	Star     bool // COUNT(*)
+	Distinct bool
+}
+
+// Literal is a constant value
+type Literal struct {
+	Value any
+}
+
+// ColumnRef is a possibly table-qualified column name
+type ColumnRef struct {
+	Table  string
+	Column string
+}
+
+// Param is a positional parameter; Index is 1-based as in $1
+type Param struct {
+	Index int
+}
+
+// BinaryExpr is a binary operator: arithmetic, comparison, AND, OR or ||
+type BinaryExpr struct {
+	Op    string
+	Left  Expr
+	Right Expr
+}
+
+// UnaryExpr is NOT or unary minus
+type UnaryExpr struct {
+	Op   string
+	Expr Expr
+}
+
+// IsNullExpr is expr IS [NOT] NULL
+type IsNullExpr struct {
+	Expr Expr
+	Not  bool
+}
+
+// BetweenExpr is expr [NOT] BETWEEN low AND high
+type BetweenExpr struct {
+	Expr Expr
+	Low  Expr
+	High Expr
+	Not  bool
+}
+
+// InExpr is expr [NOT] IN (list)
+type InExpr struct {
+	Expr Expr
+	List []Expr
+	Not  bool
+}
+
+// LikeExpr is expr [NOT] LIKE pattern, where % and _ are wildcards
+type LikeExpr struct {
+	Expr    Expr
+	Pattern Expr
+	Not     bool
+}
+
+// MatchExpr is expr [NOT] MATCH query, a full-text match of a string
+// against a query such as 'fast "search engine" data*'
+type MatchExpr struct {
+	Expr  Expr
+	Query Expr
+	Not   bool
+}
+
+// RankExpr is BM25(column, query), the relevance of the column to a
+// full-text query, computed with the column's full-text index
+type RankExpr struct {
+	Column *ColumnRef
+	Query  Expr
+}
+
+func (*Literal) expr()     {}
+func (*ColumnRef) expr()   {}
+func (*Param) expr()       {}
+func (*BinaryExpr) expr()  {}
+func (*UnaryExpr) expr()   {}
+func (*IsNullExpr) expr()  {}
+func (*BetweenExpr) expr() {}
+func (*InExpr) expr()      {}
+func (*LikeExpr) expr()    {}
+func (*FuncCall) expr()    {}
+func (*MatchExpr) expr()   {}
+func (*RankExpr) expr()    {}
+
+func (e *Literal) String() string {
+	switch v := e.Value.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+	case bool:
+		if v {
+			return "TRUE"
+		}
+		return "FALSE"
+	}
+	return fmt.Sprint(e.Value)
+}
+
+func (e *ColumnRef) String() string {
+	if e.Table != "" {
+		return e.Table + "." + e.Column
+	}
+	return e.Column
+}
+
+func (e *Param) String() string {
+	return fmt.Sprintf("$%d", e.Index)
+}
+
+func (e *BinaryExpr) String() string {
+	return fmt.Sprintf("(%s %s %s)", e.Left, e.Op, e.Right)
+}
+
+func (e *UnaryExpr) String() string {
+	if e.Op == "NOT" {
+		return "NOT " + e.Expr.String()
+	}
+	return e.Op + e.Expr.String()
+}
+
+func (e *IsNullExpr) String() string {
+	if e.Not {
+		return e.Expr.String() + " IS NOT NULL"
+	}
+	return e.Expr.String() + " IS NULL"
+}
+
+func (e *BetweenExpr) String() string {
+	not := ""
+	if e.Not {
+		not = "NOT "
+	}
+	return fmt.Sprintf("%s %sBETWEEN %s AND %s", e.Expr, not, e.Low, e.High)
+}
+
+func (e *InExpr) String() string {
+	items := make([]string, len(e.List))
+	for i, item := range e.List {
+		items[i] = item.String()
+	}
+	not := ""
+	if e.Not {
+		not = "NOT "
+	}
+	return fmt.Sprintf("%s %sIN (%s)", e.Expr, not, strings.Join(items, ", "))
+}
+
+func (e *LikeExpr) String() string {
+	not := ""
+	if e.Not {
+		not = "NOT "
+	}
+	return fmt.Sprintf("%s %sLIKE %s", e.Expr, not, e.Pattern)
+}
+
+func (e *MatchExpr) String() string {
+	not := ""
+	if e.Not {
+		not = "NOT "
+	}
+	return fmt.Sprintf("%s %sMATCH %s", e.Expr, not, e.Query)
+}
+
+func (e *RankExpr) String() string {
+	return fmt.Sprintf("BM25(%s, %s)", e.Column, e.Query)
+}
+
+func (e *FuncCall) String() string {
+	if e.Star {
+		return e.Name + "(*)"
+	}
+	args := make([]string, len(e.Args))
+	for i, arg := range e.Args {
+		args[i] = arg.String()
+	}
+	distinct := ""
+	if e.Distinct {
+		distinct = "DISTINCT "
+	}
+	return fmt.Sprintf("%s(%s%s)", e.Name, distinct, strings.Join(args, ", "))
+}
@@ -0,0 +1,267 @@
+package main
+
+// Describe reports the result columns of a statement and their types without
+// running it. Statements that return no rows have no columns. A zero
+// ColumnType means the type could not be inferred.
+func (db *Database) Describe(stmt Statement) ([]string, []ColumnType, error) {
+	switch s := stmt.(type) {
+	case *SelectStmt:
+		var sources []source
+		if s.From != nil {
+			var err error
+			if sources, err = db.sources(s); err != nil {
+				return nil, nil, err
+			}
+		}
+		exprs, names, err := selectList(s, sources)
+		if err != nil {
+			return nil, nil, err
+		}
+		types := make([]ColumnType, len(exprs))
+		for i, expr := range exprs {
+			types[i] = exprType(expr, sourceTypes(sources))
+		}
+		return names, types, nil
+	case *ExplainStmt:
+		return []string{"QUERY PLAN"}, []ColumnType{TypeString}, nil
+	case *AnalyzeStmt:
+		return []string{"table", "column", "rows", "distinct", "nulls", "min", "max"},
+			[]ColumnType{TypeString, TypeString, TypeInt, TypeInt, TypeInt, 0, 0}, nil
+	case *ShowReplicationStmt:
+		return replicationColumns, replicationTypes, nil
+	}
+	return nil, nil, nil
+}
+
+// ParamTypes infers the type of each positional parameter from the column it
+// is compared with or assigned to. Element i is the type of $i+1; a zero
+// ColumnType means unknown.
+func (db *Database) ParamTypes(stmt Statement) ([]ColumnType, error) {
+	inf := &paramInference{}
+	switch s := stmt.(type) {
+	case *SelectStmt:
+		var sources []source
+		if s.From != nil {
+			var err error
+			if sources, err = db.sources(s); err != nil {
+				return nil, err
+			}
+		}
+		lookup := sourceTypes(sources)
+		for _, item := range s.Columns {
+			inf.walk(item.Expr, lookup)
+		}
+		for _, join := range s.Joins {
+			inf.walk(join.On, lookup)
+		}
+		inf.walk(s.Where, lookup)
+		for _, key := range s.GroupBy {
+			inf.walk(key, lookup)
+		}
+		inf.walk(s.Having, lookup)
+		for _, item := range s.OrderBy {
+			inf.walk(item.Expr, lookup)
+		}
+		inf.expect(s.Limit, TypeInt)
+		inf.expect(s.Offset, TypeInt)
+
+	case *InsertStmt:
+		schema, err := db.Schema(s.Table)
+		if err != nil {
+			return nil, err
+		}
+		columns := s.Columns
+		if len(columns) == 0 {
+			for _, column := range schema.Columns {
+				columns = append(columns, column.Name)
+			}
+		}
+		for _, row := range s.Rows {
+			for i, value := range row {
+				if i < len(columns) {
+					if column, exists := schema.Column(columns[i]); exists {
+						inf.expect(value, column.Type)
+					}
+				}
+				inf.walk(value, nil)
+			}
+		}
+
+	case *UpdateStmt:
+		schema, err := db.Schema(s.Table)
+		if err != nil {
+			return nil, err
+		}
+		lookup := sourceTypes([]source{{name: s.Table, table: s.Table, schema: schema}})
+		for _, assignment := range s.Set {
+			if column, exists := schema.Column(assignment.Column); exists {
+				inf.expect(assignment.Value, column.Type)
+			}
+			inf.walk(assignment.Value, lookup)
+		}
+		inf.walk(s.Where, lookup)
+
+	case *DeleteStmt:
+		schema, err := db.Schema(s.Table)
+		if err != nil {
+			return nil, err
+		}
+		inf.walk(s.Where, sourceTypes([]source{{name: s.Table, table: s.Table, schema: schema}}))
+
+	case *ExplainStmt:
+		return db.ParamTypes(s.Stmt)
+	}
+	return inf.types, nil
+}
+
+// sourceTypes returns a function giving the type of a column reference
+func sourceTypes(sources []source) func(*ColumnRef) ColumnType {
+	return func(ref *ColumnRef) ColumnType {
+		i, err := resolveSource(sources, ref)
+		if err != nil {
+			return 0
+		}
+		column, _ := sources[i].schema.Column(ref.Column)
+		return column.Type
+	}
+}
+
+// exprType infers the type an expression evaluates to
+func exprType(expr Expr, lookup func(*ColumnRef) ColumnType) ColumnType {
+	switch e := expr.(type) {
+	case *Literal:
+		switch e.Value.(type) {
+		case int64:
+			return TypeInt
+		case float64:
+			return TypeFloat
+		case string:
+			return TypeString
+		case bool:
+			return TypeBool
+		}
+	case *ColumnRef:
+		if lookup != nil {
+			return lookup(e)
+		}
+	case *BinaryExpr:
+		switch e.Op {
+		case "||":
+			return TypeString
+		case "+", "-", "*", "/", "%":
+			left, right := exprType(e.Left, lookup), exprType(e.Right, lookup)
+			switch {
+			case left == TypeInt && right == TypeInt:
+				return TypeInt
+			case (left == TypeInt || left == TypeFloat) && (right == TypeInt || right == TypeFloat):
+				return TypeFloat
+			}
+		default:
+			return TypeBool
+		}
+	case *UnaryExpr:
+		if e.Op == "NOT" {
+			return TypeBool
+		}
+		return exprType(e.Expr, lookup)
+	case *IsNullExpr, *BetweenExpr, *InExpr, *LikeExpr, *MatchExpr:
+		return TypeBool
+	case *RankExpr:
+		return TypeFloat
+	case *FuncCall:
+		switch e.Name {
+		case "COUNT":
+			return TypeInt
+		case "AVG":
+			return TypeFloat
+		default:
+			return exprType(e.Args[0], lookup)
+		}
+	}
+	return 0
+}
+
+// paramInference collects parameter types while walking expressions
+type paramInference struct {
+	types []ColumnType
+}
+
+// expect records t as the type of expr if it is a parameter of unknown type
+func (inf *paramInference) expect(expr Expr, t ColumnType) {
+	param, ok := expr.(*Param)
+	if !ok || t == 0 {
+		return
+	}
+	for len(inf.types) < param.Index {
+		inf.types = append(inf.types, 0)
+	}
+	if inf.types[param.Index-1] == 0 {
+		inf.types[param.Index-1] = t
+	}
+}
+
+// walk infers parameter types from the operands they meet in expr
+func (inf *paramInference) walk(expr Expr, lookup func(*ColumnRef) ColumnType) {
+	peers := func(exprs ...Expr) {
+		var t ColumnType
+		for _, e := range exprs {
+			if t = exprType(e, lookup); t != 0 {
+				break
+			}
+		}
+		for _, e := range exprs {
+			inf.expect(e, t)
+			inf.walk(e, lookup)
+		}
+	}
+
+	switch e := expr.(type) {
+	case *Param:
+		for len(inf.types) < e.Index {
+			inf.types = append(inf.types, 0)
+		}
+	case *BinaryExpr:
+		switch e.Op {
+		case "AND", "OR":
+			inf.expect(e.Left, TypeBool)
+			inf.expect(e.Right, TypeBool)
+			inf.walk(e.Left, lookup)
+			inf.walk(e.Right, lookup)
+		case "||":
+			inf.expect(e.Left, TypeString)
+			inf.expect(e.Right, TypeString)
+			inf.walk(e.Left, lookup)
+			inf.walk(e.Right, lookup)
+		default:
+			peers(e.Left, e.Right)
+		}
+	case *UnaryExpr:
+		if e.Op == "NOT" {
+			inf.expect(e.Expr, TypeBool)
+		}
+		inf.walk(e.Expr, lookup)
+	case *IsNullExpr:
+		inf.walk(e.Expr, lookup)
+	case *BetweenExpr:
+		peers(e.Expr, e.Low, e.High)
+	case *InExpr:
+		peers(append([]Expr{e.Expr}, e.List...)...)
+	case *LikeExpr:
+		inf.expect(e.Expr, TypeString)
+		inf.expect(e.Pattern, TypeString)
+		inf.walk(e.Expr, lookup)
+		inf.walk(e.Pattern, lookup)
+	case *MatchExpr:
+		inf.expect(e.Expr, TypeString)
+		inf.expect(e.Query, TypeString)
+		inf.walk(e.Expr, lookup)
+		inf.walk(e.Query, lookup)
+	case *RankExpr:
+		inf.expect(e.Query, TypeString)
+		inf.walk(e.Query, lookup)
+	case *FuncCall:
+		for _, arg := range e.Args {
+			inf.walk(arg, lookup)
+		}
+	}
+}
@@ -0,0 +1,856 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ErrIntegerRange is returned when integer arithmetic overflows int64
+var ErrIntegerRange = errors.New("integer out of range")
+
+// Result is the outcome of executing a statement. Queries fill Columns and
+// Rows; INSERT, UPDATE and DELETE report RowsAffected.
+type Result struct {
+	Command      string // Statement kind such as "SELECT" or "CREATE TABLE"
+	Columns      []string
+	Rows         [][]any
+	RowsAffected int
+}
+
+// Exec parses and runs a single SQL statement in its own transaction. args
+// bind positional parameters written as $1, $2, ... or ?.
+func (db *Database) Exec(ctx context.Context, query string, args ...any) (*Result, error) {
+	stmt, err := Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	return db.ExecStatement(ctx, stmt, args...)
+}
+
+// ExecStatement runs a parsed statement in its own transaction
+func (db *Database) ExecStatement(ctx context.Context, stmt Statement, args ...any) (*Result, error) {
+	tx, err := db.BeginTransaction(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result, err := tx.ExecStatement(stmt, args...)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Exec parses and runs a single SQL statement inside the transaction
+func (tx *Transaction) Exec(query string, args ...any) (*Result, error) {
+	stmt, err := Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	return tx.ExecStatement(stmt, args...)
+}
+
+// execStatement runs a statement that ctx may cancel without ending the
+// transaction, as sessions do for statements inside BEGIN ... COMMIT
+func (tx *Transaction) execStatement(ctx context.Context, stmt Statement, args ...any) (*Result, error) {
+	tx.mu.Lock()
+	tx.stmtCtx = ctx
+	tx.mu.Unlock()
+	defer func() {
+		tx.mu.Lock()
+		tx.stmtCtx = nil
+		tx.mu.Unlock()
+	}()
+	return tx.ExecStatement(stmt, args...)
+}
+
+// ExecStatement runs a parsed statement inside the transaction. CREATE TABLE
+// and CREATE INDEX are not transactional and take effect immediately.
+func (tx *Transaction) ExecStatement(stmt Statement, args ...any) (*Result, error) {
+	ex := &executor{tx: tx, args: args}
+	result, err := ex.exec(stmt)
+	if err != nil {
+		return nil, err
+	}
+	result.Command = commandName(stmt)
+	return result, nil
+}
+
+func (ex *executor) exec(stmt Statement) (*Result, error) {
+	tx := ex.tx
+	switch s := stmt.(type) {
+	case *SelectStmt:
+		return ex.execSelect(s)
+	case *InsertStmt:
+		return ex.execInsert(s)
+	case *UpdateStmt:
+		return ex.execUpdate(s)
+	case *DeleteStmt:
+		return ex.execDelete(s)
+	case *CreateTableStmt:
+		return ex.execCreateTable(s)
+	case *CreateIndexStmt:
+		return &Result{}, tx.db.CreateIndexWithSpec(tx.ctx, s.Table, s.Spec)
+	case *AlterTableStmt:
+		return &Result{}, tx.db.SetTTL(tx.ctx, s.Table, s.TTL)
+	case *ExplainStmt:
+		return ex.explain(s.Stmt)
+	case *AnalyzeStmt:
+		return ex.execAnalyze(s)
+	case *PromoteStmt:
+		return &Result{}, tx.db.Promote()
+	case *ShowReplicationStmt:
+		return ex.execShowReplication()
+	case *TransactionStmt:
+		return nil, fmt.Errorf("%s is only supported in a session", s.Action)
+	}
+	return nil, fmt.Errorf("unsupported statement %T", stmt)
+}
+
+// commandName is the kind of a statement as reported in Result.Command
+func commandName(stmt Statement) string {
+	switch s := stmt.(type) {
+	case *SelectStmt:
+		return "SELECT"
+	case *InsertStmt:
+		return "INSERT"
+	case *UpdateStmt:
+		return "UPDATE"
+	case *DeleteStmt:
+		return "DELETE"
+	case *CreateTableStmt:
+		return "CREATE TABLE"
+	case *CreateIndexStmt:
+		return "CREATE INDEX"
+	case *AlterTableStmt:
+		return "ALTER TABLE"
+	case *ExplainStmt:
+		return "EXPLAIN"
+	case *AnalyzeStmt:
+		return "ANALYZE"
+	case *PromoteStmt:
+		return "PROMOTE"
+	case *ShowReplicationStmt:
+		return "SHOW"
+	case *TransactionStmt:
+		return s.Action
+	}
+	return ""
+}
+
+// executor runs statements against a transaction
+type executor struct {
+	tx      *Transaction
+	args    []any
+	rankers map[*RankExpr]*textRanker // Built on first use, see rankerFor
+}
+
+// scope resolves column references while evaluating an expression
+type scope interface {
+	resolve(ref *ColumnRef) (any, error)
+}
+
+// emptyScope has no columns, for SELECT without FROM and LIMIT/OFFSET
+type emptyScope struct{}
+
+func (emptyScope) resolve(ref *ColumnRef) (any, error) {
+	return nil, &ColumnError{Column: ref.String()}
+}
+
+// rowScope resolves columns of a single table row
+type rowScope struct {
+	table  string // Table name or alias
+	schema Schema
+	row    Record
+}
+
+func (s *rowScope) resolve(ref *ColumnRef) (any, error) {
+	if ref.Table != "" && ref.Table != s.table {
+		return nil, fmt.Errorf("unknown table %q", ref.Table)
+	}
+	if _, exists := s.schema.Column(ref.Column); !exists {
+		return nil, &ColumnError{Column: ref.String()}
+	}
+	return s.row[ref.Column], nil
+}
+
+// aliasScope lets ORDER BY refer to SELECT output names
+type aliasScope struct {
+	base    scope
+	aliases map[string]Expr
+	ex      *executor
+}
+
+func (s *aliasScope) resolve(ref *ColumnRef) (any, error) {
+	if ref.Table == "" {
+		if expr, ok := s.aliases[ref.Column]; ok {
+			return s.ex.eval(expr, s.base)
+		}
+	}
+	return s.base.resolve(ref)
+}
+
+// filter keeps the rows for which where is true
+func (ex *executor) filter(rows []Record, where Expr, newScope func(Record) scope) ([]Record, error) {
+	if where == nil {
+		return rows, nil
+	}
+	kept := rows[:0]
+	for _, row := range rows {
+		match, err := ex.truth(where, newScope(row))
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			kept = append(kept, row)
+		}
+	}
+	return kept, nil
+}
+
+// count evaluates a non-negative integer such as a LIMIT
+func (ex *executor) count(expr Expr, clause string) (int, error) {
+	value, err := ex.eval(expr, emptyScope{})
+	if err != nil {
+		return 0, err
+	}
+	n, ok := value.(int64)
+	if !ok || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", clause)
+	}
+	return int(n), nil
+}
+
+func (ex *executor) execInsert(stmt *InsertStmt) (*Result, error) {
+	table, err := ex.tx.db.lookupTable(stmt.Table)
+	if err != nil {
+		return nil, err
+	}
+	columns := stmt.Columns
+	if columns == nil {
+		for _, column := range table.schema.Columns {
+			columns = append(columns, column.Name)
+		}
+	}
+
+	result := &Result{}
+	for _, values := range stmt.Rows {
+		if len(values) != len(columns) {
+			return nil, fmt.Errorf("INSERT has %d columns but %d values", len(columns), len(values))
+		}
+		record := make(Record, len(columns))
+		for i, name := range columns {
+			column, exists := table.schema.Column(name)
+			if !exists {
+				return nil, &ColumnError{Column: name}
+			}
+			value, err := ex.eval(values[i], emptyScope{})
+			if err != nil {
+				return nil, err
+			}
+			if record[name], err = sqlCoerce(value, column.Type); err != nil {
+				return nil, fmt.Errorf("column %q: %w", name, err)
+			}
+		}
+		if err := ex.tx.Insert(stmt.Table, record); err != nil {
+			return nil, err
+		}
+		result.RowsAffected++
+	}
+	return result, nil
+}
+
+func (ex *executor) execUpdate(stmt *UpdateStmt) (*Result, error) {
+	table, rows, err := ex.scanRows(stmt.Table, stmt.Table, stmt.Where)
+	if err != nil {
+		return nil, err
+	}
+	newScope := func(row Record) scope { return &rowScope{table: stmt.Table, schema: table.schema, row: row} }
+	rows, err = ex.filter(rows, stmt.Where, newScope)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{}
+	for _, row := range rows {
+		changes := make(Record, len(stmt.Set))
+		for _, assignment := range stmt.Set {
+			column, exists := table.schema.Column(assignment.Column)
+			if !exists {
+				return nil, &ColumnError{Column: assignment.Column}
+			}
+			value, err := ex.eval(assignment.Value, newScope(row))
+			if err != nil {
+				return nil, err
+			}
+			if changes[column.Name], err = sqlCoerce(value, column.Type); err != nil {
+				return nil, fmt.Errorf("column %q: %w", column.Name, err)
+			}
+		}
+		if err := ex.tx.Update(stmt.Table, row[table.schema.PrimaryKey], changes); err != nil {
+			return nil, err
+		}
+		result.RowsAffected++
+	}
+	return result, nil
+}
+
+func (ex *executor) execDelete(stmt *DeleteStmt) (*Result, error) {
+	table, rows, err := ex.scanRows(stmt.Table, stmt.Table, stmt.Where)
+	if err != nil {
+		return nil, err
+	}
+	newScope := func(row Record) scope { return &rowScope{table: stmt.Table, schema: table.schema, row: row} }
+	rows, err = ex.filter(rows, stmt.Where, newScope)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{}
+	for _, row := range rows {
+		if err := ex.tx.Delete(stmt.Table, row[table.schema.PrimaryKey]); err != nil {
+			return nil, err
+		}
+		result.RowsAffected++
+	}
+	return result, nil
+}
+
+func (ex *executor) execCreateTable(stmt *CreateTableStmt) (*Result, error) {
+	schema := stmt.Schema
+	schema.Columns = append([]Column(nil), schema.Columns...)
+	for i, column := range schema.Columns {
+		if column.Default == nil {
+			continue
+		}
+		value, err := sqlCoerce(column.Default, column.Type)
+		if err != nil {
+			return nil, fmt.Errorf("column %q default: %w", column.Name, err)
+		}
+		schema.Columns[i].Default = value
+	}
+	return &Result{}, ex.tx.db.CreateTable(stmt.Table, schema)
+}
+
+// truth evaluates a boolean condition; NULL counts as false
+func (ex *executor) truth(expr Expr, sc scope) (bool, error) {
+	value, err := ex.eval(expr, sc)
+	if err != nil {
+		return false, err
+	}
+	b, isNull, err := toBool(value)
+	return b && !isNull, err
+}
+
+// eval evaluates expr with SQL three-valued logic: most operators yield NULL
+// when an operand is NULL
+func (ex *executor) eval(expr Expr, sc scope) (any, error) {
+	if g := groupOf(sc); g != nil {
+		if value, ok := g.lookup(expr); ok {
+			return value, nil
+		}
+	}
+
+	switch e := expr.(type) {
+	case *Literal:
+		return e.Value, nil
+
+	case *Param:
+		if e.Index > len(ex.args) {
+			return nil, fmt.Errorf("no value for parameter $%d", e.Index)
+		}
+		return normalizeArg(ex.args[e.Index-1])
+
+	case *ColumnRef:
+		return sc.resolve(e)
+
+	case *FuncCall:
+		g := groupOf(sc)
+		if g == nil {
+			return nil, fmt.Errorf("aggregate function %s is not allowed here", e.Name)
+		}
+		return ex.aggregate(e, g)
+
+	case *UnaryExpr:
+		value, err := ex.eval(e.Expr, sc)
+		if err != nil || value == nil {
+			return nil, err
+		}
+		if e.Op == "NOT" {
+			b, _, err := toBool(value)
+			return !b, err
+		}
+		switch v := value.(type) {
+		case int64:
+			if v == math.MinInt64 {
+				return nil, ErrIntegerRange
+			}
+			return -v, nil
+		case float64:
+			return -v, nil
+		}
+		return nil, fmt.Errorf("cannot negate %T", value)
+
+	case *BinaryExpr:
+		if e.Op == "AND" || e.Op == "OR" {
+			return ex.evalLogic(e, sc)
+		}
+		left, err := ex.eval(e.Left, sc)
+		if err != nil {
+			return nil, err
+		}
+		right, err := ex.eval(e.Right, sc)
+		if err != nil {
+			return nil, err
+		}
+		if left == nil || right == nil {
+			return nil, nil
+		}
+		switch e.Op {
+		case "=", "<>", "<", "<=", ">", ">=":
+			c, err := compareSQL(left, right)
+			if err != nil {
+				return nil, err
+			}
+			return compareResult(e.Op, c), nil
+		case "||":
+			return fmt.Sprint(left) + fmt.Sprint(right), nil
+		}
+		return arithmetic(e.Op, left, right)
+
+	case *IsNullExpr:
+		value, err := ex.eval(e.Expr, sc)
+		if err != nil {
+			return nil, err
+		}
+		return (value == nil) != e.Not, nil
+
+	case *BetweenExpr:
+		value, err := ex.eval(e.Expr, sc)
+		if err != nil {
+			return nil, err
+		}
+		low, err := ex.eval(e.Low, sc)
+		if err != nil {
+			return nil, err
+		}
+		high, err := ex.eval(e.High, sc)
+		if err != nil {
+			return nil, err
+		}
+		if value == nil || low == nil || high == nil {
+			return nil, nil
+		}
+		lc, err := compareSQL(value, low)
+		if err != nil {
+			return nil, err
+		}
+		hc, err := compareSQL(value, high)
+		if err != nil {
+			return nil, err
+		}
+		return (lc >= 0 && hc <= 0) != e.Not, nil
+
+	case *InExpr:
+		value, err := ex.eval(e.Expr, sc)
+		if err != nil || value == nil {
+			return nil, err
+		}
+		sawNull := false
+		for _, item := range e.List {
+			candidate, err := ex.eval(item, sc)
+			if err != nil {
+				return nil, err
+			}
+			if candidate == nil {
+				sawNull = true
+				continue
+			}
+			c, err := compareSQL(value, candidate)
+			if err != nil {
+				return nil, err
+			}
+			if c == 0 {
+				return !e.Not, nil
+			}
+		}
+		if sawNull {
+			return nil, nil
+		}
+		return e.Not, nil
+
+	case *LikeExpr:
+		value, err := ex.eval(e.Expr, sc)
+		if err != nil {
+			return nil, err
+		}
+		pattern, err := ex.eval(e.Pattern, sc)
+		if err != nil || value == nil || pattern == nil {
+			return nil, err
+		}
+		s, ok1 := value.(string)
+		p, ok2 := pattern.(string)
+		if !ok1 || !ok2 {
+			return nil, errors.New("LIKE needs string operands")
+		}
+		return likeMatch(s, p) != e.Not, nil
+
+	case *MatchExpr:
+		value, err := ex.eval(e.Expr, sc)
+		if err != nil {
+			return nil, err
+		}
+		query, err := ex.eval(e.Query, sc)
+		if err != nil || value == nil || query == nil {
+			return nil, err
+		}
+		s, ok1 := value.(string)
+		q, ok2 := query.(string)
+		if !ok1 || !ok2 {
+			return nil, errors.New("MATCH needs string operands")
+		}
+		return parseTextQuery(q).matches(textWords(s)) != e.Not, nil
+
+	case *RankExpr:
+		value, err := ex.eval(e.Column, sc)
+		if err != nil || value == nil {
+			return nil, err
+		}
+		ranker, err := ex.rankerFor(e, sc)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := value.(string)
+		if !ok {
+			return nil, errors.New("BM25 needs a string column")
+		}
+		return ranker.score(s), nil
+	}
+	return nil, fmt.Errorf("unsupported expression %T", expr)
+}
+
+// evalLogic evaluates AND and OR, where FALSE AND NULL is FALSE and TRUE OR
+// NULL is TRUE
+func (ex *executor) evalLogic(e *BinaryExpr, sc scope) (any, error) {
+	left, err := ex.eval(e.Left, sc)
+	if err != nil {
+		return nil, err
+	}
+	lb, lnull, err := toBool(left)
+	if err != nil {
+		return nil, err
+	}
+	if !lnull && lb == (e.Op == "OR") {
+		return lb, nil // Short-circuit
+	}
+	right, err := ex.eval(e.Right, sc)
+	if err != nil {
+		return nil, err
+	}
+	rb, rnull, err := toBool(right)
+	if err != nil {
+		return nil, err
+	}
+	if !rnull && rb == (e.Op == "OR") {
+		return rb, nil
+	}
+	if lnull || rnull {
+		return nil, nil
+	}
+	return rb, nil
+}
+
+// toBool interprets a value as a condition
+func toBool(value any) (b bool, isNull bool, err error) {
+	switch v := value.(type) {
+	case nil:
+		return false, true, nil
+	case bool:
+		return v, false, nil
+	}
+	return false, false, &TypeError{Type: "boolean", Value: value}
+}
+
+func compareResult(op string, c int) bool {
+	switch op {
+	case "=":
+		return c == 0
+	case "<>":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+// compareSQL compares two non-NULL values, converting a string operand when
+// the other side is a time or bytes value
+func compareSQL(a, b any) (int, error) {
+	if s, ok := a.(string); ok {
+		if _, isTime := b.(time.Time); isTime {
+			t, err := parseTime(s)
+			if err != nil {
+				return 0, err
+			}
+			a = t
+		}
+		if _, isBytes := b.([]byte); isBytes {
+			a = []byte(s)
+		}
+	}
+	if s, ok := b.(string); ok {
+		if _, isTime := a.(time.Time); isTime {
+			t, err := parseTime(s)
+			if err != nil {
+				return 0, err
+			}
+			b = t
+		}
+		if _, isBytes := a.([]byte); isBytes {
+			b = []byte(s)
+		}
+	}
+
+	switch a.(type) {
+	case int64, float64:
+		switch b.(type) {
+		case int64, float64:
+			return compareValues(a, b), nil
+		}
+	default:
+		if fmt.Sprintf("%T", a) == fmt.Sprintf("%T", b) {
+			return compareValues(a, b), nil
+		}
+	}
+	return 0, fmt.Errorf("cannot compare %T with %T", a, b)
+}
+
+// arithmetic applies + - * / % to two non-NULL numbers. Two ints give an int,
+// or ErrIntegerRange if it overflows; anything involving a float gives a
+// float.
+func arithmetic(op string, left, right any) (any, error) {
+	li, lInt := left.(int64)
+	ri, rInt := right.(int64)
+	if lInt && rInt {
+		switch op {
+		case "+":
+			sum := li + ri
+			if (sum > li) != (ri > 0) {
+				return nil, ErrIntegerRange
+			}
+			return sum, nil
+		case "-":
+			diff := li - ri
+			if (diff < li) != (ri > 0) {
+				return nil, ErrIntegerRange
+			}
+			return diff, nil
+		case "*":
+			product := li * ri
+			if li != 0 && (product/li != ri || li == -1 && ri == math.MinInt64 || ri == -1 && li == math.MinInt64) {
+				return nil, ErrIntegerRange
+			}
+			return product, nil
+		case "/", "%":
+			if ri == 0 {
+				return nil, errors.New("division by zero")
+			}
+			if op == "/" {
+				if li == math.MinInt64 && ri == -1 {
+					return nil, ErrIntegerRange
+				}
+				return li / ri, nil
+			}
+			if ri == -1 {
+				return int64(0), nil
+			}
+			return li % ri, nil
+		}
+	}
+
+	lf, ok1 := toFloat(left)
+	rf, ok2 := toFloat(right)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("operator %s needs numbers, got %T and %T", op, left, right)
+	}
+	switch op {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/":
+		if rf == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return lf / rf, nil
+	case "%":
+		if rf == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return math.Mod(lf, rf), nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", op)
+}
+
+func toFloat(value any) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// likeMatch matches s against a LIKE pattern where % is any run of
+// characters and _ is a single character
+func likeMatch(s, pattern string) bool {
+	str, pat := []rune(s), []rune(pattern)
+	// match[j] reports whether pat[:i] matches str[:j] for the current i
+	match := make([]bool, len(str)+1)
+	match[0] = true
+	for _, p := range pat {
+		next := make([]bool, len(str)+1)
+		if p == '%' {
+			seen := false
+			for j := range match {
+				seen = seen || match[j]
+				next[j] = seen
+			}
+		} else {
+			for j := 1; j <= len(str); j++ {
+				next[j] = match[j-1] && (p == '_' || p == str[j-1])
+			}
+		}
+		match = next
+	}
+	return match[len(str)]
+}
+
+// normalizeArg converts a Go parameter value to the executor's value types
+func normalizeArg(arg any) (any, error) {
+	switch v := arg.(type) {
+	case nil, int64, float64, string, bool, []byte:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case time.Time:
+		return v.UTC().Round(0), nil
+	}
+	if n, err := convertValue(arg, TypeInt); err == nil {
+		return n, nil
+	}
+	return nil, fmt.Errorf("unsupported parameter type %T", arg)
+}
+
+// sqlCoerce converts an evaluated value for storage in a column of type t,
+// also accepting strings for time columns
+func sqlCoerce(value any, t ColumnType) (any, error) {
+	if s, ok := value.(string); ok && t == TypeTime {
+		return parseTime(s)
+	}
+	return convertValue(value, t)
+}
+
+// parseTime accepts RFC 3339 timestamps, "2006-01-02 15:04:05" with an
+// optional zone offset as PostgreSQL prints it, and dates
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range []string{
+		time.RFC3339Nano,
+		"2006-01-02 15:04:05.999999999",
+		"2006-01-02 15:04:05.999999999Z07:00",
+		"2006-01-02 15:04:05.999999999Z07",
+		"2006-01-02",
+	} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, &TypeError{Type: "time", Value: s, Text: true}
+}
+
+// Tag returns the PostgreSQL-style command tag, such as "SELECT 2" or
+// "INSERT 0 1"
+func (r *Result) Tag() string {
+	switch r.Command {
+	case "SELECT":
+		return fmt.Sprintf("SELECT %d", len(r.Rows))
+	case "INSERT":
+		return fmt.Sprintf("INSERT 0 %d", r.RowsAffected)
+	case "UPDATE", "DELETE":
+		return fmt.Sprintf("%s %d", r.Command, r.RowsAffected)
+	}
+	return r.Command
+}
+
+// String renders the result as an aligned text table
+func (r *Result) String() string {
+	if len(r.Columns) == 0 {
+		return fmt.Sprintf("%d row(s) affected", r.RowsAffected)
+	}
+
+	cells := make([][]string, len(r.Rows))
+	widths := make([]int, len(r.Columns))
+	for i, name := range r.Columns {
+		widths[i] = utf8.RuneCountInString(name)
+	}
+	for i, row := range r.Rows {
+		cells[i] = make([]string, len(row))
+		for j, value := range row {
+			cells[i][j] = formatValue(value)
+			widths[j] = max(widths[j], utf8.RuneCountInString(cells[i][j]))
+		}
+	}
+
+	var sb strings.Builder
+	writeRow := func(values []string) {
+		for i, value := range values {
+			if i > 0 {
+				sb.WriteString(" | ")
+			}
+			sb.WriteString(value + strings.Repeat(" ", widths[i]-utf8.RuneCountInString(value)))
+		}
+		sb.WriteString("\n")
+	}
+	writeRow(r.Columns)
+	for i, width := range widths {
+		if i > 0 {
+			sb.WriteString("-+-")
+		}
+		sb.WriteString(strings.Repeat("-", width))
+	}
+	sb.WriteString("\n")
+	for _, row := range cells {
+		writeRow(row)
+	}
+	fmt.Fprintf(&sb, "(%d row(s))", len(r.Rows))
+	return sb.String()
+}
+
+// formatValue renders a value for display
+func formatValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case []byte:
+		return fmt.Sprintf("\\x%x", v)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SyntaxError is a lexing or parsing error with its position in the query
+type SyntaxError struct {
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at line %d, column %d: %s", e.Line, e.Column, e.Msg)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokQuotedIdent
+	tokNumber
+	tokString
+	tokParam
+	tokSymbol
+)
+
+// token is a lexical token. Keywords are plain identifiers; the parser
+// matches them case-insensitively.
+type token struct {
+	kind   tokenKind
+	text   string
+	line   int
+	column int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of input"
+	case tokString:
+		return fmt.Sprintf("string '%s'", t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+// lexer splits a query into tokens
+type lexer struct {
+	src    string
+	pos    int
+	line   int
+	column int
+	params int // Count of "?" placeholders seen so far
+}
+
+// tokenize returns every token of src followed by tokEOF
+func tokenize(src string) ([]token, error) {
+	lx := &lexer{src: src, line: 1, column: 1}
+	var tokens []token
+	for {
+		tok, err := lx.next()
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, tok)
+		if tok.kind == tokEOF {
+			return tokens, nil
+		}
+	}
+}
+
+func (lx *lexer) errorf(line, column int, format string, args ...any) error {
+	return &SyntaxError{Line: line, Column: column, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (lx *lexer) peek(offset int) byte {
+	if lx.pos+offset < len(lx.src) {
+		return lx.src[lx.pos+offset]
+	}
+	return 0
+}
+
+// advance consumes n bytes, keeping line and column up to date
+func (lx *lexer) advance(n int) {
+	for i := 0; i < n && lx.pos < len(lx.src); i++ {
+		if lx.src[lx.pos] == '\n' {
+			lx.line++
+			lx.column = 1
+		} else if utf8.RuneStart(lx.src[lx.pos]) {
+			lx.column++
+		}
+		lx.pos++
+	}
+}
+
+// skipSpace skips whitespace and comments
+func (lx *lexer) skipSpace() error {
+	for lx.pos < len(lx.src) {
+		c := lx.src[lx.pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			lx.advance(1)
+		case c == '-' && lx.peek(1) == '-':
+			for lx.pos < len(lx.src) && lx.src[lx.pos] != '\n' {
+				lx.advance(1)
+			}
+		case c == '/' && lx.peek(1) == '*':
+			line, column := lx.line, lx.column
+			end := strings.Index(lx.src[lx.pos+2:], "*/")
+			if end < 0 {
+				return lx.errorf(line, column, "unterminated comment")
+			}
+			lx.advance(end + 4)
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (lx *lexer) next() (token, error) {
+	if err := lx.skipSpace(); err != nil {
+		return token{}, err
+	}
+	line, column := lx.line, lx.column
+	if lx.pos >= len(lx.src) {
+		return token{kind: tokEOF, line: line, column: column}, nil
+	}
+
+	start := lx.pos
+	c := lx.src[lx.pos]
+	switch {
+	case c == '_' || isLetter(c):
+		for lx.pos < len(lx.src) && (lx.src[lx.pos] == '_' || isLetter(lx.src[lx.pos]) || isDigit(lx.src[lx.pos])) {
+			lx.advance(1)
+		}
+		return token{kind: tokIdent, text: lx.src[start:lx.pos], line: line, column: column}, nil
+
+	case isDigit(c) || (c == '.' && isDigit(lx.peek(1))):
+		for lx.pos < len(lx.src) && isDigit(lx.src[lx.pos]) {
+			lx.advance(1)
+		}
+		if lx.peek(0) == '.' {
+			lx.advance(1)
+			for lx.pos < len(lx.src) && isDigit(lx.src[lx.pos]) {
+				lx.advance(1)
+			}
+		}
+		if e := lx.peek(0); e == 'e' || e == 'E' {
+			n := 1
+			if s := lx.peek(1); s == '+' || s == '-' {
+				n = 2
+			}
+			if isDigit(lx.peek(n)) {
+				lx.advance(n)
+				for lx.pos < len(lx.src) && isDigit(lx.src[lx.pos]) {
+					lx.advance(1)
+				}
+			}
+		}
+		return token{kind: tokNumber, text: lx.src[start:lx.pos], line: line, column: column}, nil
+
+	case c == '\'':
+		text, err := lx.quoted('\'')
+		if err != nil {
+			return token{}, lx.errorf(line, column, "unterminated string")
+		}
+		return token{kind: tokString, text: text, line: line, column: column}, nil
+
+	case c == '"':
+		text, err := lx.quoted('"')
+		if err != nil {
+			return token{}, lx.errorf(line, column, "unterminated quoted identifier")
+		}
+		return token{kind: tokQuotedIdent, text: text, line: line, column: column}, nil
+
+	case c == '?':
+		lx.advance(1)
+		lx.params++
+		return token{kind: tokParam, text: fmt.Sprintf("$%d", lx.params), line: line, column: column}, nil
+
+	case c == '$' && isDigit(lx.peek(1)):
+		lx.advance(1)
+		for lx.pos < len(lx.src) && isDigit(lx.src[lx.pos]) {
+			lx.advance(1)
+		}
+		return token{kind: tokParam, text: lx.src[start:lx.pos], line: line, column: column}, nil
+	}
+
+	for _, symbol := range []string{"<=", ">=", "<>", "!=", "||", "(", ")", ",", ";", "*", "+", "-", "/", "%", "=", "<", ">", "."} {
+		if strings.HasPrefix(lx.src[lx.pos:], symbol) {
+			lx.advance(len(symbol))
+			return token{kind: tokSymbol, text: symbol, line: line, column: column}, nil
+		}
+	}
+
+	r, _ := utf8.DecodeRuneInString(lx.src[lx.pos:])
+	if unicode.IsLetter(r) {
+		return token{}, lx.errorf(line, column, "non-ASCII identifiers must be quoted")
+	}
+	return token{}, lx.errorf(line, column, "unexpected character %q", r)
+}
+
+// quoted reads a quote-delimited string where a doubled quote is an escaped
+// quote
+func (lx *lexer) quoted(quote byte) (string, error) {
+	lx.advance(1)
+	var sb strings.Builder
+	for lx.pos < len(lx.src) {
+		c := lx.src[lx.pos]
+		if c == quote {
+			if lx.peek(1) == quote {
+				sb.WriteByte(quote)
+				lx.advance(2)
+				continue
+			}
+			lx.advance(1)
+			return sb.String(), nil
+		}
+		sb.WriteByte(c)
+		lx.advance(1)
+	}
+	return "", fmt.Errorf("unterminated")
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,1209 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parser is a recursive-descent SQL parser over a token slice
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse parses a single SQL statement. A trailing semicolon is allowed.
+func Parse(query string) (Statement, error) {
+	stmts, err := ParseScript(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(stmts) != 1 {
+		return nil, &SyntaxError{Line: 1, Column: 1, Msg: fmt.Sprintf("expected one statement, found %d", len(stmts))}
+	}
+	return stmts[0], nil
+}
+
+// ParseScript parses a sequence of semicolon-separated statements
+func ParseScript(query string) ([]Statement, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+
+	var stmts []Statement
+	for {
+		for p.acceptSymbol(";") {
+		}
+		if p.peek().kind == tokEOF {
+			return stmts, nil
+		}
+		stmt, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt)
+		if !p.acceptSymbol(";") && p.peek().kind != tokEOF {
+			return nil, p.unexpected("end of statement")
+		}
+	}
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) errorAt(tok token, format string, args ...any) error {
+	return &SyntaxError{Line: tok.line, Column: tok.column, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) unexpected(want string) error {
+	return p.errorAt(p.peek(), "expected %s, found %s", want, p.peek())
+}
+
+// isKeyword reports whether the next token is the given keyword
+func (p *parser) isKeyword(keyword string) bool {
+	tok := p.peek()
+	return tok.kind == tokIdent && strings.EqualFold(tok.text, keyword)
+}
+
+func (p *parser) acceptKeyword(keyword string) bool {
+	if p.isKeyword(keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectKeyword(keyword string) error {
+	if !p.acceptKeyword(keyword) {
+		return p.unexpected(keyword)
+	}
+	return nil
+}
+
+func (p *parser) acceptSymbol(symbol string) bool {
+	tok := p.peek()
+	if tok.kind == tokSymbol && tok.text == symbol {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectSymbol(symbol string) error {
+	if !p.acceptSymbol(symbol) {
+		return p.unexpected(fmt.Sprintf("%q", symbol))
+	}
+	return nil
+}
+
+// reserved words cannot be used as bare identifiers
+var reserved = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true, "ORDER": true, "BY": true, "LIMIT": true,
+	"OFFSET": true, "INSERT": true, "INTO": true, "VALUES": true, "UPDATE": true, "SET": true,
+	"DELETE": true, "CREATE": true, "TABLE": true, "INDEX": true, "ON": true, "AND": true,
+	"OR": true, "NOT": true, "NULL": true, "IS": true, "IN": true, "BETWEEN": true, "LIKE": true,
+	"AS": true, "ASC": true, "DESC": true, "TRUE": true, "FALSE": true, "PRIMARY": true,
+	"KEY": true, "DEFAULT": true, "UNIQUE": true, "USING": true, "JOIN": true, "INNER": true,
+	"LEFT": true, "OUTER": true, "GROUP": true, "HAVING": true, "DISTINCT": true,
+	"CHECK": true, "CONSTRAINT": true, "FOREIGN": true, "REFERENCES": true,
+}
+
+// parseIdent reads a bare or quoted identifier
+func (p *parser) parseIdent(what string) (string, error) {
+	tok := p.peek()
+	switch {
+	case tok.kind == tokQuotedIdent:
+		p.pos++
+		return tok.text, nil
+	case tok.kind == tokIdent && !reserved[strings.ToUpper(tok.text)]:
+		p.pos++
+		return tok.text, nil
+	}
+	return "", p.unexpected(what)
+}
+
+func (p *parser) parseStatement() (Statement, error) {
+	switch {
+	case p.acceptKeyword("SELECT"):
+		return p.parseSelect()
+	case p.acceptKeyword("INSERT"):
+		return p.parseInsert()
+	case p.acceptKeyword("UPDATE"):
+		return p.parseUpdate()
+	case p.acceptKeyword("DELETE"):
+		return p.parseDelete()
+	case p.acceptKeyword("CREATE"):
+		if p.acceptKeyword("TABLE") {
+			return p.parseCreateTable()
+		}
+		unique := p.acceptKeyword("UNIQUE")
+		if p.acceptKeyword("INDEX") {
+			return p.parseCreateIndex(unique)
+		}
+		return nil, p.unexpected("TABLE or INDEX")
+	case p.acceptKeyword("ALTER"):
+		return p.parseAlterTable()
+	case p.acceptKeyword("BEGIN"):
+		p.skipTransactionNoise()
+		return &TransactionStmt{Action: "BEGIN"}, nil
+	case p.acceptKeyword("START"):
+		if err := p.expectKeyword("TRANSACTION"); err != nil {
+			return nil, err
+		}
+		return &TransactionStmt{Action: "BEGIN"}, nil
+	case p.acceptKeyword("COMMIT"), p.acceptKeyword("END"):
+		p.skipTransactionNoise()
+		return &TransactionStmt{Action: "COMMIT"}, nil
+	case p.acceptKeyword("ROLLBACK"), p.acceptKeyword("ABORT"):
+		p.skipTransactionNoise()
+		return &TransactionStmt{Action: "ROLLBACK"}, nil
+	case p.acceptKeyword("EXPLAIN"):
+		if p.isKeyword("EXPLAIN") {
+			return nil, p.errorAt(p.peek(), "EXPLAIN cannot be nested")
+		}
+		stmt, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+		return &ExplainStmt{Stmt: stmt}, nil
+	case p.acceptKeyword("PROMOTE"):
+		return &PromoteStmt{}, nil
+	case p.acceptKeyword("SHOW"):
+		if err := p.expectKeyword("REPLICATION"); err != nil {
+			return nil, err
+		}
+		return &ShowReplicationStmt{}, nil
+	case p.acceptKeyword("ANALYZE"):
+		stmt := &AnalyzeStmt{}
+		if tok := p.peek(); tok.kind == tokEOF || (tok.kind == tokSymbol && tok.text == ";") {
+			return stmt, nil
+		}
+		var err error
+		stmt.Table, err = p.parseIdent("table name")
+		return stmt, err
+	}
+	return nil, p.unexpected("a statement")
+}
+
+func (p *parser) parseSelect() (*SelectStmt, error) {
+	stmt := &SelectStmt{}
+	for {
+		item, err := p.parseSelectItem()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Columns = append(stmt.Columns, item)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+
+	if p.acceptKeyword("FROM") {
+		ref, err := p.parseTableRef()
+		if err != nil {
+			return nil, err
+		}
+		stmt.From = ref
+
+		for {
+			join, ok, err := p.parseJoin()
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				break
+			}
+			stmt.Joins = append(stmt.Joins, join)
+		}
+	}
+
+	if p.acceptKeyword("WHERE") {
+		where, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Where = where
+	}
+
+	if p.acceptKeyword("GROUP") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			expr, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			stmt.GroupBy = append(stmt.GroupBy, expr)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+
+	if p.acceptKeyword("HAVING") {
+		having, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Having = having
+	}
+
+	if p.acceptKeyword("ORDER") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			expr, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			item := OrderItem{Expr: expr}
+			if p.acceptKeyword("DESC") {
+				item.Desc = true
+			} else {
+				p.acceptKeyword("ASC")
+			}
+			stmt.OrderBy = append(stmt.OrderBy, item)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+
+	for {
+		switch {
+		case stmt.Limit == nil && p.acceptKeyword("LIMIT"):
+			limit, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			stmt.Limit = limit
+		case stmt.Offset == nil && p.acceptKeyword("OFFSET"):
+			offset, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			stmt.Offset = offset
+		default:
+			return stmt, nil
+		}
+	}
+}
+
+// skipTransactionNoise skips the optional TRANSACTION or WORK after BEGIN,
+// COMMIT and ROLLBACK
+func (p *parser) skipTransactionNoise() {
+	if !p.acceptKeyword("TRANSACTION") {
+		p.acceptKeyword("WORK")
+	}
+}
+
+// parseJoin reads one [INNER] JOIN or LEFT [OUTER] JOIN clause, if present
+func (p *parser) parseJoin() (JoinClause, bool, error) {
+	join := JoinClause{Kind: InnerJoin}
+	switch {
+	case p.acceptKeyword("JOIN"):
+	case p.acceptKeyword("INNER"):
+		if err := p.expectKeyword("JOIN"); err != nil {
+			return join, false, err
+		}
+	case p.acceptKeyword("LEFT"):
+		p.acceptKeyword("OUTER")
+		if err := p.expectKeyword("JOIN"); err != nil {
+			return join, false, err
+		}
+		join.Kind = LeftJoin
+	default:
+		return join, false, nil
+	}
+
+	ref, err := p.parseTableRef()
+	if err != nil {
+		return join, false, err
+	}
+	join.Table = *ref
+	if err := p.expectKeyword("ON"); err != nil {
+		return join, false, err
+	}
+	if join.On, err = p.parseExpr(); err != nil {
+		return join, false, err
+	}
+	return join, true, nil
+}
+
+func (p *parser) parseSelectItem() (SelectItem, error) {
+	if p.acceptSymbol("*") {
+		return SelectItem{}, nil
+	}
+	if p.pos+2 < len(p.tokens) && p.tokens[p.pos+1].kind == tokSymbol && p.tokens[p.pos+1].text == "." &&
+		p.tokens[p.pos+2].kind == tokSymbol && p.tokens[p.pos+2].text == "*" {
+		table, err := p.parseIdent("table name")
+		if err != nil {
+			return SelectItem{}, err
+		}
+		p.pos += 2
+		return SelectItem{Table: table}, nil
+	}
+	expr, err := p.parseExpr()
+	if err != nil {
+		return SelectItem{}, err
+	}
+	item := SelectItem{Expr: expr}
+	if p.acceptKeyword("AS") {
+		alias, err := p.parseIdent("column alias")
+		if err != nil {
+			return SelectItem{}, err
+		}
+		item.Alias = alias
+	} else if tok := p.peek(); tok.kind == tokQuotedIdent || (tok.kind == tokIdent && !reserved[strings.ToUpper(tok.text)]) {
+		item.Alias, _ = p.parseIdent("column alias")
+	}
+	return item, nil
+}
+
+func (p *parser) parseTableRef() (*TableRef, error) {
+	name, err := p.parseIdent("table name")
+	if err != nil {
+		return nil, err
+	}
+	ref := &TableRef{Name: name}
+	if p.acceptKeyword("AS") {
+		alias, err := p.parseIdent("table alias")
+		if err != nil {
+			return nil, err
+		}
+		ref.Alias = alias
+	} else if tok := p.peek(); tok.kind == tokQuotedIdent || (tok.kind == tokIdent && !reserved[strings.ToUpper(tok.text)]) {
+		ref.Alias, _ = p.parseIdent("table alias")
+	}
+	return ref, nil
+}
+
+func (p *parser) parseInsert() (*InsertStmt, error) {
+	if err := p.expectKeyword("INTO"); err != nil {
+		return nil, err
+	}
+	table, err := p.parseIdent("table name")
+	if err != nil {
+		return nil, err
+	}
+	stmt := &InsertStmt{Table: table}
+
+	if p.acceptSymbol("(") {
+		columns, err := p.parseIdentList()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Columns = columns
+	}
+
+	if err := p.expectKeyword("VALUES"); err != nil {
+		return nil, err
+	}
+	for {
+		if err := p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		var row []Expr
+		for {
+			expr, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, expr)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		stmt.Rows = append(stmt.Rows, row)
+		if !p.acceptSymbol(",") {
+			return stmt, nil
+		}
+	}
+}
+
+// parseIdentList parses "a, b, c)" after an opening parenthesis
+func (p *parser) parseIdentList() ([]string, error) {
+	var names []string
+	for {
+		name, err := p.parseIdent("column name")
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	return names, p.expectSymbol(")")
+}
+
+func (p *parser) parseUpdate() (*UpdateStmt, error) {
+	table, err := p.parseIdent("table name")
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("SET"); err != nil {
+		return nil, err
+	}
+	stmt := &UpdateStmt{Table: table}
+	for {
+		column, err := p.parseIdent("column name")
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol("="); err != nil {
+			return nil, err
+		}
+		value, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Set = append(stmt.Set, Assignment{Column: column, Value: value})
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	if p.acceptKeyword("WHERE") {
+		where, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Where = where
+	}
+	return stmt, nil
+}
+
+func (p *parser) parseDelete() (*DeleteStmt, error) {
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	table, err := p.parseIdent("table name")
+	if err != nil {
+		return nil, err
+	}
+	stmt := &DeleteStmt{Table: table}
+	if p.acceptKeyword("WHERE") {
+		where, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Where = where
+	}
+	return stmt, nil
+}
+
+func (p *parser) parseCreateTable() (*CreateTableStmt, error) {
+	table, err := p.parseIdent("table name")
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+
+	stmt := &CreateTableStmt{Table: table}
+	for {
+		if p.acceptKeyword("PRIMARY") {
+			tok := p.peek()
+			if err := p.expectKeyword("KEY"); err != nil {
+				return nil, err
+			}
+			if err := p.expectSymbol("("); err != nil {
+				return nil, err
+			}
+			columns, err := p.parseIdentList()
+			if err != nil {
+				return nil, err
+			}
+			if len(columns) != 1 {
+				return nil, p.errorAt(tok, "only single-column primary keys are supported")
+			}
+			if stmt.Schema.PrimaryKey != "" {
+				return nil, p.errorAt(tok, "multiple primary keys")
+			}
+			stmt.Schema.PrimaryKey = columns[0]
+		} else if p.isKeyword("UNIQUE") || p.isKeyword("FOREIGN") || p.isKeyword("CHECK") || p.isKeyword("CONSTRAINT") {
+			if err := p.parseTableConstraint(&stmt.Schema); err != nil {
+				return nil, err
+			}
+		} else {
+			column, primary, err := p.parseColumnDef(&stmt.Schema)
+			if err != nil {
+				return nil, err
+			}
+			if primary {
+				if stmt.Schema.PrimaryKey != "" {
+					return nil, p.errorAt(p.peek(), "multiple primary keys")
+				}
+				stmt.Schema.PrimaryKey = column.Name
+			}
+			stmt.Schema.Columns = append(stmt.Schema.Columns, column)
+		}
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+
+	if p.acceptKeyword("TTL") {
+		ttl, err := p.parseTTL()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Schema.TTL = ttl
+	}
+
+	// Primary key columns are implicitly NOT NULL
+	for i := range stmt.Schema.Columns {
+		if stmt.Schema.Columns[i].Name == stmt.Schema.PrimaryKey {
+			stmt.Schema.Columns[i].Nullable = false
+		}
+	}
+	return stmt, nil
+}
+
+// parseTTL parses "(column [, 'duration'])" after TTL. The duration is in Go
+// syntax, such as '30m' or '24h'.
+func (p *parser) parseTTL() (*TTL, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	column, err := p.parseIdent("column name")
+	if err != nil {
+		return nil, err
+	}
+	ttl := &TTL{Column: column}
+	if p.acceptSymbol(",") {
+		tok := p.next()
+		if tok.kind != tokString {
+			return nil, p.errorAt(tok, "expected a duration such as '30m', found %s", tok)
+		}
+		if ttl.After, err = time.ParseDuration(tok.text); err != nil {
+			return nil, p.errorAt(tok, "%v", err)
+		}
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	return ttl, nil
+}
+
+func (p *parser) parseAlterTable() (*AlterTableStmt, error) {
+	if err := p.expectKeyword("TABLE"); err != nil {
+		return nil, err
+	}
+	table, err := p.parseIdent("table name")
+	if err != nil {
+		return nil, err
+	}
+	stmt := &AlterTableStmt{Table: table}
+	switch {
+	case p.acceptKeyword("SET"):
+		if err := p.expectKeyword("TTL"); err != nil {
+			return nil, err
+		}
+		stmt.TTL, err = p.parseTTL()
+		return stmt, err
+	case p.acceptKeyword("DROP"):
+		return stmt, p.expectKeyword("TTL")
+	}
+	return nil, p.unexpected("SET TTL or DROP TTL")
+}
+
+// parseTableConstraint parses "UNIQUE (columns)", "FOREIGN KEY (column)
+// REFERENCES ..." or "[CONSTRAINT name] CHECK (expr)" into schema
+func (p *parser) parseTableConstraint(schema *Schema) error {
+	switch {
+	case p.acceptKeyword("UNIQUE"):
+		if err := p.expectSymbol("("); err != nil {
+			return err
+		}
+		columns, err := p.parseIdentList()
+		if err != nil {
+			return err
+		}
+		schema.Unique = append(schema.Unique, columns)
+	case p.acceptKeyword("FOREIGN"):
+		tok := p.peek()
+		if err := p.expectKeyword("KEY"); err != nil {
+			return err
+		}
+		if err := p.expectSymbol("("); err != nil {
+			return err
+		}
+		columns, err := p.parseIdentList()
+		if err != nil {
+			return err
+		}
+		if len(columns) != 1 {
+			return p.errorAt(tok, "only single-column foreign keys are supported")
+		}
+		if err := p.expectKeyword("REFERENCES"); err != nil {
+			return err
+		}
+		fk, err := p.parseReferences(columns[0])
+		if err != nil {
+			return err
+		}
+		schema.ForeignKeys = append(schema.ForeignKeys, fk)
+	default:
+		name := ""
+		if p.acceptKeyword("CONSTRAINT") {
+			var err error
+			if name, err = p.parseIdent("constraint name"); err != nil {
+				return err
+			}
+			if !p.isKeyword("CHECK") {
+				return p.unexpected("CHECK, only check constraints can be named")
+			}
+		}
+		if err := p.expectKeyword("CHECK"); err != nil {
+			return err
+		}
+		check, err := p.parseCheck()
+		if err != nil {
+			return err
+		}
+		check.Name = name
+		schema.Checks = append(schema.Checks, check)
+	}
+	return nil
+}
+
+// parseReferences parses "table [(column)] [ON DELETE action]" after
+// REFERENCES, where action is RESTRICT, NO ACTION, CASCADE or SET NULL
+func (p *parser) parseReferences(column string) (ForeignKey, error) {
+	table, err := p.parseIdent("table name")
+	if err != nil {
+		return ForeignKey{}, err
+	}
+	fk := ForeignKey{Column: column, Table: table}
+	if p.acceptSymbol("(") {
+		tok := p.peek()
+		columns, err := p.parseIdentList()
+		if err != nil {
+			return ForeignKey{}, err
+		}
+		if len(columns) != 1 {
+			return ForeignKey{}, p.errorAt(tok, "only single-column foreign keys are supported")
+		}
+		fk.References = columns[0]
+	}
+	if p.acceptKeyword("ON") {
+		if err := p.expectKeyword("DELETE"); err != nil {
+			return ForeignKey{}, err
+		}
+		switch {
+		case p.acceptKeyword("RESTRICT"):
+			fk.OnDelete = FKRestrict
+		case p.acceptKeyword("NO"):
+			if err := p.expectKeyword("ACTION"); err != nil {
+				return ForeignKey{}, err
+			}
+			fk.OnDelete = FKRestrict
+		case p.acceptKeyword("CASCADE"):
+			fk.OnDelete = FKCascade
+		case p.acceptKeyword("SET"):
+			if err := p.expectKeyword("NULL"); err != nil {
+				return ForeignKey{}, err
+			}
+			fk.OnDelete = FKSetNull
+		default:
+			return ForeignKey{}, p.unexpected("RESTRICT, NO ACTION, CASCADE or SET NULL")
+		}
+	}
+	return fk, nil
+}
+
+// parseCheck parses "(expr)" after CHECK
+func (p *parser) parseCheck() (Check, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return Check{}, err
+	}
+	expr, err := p.parseExpr()
+	if err != nil {
+		return Check{}, err
+	}
+	return Check{Expr: expr.String()}, p.expectSymbol(")")
+}
+
+// parseColumnDef parses "name type [NOT NULL | NULL] [PRIMARY KEY] [UNIQUE]
+// [DEFAULT literal] [REFERENCES ...] [CHECK (expr)]", adding the column's
+// constraints to schema
+func (p *parser) parseColumnDef(schema *Schema) (Column, bool, error) {
+	name, err := p.parseIdent("column name")
+	if err != nil {
+		return Column{}, false, err
+	}
+	typeTok := p.peek()
+	if typeTok.kind != tokIdent {
+		return Column{}, false, p.unexpected("column type")
+	}
+	p.pos++
+	columnType, err := ParseColumnType(typeTok.text)
+	if err != nil {
+		return Column{}, false, p.errorAt(typeTok, "%v", err)
+	}
+	if p.acceptSymbol("(") {
+		// Length modifiers such as VARCHAR(255) are accepted and ignored
+		if tok := p.next(); tok.kind != tokNumber {
+			return Column{}, false, p.errorAt(tok, "expected length, found %s", tok)
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return Column{}, false, err
+		}
+	}
+
+	column := Column{Name: name, Type: columnType, Nullable: true}
+	primary := false
+	for {
+		switch {
+		case p.acceptKeyword("NOT"):
+			if err := p.expectKeyword("NULL"); err != nil {
+				return Column{}, false, err
+			}
+			column.Nullable = false
+		case p.acceptKeyword("NULL"):
+			column.Nullable = true
+		case p.acceptKeyword("PRIMARY"):
+			if err := p.expectKeyword("KEY"); err != nil {
+				return Column{}, false, err
+			}
+			primary = true
+		case p.acceptKeyword("DEFAULT"):
+			tok := p.peek()
+			expr, err := p.parseUnary()
+			if err != nil {
+				return Column{}, false, err
+			}
+			value, ok := constantValue(expr)
+			if !ok {
+				return Column{}, false, p.errorAt(tok, "default must be a constant")
+			}
+			column.Default = value
+		case p.acceptKeyword("UNIQUE"):
+			schema.Unique = append(schema.Unique, []string{name})
+		case p.acceptKeyword("REFERENCES"):
+			fk, err := p.parseReferences(name)
+			if err != nil {
+				return Column{}, false, err
+			}
+			schema.ForeignKeys = append(schema.ForeignKeys, fk)
+		case p.acceptKeyword("CHECK"):
+			check, err := p.parseCheck()
+			if err != nil {
+				return Column{}, false, err
+			}
+			schema.Checks = append(schema.Checks, check)
+		default:
+			return column, primary, nil
+		}
+	}
+}
+
+// constantValue folds a literal or negated numeric literal
+func constantValue(expr Expr) (any, bool) {
+	switch e := expr.(type) {
+	case *Literal:
+		return e.Value, true
+	case *UnaryExpr:
+		if e.Op != "-" {
+			return nil, false
+		}
+		value, ok := constantValue(e.Expr)
+		if !ok {
+			return nil, false
+		}
+		switch v := value.(type) {
+		case int64:
+			return -v, true
+		case float64:
+			return -v, true
+		}
+	}
+	return nil, false
+}
+
+func (p *parser) parseCreateIndex(unique bool) (*CreateIndexStmt, error) {
+	stmt := &CreateIndexStmt{Spec: IndexSpec{Unique: unique, Ordered: true}}
+	if !p.isKeyword("ON") {
+		name, err := p.parseIdent("index name")
+		if err != nil {
+			return nil, err
+		}
+		stmt.Spec.Name = name
+	}
+	if err := p.expectKeyword("ON"); err != nil {
+		return nil, err
+	}
+	table, err := p.parseIdent("table name")
+	if err != nil {
+		return nil, err
+	}
+	stmt.Table = table
+
+	if p.acceptKeyword("USING") {
+		tok := p.next()
+		switch {
+		case tok.kind == tokIdent && strings.EqualFold(tok.text, "BTREE"):
+			stmt.Spec.Ordered = true
+		case tok.kind == tokIdent && strings.EqualFold(tok.text, "HASH"):
+			stmt.Spec.Ordered = false
+		case tok.kind == tokIdent && strings.EqualFold(tok.text, "FULLTEXT"):
+			stmt.Spec.Ordered, stmt.Spec.FullText = false, true
+		default:
+			return nil, p.errorAt(tok, "expected BTREE, HASH or FULLTEXT, found %s", tok)
+		}
+	}
+
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	columns, err := p.parseIdentList()
+	if err != nil {
+		return nil, err
+	}
+	stmt.Spec.Columns = columns
+	return stmt, nil
+}
+
+// Expression grammar, lowest precedence first:
+//
+//	or      := and { OR and }
+//	and     := not { AND not }
+//	not     := NOT not | compare
+//	compare := sum [ cmpop sum | IS [NOT] NULL | [NOT] BETWEEN | [NOT] IN | [NOT] LIKE | [NOT] MATCH ]
+//	sum     := product { (+ | - | ||) product }
+//	product := unary { (* | / | %) unary }
+//	unary   := - unary | primary
+func (p *parser) parseExpr() (Expr, error) {
+	return p.parseOr()
+}
+
+func (p *parser) parseOr() (Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Op: "OR", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Op: "AND", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (Expr, error) {
+	if p.acceptKeyword("NOT") {
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryExpr{Op: "NOT", Expr: expr}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *parser) parseCompare() (Expr, error) {
+	left, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+
+	tok := p.peek()
+	if tok.kind == tokSymbol {
+		switch tok.text {
+		case "=", "<>", "!=", "<", "<=", ">", ">=":
+			p.pos++
+			right, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			op := tok.text
+			if op == "!=" {
+				op = "<>"
+			}
+			return &BinaryExpr{Op: op, Left: left, Right: right}, nil
+		}
+	}
+
+	if p.acceptKeyword("IS") {
+		not := p.acceptKeyword("NOT")
+		if err := p.expectKeyword("NULL"); err != nil {
+			return nil, err
+		}
+		return &IsNullExpr{Expr: left, Not: not}, nil
+	}
+
+	not := p.acceptKeyword("NOT")
+	switch {
+	case p.acceptKeyword("BETWEEN"):
+		low, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("AND"); err != nil {
+			return nil, err
+		}
+		high, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		return &BetweenExpr{Expr: left, Low: low, High: high, Not: not}, nil
+	case p.acceptKeyword("IN"):
+		if err := p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		var list []Expr
+		for {
+			item, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		return &InExpr{Expr: left, List: list, Not: not}, nil
+	case p.acceptKeyword("LIKE"):
+		pattern, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		return &LikeExpr{Expr: left, Pattern: pattern, Not: not}, nil
+	case p.acceptKeyword("MATCH"):
+		query, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		return &MatchExpr{Expr: left, Query: query, Not: not}, nil
+	}
+	if not {
+		return nil, p.unexpected("BETWEEN, IN, LIKE or MATCH")
+	}
+	return left, nil
+}
+
+func (p *parser) parseSum() (Expr, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		if tok.kind != tokSymbol || (tok.text != "+" && tok.text != "-" && tok.text != "||") {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Op: tok.text, Left: left, Right: right}
+	}
+}
+
+func (p *parser) parseProduct() (Expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		if tok.kind != tokSymbol || (tok.text != "*" && tok.text != "/" && tok.text != "%") {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Op: tok.text, Left: left, Right: right}
+	}
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if p.acceptSymbol("-") {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryExpr{Op: "-", Expr: expr}, nil
+	}
+	if p.acceptSymbol("+") {
+		return p.parseUnary()
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	tok := p.peek()
+	switch tok.kind {
+	case tokNumber:
+		p.pos++
+		if !strings.ContainsAny(tok.text, ".eE") {
+			if n, err := strconv.ParseInt(tok.text, 10, 64); err == nil {
+				return &Literal{Value: n}, nil
+			}
+		}
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, p.errorAt(tok, "invalid number %s", tok.text)
+		}
+		return &Literal{Value: f}, nil
+
+	case tokString:
+		p.pos++
+		return &Literal{Value: tok.text}, nil
+
+	case tokParam:
+		p.pos++
+		n, err := strconv.Atoi(tok.text[1:])
+		if err != nil || n < 1 {
+			return nil, p.errorAt(tok, "invalid parameter %s", tok.text)
+		}
+		return &Param{Index: n}, nil
+
+	case tokSymbol:
+		if tok.text == "(" {
+			p.pos++
+			expr, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			return expr, p.expectSymbol(")")
+		}
+
+	case tokIdent, tokQuotedIdent:
+		if tok.kind == tokIdent {
+			switch strings.ToUpper(tok.text) {
+			case "NULL":
+				p.pos++
+				return &Literal{Value: nil}, nil
+			case "TRUE":
+				p.pos++
+				return &Literal{Value: true}, nil
+			case "FALSE":
+				p.pos++
+				return &Literal{Value: false}, nil
+			}
+		}
+		name, err := p.parseIdent("expression")
+		if err != nil {
+			return nil, err
+		}
+		if tok.kind == tokIdent && p.acceptSymbol("(") {
+			return p.parseCall(tok, name)
+		}
+		if p.acceptSymbol(".") {
+			column, err := p.parseIdent("column name")
+			if err != nil {
+				return nil, err
+			}
+			return &ColumnRef{Table: name, Column: column}, nil
+		}
+		return &ColumnRef{Column: name}, nil
+	}
+	return nil, p.unexpected("expression")
+}
+
+// parseCall reads the arguments of an aggregate function call or BM25; the
+// opening parenthesis has been consumed
+func (p *parser) parseCall(tok token, name string) (Expr, error) {
+	if strings.EqualFold(name, "BM25") {
+		return p.parseRank()
+	}
+	call := &FuncCall{Name: strings.ToUpper(name)}
+	if !aggregateFuncs[call.Name] {
+		return nil, p.errorAt(tok, "unknown function %s", name)
+	}
+	if call.Name == "COUNT" && p.acceptSymbol("*") {
+		call.Star = true
+		return call, p.expectSymbol(")")
+	}
+	call.Distinct = p.acceptKeyword("DISTINCT")
+	arg, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	call.Args = []Expr{arg}
+	return call, p.expectSymbol(")")
+}
+
+// parseRank reads the arguments of BM25(column, query)
+func (p *parser) parseRank() (Expr, error) {
+	tok := p.peek()
+	column, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	ref, ok := column.(*ColumnRef)
+	if !ok {
+		return nil, p.errorAt(tok, "BM25 needs a column")
+	}
+	if err := p.expectSymbol(","); err != nil {
+		return nil, err
+	}
+	query, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	return &RankExpr{Column: ref, Query: query}, p.expectSymbol(")")
+}
+
+// ParseExpr parses a standalone expression such as a WHERE condition
+func ParseExpr(text string) (Expr, error) {
+	tokens, err := tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, p.unexpected("end of expression")
+	}
+	return expr, nil
+}
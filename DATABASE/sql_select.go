@@ -0,0 +1,604 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// source is one table of a FROM clause
+type source struct {
+	name   string // Alias, or the table name
+	table  string
+	schema Schema
+}
+
+// tupleScope resolves columns across the joined rows of one result tuple. A
+// nil row is the NULL side of a LEFT JOIN.
+type tupleScope struct {
+	sources []source
+	rows    []Record
+}
+
+func (s *tupleScope) resolve(ref *ColumnRef) (any, error) {
+	i, err := resolveSource(s.sources, ref)
+	if err != nil {
+		return nil, err
+	}
+	return s.rows[i][ref.Column], nil
+}
+
+// resolveSource finds the source a column reference belongs to
+func resolveSource(sources []source, ref *ColumnRef) (int, error) {
+	found := -1
+	for i, src := range sources {
+		if ref.Table != "" {
+			if src.name != ref.Table {
+				continue
+			}
+			if _, exists := src.schema.Column(ref.Column); !exists {
+				return -1, &ColumnError{Column: ref.String()}
+			}
+			return i, nil
+		}
+		if _, exists := src.schema.Column(ref.Column); exists {
+			if found >= 0 {
+				return -1, fmt.Errorf("column reference %q is ambiguous", ref.Column)
+			}
+			found = i
+		}
+	}
+	if found < 0 {
+		if ref.Table != "" {
+			return -1, fmt.Errorf("unknown table %q", ref.Table)
+		}
+		return -1, &ColumnError{Column: ref.String()}
+	}
+	return found, nil
+}
+
+// groupScope is one GROUP BY group. Column references must match a grouping
+// expression; aggregate calls are evaluated over the member tuples.
+type groupScope struct {
+	rows   []scope
+	keys   []Expr
+	values []any
+}
+
+func (s *groupScope) resolve(ref *ColumnRef) (any, error) {
+	for i, key := range s.keys {
+		if k, ok := key.(*ColumnRef); ok && k.Column == ref.Column && (k.Table == ref.Table || k.Table == "" || ref.Table == "") {
+			return s.values[i], nil
+		}
+	}
+	return nil, fmt.Errorf("column %q must appear in the GROUP BY clause or be used in an aggregate function", ref.String())
+}
+
+// lookup returns the value of expr if it is one of the grouping expressions
+func (s *groupScope) lookup(expr Expr) (any, bool) {
+	text := expr.String()
+	for i, key := range s.keys {
+		if key.String() == text {
+			return s.values[i], true
+		}
+	}
+	return nil, false
+}
+
+// groupOf returns the group a scope belongs to, if any
+func groupOf(sc scope) *groupScope {
+	switch s := sc.(type) {
+	case *groupScope:
+		return s
+	case *aliasScope:
+		return groupOf(s.base)
+	}
+	return nil
+}
+
+func (ex *executor) execSelect(stmt *SelectStmt) (*Result, error) {
+	sources, rows, err := ex.selectRows(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	exprs, names, err := selectList(stmt, sources)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{Columns: names}
+
+	if stmt.GroupBy != nil || stmt.Having != nil || selectHasAggregate(stmt) {
+		if rows, err = ex.group(rows, stmt.GroupBy); err != nil {
+			return nil, err
+		}
+		if rows, err = ex.filterScopes(rows, stmt.Having); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(stmt.OrderBy) > 0 {
+		aliases := make(map[string]Expr)
+		for i, name := range result.Columns {
+			aliases[name] = exprs[i]
+		}
+		if err := ex.sortRows(rows, stmt.OrderBy, exprs, aliases); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err = ex.limit(rows, stmt.Limit, stmt.Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sc := range rows {
+		out := make([]any, len(exprs))
+		for i, expr := range exprs {
+			value, err := ex.eval(expr, sc)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = value
+		}
+		result.Rows = append(result.Rows, out)
+	}
+	return result, nil
+}
+
+// selectList expands * and table.* and names the output columns
+func selectList(stmt *SelectStmt, sources []source) ([]Expr, []string, error) {
+	var exprs []Expr
+	var names []string
+	for _, item := range stmt.Columns {
+		if item.Expr != nil {
+			exprs = append(exprs, item.Expr)
+			names = append(names, outputName(item))
+			continue
+		}
+		if stmt.From == nil {
+			return nil, nil, errors.New("SELECT * needs a FROM clause")
+		}
+		matched := false
+		for _, src := range sources {
+			if item.Table != "" && item.Table != src.name {
+				continue
+			}
+			matched = true
+			for _, column := range src.schema.Columns {
+				exprs = append(exprs, &ColumnRef{Table: src.name, Column: column.Name})
+				names = append(names, column.Name)
+			}
+		}
+		if !matched {
+			return nil, nil, fmt.Errorf("unknown table %q", item.Table)
+		}
+	}
+	return exprs, names, nil
+}
+
+// selectRows produces the tuples of the FROM clause, joined and filtered by
+// WHERE
+func (ex *executor) selectRows(stmt *SelectStmt) ([]source, []scope, error) {
+	if stmt.From == nil {
+		rows, err := ex.filterScopes([]scope{emptyScope{}}, stmt.Where)
+		return nil, rows, err
+	}
+
+	sources, err := ex.tx.db.sources(stmt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, base, err := ex.scanRows(sources[0].table, sources[0].name, stmt.Where)
+	if err != nil {
+		return nil, nil, err
+	}
+	tuples := make([][]Record, len(base))
+	for i, row := range base {
+		tuples[i] = []Record{row}
+	}
+
+	for j, join := range stmt.Joins {
+		// Pushing WHERE into the scan of a joined table is safe because the
+		// planner only uses conditions that reject the NULL side anyway
+		src := sources[j+1]
+		_, right, err := ex.scanRows(src.table, src.name, stmt.Where)
+		if err != nil {
+			return nil, nil, err
+		}
+		if tuples, err = ex.join(tuples, sources[:j+2], right, join); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	rows := make([]scope, len(tuples))
+	for i, tuple := range tuples {
+		rows[i] = &tupleScope{sources: sources, rows: tuple}
+	}
+	rows, err = ex.filterScopes(rows, stmt.Where)
+	return sources, rows, err
+}
+
+// sources lists the tables of the FROM clause in join order
+func (db *Database) sources(stmt *SelectStmt) ([]source, error) {
+	refs := []TableRef{*stmt.From}
+	for _, join := range stmt.Joins {
+		refs = append(refs, join.Table)
+	}
+
+	sources := make([]source, len(refs))
+	for i, ref := range refs {
+		table, err := db.lookupTable(ref.Name)
+		if err != nil {
+			return nil, err
+		}
+		name := ref.Name
+		if ref.Alias != "" {
+			name = ref.Alias
+		}
+		for _, other := range sources[:i] {
+			if other.name == name {
+				return nil, fmt.Errorf("table name %q specified more than once", name)
+			}
+		}
+		sources[i] = source{name: name, table: ref.Name, schema: table.schema}
+	}
+	return sources, nil
+}
+
+// join extends every tuple with the matching rows of the last source, using a
+// hash join on an equality between columns of the same type when ON has one
+// and a nested loop otherwise
+func (ex *executor) join(tuples [][]Record, sources []source, right []Record, join JoinClause) ([][]Record, error) {
+	var joined [][]Record
+	emit := func(tuple []Record, row Record) []Record {
+		extended := make([]Record, len(tuple), len(tuple)+1)
+		copy(extended, tuple)
+		return append(extended, row)
+	}
+
+	var buckets map[any][]Record
+	leftSource, leftColumn, rightColumn, hashed := equiJoin(sources, join.On)
+	if hashed {
+		buckets = make(map[any][]Record)
+		for _, row := range right {
+			if value := row[rightColumn]; value != nil {
+				buckets[keyOf(value)] = append(buckets[keyOf(value)], row)
+			}
+		}
+	}
+
+	for _, tuple := range tuples {
+		candidates := right
+		if hashed {
+			candidates = nil
+			if value := tuple[leftSource][leftColumn]; value != nil {
+				candidates = buckets[keyOf(value)]
+			}
+		}
+
+		matched := false
+		for _, row := range candidates {
+			extended := emit(tuple, row)
+			ok, err := ex.truth(join.On, &tupleScope{sources: sources, rows: extended})
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				joined = append(joined, extended)
+				matched = true
+			}
+		}
+		if !matched && join.Kind == LeftJoin {
+			joined = append(joined, emit(tuple, nil))
+		}
+	}
+	return joined, nil
+}
+
+// equiJoin looks for an ON term "a.x = b.y" between the joined table and an
+// earlier one where both columns have the same type, so equal values have
+// equal hash keys
+func equiJoin(sources []source, on Expr) (int, string, string, bool) {
+	last := len(sources) - 1
+	for _, term := range splitConjuncts(on) {
+		e, ok := term.(*BinaryExpr)
+		if !ok || e.Op != "=" {
+			continue
+		}
+		a, ok1 := e.Left.(*ColumnRef)
+		b, ok2 := e.Right.(*ColumnRef)
+		if !ok1 || !ok2 {
+			continue
+		}
+		i, err1 := resolveSource(sources, a)
+		j, err2 := resolveSource(sources, b)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		if i == last {
+			i, j, a, b = j, i, b, a
+		}
+		if j != last || i == last {
+			continue
+		}
+		left, _ := sources[i].schema.Column(a.Column)
+		right, _ := sources[j].schema.Column(b.Column)
+		if left.Type == right.Type {
+			return i, a.Column, b.Column, true
+		}
+	}
+	return 0, "", "", false
+}
+
+// group partitions rows by the GROUP BY expressions, keeping first-seen
+// order. Without GROUP BY all rows form a single group, even when empty.
+func (ex *executor) group(rows []scope, keys []Expr) ([]scope, error) {
+	if len(keys) == 0 {
+		return []scope{&groupScope{rows: rows}}, nil
+	}
+
+	var groups []scope
+	index := make(map[string]*groupScope)
+	for _, row := range rows {
+		values := make([]any, len(keys))
+		var encoded []byte
+		for i, key := range keys {
+			value, err := ex.eval(key, row)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+			if value == nil {
+				encoded = append(encoded, 0x00)
+			} else if encoded, err = appendKey(encoded, value); err != nil {
+				return nil, err
+			}
+		}
+		g, exists := index[string(encoded)]
+		if !exists {
+			g = &groupScope{keys: keys, values: values}
+			index[string(encoded)] = g
+			groups = append(groups, g)
+		}
+		g.rows = append(g.rows, row)
+	}
+	return groups, nil
+}
+
+// aggregate evaluates an aggregate call over the rows of a group
+func (ex *executor) aggregate(call *FuncCall, g *groupScope) (any, error) {
+	if call.Star {
+		return int64(len(g.rows)), nil
+	}
+
+	var count int64
+	var sum, best any
+	seen := make(map[any]bool)
+	if hasAggregate(call.Args[0]) {
+		return nil, errors.New("aggregate function calls cannot be nested")
+	}
+	for _, row := range g.rows {
+		value, err := ex.eval(call.Args[0], row)
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			continue
+		}
+		if call.Distinct {
+			if seen[keyOf(value)] {
+				continue
+			}
+			seen[keyOf(value)] = true
+		}
+		count++
+
+		switch call.Name {
+		case "SUM", "AVG":
+			if _, ok := toFloat(value); !ok {
+				return nil, fmt.Errorf("%s needs numbers, got %T", call.Name, value)
+			}
+			if sum == nil {
+				sum = value
+			} else if sum, err = arithmetic("+", sum, value); err != nil {
+				return nil, err
+			}
+		case "MIN", "MAX":
+			if best == nil {
+				best = value
+				continue
+			}
+			c, err := compareSQL(value, best)
+			if err != nil {
+				return nil, err
+			}
+			if (call.Name == "MIN" && c < 0) || (call.Name == "MAX" && c > 0) {
+				best = value
+			}
+		}
+	}
+
+	switch call.Name {
+	case "COUNT":
+		return count, nil
+	case "SUM":
+		return sum, nil
+	case "AVG":
+		if count == 0 {
+			return nil, nil
+		}
+		total, _ := toFloat(sum)
+		return total / float64(count), nil
+	}
+	return best, nil
+}
+
+// hasAggregate reports whether any of exprs contains an aggregate call
+func hasAggregate(exprs ...Expr) bool {
+	for _, expr := range exprs {
+		switch e := expr.(type) {
+		case *FuncCall:
+			return true
+		case *BinaryExpr:
+			if hasAggregate(e.Left, e.Right) {
+				return true
+			}
+		case *UnaryExpr:
+			if hasAggregate(e.Expr) {
+				return true
+			}
+		case *IsNullExpr:
+			if hasAggregate(e.Expr) {
+				return true
+			}
+		case *BetweenExpr:
+			if hasAggregate(e.Expr, e.Low, e.High) {
+				return true
+			}
+		case *InExpr:
+			if hasAggregate(e.Expr) || hasAggregate(e.List...) {
+				return true
+			}
+		case *LikeExpr:
+			if hasAggregate(e.Expr, e.Pattern) {
+				return true
+			}
+		case *MatchExpr:
+			if hasAggregate(e.Expr, e.Query) {
+				return true
+			}
+		case *RankExpr:
+			if hasAggregate(e.Query) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// selectHasAggregate reports whether the SELECT list or ORDER BY of stmt
+// calls an aggregate
+func selectHasAggregate(stmt *SelectStmt) bool {
+	for _, item := range stmt.Columns {
+		if hasAggregate(item.Expr) {
+			return true
+		}
+	}
+	for _, item := range stmt.OrderBy {
+		if hasAggregate(item.Expr) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterScopes keeps the rows for which where is true
+func (ex *executor) filterScopes(rows []scope, where Expr) ([]scope, error) {
+	if where == nil {
+		return rows, nil
+	}
+	kept := rows[:0]
+	for _, sc := range rows {
+		match, err := ex.truth(where, sc)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			kept = append(kept, sc)
+		}
+	}
+	return kept, nil
+}
+
+// outputName is the result column name of a SELECT item
+func outputName(item SelectItem) string {
+	if item.Alias != "" {
+		return item.Alias
+	}
+	if ref, ok := item.Expr.(*ColumnRef); ok {
+		return ref.Column
+	}
+	return item.Expr.String()
+}
+
+// sortRows orders rows by the ORDER BY terms. An integer literal term refers
+// to a SELECT output column by position, and a bare name may be an output
+// alias.
+func (ex *executor) sortRows(rows []scope, order []OrderItem, outputs []Expr, aliases map[string]Expr) error {
+	exprs := make([]Expr, len(order))
+	for i, item := range order {
+		exprs[i] = item.Expr
+		if lit, ok := item.Expr.(*Literal); ok {
+			if n, ok := lit.Value.(int64); ok {
+				if n < 1 || int(n) > len(outputs) {
+					return fmt.Errorf("ORDER BY position %d is not in select list", n)
+				}
+				exprs[i] = outputs[n-1]
+			}
+		}
+	}
+
+	keys := make([][]any, len(rows))
+	for r, row := range rows {
+		sc := &aliasScope{base: row, aliases: aliases, ex: ex}
+		keys[r] = make([]any, len(exprs))
+		for i, expr := range exprs {
+			value, err := ex.eval(expr, sc)
+			if err != nil {
+				return err
+			}
+			keys[r][i] = value
+		}
+	}
+
+	perm := make([]int, len(rows))
+	for i := range perm {
+		perm[i] = i
+	}
+	sort.SliceStable(perm, func(a, b int) bool {
+		for i, item := range order {
+			c := compareValues(keys[perm[a]][i], keys[perm[b]][i])
+			if c == 0 {
+				continue
+			}
+			if item.Desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+
+	sorted := make([]scope, len(rows))
+	for i, p := range perm {
+		sorted[i] = rows[p]
+	}
+	copy(rows, sorted)
+	return nil
+}
+
+// limit applies OFFSET and LIMIT
+func (ex *executor) limit(rows []scope, limitExpr, offsetExpr Expr) ([]scope, error) {
+	if offsetExpr != nil {
+		offset, err := ex.count(offsetExpr, "OFFSET")
+		if err != nil {
+			return nil, err
+		}
+		if offset >= len(rows) {
+			return nil, nil
+		}
+		rows = rows[offset:]
+	}
+	if limitExpr != nil {
+		limit, err := ex.count(limitExpr, "LIMIT")
+		if err != nil {
+			return nil, err
+		}
+		if limit < len(rows) {
+			rows = rows[:limit]
+		}
+	}
+	return rows, nil
+}
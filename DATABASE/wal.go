@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	walFileName   = "wal.log"
+	walHeaderSize = 8       // 4 bytes payload length + 4 bytes CRC32
+	walMaxRecord  = 1 << 26 // Anything larger is treated as a torn length field
+)
+
+// Operations recorded in the write-ahead log
+const (
+	opCreateTable = "create_table"
+	opInsert      = "insert"
+	opUpdate      = "update"
+	opDelete      = "delete"
+	opCreateIndex = "create_index"
+	opCommit      = "commit" // Batch of writes from one transaction
+	opSetTTL      = "set_ttl"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// walEntry is a single mutation recorded in the write-ahead log
+type walEntry struct {
+	LSN     uint64     `json:"lsn"`
+	Op      string     `json:"op"`
+	Table   string     `json:"table"`
+	Key     any        `json:"key,omitempty"` // Primary key of a row write
+	Index   *IndexSpec `json:"index,omitempty"`
+	Record  Record     `json:"record,omitempty"` // Full row after an insert or update
+	Old     Record     `json:"old,omitempty"`    // Row before an update or delete
+	Schema  *Schema    `json:"schema,omitempty"`
+	TTL     *TTL       `json:"ttl,omitempty"` // New TTL of a set_ttl entry, nil to remove it
+	Batch   []walEntry `json:"batch,omitempty"`
+	Version int        `json:"version,omitempty"` // Commit version of a row write or commit
+	Time    int64      `json:"time,omitempty"`    // When the entry was logged, in Unix nanoseconds
+}
+
+// WAL is an append-only, checksummed write-ahead log. Each record is framed
+// as [length][crc32][json payload] and fsynced before Append returns. With
+// keys, each payload is encrypted.
+type WAL struct {
+	file *os.File
+	lsn  uint64
+	keys *Keyring
+	mu   sync.Mutex
+}
+
+// openWAL opens (or creates) the log at path for appending
+func openWAL(path string, lastLSN uint64, keys *Keyring) (*WAL, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &WAL{file: file, lsn: lastLSN, keys: keys}, nil
+}
+
+// Append assigns the next LSN to entry and durably writes it to the log
+func (w *WAL) Append(entry walEntry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	entry.LSN = w.lsn + 1
+	payload, err := json.Marshal(entry)
+	if err == nil {
+		payload, err = w.keys.seal(payload, walAAD)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.file.Write(encodeFrame(payload)); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.lsn = entry.LSN
+	return nil
+}
+
+// encodeFrame wraps payload as [length][crc32][payload]
+func encodeFrame(payload []byte) []byte {
+	buf := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+	copy(buf[walHeaderSize:], payload)
+	return buf
+}
+
+// LSN returns the sequence number of the last appended entry
+func (w *WAL) LSN() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.lsn
+}
+
+// Truncate discards every entry in the log. LSNs keep increasing.
+func (w *WAL) Truncate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// reset discards every entry in the log and continues it after lsn
+func (w *WAL) reset(lsn uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.lsn = lsn
+	return nil
+}
+
+// Close closes the underlying log file
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+// decodeJSON unmarshals data keeping numbers as json.Number so int64 values
+// survive the round trip
+func decodeJSON(data []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// readWAL calls fn for every intact entry in the log at path. Reading stops
+// at the first short, oversized or corrupt record; the returned offset is the
+// end of the last good record so the caller can cut off a torn tail. A record
+// that cannot be decrypted is an error, since its checksum was good.
+func readWAL(path string, keys *Keyring, fn func(walEntry) error) (int64, bool, error) {
+	return readFrames(path, func(payload []byte) (bool, error) {
+		payload, err := keys.open(payload, walAAD)
+		if err != nil {
+			return false, err
+		}
+		var entry walEntry
+		if err := decodeJSON(payload, &entry); err != nil {
+			return false, nil
+		}
+		return true, fn(entry)
+	})
+}
+
+// readFrames calls fn with the payload of every intact frame in the file at
+// path, with the same torn-tail handling as readWAL. fn reports false if the
+// payload cannot be decoded, which also counts as a torn tail.
+func readFrames(path string, fn func(payload []byte) (bool, error)) (int64, bool, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		payload, err := readFrame(reader)
+		if err == io.EOF {
+			return offset, false, nil
+		}
+		if err == errTornFrame {
+			return offset, true, nil
+		}
+		if err != nil {
+			return offset, false, err
+		}
+
+		ok, err := fn(payload)
+		if err != nil {
+			return offset, false, err
+		}
+		if !ok {
+			return offset, true, nil
+		}
+		offset += int64(walHeaderSize) + int64(len(payload))
+	}
+}
+
+// errTornFrame is returned by readFrame for a short, oversized or corrupt frame
+var errTornFrame = errors.New("torn or corrupt frame")
+
+// readFrame reads the payload of one frame written by encodeFrame. It returns
+// io.EOF if r ends before the frame starts.
+func readFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errTornFrame
+		}
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if length > walMaxRecord {
+		return nil, errTornFrame
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errTornFrame
+		}
+		return nil, err
+	}
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return nil, errTornFrame
+	}
+	return payload, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// runtimeBlocklist holds the entries added and removed through the admin
+// API. They take precedence over the configured blocklist and are kept
+// across reloads, but not across restarts.
+type runtimeBlocklist struct {
+	list *blocklist
+	mu   sync.RWMutex
+}
+
+var adminBlocklist = &runtimeBlocklist{list: newBlocklist()}
+
+// Check if a canonical name is blocked, here or by the configuration
+func (r *runtimeBlocklist) blocked(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return blockedBy(name, false, r.list, config.Load().blocklist)
+}
+
+// Add an entry, replacing the one for the same name
+func (r *runtimeBlocklist) add(entry string) error {
+	name, rule, err := parseBlockEntry(entry)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.list.rules[name] = rule
+	return nil
+}
+
+// Unblock a name and its subdomains, apart from those with entries of their
+// own: drop its entry, and add an exception if the configuration still
+// blocks it
+func (r *runtimeBlocklist) remove(entry string) error {
+	name, _, err := parseBlockEntry(strings.TrimPrefix(entry, "@@"))
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.list.rules, name)
+	if blockedBy(name, true, r.list, config.Load().blocklist) {
+		r.list.rules[name] = allowName
+	}
+	return nil
+}
+
+func (r *runtimeBlocklist) entries() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.list.entries()
+}
+
+// Start the admin API on its configured address, unless it is empty
+func startAdmin() error {
+	cfg := config.Load()
+	if cfg.AdminListen == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", cfg.AdminListen)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/stats", handleStats)
+	mux.HandleFunc("/cache/flush", handleCacheFlush)
+	mux.HandleFunc("/blocklist", handleBlocklist)
+	server := &http.Server{
+		Handler:           authorized(mux),
+		ReadHeaderTimeout: tcpIdleTimeout,
+		IdleTimeout:       tcpIdleTimeout,
+	}
+	log.Printf("Admin API is running on http://%s", cfg.AdminListen)
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.Printf("Admin API stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Require the configured admin token as a bearer token, if one is set
+func authorized(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		token := config.Load().AdminToken
+		given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="dns"`)
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// Check the method of a request, answering 405 if it is not one of those
+// allowed
+func allowMethods(rw http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	rw.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+func writeJSON(rw http.ResponseWriter, v any) {
+	rw.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(rw)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+// Metrics in the Prometheus text format
+func handleMetrics(rw http.ResponseWriter, r *http.Request) {
+	if !allowMethods(rw, r, http.MethodGet) {
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.writePrometheus(rw)
+}
+
+// Metrics as JSON
+func handleStats(rw http.ResponseWriter, r *http.Request) {
+	if !allowMethods(rw, r, http.MethodGet) {
+		return
+	}
+	writeJSON(rw, metrics.snapshot())
+}
+
+// Drop the cached answers for the name parameter, or all of them
+func handleCacheFlush(rw http.ResponseWriter, r *http.Request) {
+	if !allowMethods(rw, r, http.MethodPost) {
+		return
+	}
+	name := ""
+	if r.URL.Query().Has("name") {
+		name = canonicalName(r.URL.Query().Get("name"))
+		if name == "" || checkName(name) != nil {
+			http.Error(rw, "invalid name", http.StatusBadRequest)
+			return
+		}
+	}
+	n := cache.flush(name)
+	if name == "" {
+		log.Printf("Flushed the cache (%d entries)", n)
+	} else {
+		log.Printf("Flushed %s from the cache (%d entries)", name, n)
+	}
+	writeJSON(rw, map[string]int{"flushed": n})
+}
+
+// GET lists the entries added at runtime, or tells whether the name
+// parameter is blocked. POST adds the entry in the name parameter and
+// DELETE unblocks it.
+func handleBlocklist(rw http.ResponseWriter, r *http.Request) {
+	if !allowMethods(rw, r, http.MethodGet, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	entry := r.URL.Query().Get("name")
+	if entry == "" && r.Method != http.MethodGet {
+		http.Error(rw, "missing name parameter", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		if entry == "" {
+			writeJSON(rw, map[string]any{
+				"entries":    adminBlocklist.entries(),
+				"configured": config.Load().blocklist.len(),
+			})
+			return
+		}
+		name := canonicalName(entry)
+		writeJSON(rw, map[string]any{"name": name, "blocked": adminBlocklist.blocked(name)})
+		return
+	case http.MethodPost:
+		if err = adminBlocklist.add(entry); err == nil {
+			log.Printf("Added %s to the blocklist", entry)
+		}
+	case http.MethodDelete:
+		if err = adminBlocklist.remove(entry); err == nil {
+			log.Printf("Removed %s from the blocklist", entry)
+		}
+	}
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(rw, map[string]any{"entries": adminBlocklist.entries()})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// blockRule says what an entry of a blocklist does to a name
+type blockRule uint8
+
+const (
+	blockName  blockRule = 1 << iota // Block the name and its subdomains
+	blockBelow                       // Block only its subdomains, from a *.name entry
+	allowName                        // Exception for the name and its subdomains
+)
+
+// blocklist holds blocked names. The entry closest to a queried name
+// decides, so an exception for a subdomain of a blocked name unblocks it.
+type blocklist struct {
+	rules map[string]blockRule
+}
+
+func newBlocklist() *blocklist {
+	return &blocklist{rules: make(map[string]blockRule)}
+}
+
+// Check if a canonical name is blocked
+func (b *blocklist) blocked(name string) bool {
+	return blockedBy(name, false, b)
+}
+
+// What the entry for a name says about it, or about its subdomains if
+// below is set: whether it is blocked, and whether there is an entry
+// deciding it at all
+func (b *blocklist) decide(name string, below bool) (blocked, ok bool) {
+	rule := b.rules[name]
+	switch {
+	case rule&allowName != 0:
+		return false, true
+	case rule&blockName != 0 || rule&blockBelow != 0 && below:
+		return true, true
+	}
+	return false, false
+}
+
+// Check if a canonical name is blocked by several lists. At each level from
+// the name up to the root, the first list with an entry that decides wins.
+// With below set, the name is checked as if it were one of its subdomains.
+func blockedBy(name string, below bool, lists ...*blocklist) bool {
+	for ; ; below = true {
+		for _, b := range lists {
+			if blocked, ok := b.decide(name, below); ok {
+				return blocked
+			}
+		}
+		if name == "" {
+			return false
+		}
+		name = parentName(name)
+	}
+}
+
+// Add an entry: name, *.name, or @@name for an exception
+func (b *blocklist) add(entry string) error {
+	name, rule, err := parseBlockEntry(entry)
+	if err != nil {
+		return err
+	}
+	b.rules[name] |= rule
+	return nil
+}
+
+// Split an entry into its canonical name and rule
+func parseBlockEntry(entry string) (string, blockRule, error) {
+	rule := blockName
+	switch {
+	case strings.HasPrefix(entry, "@@"):
+		rule, entry = allowName, entry[2:]
+	case strings.HasPrefix(entry, "*."):
+		rule, entry = blockBelow, entry[2:]
+	}
+	name := canonicalName(entry)
+	if name == "" || checkName(name) != nil || strings.IndexFunc(name, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.')
+	}) >= 0 {
+		return "", 0, fmt.Errorf("invalid name %q", entry)
+	}
+	return name, rule, nil
+}
+
+// Entries as they are written in a blocklist, sorted by name
+func (b *blocklist) entries() []string {
+	names := make([]string, 0, len(b.rules))
+	for name := range b.rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	entries := []string{}
+	for _, name := range names {
+		rule := b.rules[name]
+		if rule&allowName != 0 {
+			entries = append(entries, "@@"+name)
+		}
+		if rule&blockName != 0 {
+			entries = append(entries, name)
+		} else if rule&blockBelow != 0 {
+			entries = append(entries, "*."+name)
+		}
+	}
+	return entries
+}
+
+// Number of entries
+func (b *blocklist) len() int {
+	return len(b.rules)
+}
+
+// Read a blocklist file. Each line is either in hosts format (an address
+// followed by names, whose address is ignored), a bare name, or an adblock
+// rule of the form ||name^ or @@||name^ for an exception. Comments start
+// with # or !, and adblock rules with options or paths are skipped, as they
+// do not apply to whole names. Lines with invalid names are skipped and
+// counted in the log, as published lists often have a few.
+func (b *blocklist) load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	invalid := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Comments start a line or follow white space; ## is an adblock
+		// element hiding rule
+		for i := 0; i < len(line); i++ {
+			if line[i] == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+				line = line[:i]
+				break
+			}
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+
+		var entries []string
+		switch {
+		case strings.Contains(line, "#"):
+			continue // Adblock element hiding rule
+		case strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@||"):
+			exception := strings.HasPrefix(line, "@@")
+			rule := strings.TrimPrefix(strings.TrimPrefix(line, "@@"), "||")
+			name, ok := strings.CutSuffix(rule, "^")
+			if !ok || strings.ContainsAny(name, "^$/|") {
+				continue
+			}
+			if exception {
+				name = "@@" + name
+			}
+			entries = []string{name}
+		default:
+			fields := strings.Fields(line)
+			if net.ParseIP(fields[0]) != nil {
+				fields = fields[1:]
+			}
+			for _, name := range fields {
+				if !localHostNames[strings.ToLower(name)] {
+					entries = append(entries, name)
+				}
+			}
+		}
+		for _, entry := range entries {
+			if err := b.add(entry); err != nil {
+				invalid++
+			}
+		}
+	}
+	if invalid > 0 {
+		log.Printf("Skipped %d invalid names in %s", invalid, path)
+	}
+	return scanner.Err()
+}
+
+// Names found in hosts files that are not blocking entries
+var localHostNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"sync"
+	"time"
+)
+
+const defaultCacheSize = 10000
+
+// cacheKey identifies a cached answer. Names are canonical, so lookups
+// ignore case. Queries asking for DNSSEC records (DO) or with validation
+// disabled (CD) get different answers, so they are cached apart.
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	do     bool
+	cd     bool
+}
+
+// cacheEntry is an upstream answer with the time it was stored
+type cacheEntry struct {
+	key         cacheKey
+	question    DNSQuestion
+	answer      DNSMessage
+	stored      time.Time
+	ttl         time.Duration // Lowest TTL of its records when stored
+	hits        int
+	prefetching bool
+	element     *list.Element
+}
+
+// responseCache holds upstream answers until their TTLs run out, evicting
+// the least recently used when full
+type responseCache struct {
+	entries    map[cacheKey]*cacheEntry
+	lru        *list.List // Most recently used first
+	size       int
+	hits       uint64
+	misses     uint64
+	prefetches uint64
+	mu         sync.Mutex
+}
+
+// cacheStats is a snapshot of the cache counters
+type cacheStats struct {
+	Entries    int
+	Hits       uint64
+	Misses     uint64
+	Prefetches uint64
+}
+
+// Share of lookups answered from the cache
+func (s cacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+func newResponseCache(size int) *responseCache {
+	return &responseCache{entries: make(map[cacheKey]*cacheEntry), lru: list.New(), size: size}
+}
+
+// Key of the answer to a query with one question
+func keyOf(query *DNSMessage) cacheKey {
+	q := query.Questions[0]
+	edns, _ := query.EDNS()
+	return cacheKey{
+		name:   canonicalName(q.Name),
+		qtype:  q.Type,
+		qclass: q.Class,
+		do:     edns.DO,
+		cd:     query.Header.Flags&flagCheckingDisabled != 0,
+	}
+}
+
+// Look up the answer to a query, with the TTLs of its records lowered by
+// the time it spent in the cache. Popular entries close to expiry are
+// refreshed in the background.
+func (c *responseCache) get(query *DNSMessage) (DNSMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[keyOf(query)]
+	if ok && time.Since(e.stored) >= e.ttl {
+		c.remove(e)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return DNSMessage{}, false
+	}
+	c.hits++
+	e.hits++
+	c.lru.MoveToFront(e.element)
+
+	elapsed := time.Since(e.stored)
+	if e.hits >= prefetchMinHits && !e.prefetching && e.ttl-elapsed < time.Duration(float64(e.ttl)*prefetchThreshold) {
+		e.prefetching = true
+		c.prefetches++
+		go c.prefetch(e.key, e.question)
+	}
+
+	age := uint32(elapsed / time.Second)
+	answer := e.answer
+	answer.Header.Flags &^= flagAuthoritative
+	answer.Answers = aged(answer.Answers, age)
+	answer.Authority = aged(answer.Authority, age)
+	answer.Additional = aged(answer.Additional, age)
+	return answer, true
+}
+
+// Store an upstream answer. Positive answers are kept for the lowest TTL of
+// their records. NXDOMAIN and NODATA answers are kept for the TTL of their
+// SOA record, bounded by its minimum field (RFC 2308); without one they are
+// not cached. Truncated answers, failures and referrals are not cached.
+func (c *responseCache) put(query *DNSMessage, answer DNSMessage) {
+	rcode := answer.Rcode()
+	if answer.Header.Flags&flagTruncated != 0 || rcode != rcodeSuccess && rcode != rcodeNameError {
+		return
+	}
+	negative := rcode == rcodeNameError || len(answer.Answers) == 0
+	maxTTL := uint32(cacheMaxTTL / time.Second)
+
+	stored := DNSMessage{Header: answer.Header, Answers: capped(answer.Answers, maxTTL), Authority: capped(answer.Authority, maxTTL)}
+	for _, r := range answer.Additional {
+		if r.Type != typeOPT {
+			stored.Additional = append(stored.Additional, capped([]DNSRecord{r}, maxTTL)...)
+		}
+	}
+	if negative {
+		soa := -1
+		for i, r := range stored.Authority {
+			if data, ok := r.Data.(SOAData); ok {
+				soa = i
+				stored.Authority[i].TTL = min(r.TTL, data.Minimum, uint32(cacheMaxNegativeTTL/time.Second))
+			}
+		}
+		if soa < 0 {
+			return
+		}
+	}
+
+	ttl := maxTTL
+	for _, section := range [][]DNSRecord{stored.Answers, stored.Authority, stored.Additional} {
+		for _, r := range section {
+			ttl = min(ttl, r.TTL)
+		}
+	}
+	if ttl == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := keyOf(query)
+	if old, ok := c.entries[key]; ok {
+		c.remove(old)
+	}
+	for c.lru.Len() >= c.size && c.lru.Len() > 0 {
+		c.remove(c.lru.Back().Value.(*cacheEntry))
+	}
+	e := &cacheEntry{key: key, question: query.Questions[0], answer: stored, stored: time.Now(), ttl: time.Duration(ttl) * time.Second}
+	e.element = c.lru.PushFront(e)
+	c.entries[key] = e
+}
+
+// Change the number of entries kept, evicting the least recently used
+func (c *responseCache) resize(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size = size
+	for c.lru.Len() > size {
+		c.remove(c.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+// Drop the answers for a canonical name, of every type, or every answer for
+// an empty name. Returns the number dropped.
+func (c *responseCache) flush(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if name == "" {
+		n := len(c.entries)
+		c.entries = make(map[cacheKey]*cacheEntry)
+		c.lru.Init()
+		return n
+	}
+	n := 0
+	for key, e := range c.entries {
+		if key.name == name {
+			c.remove(e)
+			n++
+		}
+	}
+	return n
+}
+
+// Must be called with the lock held
+func (c *responseCache) remove(e *cacheEntry) {
+	c.lru.Remove(e.element)
+	delete(c.entries, e.key)
+}
+
+// Fetch the answer to a question again, with the DO and CD bits of its
+// key, replacing the cached one
+func (c *responseCache) prefetch(key cacheKey, q DNSQuestion) {
+	query := DNSMessage{
+		Header:    DNSHeader{Flags: flagRecursionDesired},
+		Questions: []DNSQuestion{q},
+	}
+	if key.cd {
+		query.Header.Flags |= flagCheckingDisabled
+	}
+	query.SetEDNS(EDNS{UDPSize: ednsPayloadSize, DO: key.do})
+	answer, err := forwardToUpstream(getNextUpstream(), &query)
+	if err != nil {
+		log.Printf("Failed to prefetch %s %s: %v", q.Name, typeName(q.Type), err)
+		c.mu.Lock()
+		if e, ok := c.entries[key]; ok {
+			e.prefetching = false
+		}
+		c.mu.Unlock()
+		return
+	}
+	c.put(&query, answer)
+}
+
+// Snapshot of the cache counters
+func (c *responseCache) stats() cacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return cacheStats{Entries: len(c.entries), Hits: c.hits, Misses: c.misses, Prefetches: c.prefetches}
+}
+
+// Copy records with their TTLs lowered by age seconds
+func aged(records []DNSRecord, age uint32) []DNSRecord {
+	if len(records) == 0 {
+		return nil
+	}
+	out := make([]DNSRecord, len(records))
+	for i, r := range records {
+		r.TTL -= min(r.TTL, age)
+		out[i] = r
+	}
+	return out
+}
+
+// Copy records with their TTLs bounded by limit
+func capped(records []DNSRecord, limit uint32) []DNSRecord {
+	if len(records) == 0 {
+		return nil
+	}
+	out := make([]DNSRecord, len(records))
+	for i, r := range records {
+		r.TTL = min(r.TTL, limit)
+		out[i] = r
+	}
+	return out
+}
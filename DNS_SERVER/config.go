@@ -0,0 +1,475 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Config is the server configuration. Reloading builds a new one and swaps
+// it in whole, so queries in flight finish with the one they started with.
+type Config struct {
+	Listen     string   // Address of the UDP and TCP listeners
+	Upstreams  []string // host:port, tls://host:port or https:// URLs
+	QueryLimit int      // Queries per client per minute, 0 for no limit
+	LogFile    string
+	ZoneDir    string
+
+	// Clients in Allow and not in Deny may query. Entries are CIDR
+	// prefixes or addresses; an empty Allow list allows everyone.
+	Allow []string
+	Deny  []string
+
+	// Names to block and blocklist files to read them from
+	Blocked           []string
+	BlocklistFiles    []string
+	BlackholeAddress  string
+	BlackholeAddress6 string
+
+	CacheSize int
+
+	// Encrypted transports, started when a certificate is given. An empty
+	// address disables one.
+	TLSCertFile string
+	TLSKeyFile  string
+	DoTListen   string
+	DoHListen   string
+	DoHPath     string
+
+	// Admin API with the metrics, disabled by an empty address. A token, if
+	// set, must be sent as a bearer token.
+	AdminListen string
+	AdminToken  string
+	TopN        int // Domains and clients tracked in the metrics
+
+	allow, deny []*net.IPNet
+	blocklist   *blocklist
+}
+
+// Configuration in use
+var config atomic.Pointer[Config]
+
+// Configuration used without a configuration file
+func defaultConfig() *Config {
+	return &Config{
+		Listen:            "0.0.0.0:53",
+		Upstreams:         []string{"8.8.8.8:53", "1.1.1.1:53"},
+		QueryLimit:        10,
+		LogFile:           "dns_queries.log",
+		ZoneDir:           "zones",
+		Allow:             []string{"127.0.0.1", "::1"},
+		Blocked:           []string{"ads.example.com", "malware.net"},
+		BlackholeAddress:  "0.0.0.0",
+		BlackholeAddress6: "::",
+		CacheSize:         defaultCacheSize,
+		DoTListen:         ":853",
+		DoHListen:         ":443",
+		DoHPath:           "/dns-query",
+		AdminListen:       "127.0.0.1:8053",
+		TopN:              defaultTopN,
+	}
+}
+
+// Keys of the configuration file and the fields they set
+func (c *Config) fields() map[string]any {
+	return map[string]any{
+		"listen":             &c.Listen,
+		"upstreams":          &c.Upstreams,
+		"query_limit":        &c.QueryLimit,
+		"log_file":           &c.LogFile,
+		"zone_dir":           &c.ZoneDir,
+		"access.allow":       &c.Allow,
+		"access.deny":        &c.Deny,
+		"blocklist.names":    &c.Blocked,
+		"blocklist.files":    &c.BlocklistFiles,
+		"blocklist.address":  &c.BlackholeAddress,
+		"blocklist.address6": &c.BlackholeAddress6,
+		"cache.size":         &c.CacheSize,
+		"tls.cert_file":      &c.TLSCertFile,
+		"tls.key_file":       &c.TLSKeyFile,
+		"tls.dot_listen":     &c.DoTListen,
+		"tls.doh_listen":     &c.DoHListen,
+		"tls.doh_path":       &c.DoHPath,
+		"admin.listen":       &c.AdminListen,
+		"admin.token":        &c.AdminToken,
+		"admin.top_n":        &c.TopN,
+	}
+}
+
+// Read a configuration file over the defaults, then load the blocklist
+// files it names
+func loadConfig(path string) (*Config, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values, err := parseTOML(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	c := defaultConfig()
+	fields := c.fields()
+	for key, v := range values {
+		field, ok := fields[key]
+		if !ok {
+			return nil, fmt.Errorf("%s: line %d: unknown key %s", path, v.line, key)
+		}
+		if err := v.assign(field); err != nil {
+			return nil, fmt.Errorf("%s: line %d: %s: %v", path, v.line, key, err)
+		}
+	}
+	if err := c.compile(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// Check the configuration and build the access lists and blocklist
+func (c *Config) compile() error {
+	if len(c.Upstreams) == 0 {
+		return errors.New("no upstream servers")
+	}
+	if c.QueryLimit < 0 || c.CacheSize < 1 || c.TopN < 0 {
+		return errors.New("query_limit, cache.size and admin.top_n must be positive")
+	}
+	if ip := net.ParseIP(c.BlackholeAddress); ip == nil || ip.To4() == nil {
+		return fmt.Errorf("invalid IPv4 blackhole address %q", c.BlackholeAddress)
+	}
+	if ip := net.ParseIP(c.BlackholeAddress6); ip == nil || ip.To4() != nil {
+		return fmt.Errorf("invalid IPv6 blackhole address %q", c.BlackholeAddress6)
+	}
+
+	var err error
+	if c.allow, err = parseNetworks(c.Allow); err != nil {
+		return err
+	}
+	if c.deny, err = parseNetworks(c.Deny); err != nil {
+		return err
+	}
+
+	c.blocklist = newBlocklist()
+	for _, name := range c.Blocked {
+		if err := c.blocklist.add(name); err != nil {
+			return err
+		}
+	}
+	for _, path := range c.BlocklistFiles {
+		if err := c.blocklist.load(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parse CIDR prefixes, taking a bare address as a prefix of its full length
+func parseNetworks(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Check if a client may query
+func (c *Config) allowed(ip net.IP) bool {
+	for _, network := range c.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(c.allow) == 0 {
+		return true
+	}
+	for _, network := range c.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Read the configuration file again and swap it in. A file that fails to
+// load keeps the configuration in use. Listeners are kept open, so changes
+// to their addresses need a restart.
+func reloadConfig(path string) {
+	c, err := loadConfig(path)
+	if err != nil {
+		log.Printf("Failed to reload configuration: %v", err)
+		return
+	}
+	old := config.Swap(c)
+	log.Printf("Reloaded configuration from %s (%d blocked names)", path, c.blocklist.len())
+	if c.Listen != old.Listen || c.DoTListen != old.DoTListen || c.DoHListen != old.DoHListen || c.DoHPath != old.DoHPath ||
+		c.AdminListen != old.AdminListen ||
+		(c.TLSCertFile == "") != (old.TLSCertFile == "") {
+		log.Printf("Changes to listeners take effect after a restart")
+	}
+
+	cache.resize(c.CacheSize)
+	metrics.resize(c.TopN)
+	zones.load(c.ZoneDir)
+	if c.TLSCertFile != "" && certificate.Load() != nil {
+		if err := loadCertificate(); err != nil {
+			log.Printf("Failed to reload certificate: %v", err)
+		}
+	}
+}
+
+// tomlValue is a value of a configuration file with the line it is on
+type tomlValue struct {
+	value any // string, int64, bool or []any
+	line  int
+}
+
+// Store the value in a field of the matching type
+func (v tomlValue) assign(field any) error {
+	switch field := field.(type) {
+	case *string:
+		s, ok := v.value.(string)
+		if !ok {
+			return errors.New("want a string")
+		}
+		*field = s
+	case *int:
+		n, ok := v.value.(int64)
+		if !ok {
+			return errors.New("want an integer")
+		}
+		*field = int(n)
+	case *[]string:
+		list, ok := v.value.([]any)
+		if !ok {
+			return errors.New("want an array of strings")
+		}
+		strs := make([]string, len(list))
+		for i, item := range list {
+			if strs[i], ok = item.(string); !ok {
+				return errors.New("want an array of strings")
+			}
+		}
+		*field = strs
+	default:
+		return fmt.Errorf("unsupported field type %T", field)
+	}
+	return nil
+}
+
+// tomlParser reads the subset of TOML the configuration file needs: tables,
+// and keys set to strings, integers, booleans or arrays of those
+type tomlParser struct {
+	text   string
+	pos    int
+	table  string
+	values map[string]tomlValue
+}
+
+// Parse TOML, returning the values by dotted key
+func parseTOML(text string) (map[string]tomlValue, error) {
+	p := &tomlParser{text: text, values: make(map[string]tomlValue)}
+	for {
+		p.skip(true)
+		if p.pos >= len(p.text) {
+			return p.values, nil
+		}
+		var err error
+		if p.text[p.pos] == '[' {
+			err = p.parseTable()
+		} else {
+			err = p.parseKey()
+		}
+		if err == nil {
+			err = p.endLine()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", p.line(), err)
+		}
+	}
+}
+
+func (p *tomlParser) line() int {
+	return strings.Count(p.text[:p.pos], "\n") + 1
+}
+
+// Skip spaces and comments, and line ends too with newlines
+func (p *tomlParser) skip(newlines bool) {
+	for p.pos < len(p.text) {
+		switch p.text[p.pos] {
+		case ' ', '\t', '\r':
+			p.pos++
+		case '\n':
+			if !newlines {
+				return
+			}
+			p.pos++
+		case '#':
+			for p.pos < len(p.text) && p.text[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) endLine() error {
+	p.skip(false)
+	if p.pos < len(p.text) && p.text[p.pos] != '\n' {
+		return fmt.Errorf("unexpected %q", p.text[p.pos])
+	}
+	return nil
+}
+
+func (p *tomlParser) name() (string, error) {
+	p.skip(false)
+	start := p.pos
+	for p.pos < len(p.text) {
+		c := p.text[p.pos]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+			break
+		}
+		p.pos++
+	}
+	if p.pos == start {
+		return "", errors.New("missing key")
+	}
+	return p.text[start:p.pos], nil
+}
+
+func (p *tomlParser) parseTable() error {
+	p.pos++ // [
+	name, err := p.name()
+	if err != nil {
+		return err
+	}
+	p.skip(false)
+	if p.pos >= len(p.text) || p.text[p.pos] != ']' {
+		return errors.New("unterminated table header")
+	}
+	p.pos++
+	p.table = name
+	return nil
+}
+
+func (p *tomlParser) parseKey() error {
+	key, err := p.name()
+	if err != nil {
+		return err
+	}
+	if p.table != "" {
+		key = p.table + "." + key
+	}
+	line := p.line()
+	p.skip(false)
+	if p.pos >= len(p.text) || p.text[p.pos] != '=' {
+		return fmt.Errorf("missing = after %s", key)
+	}
+	p.pos++
+	value, err := p.parseValue()
+	if err != nil {
+		return err
+	}
+	if _, ok := p.values[key]; ok {
+		return fmt.Errorf("%s is set twice", key)
+	}
+	p.values[key] = tomlValue{value: value, line: line}
+	return nil
+}
+
+func (p *tomlParser) parseValue() (any, error) {
+	p.skip(false)
+	if p.pos >= len(p.text) {
+		return nil, errors.New("missing value")
+	}
+	switch c := p.text[p.pos]; {
+	case c == '"':
+		return p.parseString()
+	case c == '\'':
+		end := strings.IndexAny(p.text[p.pos+1:], "'\n")
+		if end < 0 || p.text[p.pos+1+end] != '\'' {
+			return nil, errors.New("unterminated string")
+		}
+		s := p.text[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		return s, nil
+	case c == '[':
+		p.pos++
+		var list []any
+		for {
+			p.skip(true)
+			if p.pos < len(p.text) && p.text[p.pos] == ']' {
+				p.pos++
+				return list, nil
+			}
+			item, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+			p.skip(true)
+			if p.pos < len(p.text) && p.text[p.pos] == ',' {
+				p.pos++
+			} else if p.pos >= len(p.text) || p.text[p.pos] != ']' {
+				return nil, errors.New("unterminated array")
+			}
+		}
+	default:
+		start := p.pos
+		for p.pos < len(p.text) && strings.IndexByte(" \t\r\n#,]", p.text[p.pos]) < 0 {
+			p.pos++
+		}
+		word := p.text[start:p.pos]
+		switch word {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		n, err := strconv.ParseInt(strings.ReplaceAll(word, "_", ""), 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q", word)
+		}
+		return n, nil
+	}
+}
+
+// Parse a basic string. Its escapes are a subset of Go's, so strconv
+// decodes them.
+func (p *tomlParser) parseString() (string, error) {
+	end := p.pos + 1
+	for end < len(p.text) && p.text[end] != '"' && p.text[end] != '\n' {
+		if p.text[end] == '\\' {
+			end++
+		}
+		end++
+	}
+	if end >= len(p.text) || p.text[end] != '"' {
+		return "", errors.New("unterminated string")
+	}
+	s, err := strconv.Unquote(p.text[p.pos : end+1])
+	if err != nil {
+		return "", fmt.Errorf("invalid string %s", p.text[p.pos:end+1])
+	}
+	p.pos = end + 1
+	return s, nil
+}
@@ -1,31 +1,58 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
+	"io/fs"
 	"log"
+	"math/rand/v2"
 	"net"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
-// Server Configuration
+// Server Configuration, apart from what the configuration file sets; see
+// Config
 var (
-	upstreamServers  = []string{"8.8.8.8:53", "1.1.1.1:53"}
-	currentUpstream  = 0
-	blocklist        = map[string]bool{"ads.example.com": true, "malware.net": true}
-	allowedIPs       = map[string]bool{"127.0.0.1": true, "::1": true}
-	queryLimit       = 10
-	queryCount       = make(map[string]int)
-	blackholeAddress = "0.0.0.0"
-	logFile          = "dns_queries.log"
-
-	// Metrics
-	totalQueries      int
-	blockedQueries    int
-	perDomainCounters = make(map[string]int)
+	configFile      = flag.String("config", "dns.toml", "configuration file")
+	currentUpstream = 0
+	limiter         = newRateLimiter()
+
+	// Responses
+	blackholeTTL    = uint32(60)
+	upstreamTimeout = 2 * time.Second
+	ednsPayloadSize = uint16(1232) // Largest UDP message we send or ask for with EDNS0
+	tcpIdleTimeout  = 10 * time.Second
+
+	// Stream transports. A listener stops accepting at maxStreamConns open
+	// connections, and a connection stops reading at maxStreamQueries
+	// queries in flight, until one finishes.
+	maxStreamConns   = 1000
+	maxStreamQueries = 16
+
+	// Authoritative zones, loaded from *.zone files and reloaded when they
+	// change
+	zoneReloadInterval = 5 * time.Second
+	zones              = newZoneSet()
+
+	// Cache of upstream answers. Entries asked at least prefetchMinHits
+	// times are refreshed when less than prefetchThreshold of their TTL is
+	// left.
+	cacheMaxTTL         = 24 * time.Hour
+	cacheMaxNegativeTTL = 3 * time.Hour
+	prefetchMinHits     = 3
+	prefetchThreshold   = 0.1
+	cache               = newResponseCache(defaultCacheSize)
+
+	// Metrics served by the admin API
+	metrics = newMetrics(defaultTopN)
 
 	mu sync.Mutex
 )
@@ -49,54 +76,35 @@ type DNSQuestion struct {
 
 // Round-robin load balancer for upstream DNS servers
 func getNextUpstream() string {
+	upstreams := config.Load().Upstreams
 	mu.Lock()
 	defer mu.Unlock()
-	currentUpstream = (currentUpstream + 1) % len(upstreamServers)
-	return upstreamServers[currentUpstream]
+	currentUpstream = (currentUpstream + 1) % len(upstreams)
+	return upstreams[currentUpstream]
 }
 
 // Check if IP is allowed (Access Control)
-func isAllowedIP(ip string) bool {
-	_, allowed := allowedIPs[ip]
-	return allowed
+func isAllowedIP(ip net.IP) bool {
+	return config.Load().allowed(ip)
 }
 
-// Check rate limit
+// Check whether a client is over its query_limit queries per minute
 func isRateLimited(ip string) bool {
-	mu.Lock()
-	defer mu.Unlock()
-
-	now := time.Now().Minute()
-	if queryCount[ip] != now {
-		queryCount[ip] = 0
-	}
-	queryCount[ip]++
-	return queryCount[ip] > queryLimit
+	limit := config.Load().QueryLimit
+	return limit > 0 && !limiter.allow(ip, limit, time.Now())
 }
 
-// Check if domain is blocked
+// Check if domain or one of its parents is blocked, by the configuration or
+// through the admin API
 func isBlocked(domain string) bool {
-	_, exists := blocklist[domain]
-	return exists
-}
-
-// Encode domain name to DNS format
-func encodeDomainName(domain string) []byte {
-	parts := strings.Split(domain, ".")
-	var encoded []byte
-	for _, part := range parts {
-		encoded = append(encoded, byte(len(part)))
-		encoded = append(encoded, []byte(part)...)
-	}
-	encoded = append(encoded, 0)
-	return encoded
+	return adminBlocklist.blocked(domain)
 }
 
 // Log DNS queries
 func logQuery(clientIP, domain string) {
 	mu.Lock()
 	defer mu.Unlock()
-	file, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	file, err := os.OpenFile(config.Load().LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		log.Printf("Failed to open log file: %v", err)
 		return
@@ -106,97 +114,204 @@ func logQuery(clientIP, domain string) {
 	file.WriteString(entry)
 }
 
-// Increment metrics
-func incrementMetrics(domain string, blocked bool) {
-	mu.Lock()
-	defer mu.Unlock()
-	totalQueries++
-	if blocked {
-		blockedQueries++
+// Build blackhole response (for blocked domains): the blackhole address for
+// A and AAAA queries and no data for other types
+func buildBlackholeResponse(query *DNSMessage) DNSMessage {
+	response := newResponse(query)
+	question := query.Questions[0]
+	cfg := config.Load()
+	var data RData
+	switch question.Type {
+	case typeA:
+		data = AData{IP: net.ParseIP(cfg.BlackholeAddress)}
+	case typeAAAA:
+		data = AAAAData{IP: net.ParseIP(cfg.BlackholeAddress6)}
+	}
+	if data != nil {
+		response.Answers = []DNSRecord{{Name: question.Name, Type: question.Type, Class: classIN, TTL: blackholeTTL, Data: data}}
 	}
-	perDomainCounters[domain]++
+	return response
 }
 
-// Display metrics
-func printMetrics() {
-	mu.Lock()
-	defer mu.Unlock()
-	fmt.Println("---- DNS Server Metrics ----")
-	fmt.Printf("Total Queries: %d\n", totalQueries)
-	fmt.Printf("Blocked Queries: %d\n", blockedQueries)
-	fmt.Println("Per-Domain Query Counts:")
-	for domain, count := range perDomainCounters {
-		fmt.Printf("  %s: %d\n", domain, count)
-	}
-	fmt.Println("----------------------------")
+// Forward query to upstream server over UDP, advertising our EDNS0 payload
+// size, and again over TCP if the response is truncated. Upstream servers
+// given as tls://host:port or https:// URLs are sent the query over
+// DNS-over-TLS or DNS-over-HTTPS instead. Responses that do not match the
+// query are dropped, as they may be spoofed.
+func forwardToUpstream(upstream string, query *DNSMessage) (DNSMessage, error) {
+	// A fresh ID for every exchange, so an attacker who knows the client's
+	// ID cannot use it to spoof the upstream's reply
+	forwarded := DNSMessage{Header: query.Header, Questions: query.Questions}
+	forwarded.Header.ID = uint16(rand.Uint32())
+	for _, r := range query.Additional {
+		if r.Type != typeOPT {
+			forwarded.Additional = append(forwarded.Additional, r)
+		}
+	}
+	edns, _ := query.EDNS()
+	forwarded.SetEDNS(EDNS{UDPSize: ednsPayloadSize, DO: edns.DO})
+	request, err := forwarded.pack()
+	if err != nil {
+		return DNSMessage{}, err
+	}
+
+	start := time.Now()
+	response, err := exchange(upstream, &forwarded, request)
+	metrics.upstream(upstream, time.Since(start), err)
+	response.Header.ID = query.Header.ID
+	return response, err
 }
 
-// Build blackhole response (for blocked domains)
-func buildBlackholeResponse(header DNSHeader, question DNSQuestion) []byte {
-	response := make([]byte, 12)
-	binary.BigEndian.PutUint16(response[0:2], header.ID)
-	binary.BigEndian.PutUint16(response[2:4], 0x8180) // Flags: Standard response, No error
-	binary.BigEndian.PutUint16(response[4:6], 1)      // Questions: 1
-	binary.BigEndian.PutUint16(response[6:8], 1)      // Answers: 1
-	response = append(response, encodeDomainName(question.Name)...)
-	response = append(response, 0x00, 0x01, 0x00, 0x01) // Type A, Class IN
-	response = append(response, encodeDomainName(question.Name)...)
-	response = append(response, 0x00, 0x01, 0x00, 0x01)
-	response = append(response, 0x00, 0x00, 0x00, 0x3C)                 // TTL 60
-	response = append(response, 0x00, 0x04)                             // Data length
-	response = append(response, net.ParseIP(blackholeAddress).To4()...) // IP 0.0.0.0
-	return response
+// Send a packed query to an upstream server over the transport its address
+// names
+func exchange(upstream string, query *DNSMessage, request []byte) (DNSMessage, error) {
+	switch {
+	case strings.HasPrefix(upstream, "tls://"):
+		return exchangeTLS(strings.TrimPrefix(upstream, "tls://"), query, request)
+	case strings.HasPrefix(upstream, "https://"):
+		return exchangeHTTPS(upstream, query, request)
+	}
+
+	response, err := exchangeUDP(upstream, query, request)
+	if err != nil || response.Header.Flags&flagTruncated == 0 {
+		return response, err
+	}
+	full, err := exchangeTCP(upstream, query, request)
+	if err != nil {
+		// The client can still retry over TCP itself
+		log.Printf("Failed to retry truncated response from %s over TCP: %v", upstream, err)
+		return response, nil
+	}
+	return full, nil
 }
 
-// Forward query to upstream server
-func forwardToUpstream(upstream string, request []byte) ([]byte, error) {
+func exchangeUDP(upstream string, query *DNSMessage, request []byte) (DNSMessage, error) {
 	conn, err := net.Dial("udp", upstream)
 	if err != nil {
-		return nil, err
+		return DNSMessage{}, err
 	}
 	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
 
 	_, err = conn.Write(request)
 	if err != nil {
-		return nil, err
+		return DNSMessage{}, err
 	}
 
-	response := make([]byte, 512)
-	n, err := conn.Read(response)
+	buffer := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return DNSMessage{}, err
+		}
+		response, err := checkResponse(query, buffer[:n])
+		if err != nil {
+			log.Printf("Dropped response from %s: %v", upstream, err)
+			continue
+		}
+		return response, nil
+	}
+}
+
+func exchangeTCP(upstream string, query *DNSMessage, request []byte) (DNSMessage, error) {
+	conn, err := net.DialTimeout("tcp", upstream, upstreamTimeout)
 	if err != nil {
-		return nil, err
+		return DNSMessage{}, err
 	}
-	return response[:n], nil
+	return exchangeStream(conn, query, request)
 }
 
-// Parse domain name from DNS query
-func parseDomainName(data []byte) (string, int) {
-	var parts []string
-	i := 0
-	for {
-		length := int(data[i])
-		if length == 0 {
-			break
+// Send a query over a connection carrying length-prefixed messages, then
+// close it
+func exchangeStream(conn net.Conn, query *DNSMessage, request []byte) (DNSMessage, error) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
+
+	if err := writeFrame(conn, request); err != nil {
+		return DNSMessage{}, err
+	}
+	data, err := readFrame(conn)
+	if err != nil {
+		return DNSMessage{}, err
+	}
+	return checkResponse(query, data)
+}
+
+// Decode a response and check that it answers the query
+func checkResponse(query *DNSMessage, data []byte) (DNSMessage, error) {
+	response, err := parseMessage(data)
+	if err != nil {
+		return response, err
+	}
+	if response.Header.ID != query.Header.ID || response.Header.Flags&flagResponse == 0 {
+		return response, fmt.Errorf("not a response to query %d", query.Header.ID)
+	}
+	if len(response.Questions) != 1 {
+		return response, fmt.Errorf("%d questions", len(response.Questions))
+	}
+	q, want := response.Questions[0], query.Questions[0]
+	if q.Type != want.Type || q.Class != want.Class || canonicalName(q.Name) != canonicalName(want.Name) {
+		return response, fmt.Errorf("answers %s %s instead", q.Name, typeName(q.Type))
+	}
+	return response, nil
+}
+
+// Build the response to a query from an upstream or cached answer. The OPT
+// record of the answer is dropped, as EDNS0 is negotiated hop by hop.
+func relayResponse(query *DNSMessage, answer DNSMessage) DNSMessage {
+	response := newResponse(query)
+	response.Header.Flags |= answer.Header.Flags & (flagAuthoritative | flagTruncated | flagAuthenticData)
+	response.Answers = answer.Answers
+	response.Authority = answer.Authority
+	for _, r := range answer.Additional {
+		if r.Type != typeOPT {
+			response.Additional = append(response.Additional, r)
 		}
-		i++
-		parts = append(parts, string(data[i:i+length]))
-		i += length
 	}
-	return strings.Join(parts, "."), i + 1
+	response.SetRcode(answer.Rcode())
+	return response
 }
 
-// Handle incoming DNS requests
-func handleRequest(conn *net.UDPConn, addr *net.UDPAddr, request []byte) {
-	clientIP := addr.IP.String()
-	header := DNSHeader{
-		ID: binary.BigEndian.Uint16(request[:2]),
+// Send a response to a client, or SERVFAIL if it cannot be encoded. Over
+// UDP, a response larger than the client can receive is sent truncated, with
+// the TC flag telling it to retry over TCP.
+func sendResponse(w responseWriter, query *DNSMessage, response DNSMessage) {
+	data, err := response.pack()
+	if err != nil {
+		log.Printf("Failed to encode response for %s: %v", w.remoteIP(), err)
+		response = withoutRecords(response)
+		response.Header.Flags &^= flagAuthoritative
+		response.SetRcode(rcodeServerFailure)
+		data, err = response.pack()
+	} else if w.udp() && len(data) > udpLimit(query) {
+		response = withoutRecords(response)
+		response.Header.Flags |= flagTruncated
+		data, err = response.pack()
 	}
+	if err != nil {
+		return
+	}
+	metrics.response(response.Rcode())
+	w.write(data)
+}
 
-	domain, _ := parseDomainName(request[12:])
-	log.Printf("Received query for %s from %s", domain, clientIP)
+// Copy of a response with only its question and OPT record
+func withoutRecords(response DNSMessage) DNSMessage {
+	response.Answers, response.Authority = nil, nil
+	if opt := response.opt(); opt != nil {
+		response.Additional = []DNSRecord{*opt}
+	} else {
+		response.Additional = nil
+	}
+	return response
+}
+
+// Handle incoming DNS requests
+func handleRequest(w responseWriter, request []byte) {
+	clientIP := w.remoteIP().String()
 
 	// Access control
-	if !isAllowedIP(clientIP) {
+	if !isAllowedIP(w.remoteIP()) {
 		log.Printf("Access denied for %s", clientIP)
 		return
 	}
@@ -207,55 +322,141 @@ func handleRequest(conn *net.UDPConn, addr *net.UDPAddr, request []byte) {
 		return
 	}
 
+	query, err := parseMessage(request)
+	if err == nil && len(query.Questions) != 1 {
+		err = fmt.Errorf("%d questions", len(query.Questions))
+	}
+	if err != nil {
+		log.Printf("Malformed query from %s: %v", clientIP, err)
+		// Answer FORMERR if the header is readable and is not a response
+		if len(request) >= headerSize && binary.BigEndian.Uint16(request[2:4])&flagResponse == 0 {
+			header := DNSHeader{ID: binary.BigEndian.Uint16(request[0:2]), Flags: flagResponse | rcodeFormatError}
+			sendResponse(w, nil, DNSMessage{Header: header})
+		}
+		return
+	}
+	if query.Header.Flags&flagResponse != 0 {
+		log.Printf("Ignored response from %s", clientIP)
+		return
+	}
+
+	question := query.Questions[0]
+	domain := canonicalName(question.Name)
+	log.Printf("Received query for %s %s from %s", domain, typeName(question.Type), clientIP)
+	metrics.query(clientIP, domain, question.Type)
+
+	if query.Header.Opcode() != 0 {
+		sendResponse(w, &query, errorResponse(&query, rcodeNotImplemented))
+		return
+	}
+	if edns, ok := query.EDNS(); ok && edns.Version > 0 {
+		sendResponse(w, &query, errorResponse(&query, rcodeBadVersion))
+		return
+	}
+
 	// Blocklist check
 	if isBlocked(domain) {
 		log.Printf("Blocked domain: %s", domain)
-		incrementMetrics(domain, true)
-		response := buildBlackholeResponse(header, DNSQuestion{Name: domain})
-		conn.WriteToUDP(response, addr)
+		metrics.block()
+		sendResponse(w, &query, buildBlackholeResponse(&query))
+		return
+	}
+
+	// Authoritative zones
+	if response, ok := zones.answer(&query); ok {
+		logQuery(clientIP, domain)
+		sendResponse(w, &query, response)
+		return
+	}
+
+	// Cached answers
+	if answer, ok := cache.get(&query); ok {
+		logQuery(clientIP, domain)
+		sendResponse(w, &query, relayResponse(&query, answer))
 		return
 	}
 
 	// Forward to upstream server
 	upstream := getNextUpstream()
-	response, err := forwardToUpstream(upstream, request)
+	answer, err := forwardToUpstream(upstream, &query)
 	if err != nil {
 		log.Printf("Failed to forward query: %v", err)
 		return
 	}
+	cache.put(&query, answer)
 
-	// Log query and increment metrics
+	// Log query
 	logQuery(clientIP, domain)
-	incrementMetrics(domain, false)
 
 	// Send response
-	conn.WriteToUDP(response, addr)
+	sendResponse(w, &query, relayResponse(&query, answer))
 }
 
 func main() {
-	addr := net.UDPAddr{Port: 53, IP: net.ParseIP("0.0.0.0")}
-	conn, err := net.ListenUDP("udp", &addr)
+	flag.Parse()
+	cfg, err := loadConfig(*configFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("No configuration file %s, using the defaults", *configFile)
+		cfg = defaultConfig()
+		err = cfg.compile()
+	}
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	config.Store(cfg)
+	cache.resize(cfg.CacheSize)
+	metrics.resize(cfg.TopN)
+
+	udpAddr, err := net.ResolveUDPAddr("udp", cfg.Listen)
+	if err != nil {
+		log.Fatalf("Invalid listen address: %v", err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
 	if err != nil {
 		log.Fatalf("Failed to start DNS server: %v", err)
 	}
 	defer conn.Close()
-	log.Println("DNS server is running on 0.0.0.0:53")
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: udpAddr.IP, Port: udpAddr.Port, Zone: udpAddr.Zone})
+	if err != nil {
+		log.Fatalf("Failed to start DNS server: %v", err)
+	}
+	defer listener.Close()
+	log.Printf("DNS server is running on %s (UDP and TCP)", cfg.Listen)
+	go serveStream(listener)
+	if cfg.TLSCertFile != "" {
+		if err := startEncrypted(); err != nil {
+			log.Fatalf("Failed to start encrypted transports: %v", err)
+		}
+	}
+	if err := startAdmin(); err != nil {
+		log.Fatalf("Failed to start admin API: %v", err)
+	}
+
+	// Reload the configuration on SIGHUP
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			reloadConfig(*configFile)
+		}
+	}()
 
-	// Print metrics every 30 seconds
+	// Load zones and reload them when their files change
+	zones.load(cfg.ZoneDir)
 	go func() {
 		for {
-			time.Sleep(30 * time.Second)
-			printMetrics()
+			time.Sleep(zoneReloadInterval)
+			zones.load(config.Load().ZoneDir)
 		}
 	}()
 
+	buffer := make([]byte, maxMessageSize)
 	for {
-		buffer := make([]byte, 512)
 		n, clientAddr, err := conn.ReadFromUDP(buffer)
 		if err != nil {
 			log.Printf("Error reading from UDP: %v", err)
 			continue
 		}
-		go handleRequest(conn, clientAddr, buffer[:n])
+		go handleRequest(&udpWriter{conn: conn, addr: clientAddr}, bytes.Clone(buffer[:n]))
 	}
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Media type of DNS messages carried over HTTPS (RFC 8484)
+const dohMediaType = "application/dns-message"
+
+var (
+	// Server certificate of the encrypted transports
+	certificate atomic.Pointer[tls.Certificate]
+
+	// Client for DNS-over-HTTPS upstream servers, which keeps their
+	// connections open between queries
+	dohClient = &http.Client{Timeout: upstreamTimeout}
+)
+
+// Load the server certificate and key from the configured files.
+// Connections made before keep the previous certificate.
+func loadCertificate() error {
+	cfg := config.Load()
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return err
+	}
+	certificate.Store(&cert)
+	return nil
+}
+
+// Start DNS-over-TLS (RFC 7858) and DNS-over-HTTPS (RFC 8484) on their
+// configured addresses. Either is disabled by an empty address.
+func startEncrypted() error {
+	if err := loadCertificate(); err != nil {
+		return err
+	}
+	cfg := config.Load()
+	tlsConfig := func(protos ...string) *tls.Config {
+		return &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			NextProtos: protos,
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return certificate.Load(), nil
+			},
+		}
+	}
+
+	if cfg.DoTListen != "" {
+		listener, err := tls.Listen("tcp", cfg.DoTListen, tlsConfig("dot"))
+		if err != nil {
+			return err
+		}
+		log.Printf("DNS-over-TLS is running on %s", cfg.DoTListen)
+		go serveStream(listener)
+	}
+
+	if cfg.DoHListen != "" {
+		listener, err := net.Listen("tcp", cfg.DoHListen)
+		if err != nil {
+			return err
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc(cfg.DoHPath, handleDoH)
+		server := &http.Server{
+			Handler:           mux,
+			TLSConfig:         tlsConfig("h2", "http/1.1"),
+			ReadHeaderTimeout: tcpIdleTimeout,
+			IdleTimeout:       tcpIdleTimeout,
+		}
+		log.Printf("DNS-over-HTTPS is running on https://%s%s", cfg.DoHListen, cfg.DoHPath)
+		go func() {
+			if err := server.ServeTLS(listener, "", ""); err != nil {
+				log.Printf("DNS-over-HTTPS server stopped: %v", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// httpWriter keeps the response to a DNS-over-HTTPS query, which
+// handleRequest writes before it returns
+type httpWriter struct {
+	ip   net.IP
+	data []byte
+}
+
+func (w *httpWriter) remoteIP() net.IP { return w.ip }
+func (w *httpWriter) udp() bool        { return false }
+
+func (w *httpWriter) write(data []byte) error {
+	w.data = data
+	return nil
+}
+
+// Answer a DNS-over-HTTPS query: a GET with the message in the base64url
+// dns parameter, or a POST with the message as its body
+func handleDoH(rw http.ResponseWriter, r *http.Request) {
+	var request []byte
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			http.Error(rw, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+		var err error
+		request, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+		if err != nil {
+			http.Error(rw, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != dohMediaType {
+			http.Error(rw, "content type must be "+dohMediaType, http.StatusUnsupportedMediaType)
+			return
+		}
+		var err error
+		request, err = io.ReadAll(io.LimitReader(r.Body, maxMessageSize+1))
+		if err != nil {
+			http.Error(rw, "failed to read query", http.StatusBadRequest)
+			return
+		}
+		if len(request) > maxMessageSize {
+			http.Error(rw, "query too long", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		rw.Header().Set("Allow", "GET, POST")
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	w := &httpWriter{ip: net.ParseIP(host)}
+	handleRequest(w, request)
+	if w.data == nil {
+		// Refused, rate limited or not answered upstream
+		http.Error(rw, "no response", http.StatusServiceUnavailable)
+		return
+	}
+	rw.Header().Set("Content-Type", dohMediaType)
+	if age, ok := maxAge(w.data); ok {
+		rw.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", age))
+	}
+	rw.Write(w.data)
+}
+
+// How long HTTP caches may keep a response: the lowest TTL of its records
+// (RFC 8484 section 5.1)
+func maxAge(data []byte) (uint32, bool) {
+	response, err := parseMessage(data)
+	if err != nil {
+		return 0, false
+	}
+	age, ok := uint32(0), false
+	for _, section := range [][]DNSRecord{response.Answers, response.Authority, response.Additional} {
+		for _, r := range section {
+			if r.Type != typeOPT && (!ok || r.TTL < age) {
+				age, ok = r.TTL, true
+			}
+		}
+	}
+	return age, ok
+}
+
+// Send a query to a DNS-over-TLS upstream server, given as host:port
+func exchangeTLS(upstream string, query *DNSMessage, request []byte) (DNSMessage, error) {
+	host, _, err := net.SplitHostPort(upstream)
+	if err != nil {
+		return DNSMessage{}, err
+	}
+	dialer := &net.Dialer{Timeout: upstreamTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", upstream, &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12})
+	if err != nil {
+		return DNSMessage{}, err
+	}
+	return exchangeStream(conn, query, request)
+}
+
+// Send a query to a DNS-over-HTTPS upstream server as a POST to its URL
+func exchangeHTTPS(url string, query *DNSMessage, request []byte) (DNSMessage, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(request))
+	if err != nil {
+		return DNSMessage{}, err
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+	resp, err := dohClient.Do(req)
+	if err != nil {
+		return DNSMessage{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return DNSMessage{}, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxMessageSize+1))
+	if err != nil {
+		return DNSMessage{}, err
+	}
+	if len(data) > maxMessageSize {
+		return DNSMessage{}, errors.New("response too long")
+	}
+	return checkResponse(query, data)
+}
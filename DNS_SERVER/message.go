@@ -0,0 +1,537 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Header flags
+const (
+	flagResponse           uint16 = 1 << 15
+	flagAuthoritative      uint16 = 1 << 10
+	flagTruncated          uint16 = 1 << 9
+	flagRecursionDesired   uint16 = 1 << 8
+	flagRecursionAvailable uint16 = 1 << 7
+	flagAuthenticData      uint16 = 1 << 5
+	flagCheckingDisabled   uint16 = 1 << 4
+	opcodeMask             uint16 = 0xF << 11
+	rcodeMask              uint16 = 0xF
+)
+
+// Response codes. Those above 15 need EDNS0.
+const (
+	rcodeSuccess        = 0
+	rcodeFormatError    = 1
+	rcodeServerFailure  = 2
+	rcodeNameError      = 3 // NXDOMAIN
+	rcodeNotImplemented = 4
+	rcodeRefused        = 5
+	rcodeBadVersion     = 16
+)
+
+const (
+	headerSize     = 12
+	maxNameLength  = 255 // In wire format
+	maxLabelLength = 63
+	maxPointer     = 0x3FFF
+)
+
+var (
+	errMalformed = errors.New("malformed message")
+	errTooLong   = errors.New("message too long")
+)
+
+// DNSMessage represents a whole DNS message. The counts in Header are set
+// from the sections when it is packed.
+type DNSMessage struct {
+	Header     DNSHeader
+	Questions  []DNSQuestion
+	Answers    []DNSRecord
+	Authority  []DNSRecord
+	Additional []DNSRecord
+}
+
+// EDNS holds the EDNS0 parameters carried by an OPT record (RFC 6891)
+type EDNS struct {
+	UDPSize uint16 // Largest UDP payload the sender can receive
+	Version uint8
+	DO      bool // DNSSEC answer OK
+	Options []EDNSOption
+}
+
+// Opcode of the message
+func (h DNSHeader) Opcode() uint16 {
+	return (h.Flags & opcodeMask) >> 11
+}
+
+// OPT record of the message, or nil if it has none
+func (m *DNSMessage) opt() *DNSRecord {
+	for i := range m.Additional {
+		if m.Additional[i].Type == typeOPT {
+			return &m.Additional[i]
+		}
+	}
+	return nil
+}
+
+// EDNS0 parameters of the message, if it has an OPT record
+func (m *DNSMessage) EDNS() (EDNS, bool) {
+	opt := m.opt()
+	if opt == nil {
+		return EDNS{}, false
+	}
+	e := EDNS{
+		UDPSize: opt.Class,
+		Version: uint8(opt.TTL >> 16),
+		DO:      opt.TTL&(1<<15) != 0,
+	}
+	if data, ok := opt.Data.(OPTData); ok {
+		e.Options = data.Options
+	}
+	return e, true
+}
+
+// Add or replace the OPT record, keeping the extended response code
+func (m *DNSMessage) SetEDNS(e EDNS) {
+	rcode := m.Rcode()
+	ttl := uint32(e.Version) << 16
+	if e.DO {
+		ttl |= 1 << 15
+	}
+	record := DNSRecord{Type: typeOPT, Class: e.UDPSize, TTL: ttl, Data: OPTData{Options: e.Options}}
+	if opt := m.opt(); opt != nil {
+		*opt = record
+	} else {
+		m.Additional = append(m.Additional, record)
+	}
+	m.SetRcode(rcode)
+}
+
+// Response code, including the upper bits held by the OPT record
+func (m *DNSMessage) Rcode() int {
+	rcode := int(m.Header.Flags & rcodeMask)
+	if opt := m.opt(); opt != nil {
+		rcode |= int(opt.TTL>>24) << 4
+	}
+	return rcode
+}
+
+// Set the response code. Codes above 15 need an OPT record.
+func (m *DNSMessage) SetRcode(rcode int) {
+	m.Header.Flags = m.Header.Flags&^rcodeMask | uint16(rcode)&rcodeMask
+	if opt := m.opt(); opt != nil {
+		opt.TTL = opt.TTL&0x00FFFFFF | uint32(rcode>>4)<<24
+	}
+}
+
+// Start a response to a query, echoing its ID, opcode, RD and CD flags and
+// question. A query with EDNS0 gets an OPT record in return.
+func newResponse(query *DNSMessage) DNSMessage {
+	flags := flagResponse | flagRecursionAvailable | query.Header.Flags&(opcodeMask|flagRecursionDesired|flagCheckingDisabled)
+	response := DNSMessage{
+		Header:    DNSHeader{ID: query.Header.ID, Flags: flags},
+		Questions: query.Questions,
+	}
+	if e, ok := query.EDNS(); ok {
+		response.SetEDNS(EDNS{UDPSize: ednsPayloadSize, DO: e.DO})
+	}
+	return response
+}
+
+// Build an empty response with an error code
+func errorResponse(query *DNSMessage, rcode int) DNSMessage {
+	response := newResponse(query)
+	response.SetRcode(rcode)
+	return response
+}
+
+// builder appends a message in wire format, remembering where names were
+// written so later ones can point at them
+type builder struct {
+	buf   []byte
+	names map[string]int // Offset of each name suffix written, by name as written
+}
+
+// Encode a message to wire format with name compression
+func (m *DNSMessage) pack() ([]byte, error) {
+	b := &builder{buf: make([]byte, headerSize, 512), names: make(map[string]int)}
+	binary.BigEndian.PutUint16(b.buf[0:2], m.Header.ID)
+	binary.BigEndian.PutUint16(b.buf[2:4], m.Header.Flags)
+	counts := []int{len(m.Questions), len(m.Answers), len(m.Authority), len(m.Additional)}
+	for i, n := range counts {
+		if n > 0xFFFF {
+			return nil, errTooLong
+		}
+		binary.BigEndian.PutUint16(b.buf[4+2*i:], uint16(n))
+	}
+
+	for _, q := range m.Questions {
+		if err := b.name(q.Name, true); err != nil {
+			return nil, err
+		}
+		b.uint16(q.Type)
+		b.uint16(q.Class)
+	}
+	for _, section := range [][]DNSRecord{m.Answers, m.Authority, m.Additional} {
+		for _, r := range section {
+			if err := b.record(r); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(b.buf) > 0xFFFF {
+		return nil, errTooLong
+	}
+	return b.buf, nil
+}
+
+func (b *builder) record(r DNSRecord) error {
+	if r.Data == nil {
+		return fmt.Errorf("%s record of %s has no data", typeName(r.Type), r.Name)
+	}
+	if err := b.name(r.Name, true); err != nil {
+		return err
+	}
+	b.uint16(r.Type)
+	b.uint16(r.Class)
+	b.uint32(r.TTL)
+	start := len(b.buf)
+	b.uint16(0)
+	if err := r.Data.pack(b); err != nil {
+		return fmt.Errorf("%s record of %s: %w", typeName(r.Type), r.Name, err)
+	}
+	length := len(b.buf) - start - 2
+	if length > 0xFFFF {
+		return errTooLong
+	}
+	binary.BigEndian.PutUint16(b.buf[start:], uint16(length))
+	return nil
+}
+
+func (b *builder) uint8(v uint8)   { b.buf = append(b.buf, v) }
+func (b *builder) uint16(v uint16) { b.buf = binary.BigEndian.AppendUint16(b.buf, v) }
+func (b *builder) uint32(v uint32) { b.buf = binary.BigEndian.AppendUint32(b.buf, v) }
+func (b *builder) bytes(v []byte)  { b.buf = append(b.buf, v...) }
+
+// Append a character string: a length byte and up to 255 bytes
+func (b *builder) string(s string) error {
+	if len(s) > 255 {
+		return errors.New("character string longer than 255 bytes")
+	}
+	b.buf = append(b.buf, byte(len(s)))
+	b.buf = append(b.buf, s...)
+	return nil
+}
+
+// Append a domain name. With compress, a suffix already in the message is
+// replaced by a pointer to it (RFC 1035 section 4.1.4). Only suffixes of the
+// same case are shared, so names keep the case they were given.
+func (b *builder) name(name string, compress bool) error {
+	labels, err := nameLabels(name)
+	if err != nil {
+		return err
+	}
+	for i := range labels {
+		suffix := joinLabels(labels[i:])
+		if compress {
+			if off, ok := b.names[suffix]; ok {
+				b.uint16(0xC000 | uint16(off))
+				return nil
+			}
+		}
+		if len(b.buf) <= maxPointer {
+			if _, ok := b.names[suffix]; !ok {
+				b.names[suffix] = len(b.buf)
+			}
+		}
+		b.uint8(uint8(len(labels[i])))
+		b.bytes(labels[i])
+	}
+	b.uint8(0)
+	return nil
+}
+
+// Split a name in presentation format into labels, decoding \. and \DDD
+// escapes, and check its length
+func nameLabels(name string) ([][]byte, error) {
+	if name == "" || name == "." {
+		return nil, nil
+	}
+	var labels [][]byte
+	var label []byte
+	length := 1
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; c {
+		case '.':
+			if len(label) == 0 {
+				return nil, fmt.Errorf("empty label in %q", name)
+			}
+			labels, label = append(labels, label), nil
+		case '\\':
+			n, v := unescape(name[i+1:])
+			if n == 0 {
+				return nil, fmt.Errorf("invalid escape in %q", name)
+			}
+			label = append(label, v)
+			i += n
+		default:
+			label = append(label, c)
+		}
+		if len(label) > maxLabelLength {
+			return nil, fmt.Errorf("label longer than %d bytes in %q", maxLabelLength, name)
+		}
+	}
+	if len(label) > 0 {
+		labels = append(labels, label)
+	}
+	for _, l := range labels {
+		length += len(l) + 1
+	}
+	if length > maxNameLength {
+		return nil, fmt.Errorf("name %q is too long", name)
+	}
+	return labels, nil
+}
+
+// Join labels into a name in presentation format, escaping dots,
+// backslashes and unprintable bytes
+func joinLabels(labels [][]byte) string {
+	var sb strings.Builder
+	for i, label := range labels {
+		if i > 0 {
+			sb.WriteByte('.')
+		}
+		for _, c := range label {
+			switch {
+			case c == '.' || c == '\\':
+				sb.WriteByte('\\')
+				sb.WriteByte(c)
+			case c < '!' || c > '~':
+				fmt.Fprintf(&sb, "\\%03d", c)
+			default:
+				sb.WriteByte(c)
+			}
+		}
+	}
+	return sb.String()
+}
+
+// Decode the escape after a backslash: \DDD is a decimal byte and any other
+// character stands for itself. Returns the length consumed, 0 if invalid.
+func unescape(s string) (int, byte) {
+	if len(s) >= 3 && isDigits(s[:3]) {
+		v, _ := strconv.Atoi(s[:3])
+		if v > 255 {
+			return 0, 0
+		}
+		return 3, byte(v)
+	}
+	if len(s) == 0 || s[0] == '\n' {
+		return 0, 0
+	}
+	return 1, s[0]
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Decode a message. Every length, count and compression pointer is checked
+// against the data, so malformed input returns an error rather than
+// panicking.
+func parseMessage(data []byte) (DNSMessage, error) {
+	var m DNSMessage
+	if len(data) < headerSize {
+		return m, errMalformed
+	}
+	m.Header = DNSHeader{
+		ID:      binary.BigEndian.Uint16(data[0:2]),
+		Flags:   binary.BigEndian.Uint16(data[2:4]),
+		QDCount: binary.BigEndian.Uint16(data[4:6]),
+		ANCount: binary.BigEndian.Uint16(data[6:8]),
+		NSCount: binary.BigEndian.Uint16(data[8:10]),
+		ARCount: binary.BigEndian.Uint16(data[10:12]),
+	}
+
+	off := headerSize
+	for i := 0; i < int(m.Header.QDCount); i++ {
+		name, next, err := readName(data, off)
+		if err != nil {
+			return m, err
+		}
+		if next+4 > len(data) {
+			return m, errMalformed
+		}
+		m.Questions = append(m.Questions, DNSQuestion{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(data[next:]),
+			Class: binary.BigEndian.Uint16(data[next+2:]),
+		})
+		off = next + 4
+	}
+
+	sections := []struct {
+		count   uint16
+		records *[]DNSRecord
+	}{
+		{m.Header.ANCount, &m.Answers},
+		{m.Header.NSCount, &m.Authority},
+		{m.Header.ARCount, &m.Additional},
+	}
+	for _, section := range sections {
+		for i := 0; i < int(section.count); i++ {
+			r, next, err := readRecord(data, off)
+			if err != nil {
+				return m, err
+			}
+			*section.records = append(*section.records, r)
+			off = next
+		}
+	}
+
+	opts := 0
+	for _, r := range m.Additional {
+		if r.Type == typeOPT {
+			if opts++; opts > 1 || r.Name != "" {
+				return m, errors.New("invalid OPT record")
+			}
+		}
+	}
+	for _, section := range [][]DNSRecord{m.Answers, m.Authority} {
+		for _, r := range section {
+			if r.Type == typeOPT {
+				return m, errors.New("OPT record outside the additional section")
+			}
+		}
+	}
+	return m, nil
+}
+
+// Read a resource record at off, returning it and the offset after it
+func readRecord(msg []byte, off int) (DNSRecord, int, error) {
+	name, off, err := readName(msg, off)
+	if err != nil {
+		return DNSRecord{}, 0, err
+	}
+	if off+10 > len(msg) {
+		return DNSRecord{}, 0, errMalformed
+	}
+	r := DNSRecord{
+		Name:  name,
+		Type:  binary.BigEndian.Uint16(msg[off:]),
+		Class: binary.BigEndian.Uint16(msg[off+2:]),
+		TTL:   binary.BigEndian.Uint32(msg[off+4:]),
+	}
+	length := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+	if off+length > len(msg) {
+		return DNSRecord{}, 0, errMalformed
+	}
+	if r.Data, err = unpackRData(msg, off, off+length, r.Type); err != nil {
+		return DNSRecord{}, 0, fmt.Errorf("%s record of %s: %w", typeName(r.Type), name, err)
+	}
+	return r, off + length, nil
+}
+
+// Read a possibly compressed name at off, returning it in presentation
+// format without the final dot and the offset after it. Pointers must point
+// backwards, so they cannot loop.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels [][]byte
+	end := -1 // Offset after the name where it started
+	length := 1
+	for {
+		if off >= len(msg) {
+			return "", 0, errMalformed
+		}
+		c := int(msg[off])
+		switch c & 0xC0 {
+		case 0x00:
+			if c == 0 {
+				if end < 0 {
+					end = off + 1
+				}
+				return joinLabels(labels), end, nil
+			}
+			if off+1+c > len(msg) {
+				return "", 0, errMalformed
+			}
+			if length += c + 1; length > maxNameLength {
+				return "", 0, errors.New("name too long")
+			}
+			labels = append(labels, msg[off+1:off+1+c])
+			off += 1 + c
+		case 0xC0:
+			if off+2 > len(msg) {
+				return "", 0, errMalformed
+			}
+			ptr := (c&0x3F)<<8 | int(msg[off+1])
+			if ptr >= off {
+				return "", 0, errors.New("compression pointer does not point backwards")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = ptr
+		default:
+			return "", 0, errors.New("unsupported label type")
+		}
+	}
+}
+
+// reader decodes the fields of record data between off and end, remembering
+// the first error
+type reader struct {
+	msg      []byte
+	off, end int
+	err      error
+}
+
+func (r *reader) next(n int) []byte {
+	if r.err != nil || r.off+n > r.end {
+		r.err = errMalformed
+		return make([]byte, n)
+	}
+	b := r.msg[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *reader) uint8() uint8   { return r.next(1)[0] }
+func (r *reader) uint16() uint16 { return binary.BigEndian.Uint16(r.next(2)) }
+func (r *reader) uint32() uint32 { return binary.BigEndian.Uint32(r.next(4)) }
+
+// Read a character string
+func (r *reader) string() string {
+	n := int(r.uint8())
+	return string(r.next(n))
+}
+
+func (r *reader) name() string {
+	if r.err != nil {
+		return ""
+	}
+	name, next, err := readName(r.msg[:r.end], r.off)
+	if err != nil {
+		r.err = err
+		return ""
+	}
+	r.off = next
+	return name
+}
+
+// Check that the data was consumed exactly
+func (r *reader) done() error {
+	if r.err == nil && r.off != r.end {
+		return errors.New("record data longer than its fields")
+	}
+	return r.err
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// Messages as sent by real resolvers and servers
+var seedMessages = []string{
+	// Query for www.example.com A with RD and AD set and an OPT record
+	// asking for DNSSEC with a client cookie
+	"1f2e0120000100000000000103777777076578616d706c6503636f6d000001000100002904d000008000000c000a00080123456789abcdef",
+	// Its response: a CNAME whose owner and target are compression pointers,
+	// an A record owned by a pointer into the middle of the question, and OPT
+	"1f2e8180000100020000000103777777076578616d706c6503636f6d0000010001c00c000500010000012c0002c010c0100001000100000e1000045db8d82200002904d0000000000000",
+	// NXDOMAIN for an AAAA query, with an SOA whose names end in pointers
+	"beef81830001000000010001046e6f7065076578616d706c6503636f6d00001c0001c011000600010000012c0027036e7331c0110a686f73746d6173746572c01178a3f17500001c2000000e10001275000000012c0000291000000080000000",
+	// Authoritative MX and TXT answers, with the exchange compressed
+	"000785800001000200000000076578616d706c6503636f6d00000f0001c00c000f00010000012c0009000a046d61696cc00cc00c001000010000012c000d0b763d73706631202d616c6c00",
+	// Response to a query with randomized case (0x20), answered in the
+	// zone's case without compression
+	"4a118180000100010000000003775777074578614d506c6503634f6d000001000103777777076578616d706c6503636f6d00000100010000003c00045db8d822",
+}
+
+func mustHex(t testing.TB, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Anything parseMessage accepts packs back into a message that parses to
+// the same thing
+func FuzzParseMessage(f *testing.F) {
+	for _, s := range seedMessages {
+		f.Add(mustHex(f, s))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := parseMessage(data)
+		if err != nil {
+			return
+		}
+		packed, err := m.pack()
+		if err != nil {
+			t.Fatalf("packing parsed message: %v\n%+v", err, m)
+		}
+		again, err := parseMessage(packed)
+		if err != nil {
+			t.Fatalf("parsing packed message: %v\n%x", err, packed)
+		}
+		if !reflect.DeepEqual(m, again) {
+			t.Fatalf("round trip changed the message\nparsed:   %+v\nreparsed: %+v", m, again)
+		}
+	})
+}
+
+func TestParseMessageSeeds(t *testing.T) {
+	for _, s := range seedMessages {
+		if _, err := parseMessage(mustHex(t, s)); err != nil {
+			t.Errorf("%s: %v", s, err)
+		}
+	}
+}
+
+func TestReadNamePointers(t *testing.T) {
+	// A header followed by 3foo0 at 12 and 3bar, a pointer to foo at 17
+	prefix := "000000000000000000000000" + "03666f6f00" + "03626172c00c"
+	tests := []struct {
+		name string
+		msg  string
+		off  int
+		want string // Empty if an error is expected
+		next int
+	}{
+		{"plain", prefix, 12, "foo", 17},
+		{"backward pointer", prefix, 17, "bar.foo", 23},
+		{"pointer to a pointer", prefix + "c011", 23, "bar.foo", 25},
+		{"pointer to itself", prefix + "c017", 23, "", 0},
+		{"forward pointer", prefix + "c019" + "03626172", 23, "", 0},
+		{"pointer past the end", prefix + "c0ff", 23, "", 0},
+		{"truncated pointer", prefix + "c0", 23, "", 0},
+		// 1a then a pointer back to it: each pass adds a label, so the
+		// loop ends at the name length limit
+		{"pointer loop", prefix + "0161c017", 23, "", 0},
+		{"loop through two pointers", prefix + "0161c01b" + "0162c017", 27, "", 0},
+		{"reserved label type", prefix + "4000", 23, "", 0},
+		{"label past the end", prefix + "0561", 23, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, next, err := readName(mustHex(t, tt.msg), tt.off)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("got %q, want an error", name)
+				}
+				return
+			}
+			if err != nil || name != tt.want || next != tt.next {
+				t.Fatalf("got %q, %d, %v; want %q, %d", name, next, err, tt.want, tt.next)
+			}
+		})
+	}
+}
+
+func TestParseMessagePointerLoops(t *testing.T) {
+	header := "1234010000010000" + "00000000"
+	tests := map[string]string{
+		"question pointing at itself":       header + "c00c00010001",
+		"question pointing forward":         header + "c01200010001" + "0161" + "00",
+		"answer pointing at itself":         "1234818000010001" + "00000000" + "0161000001" + "0001" + "c013000100010000012c000401020304",
+		"CNAME target pointing at itself":   "1234818000010001" + "00000000" + "0161000005" + "0001" + "c00c000500010000012c0002c01f",
+		"CNAME target looping via a label":  "1234818000010001" + "00000000" + "0161000005" + "0001" + "c00c000500010000012c00040162c01f",
+		"record data pointing past its end": "1234818000010001" + "00000000" + "0161000005" + "0001" + "c00c000500010000012c0002c021" + "00",
+	}
+	for name, msg := range tests {
+		t.Run(name, func(t *testing.T) {
+			if m, err := parseMessage(mustHex(t, msg)); err == nil {
+				t.Fatalf("parsed %+v, want an error", m)
+			}
+		})
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultTopN = 100
+
+// Upper bounds of the upstream latency histogram buckets, in seconds
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+var rcodeNames = map[int]string{
+	rcodeSuccess:        "NOERROR",
+	rcodeFormatError:    "FORMERR",
+	rcodeServerFailure:  "SERVFAIL",
+	rcodeNameError:      "NXDOMAIN",
+	rcodeNotImplemented: "NOTIMP",
+	rcodeRefused:        "REFUSED",
+	rcodeBadVersion:     "BADVERS",
+}
+
+// Name of a response code, or RCODEn for codes without one
+func rcodeName(rcode int) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+// metricsRegistry counts queries, responses and upstream exchanges. Domains
+// and clients are tracked in bounded top lists, so memory does not grow with
+// the names queried.
+type metricsRegistry struct {
+	started   time.Time
+	queries   map[uint16]uint64 // By question type
+	responses map[int]uint64    // By response code
+	blocked   uint64
+	upstreams map[string]*upstreamMetrics
+	domains   *topCounter
+	clients   *topCounter
+	mu        sync.Mutex
+}
+
+// upstreamMetrics is the latency histogram and error count of one upstream
+// server
+type upstreamMetrics struct {
+	buckets []uint64 // Per bucket, not cumulative
+	count   uint64
+	sum     float64 // Seconds
+	errors  uint64
+}
+
+func newMetrics(topN int) *metricsRegistry {
+	return &metricsRegistry{
+		started:   time.Now(),
+		queries:   make(map[uint16]uint64),
+		responses: make(map[int]uint64),
+		upstreams: make(map[string]*upstreamMetrics),
+		domains:   newTopCounter(topN),
+		clients:   newTopCounter(topN),
+	}
+}
+
+// Change the number of domains and clients tracked
+func (m *metricsRegistry) resize(topN int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.domains.resize(topN)
+	m.clients.resize(topN)
+}
+
+// Count a query
+func (m *metricsRegistry) query(clientIP, domain string, qtype uint16) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queries[qtype]++
+	m.domains.increment(domain)
+	m.clients.increment(clientIP)
+}
+
+// Count a query answered from the blocklist
+func (m *metricsRegistry) block() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blocked++
+}
+
+// Count a response sent to a client
+func (m *metricsRegistry) response(rcode int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.responses[rcode]++
+}
+
+// Record how long an upstream server took to answer, or that it failed
+func (m *metricsRegistry) upstream(server string, elapsed time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.upstreams[server]
+	if u == nil {
+		u = &upstreamMetrics{buckets: make([]uint64, len(latencyBuckets))}
+		m.upstreams[server] = u
+	}
+	if err != nil {
+		u.errors++
+		return
+	}
+	seconds := elapsed.Seconds()
+	u.count++
+	u.sum += seconds
+	if i := sort.SearchFloat64s(latencyBuckets, seconds); i < len(latencyBuckets) {
+		u.buckets[i]++
+	}
+}
+
+// metricsSnapshot is a copy of the counters, for the admin API
+type metricsSnapshot struct {
+	UptimeSeconds    int64                       `json:"uptime_seconds"`
+	Queries          uint64                      `json:"queries"`
+	Blocked          uint64                      `json:"blocked"`
+	QueriesByType    map[string]uint64           `json:"queries_by_type"`
+	ResponsesByRcode map[string]uint64           `json:"responses_by_rcode"`
+	Cache            cacheSnapshot               `json:"cache"`
+	Upstreams        map[string]upstreamSnapshot `json:"upstreams"`
+	TopDomains       []topEntry                  `json:"top_domains"`
+	TopClients       []topEntry                  `json:"top_clients"`
+}
+
+type cacheSnapshot struct {
+	Entries    int     `json:"entries"`
+	Hits       uint64  `json:"hits"`
+	Misses     uint64  `json:"misses"`
+	HitRate    float64 `json:"hit_rate"`
+	Prefetches uint64  `json:"prefetches"`
+}
+
+type upstreamSnapshot struct {
+	Answers          uint64  `json:"answers"`
+	Errors           uint64  `json:"errors"`
+	MeanLatencyMilli float64 `json:"mean_latency_ms"`
+}
+
+func (m *metricsRegistry) snapshot() metricsSnapshot {
+	stats := cache.stats()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := metricsSnapshot{
+		UptimeSeconds:    int64(time.Since(m.started) / time.Second),
+		Blocked:          m.blocked,
+		QueriesByType:    make(map[string]uint64),
+		ResponsesByRcode: make(map[string]uint64),
+		Cache: cacheSnapshot{
+			Entries:    stats.Entries,
+			Hits:       stats.Hits,
+			Misses:     stats.Misses,
+			HitRate:    stats.HitRate(),
+			Prefetches: stats.Prefetches,
+		},
+		Upstreams:  make(map[string]upstreamSnapshot),
+		TopDomains: m.domains.top(),
+		TopClients: m.clients.top(),
+	}
+	for qtype, n := range m.queries {
+		s.Queries += n
+		s.QueriesByType[typeName(qtype)] += n
+	}
+	for rcode, n := range m.responses {
+		s.ResponsesByRcode[rcodeName(rcode)] += n
+	}
+	for server, u := range m.upstreams {
+		snap := upstreamSnapshot{Answers: u.count, Errors: u.errors}
+		if u.count > 0 {
+			snap.MeanLatencyMilli = 1000 * u.sum / float64(u.count)
+		}
+		s.Upstreams[server] = snap
+	}
+	return s
+}
+
+// Write the metrics in the Prometheus text exposition format
+func (m *metricsRegistry) writePrometheus(w io.Writer) {
+	stats := cache.stats()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	header := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	header("dns_queries_total", "counter", "Queries received, by question type.")
+	var types []uint16
+	for qtype := range m.queries {
+		types = append(types, qtype)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	for _, qtype := range types {
+		fmt.Fprintf(w, "dns_queries_total{type=%s} %d\n", label(typeName(qtype)), m.queries[qtype])
+	}
+
+	header("dns_responses_total", "counter", "Responses sent, by response code.")
+	var rcodes []int
+	for rcode := range m.responses {
+		rcodes = append(rcodes, rcode)
+	}
+	sort.Ints(rcodes)
+	for _, rcode := range rcodes {
+		fmt.Fprintf(w, "dns_responses_total{rcode=%s} %d\n", label(rcodeName(rcode)), m.responses[rcode])
+	}
+
+	header("dns_blocked_queries_total", "counter", "Queries answered from the blocklist.")
+	fmt.Fprintf(w, "dns_blocked_queries_total %d\n", m.blocked)
+
+	header("dns_cache_hits_total", "counter", "Queries answered from the cache.")
+	fmt.Fprintf(w, "dns_cache_hits_total %d\n", stats.Hits)
+	header("dns_cache_misses_total", "counter", "Cache lookups that found no answer.")
+	fmt.Fprintf(w, "dns_cache_misses_total %d\n", stats.Misses)
+	header("dns_cache_prefetches_total", "counter", "Cache entries refreshed before expiring.")
+	fmt.Fprintf(w, "dns_cache_prefetches_total %d\n", stats.Prefetches)
+	header("dns_cache_entries", "gauge", "Answers in the cache.")
+	fmt.Fprintf(w, "dns_cache_entries %d\n", stats.Entries)
+
+	var servers []string
+	for server := range m.upstreams {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	header("dns_upstream_duration_seconds", "histogram", "Time upstream servers took to answer.")
+	for _, server := range servers {
+		u := m.upstreams[server]
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += u.buckets[i]
+			fmt.Fprintf(w, "dns_upstream_duration_seconds_bucket{upstream=%s,le=%q} %d\n",
+				label(server), strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "dns_upstream_duration_seconds_bucket{upstream=%s,le=\"+Inf\"} %d\n", label(server), u.count)
+		fmt.Fprintf(w, "dns_upstream_duration_seconds_sum{upstream=%s} %g\n", label(server), u.sum)
+		fmt.Fprintf(w, "dns_upstream_duration_seconds_count{upstream=%s} %d\n", label(server), u.count)
+	}
+	header("dns_upstream_errors_total", "counter", "Queries upstream servers failed to answer.")
+	for _, server := range servers {
+		fmt.Fprintf(w, "dns_upstream_errors_total{upstream=%s} %d\n", label(server), m.upstreams[server].errors)
+	}
+
+	header("dns_top_domain_queries", "gauge", "Queries for the most queried domains. Counts are estimates and may be too high.")
+	for _, e := range m.domains.top() {
+		fmt.Fprintf(w, "dns_top_domain_queries{domain=%s} %d\n", label(e.Key), e.Count)
+	}
+	header("dns_top_client_queries", "gauge", "Queries from the busiest clients. Counts are estimates and may be too high.")
+	for _, e := range m.clients.top() {
+		fmt.Fprintf(w, "dns_top_client_queries{client=%s} %d\n", label(e.Key), e.Count)
+	}
+
+	header("dns_uptime_seconds", "gauge", "Seconds since the server started.")
+	fmt.Fprintf(w, "dns_uptime_seconds %d\n", int64(time.Since(m.started)/time.Second))
+}
+
+// Quote a Prometheus label value
+func label(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return `"` + value + `"`
+}
+
+// topEntry is a key of a topCounter and its count
+type topEntry struct {
+	Key   string `json:"name"`
+	Count uint64 `json:"queries"`
+}
+
+// topCounter estimates the most frequent keys in bounded memory with the
+// Space-Saving algorithm: once full, a new key replaces the least counted
+// one and takes over its count, so counts are upper bounds and keys that
+// are frequent enough are never lost.
+type topCounter struct {
+	size  int
+	heap  topHeap // Least counted first
+	index map[string]*topItem
+}
+
+type topItem struct {
+	topEntry
+	pos int // In the heap
+}
+
+func newTopCounter(size int) *topCounter {
+	return &topCounter{size: size, index: make(map[string]*topItem)}
+}
+
+func (t *topCounter) increment(key string) {
+	if t.size <= 0 {
+		return
+	}
+	if item, ok := t.index[key]; ok {
+		item.Count++
+		heap.Fix(&t.heap, item.pos)
+		return
+	}
+	if len(t.heap) < t.size {
+		item := &topItem{topEntry: topEntry{Key: key, Count: 1}}
+		heap.Push(&t.heap, item)
+		t.index[key] = item
+		return
+	}
+	item := t.heap[0]
+	delete(t.index, item.Key)
+	item.Key = key
+	item.Count++
+	t.index[key] = item
+	heap.Fix(&t.heap, 0)
+}
+
+// Change the number of keys tracked, dropping the least counted
+func (t *topCounter) resize(size int) {
+	t.size = size
+	for len(t.heap) > max(size, 0) {
+		item := heap.Pop(&t.heap).(*topItem)
+		delete(t.index, item.Key)
+	}
+}
+
+// Keys by descending count
+func (t *topCounter) top() []topEntry {
+	entries := make([]topEntry, len(t.heap))
+	for i, item := range t.heap {
+		entries[i] = item.topEntry
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+// topHeap orders items by count for container/heap
+type topHeap []*topItem
+
+func (h topHeap) Len() int           { return len(h) }
+func (h topHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+
+func (h topHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos, h[j].pos = i, j
+}
+
+func (h *topHeap) Push(x any) {
+	item := x.(*topItem)
+	item.pos = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *topHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
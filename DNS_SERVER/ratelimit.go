@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter keeps a token bucket per client IP. A bucket holds up to a
+// minute's worth of queries and refills at the per-minute limit, so clients
+// can burst up to the limit and then keep to its rate. Its content is kept
+// as time: a full bucket holds a minute, and each query takes a minute
+// divided by the limit.
+type rateLimiter struct {
+	buckets map[string]*rateBucket
+	swept   time.Time // Last time idle buckets were dropped
+	mu      sync.Mutex
+}
+
+type rateBucket struct {
+	credit time.Duration
+	last   time.Time // When credit was last brought up to date
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*rateBucket)}
+}
+
+// Take a token for a query from ip, reporting false if its bucket is empty.
+// limit is in queries per minute.
+func (l *rateLimiter) allow(ip string, limit int, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// A bucket left alone for a minute is full again, the same as none
+	if now.Sub(l.swept) >= time.Minute {
+		for key, b := range l.buckets {
+			if now.Sub(b.last) >= time.Minute {
+				delete(l.buckets, key)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &rateBucket{credit: time.Minute, last: now}
+		l.buckets[ip] = b
+	}
+	b.credit, b.last = min(time.Minute, b.credit+max(0, now.Sub(b.last))), now
+	cost := time.Minute / time.Duration(limit)
+	if b.credit < cost {
+		return false
+	}
+	b.credit -= cost
+	return true
+}
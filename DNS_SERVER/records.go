@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Record types
+const (
+	typeA     uint16 = 1
+	typeNS    uint16 = 2
+	typeCNAME uint16 = 5
+	typeSOA   uint16 = 6
+	typePTR   uint16 = 12
+	typeMX    uint16 = 15
+	typeTXT   uint16 = 16
+	typeAAAA  uint16 = 28
+	typeSRV   uint16 = 33
+	typeOPT   uint16 = 41 // EDNS0 pseudo-record
+	typeANY   uint16 = 255
+	typeCAA   uint16 = 257
+
+	classIN  uint16 = 1
+	classANY uint16 = 255
+)
+
+var typeNames = map[uint16]string{
+	typeA:     "A",
+	typeNS:    "NS",
+	typeCNAME: "CNAME",
+	typeSOA:   "SOA",
+	typePTR:   "PTR",
+	typeMX:    "MX",
+	typeTXT:   "TXT",
+	typeAAAA:  "AAAA",
+	typeSRV:   "SRV",
+	typeOPT:   "OPT",
+	typeANY:   "ANY",
+	typeCAA:   "CAA",
+}
+
+// Name of a record type, or TYPEn for types without one
+func typeName(t uint16) string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+// DNSRecord represents a resource record
+type DNSRecord struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  RData
+}
+
+// RData is the type-specific data of a record
+type RData interface {
+	// pack appends the wire format of the data to b
+	pack(b *builder) error
+	// String returns the data in zone file format
+	String() string
+}
+
+func (r DNSRecord) String() string {
+	return fmt.Sprintf("%s %d IN %s %s", fqdn(r.Name), r.TTL, typeName(r.Type), r.Data)
+}
+
+// AData is the address of an A record
+type AData struct{ IP net.IP }
+
+// AAAAData is the address of an AAAA record
+type AAAAData struct{ IP net.IP }
+
+// NSData names the server of an NS record
+type NSData struct{ Host string }
+
+// CNAMEData is the target of a CNAME record
+type CNAMEData struct{ Target string }
+
+// PTRData is the target of a PTR record
+type PTRData struct{ Target string }
+
+// MXData is a mail exchanger
+type MXData struct {
+	Preference uint16
+	Exchange   string
+}
+
+// TXTData is one or more character strings of up to 255 bytes
+type TXTData struct{ Strings []string }
+
+// SRVData locates a service
+type SRVData struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+// SOAData is the start of authority of a zone
+type SOAData struct {
+	MName   string // Primary server
+	RName   string // Mailbox of the administrator
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32 // TTL of negative answers
+}
+
+// CAAData restricts which certificate authorities may issue for a name
+type CAAData struct {
+	Flags uint8
+	Tag   string
+	Value string
+}
+
+// OPTData holds the options of an EDNS0 OPT record. Its other fields are
+// carried in the class and TTL of the record; see EDNS.
+type OPTData struct{ Options []EDNSOption }
+
+// EDNSOption is one option of an OPT record
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// UnknownData is the raw data of a record of a type without its own
+// decoder (RFC 3597)
+type UnknownData struct{ Data []byte }
+
+func (d AData) pack(b *builder) error {
+	ip := d.IP.To4()
+	if ip == nil {
+		return fmt.Errorf("%v is not an IPv4 address", d.IP)
+	}
+	b.bytes(ip)
+	return nil
+}
+
+func (d AAAAData) pack(b *builder) error {
+	ip := d.IP.To16()
+	if ip == nil {
+		return fmt.Errorf("%v is not an IPv6 address", d.IP)
+	}
+	b.bytes(ip)
+	return nil
+}
+
+// Names in the record types of RFC 1035 may be compressed (RFC 3597
+// section 4); those of later types may not
+func (d NSData) pack(b *builder) error    { return b.name(d.Host, true) }
+func (d CNAMEData) pack(b *builder) error { return b.name(d.Target, true) }
+func (d PTRData) pack(b *builder) error   { return b.name(d.Target, true) }
+
+func (d MXData) pack(b *builder) error {
+	b.uint16(d.Preference)
+	return b.name(d.Exchange, true)
+}
+
+func (d TXTData) pack(b *builder) error {
+	if len(d.Strings) == 0 {
+		return b.string("")
+	}
+	for _, s := range d.Strings {
+		if err := b.string(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d SRVData) pack(b *builder) error {
+	b.uint16(d.Priority)
+	b.uint16(d.Weight)
+	b.uint16(d.Port)
+	return b.name(d.Target, false)
+}
+
+func (d SOAData) pack(b *builder) error {
+	if err := b.name(d.MName, true); err != nil {
+		return err
+	}
+	if err := b.name(d.RName, true); err != nil {
+		return err
+	}
+	for _, v := range []uint32{d.Serial, d.Refresh, d.Retry, d.Expire, d.Minimum} {
+		b.uint32(v)
+	}
+	return nil
+}
+
+func (d CAAData) pack(b *builder) error {
+	b.uint8(d.Flags)
+	if err := b.string(d.Tag); err != nil {
+		return err
+	}
+	b.bytes([]byte(d.Value))
+	return nil
+}
+
+func (d OPTData) pack(b *builder) error {
+	for _, o := range d.Options {
+		if len(o.Data) > 0xFFFF {
+			return fmt.Errorf("EDNS0 option %d is too long", o.Code)
+		}
+		b.uint16(o.Code)
+		b.uint16(uint16(len(o.Data)))
+		b.bytes(o.Data)
+	}
+	return nil
+}
+
+func (d UnknownData) pack(b *builder) error {
+	b.bytes(d.Data)
+	return nil
+}
+
+// Decode the data of a record of type t held in msg[off:end]. Names may
+// point anywhere before them in msg.
+func unpackRData(msg []byte, off, end int, t uint16) (RData, error) {
+	r := &reader{msg: msg, off: off, end: end}
+	var data RData
+	switch t {
+	case typeA:
+		data = AData{IP: net.IP(bytes.Clone(r.next(net.IPv4len)))}
+	case typeAAAA:
+		data = AAAAData{IP: net.IP(bytes.Clone(r.next(net.IPv6len)))}
+	case typeNS:
+		data = NSData{Host: r.name()}
+	case typeCNAME:
+		data = CNAMEData{Target: r.name()}
+	case typePTR:
+		data = PTRData{Target: r.name()}
+	case typeMX:
+		data = MXData{Preference: r.uint16(), Exchange: r.name()}
+	case typeTXT:
+		// At least one string, which may be empty (RFC 1035 section 3.3.14)
+		if off == end {
+			return nil, errors.New("TXT record has no strings")
+		}
+		var txt TXTData
+		for r.err == nil && r.off < r.end {
+			txt.Strings = append(txt.Strings, r.string())
+		}
+		data = txt
+	case typeSRV:
+		data = SRVData{Priority: r.uint16(), Weight: r.uint16(), Port: r.uint16(), Target: r.name()}
+	case typeSOA:
+		data = SOAData{
+			MName:   r.name(),
+			RName:   r.name(),
+			Serial:  r.uint32(),
+			Refresh: r.uint32(),
+			Retry:   r.uint32(),
+			Expire:  r.uint32(),
+			Minimum: r.uint32(),
+		}
+	case typeCAA:
+		flags, tag := r.uint8(), r.string()
+		data = CAAData{Flags: flags, Tag: tag, Value: string(r.next(r.end - r.off))}
+	case typeOPT:
+		var opt OPTData
+		for r.err == nil && r.off < r.end {
+			code, length := r.uint16(), int(r.uint16())
+			opt.Options = append(opt.Options, EDNSOption{Code: code, Data: bytes.Clone(r.next(length))})
+		}
+		data = opt
+	default:
+		data = UnknownData{Data: bytes.Clone(r.next(end - off))}
+	}
+	if err := r.done(); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (d AData) String() string     { return d.IP.String() }
+func (d AAAAData) String() string  { return d.IP.String() }
+func (d NSData) String() string    { return fqdn(d.Host) }
+func (d CNAMEData) String() string { return fqdn(d.Target) }
+func (d PTRData) String() string   { return fqdn(d.Target) }
+func (d MXData) String() string    { return fmt.Sprintf("%d %s", d.Preference, fqdn(d.Exchange)) }
+
+func (d TXTData) String() string {
+	quoted := make([]string, len(d.Strings))
+	for i, s := range d.Strings {
+		quoted[i] = strconv.Quote(s)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func (d SRVData) String() string {
+	return fmt.Sprintf("%d %d %d %s", d.Priority, d.Weight, d.Port, fqdn(d.Target))
+}
+
+func (d SOAData) String() string {
+	return fmt.Sprintf("%s %s %d %d %d %d %d", fqdn(d.MName), fqdn(d.RName), d.Serial, d.Refresh, d.Retry, d.Expire, d.Minimum)
+}
+
+func (d CAAData) String() string {
+	return fmt.Sprintf("%d %s %s", d.Flags, d.Tag, strconv.Quote(d.Value))
+}
+
+func (d OPTData) String() string {
+	options := make([]string, len(d.Options))
+	for i, o := range d.Options {
+		options[i] = fmt.Sprintf("%d:%x", o.Code, o.Data)
+	}
+	return strings.Join(options, " ")
+}
+
+// Generic form of RFC 3597 section 5
+func (d UnknownData) String() string { return fmt.Sprintf("\\# %d %x", len(d.Data), d.Data) }
+
+// Canonical form of a domain name: lower case without the trailing dot, and
+// only the escapes joinLabels writes, so equal names compare equal
+func canonicalName(name string) string {
+	labels, err := nameLabels(name)
+	if err != nil {
+		if isFQDN(name) {
+			name = name[:len(name)-1]
+		}
+		return strings.ToLower(name)
+	}
+	return strings.ToLower(joinLabels(labels))
+}
+
+// Check if a name ends with a dot that is not escaped
+func isFQDN(name string) bool {
+	if !strings.HasSuffix(name, ".") {
+		return false
+	}
+	escapes := 0
+	for i := len(name) - 2; i >= 0 && name[i] == '\\'; i-- {
+		escapes++
+	}
+	return escapes%2 == 0
+}
+
+// Name with its trailing dot, for display
+func fqdn(name string) string {
+	return name + "."
+}
+
+// Check if name is zone or one of its subdomains
+func isSubdomain(name, zone string) bool {
+	return zone == "" || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// Parent of a domain name, or "" for a top-level name
+func parentName(name string) string {
+	for i := 0; i < len(name); i++ {
+		switch name[i] {
+		case '\\':
+			i++ // Escaped character, which may be a dot
+		case '.':
+			return name[i+1:]
+		}
+	}
+	return ""
+}
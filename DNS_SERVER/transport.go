@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Largest DNS message, as TCP frames carry a 16 bit length
+const maxMessageSize = 65535
+
+// responseWriter sends responses back over the transport a query came in on
+type responseWriter interface {
+	remoteIP() net.IP
+	// udp reports whether responses must fit the client's UDP payload size
+	udp() bool
+	write(data []byte) error
+}
+
+// udpWriter answers a datagram
+type udpWriter struct {
+	conn *net.UDPConn
+	addr *net.UDPAddr
+}
+
+func (w *udpWriter) remoteIP() net.IP { return w.addr.IP }
+func (w *udpWriter) udp() bool        { return true }
+
+func (w *udpWriter) write(data []byte) error {
+	_, err := w.conn.WriteToUDP(data, w.addr)
+	return err
+}
+
+// streamWriter answers over a connection carrying length-prefixed messages
+// (RFC 1035 section 4.2.2). Queries on one connection are handled
+// concurrently, so writes are serialised.
+type streamWriter struct {
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+func (w *streamWriter) remoteIP() net.IP {
+	if addr, ok := w.conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+func (w *streamWriter) udp() bool { return false }
+
+func (w *streamWriter) write(data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.conn.SetWriteDeadline(time.Now().Add(tcpIdleTimeout))
+	return writeFrame(w.conn, data)
+}
+
+// Accept connections and serve the queries on them until the listener is
+// closed. At most maxStreamConns are served at once; the rest wait in the
+// listen backlog.
+func serveStream(listener net.Listener) {
+	slots := make(chan struct{}, maxStreamConns)
+	for {
+		slots <- struct{}{}
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			<-slots
+			log.Printf("Error accepting connection: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go func() {
+			defer func() { <-slots }()
+			handleStream(conn)
+		}()
+	}
+}
+
+// Read queries from a connection until the client closes it or stays idle
+// for tcpIdleTimeout, then close it once every query is answered. Reading
+// pauses while maxStreamQueries are in flight.
+func handleStream(conn net.Conn) {
+	w := &streamWriter{conn: conn}
+	inFlight := make(chan struct{}, maxStreamQueries)
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		conn.Close()
+	}()
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		request, err := readFrame(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, net.ErrClosed) && !isTimeout(err) {
+				log.Printf("Error reading from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		inFlight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-inFlight }()
+			handleRequest(w, request)
+		}()
+	}
+}
+
+// Read a message preceded by its 2 byte length
+func readFrame(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Write a message preceded by its 2 byte length, in one write
+func writeFrame(w io.Writer, data []byte) error {
+	if len(data) > maxMessageSize {
+		return errTooLong
+	}
+	frame := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(data)), uint16(len(data)))
+	_, err := w.Write(append(frame, data...))
+	return err
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Largest UDP response the sender of a query can receive: 512 bytes without
+// EDNS0, otherwise its advertised size up to our own
+func udpLimit(query *DNSMessage) int {
+	if query == nil {
+		return 512
+	}
+	e, ok := query.EDNS()
+	if !ok {
+		return 512
+	}
+	return max(512, min(int(e.UDPSize), int(ednsPayloadSize)))
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxCNAMEChain = 8
+
+// Zone is the authoritative data of one zone
+type Zone struct {
+	Origin  string
+	SOA     DNSRecord
+	records map[string]map[uint16][]DNSRecord // By owner name, then type
+	names   map[string]bool                   // Owner names and the empty non-terminals above them
+}
+
+// zoneResult is the outcome of a lookup in a zone
+type zoneResult struct {
+	Answers       []DNSRecord
+	Authority     []DNSRecord
+	Additional    []DNSRecord
+	Rcode         int
+	Authoritative bool // Unset for a referral to a delegated child zone
+}
+
+// Build a zone from the records of a zone file. The apex is the owner of its
+// only SOA record.
+func newZone(records []DNSRecord) (*Zone, error) {
+	z := &Zone{records: make(map[string]map[uint16][]DNSRecord), names: make(map[string]bool)}
+	for _, r := range records {
+		if r.Type == typeSOA {
+			if z.SOA.Data != nil {
+				return nil, fmt.Errorf("more than one SOA record")
+			}
+			z.SOA, z.Origin = r, r.Name
+		}
+	}
+	if z.SOA.Data == nil {
+		return nil, fmt.Errorf("no SOA record")
+	}
+
+	for _, r := range records {
+		if !isSubdomain(r.Name, z.Origin) {
+			return nil, fmt.Errorf("%s is outside zone %s", r.Name, z.Origin)
+		}
+		rrsets := z.records[r.Name]
+		if rrsets == nil {
+			rrsets = make(map[uint16][]DNSRecord)
+			z.records[r.Name] = rrsets
+		}
+		rrsets[r.Type] = append(rrsets[r.Type], r)
+		for name := r.Name; !z.names[name]; name = parentName(name) {
+			z.names[name] = true
+			if name == z.Origin {
+				break
+			}
+		}
+	}
+	if len(z.records[z.Origin][typeNS]) == 0 {
+		return nil, fmt.Errorf("no NS records at the apex")
+	}
+	for name, rrsets := range z.records {
+		if cnames := rrsets[typeCNAME]; len(cnames) > 1 || len(cnames) == 1 && len(rrsets) > 1 {
+			return nil, fmt.Errorf("CNAME at %s alongside other records", name)
+		}
+	}
+	return z, nil
+}
+
+// Answer a query for name, which must be within the zone, following CNAMEs
+// and wildcards inside the zone
+func (z *Zone) lookup(name string, qtype uint16) zoneResult {
+	res := zoneResult{Authoritative: true}
+	visited := make(map[string]bool)
+	for {
+		visited[name] = true
+		if cut := z.delegation(name); cut != "" {
+			// Answers already found came from this zone
+			res.Authoritative = len(res.Answers) > 0
+			res.Authority = z.records[cut][typeNS]
+			res.Additional = z.addresses(res.Authority)
+			return res
+		}
+
+		rrsets := z.records[name]
+		if !z.names[name] {
+			encloser := parentName(name)
+			for !z.names[encloser] {
+				encloser = parentName(encloser)
+			}
+			if rrsets = z.records["*."+encloser]; rrsets == nil {
+				res.Rcode = rcodeNameError
+				res.Authority = []DNSRecord{z.negativeSOA()}
+				return res
+			}
+		}
+
+		var answers []DNSRecord
+		if qtype == typeANY {
+			for _, rrset := range rrsets {
+				answers = append(answers, rrset...)
+			}
+			sort.SliceStable(answers, func(i, j int) bool { return answers[i].Type < answers[j].Type })
+		} else {
+			answers = rrsets[qtype]
+		}
+		if len(answers) > 0 {
+			res.Answers = append(res.Answers, withOwner(answers, name)...)
+			res.Additional = z.addresses(answers)
+			return res
+		}
+
+		cnames := rrsets[typeCNAME]
+		if len(cnames) == 0 || qtype == typeCNAME {
+			res.Authority = []DNSRecord{z.negativeSOA()}
+			return res
+		}
+		res.Answers = append(res.Answers, withOwner(cnames, name)...)
+		target := cnames[0].Data.(CNAMEData).Target
+		if !isSubdomain(target, z.Origin) || visited[target] || len(visited) > maxCNAMEChain {
+			return res // The resolver follows the rest of the chain
+		}
+		name = target
+	}
+}
+
+// Find the highest delegation point at or above name, below the apex
+func (z *Zone) delegation(name string) string {
+	cut := ""
+	for ; name != z.Origin && isSubdomain(name, z.Origin); name = parentName(name) {
+		if len(z.records[name][typeNS]) > 0 {
+			cut = name
+		}
+	}
+	return cut
+}
+
+// The SOA record of a negative answer, whose TTL bounds how long it is
+// cached (RFC 2308)
+func (z *Zone) negativeSOA() DNSRecord {
+	soa := z.SOA
+	soa.TTL = min(soa.TTL, soa.Data.(SOAData).Minimum)
+	return soa
+}
+
+// Addresses held by the zone for the hosts named in NS, MX and SRV records
+func (z *Zone) addresses(records []DNSRecord) []DNSRecord {
+	var additional []DNSRecord
+	seen := make(map[string]bool)
+	for _, r := range records {
+		var host string
+		switch data := r.Data.(type) {
+		case NSData:
+			host = data.Host
+		case MXData:
+			host = data.Exchange
+		case SRVData:
+			host = data.Target
+		default:
+			continue
+		}
+		if seen[host] || !isSubdomain(host, z.Origin) {
+			continue
+		}
+		seen[host] = true
+		additional = append(additional, z.records[host][typeA]...)
+		additional = append(additional, z.records[host][typeAAAA]...)
+	}
+	return additional
+}
+
+// Copy records giving them another owner, for wildcard and CNAME answers
+func withOwner(records []DNSRecord, name string) []DNSRecord {
+	out := make([]DNSRecord, len(records))
+	for i, r := range records {
+		r.Name = name
+		out[i] = r
+	}
+	return out
+}
+
+// zoneFile tracks a loaded zone file
+type zoneFile struct {
+	origin string
+	stamps map[string]fileStamp // The file and every file it includes
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// zoneSet holds the loaded zones, keyed by origin
+type zoneSet struct {
+	zones map[string]*Zone
+	files map[string]zoneFile // By path
+	mu    sync.RWMutex
+}
+
+func newZoneSet() *zoneSet {
+	return &zoneSet{zones: make(map[string]*Zone), files: make(map[string]zoneFile)}
+}
+
+// Find the zone holding name: the one with the longest matching origin
+func (s *zoneSet) find(name string) *Zone {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for {
+		if z, ok := s.zones[name]; ok {
+			return z
+		}
+		if name == "" {
+			return nil
+		}
+		name = parentName(name)
+	}
+}
+
+// Build the response to a query from the zones. Reports false if no zone
+// holds the name, so the query is forwarded.
+func (s *zoneSet) answer(query *DNSMessage) (DNSMessage, bool) {
+	question := query.Questions[0]
+	if query.Header.Opcode() != 0 || question.Class != classIN && question.Class != classANY {
+		return DNSMessage{}, false
+	}
+	name := canonicalName(question.Name)
+	z := s.find(name)
+	if z == nil {
+		return DNSMessage{}, false
+	}
+
+	res := z.lookup(name, question.Type)
+	response := newResponse(query)
+	if res.Authoritative {
+		response.Header.Flags |= flagAuthoritative
+	}
+	response.SetRcode(res.Rcode)
+	response.Answers = res.Answers
+	response.Authority = res.Authority
+	response.Additional = append(response.Additional, res.Additional...)
+	return response, true
+}
+
+// Load every *.zone file in dir, reloading those that changed since the last
+// call and dropping zones whose files are gone. The origin of a zone is the
+// owner of its SOA record; relative names start from the file name without
+// its .zone extension. A file that fails to parse keeps its previous zone.
+func (s *zoneSet) load(dir string) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.zone"))
+	if err != nil {
+		log.Printf("Failed to list zone files: %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	present := make(map[string]bool)
+	for _, path := range paths {
+		present[path] = true
+		if loaded, ok := s.files[path]; ok && !changed(loaded.stamps) {
+			continue
+		}
+		origin := strings.TrimSuffix(filepath.Base(path), ".zone")
+		records, files, err := parseZoneFile(path, origin)
+		var z *Zone
+		if err == nil {
+			z, err = newZone(records)
+		}
+		if err == nil {
+			if other, ok := s.zones[z.Origin]; ok && s.files[path].origin != z.Origin {
+				err = fmt.Errorf("zone %s is already loaded from another file", other.Origin)
+			}
+		}
+		if err != nil {
+			log.Printf("Failed to load zone file %s: %v", path, err)
+			// Retry once the files change again
+			if loaded, ok := s.files[path]; ok {
+				loaded.stamps = stampFiles(files)
+				s.files[path] = loaded
+			} else {
+				s.files[path] = zoneFile{stamps: stampFiles(files)}
+			}
+			continue
+		}
+
+		if loaded, ok := s.files[path]; ok && loaded.origin != "" {
+			delete(s.zones, loaded.origin)
+		}
+		s.zones[z.Origin] = z
+		s.files[path] = zoneFile{origin: z.Origin, stamps: stampFiles(files)}
+		log.Printf("Loaded zone %s (serial %d, %d names) from %s", z.Origin, z.SOA.Data.(SOAData).Serial, len(z.records), path)
+	}
+
+	for path, loaded := range s.files {
+		if present[path] {
+			continue
+		}
+		if loaded.origin != "" {
+			delete(s.zones, loaded.origin)
+			log.Printf("Unloaded zone %s: %s was removed", loaded.origin, path)
+		}
+		delete(s.files, path)
+	}
+}
+
+// Record the modification time and size of files
+func stampFiles(paths []string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp, len(paths))
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			stamps[path] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return stamps
+}
+
+// Check if any file changed since it was stamped
+func changed(stamps map[string]fileStamp) bool {
+	if len(stamps) == 0 {
+		return true
+	}
+	for path, stamp := range stamps {
+		info, err := os.Stat(path)
+		if err != nil || !info.ModTime().Equal(stamp.modTime) || info.Size() != stamp.size {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const maxIncludeDepth = 8
+
+// zoneToken is a word of a zone file. Quoted strings may contain spaces and
+// are never names.
+type zoneToken struct {
+	text   string // Unquoted words keep their escapes
+	quoted bool
+}
+
+// Value of a token with its escapes decoded
+func (t zoneToken) value() string {
+	if t.quoted || !strings.Contains(t.text, "\\") {
+		return t.text
+	}
+	var sb strings.Builder
+	for i := 0; i < len(t.text); i++ {
+		if t.text[i] != '\\' {
+			sb.WriteByte(t.text[i])
+			continue
+		}
+		n, b := unescape(t.text[i+1:])
+		sb.WriteByte(b)
+		i += n
+	}
+	return sb.String()
+}
+
+// zoneLine is a logical line of a zone file, with parenthesised
+// continuations joined. Blank is set when it starts with white space, so the
+// record belongs to the previous owner.
+type zoneLine struct {
+	tokens []zoneToken
+	blank  bool
+	number int
+}
+
+// zoneParser reads records from RFC 1035 master files
+type zoneParser struct {
+	origin    string
+	ttl       uint32 // From $TTL
+	hasTTL    bool
+	lastTTL   uint32 // Of the previous record, used without $TTL
+	hasLast   bool
+	lastOwner string
+	files     []string // Every file read, including those from $INCLUDE
+	records   []DNSRecord
+}
+
+// Parse the zone file at path. Relative names are completed with origin
+// until a $ORIGIN directive changes it. Also returns every file read.
+func parseZoneFile(path, origin string) ([]DNSRecord, []string, error) {
+	p := &zoneParser{origin: canonicalName(origin)}
+	if err := p.parseFile(path, 0); err != nil {
+		return nil, p.files, err
+	}
+	return p.records, p.files, nil
+}
+
+func (p *zoneParser) parseFile(path string, depth int) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	p.files = append(p.files, path)
+	lines, err := splitZoneLines(string(data))
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, line := range lines {
+		if err := p.parseLine(line, path, depth); err != nil {
+			return fmt.Errorf("%s: line %d: %w", path, line.number, err)
+		}
+	}
+	return nil
+}
+
+func (p *zoneParser) parseLine(line zoneLine, path string, depth int) error {
+	tokens := line.tokens
+	if !line.blank && !tokens[0].quoted && strings.HasPrefix(tokens[0].text, "$") {
+		return p.parseDirective(tokens, path, depth)
+	}
+
+	owner := p.lastOwner
+	if !line.blank {
+		var err error
+		if owner, err = p.name(tokens[0]); err != nil {
+			return err
+		}
+		tokens = tokens[1:]
+	} else if owner == "" && !p.hasLast {
+		return fmt.Errorf("record without an owner")
+	}
+
+	ttl, hasTTL := uint32(0), false
+	for i := 0; i < 2 && len(tokens) > 0 && !tokens[0].quoted; i++ {
+		text := tokens[0].text
+		if text[0] >= '0' && text[0] <= '9' && !hasTTL {
+			var err error
+			if ttl, err = parseTTL(text); err != nil {
+				return err
+			}
+			hasTTL = true
+		} else if strings.EqualFold(text, "IN") {
+		} else if strings.EqualFold(text, "CH") || strings.EqualFold(text, "HS") || strings.EqualFold(text, "CS") {
+			return fmt.Errorf("unsupported class %s", text)
+		} else {
+			break
+		}
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 {
+		return fmt.Errorf("missing record type")
+	}
+
+	rtype, ok := parseType(tokens[0].text)
+	if !ok || tokens[0].quoted {
+		return fmt.Errorf("unsupported record type %s", tokens[0].text)
+	}
+	data, err := p.parseRData(rtype, tokens[1:])
+	if err != nil {
+		return fmt.Errorf("%s record: %w", typeName(rtype), err)
+	}
+
+	switch {
+	case hasTTL:
+	case p.hasTTL:
+		ttl = p.ttl
+	case p.hasLast:
+		ttl = p.lastTTL
+	case rtype == typeSOA:
+		ttl = data.(SOAData).Minimum
+	default:
+		return fmt.Errorf("no TTL given and no $TTL directive")
+	}
+	p.lastOwner, p.lastTTL, p.hasLast = owner, ttl, true
+	p.records = append(p.records, DNSRecord{Name: owner, Type: rtype, Class: classIN, TTL: ttl, Data: data})
+	return nil
+}
+
+func (p *zoneParser) parseDirective(tokens []zoneToken, path string, depth int) error {
+	switch strings.ToUpper(tokens[0].text) {
+	case "$ORIGIN":
+		if len(tokens) != 2 {
+			return fmt.Errorf("$ORIGIN takes one name")
+		}
+		origin, err := p.name(tokens[1])
+		if err != nil {
+			return err
+		}
+		p.origin = origin
+	case "$TTL":
+		if len(tokens) != 2 {
+			return fmt.Errorf("$TTL takes one value")
+		}
+		ttl, err := parseTTL(tokens[1].text)
+		if err != nil {
+			return err
+		}
+		p.ttl, p.hasTTL = ttl, true
+	case "$INCLUDE":
+		if len(tokens) < 2 || len(tokens) > 3 {
+			return fmt.Errorf("$INCLUDE takes a file and an optional origin")
+		}
+		if depth >= maxIncludeDepth {
+			return fmt.Errorf("$INCLUDE nested too deeply")
+		}
+		file := tokens[1].text
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(path), file)
+		}
+		// The included file starts with its own origin and the current
+		// one is restored afterwards
+		saved, savedOwner := p.origin, p.lastOwner
+		if len(tokens) == 3 {
+			origin, err := p.name(tokens[2])
+			if err != nil {
+				return err
+			}
+			p.origin = origin
+		}
+		if err := p.parseFile(file, depth+1); err != nil {
+			return err
+		}
+		p.origin, p.lastOwner = saved, savedOwner
+	default:
+		return fmt.Errorf("unknown directive %s", tokens[0].text)
+	}
+	return nil
+}
+
+// Resolve a name relative to the current origin
+func (p *zoneParser) name(token zoneToken) (string, error) {
+	text := token.text
+	if token.quoted || text == "" {
+		return "", fmt.Errorf("invalid name %q", text)
+	}
+	var name string
+	switch {
+	case text == "@":
+		name = p.origin
+	case text == ".":
+		name = ""
+	case isFQDN(text):
+		name = canonicalName(text)
+	case p.origin == "":
+		name = canonicalName(text)
+	default:
+		name = canonicalName(text) + "." + p.origin
+	}
+	if err := checkName(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// Check the label and total lengths of a canonical name
+func checkName(name string) error {
+	_, err := nameLabels(name)
+	return err
+}
+
+func (p *zoneParser) parseRData(rtype uint16, args []zoneToken) (RData, error) {
+	want := map[uint16]int{
+		typeA: 1, typeAAAA: 1, typeNS: 1, typeCNAME: 1, typePTR: 1,
+		typeMX: 2, typeSRV: 4, typeSOA: 7, typeCAA: 3,
+	}
+	if n, ok := want[rtype]; ok && len(args) != n {
+		return nil, fmt.Errorf("want %d fields, got %d", n, len(args))
+	}
+
+	switch rtype {
+	case typeA:
+		ip := net.ParseIP(args[0].text).To4()
+		if ip == nil || args[0].quoted {
+			return nil, fmt.Errorf("invalid IPv4 address %q", args[0].text)
+		}
+		return AData{IP: ip}, nil
+	case typeAAAA:
+		ip := net.ParseIP(args[0].text)
+		if ip == nil || ip.To4() != nil || args[0].quoted {
+			return nil, fmt.Errorf("invalid IPv6 address %q", args[0].text)
+		}
+		return AAAAData{IP: ip}, nil
+	case typeNS, typeCNAME, typePTR:
+		name, err := p.name(args[0])
+		if err != nil {
+			return nil, err
+		}
+		switch rtype {
+		case typeNS:
+			return NSData{Host: name}, nil
+		case typeCNAME:
+			return CNAMEData{Target: name}, nil
+		}
+		return PTRData{Target: name}, nil
+	case typeMX:
+		pref, err := parseUint16(args[0].text)
+		if err != nil {
+			return nil, err
+		}
+		exchange, err := p.name(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return MXData{Preference: pref, Exchange: exchange}, nil
+	case typeTXT:
+		if len(args) == 0 {
+			return nil, fmt.Errorf("no strings")
+		}
+		data := TXTData{}
+		for _, arg := range args {
+			text := arg.value()
+			if len(text) > 255 {
+				return nil, fmt.Errorf("string longer than 255 bytes")
+			}
+			data.Strings = append(data.Strings, text)
+		}
+		return data, nil
+	case typeSRV:
+		var fields [3]uint16
+		for i := range fields {
+			v, err := parseUint16(args[i].text)
+			if err != nil {
+				return nil, err
+			}
+			fields[i] = v
+		}
+		target, err := p.name(args[3])
+		if err != nil {
+			return nil, err
+		}
+		return SRVData{Priority: fields[0], Weight: fields[1], Port: fields[2], Target: target}, nil
+	case typeSOA:
+		mname, err := p.name(args[0])
+		if err != nil {
+			return nil, err
+		}
+		rname, err := p.name(args[1])
+		if err != nil {
+			return nil, err
+		}
+		var times [5]uint32
+		for i := range times {
+			if times[i], err = parseTTL(args[2+i].text); err != nil {
+				return nil, err
+			}
+		}
+		return SOAData{MName: mname, RName: rname, Serial: times[0], Refresh: times[1],
+			Retry: times[2], Expire: times[3], Minimum: times[4]}, nil
+	case typeCAA:
+		flags, err := strconv.ParseUint(args[0].text, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid flags %q", args[0].text)
+		}
+		tag := args[1].text
+		if tag == "" || len(tag) > 255 || strings.IndexFunc(tag, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+		}) >= 0 {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		return CAAData{Flags: uint8(flags), Tag: strings.ToLower(tag), Value: args[2].value()}, nil
+	}
+	return nil, fmt.Errorf("unsupported record type")
+}
+
+// Parse a record type mnemonic
+func parseType(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	for t, name := range typeNames {
+		if name == s && t != typeANY {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+func parseUint16(s string) (uint16, error) {
+	v, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return uint16(v), nil
+}
+
+// Parse a TTL in seconds, or with BIND units such as 1h30m
+func parseTTL(s string) (uint32, error) {
+	if v, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(v), nil
+	}
+	units := map[byte]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}
+	var total, n uint64
+	digits := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= '0' && c <= '9':
+			n = n*10 + uint64(c-'0')
+			digits = true
+		case units[c|0x20] != 0 && digits:
+			total += n * units[c|0x20]
+			n, digits = 0, false
+		default:
+			return 0, fmt.Errorf("invalid TTL %q", s)
+		}
+		if n > 1<<32 || total > 1<<32 {
+			return 0, fmt.Errorf("TTL %q is too large", s)
+		}
+	}
+	if digits || total+n >= 1<<32 {
+		return 0, fmt.Errorf("invalid TTL %q", s)
+	}
+	return uint32(total), nil
+}
+
+// Split a zone file into logical lines, dropping comments and joining lines
+// inside parentheses
+func splitZoneLines(text string) ([]zoneLine, error) {
+	var lines []zoneLine
+	var line zoneLine
+	var word strings.Builder
+	inWord, depth, number := false, 0, 1
+	line.number = number
+
+	endWord := func(quoted bool) {
+		if inWord || quoted {
+			line.tokens = append(line.tokens, zoneToken{text: word.String(), quoted: quoted})
+		}
+		word.Reset()
+		inWord = false
+	}
+
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == ';':
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+			i--
+		case c == '"':
+			endWord(false)
+			i++
+			for ; i < len(text) && text[i] != '"'; i++ {
+				if text[i] == '\n' {
+					return nil, fmt.Errorf("line %d: unterminated string", number)
+				}
+				if text[i] != '\\' {
+					word.WriteByte(text[i])
+					continue
+				}
+				n, b := unescape(text[i+1:])
+				if n == 0 {
+					return nil, fmt.Errorf("line %d: invalid escape", number)
+				}
+				word.WriteByte(b)
+				i += n
+			}
+			if i >= len(text) {
+				return nil, fmt.Errorf("line %d: unterminated string", number)
+			}
+			endWord(true)
+		case c == '(':
+			endWord(false)
+			depth++
+		case c == ')':
+			endWord(false)
+			if depth--; depth < 0 {
+				return nil, fmt.Errorf("line %d: unbalanced parenthesis", number)
+			}
+		case c == '\n':
+			endWord(false)
+			number++
+			if depth > 0 {
+				continue
+			}
+			if len(line.tokens) > 0 {
+				lines = append(lines, line)
+			}
+			line = zoneLine{number: number}
+		case c == ' ' || c == '\t' || c == '\r':
+			if len(line.tokens) == 0 && !inWord && (i == 0 || text[i-1] == '\n') {
+				line.blank = true
+			}
+			endWord(false)
+		case c == '\\':
+			// Kept as written, since an escaped dot in a name is not a
+			// label separator; see zoneToken.value
+			n, _ := unescape(text[i+1:])
+			if n == 0 {
+				return nil, fmt.Errorf("line %d: invalid escape", number)
+			}
+			word.WriteString(text[i : i+1+n])
+			inWord = true
+			i += n
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if depth > 0 {
+		return nil, fmt.Errorf("line %d: unbalanced parenthesis", number)
+	}
+	endWord(false)
+	if len(line.tokens) > 0 {
+		lines = append(lines, line)
+	}
+	return lines, nil
+}